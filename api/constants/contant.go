@@ -13,6 +13,19 @@ const (
 	RoomsCollection    = "rooms"
 	MessagesCollection = "messages"
 	UsersCollection    = "users"
+	ClientsCollection  = "clients"
+	WebhooksCollection = "webhooks"
+	PinsCollection     = "pins"
+	ReportsCollection  = "reports"
+	InvitesCollection  = "invites"
+	// AuditLogCollection stores the account events, it's only appended to
+	AuditLogCollection = "audit_log"
+	// SessionsCollection stores the sessions behind the user tokens, MongoDB removes them once expired
+	SessionsCollection = "sessions"
+	// ReadMarkersCollection stores when each user last read each room
+	ReadMarkersCollection = "read_markers"
+	// WebhookDeadLettersCollection stores the webhook deliveries that failed permanently
+	WebhookDeadLettersCollection = "webhook_dead_letters"
 	// @TODO: it will change in production, probably move to env
 	DatabaseName = "db_chat"
 )
@@ -22,20 +35,159 @@ const (
 	RoomNotFound               = "Room not found"
 	FailedToGetRooms           = "Failed to get rooms"
 	RoomIDRequired             = "Room ID is required"
+	InvalidRoomID              = "Room ID must be up to 64 letters, digits, '-' or '_'"
+	ClientRoomIDsDisabled      = "Rooms must be created with POST /api/v1/rooms"
 	FailedToGetMessages        = "Failed to get messages"
 	FailedToCheckExistingRoom  = "Failed to check existing room"
 	FailedToCreateOrUpdateRoom = "Failed to create or update room"
+	UserNotRoomMember          = "User is not a member of the room"
+	RoomHasNoMembers           = "Room has no members"
+	RoomNotInToken             = "Token is not allowed to access the room"
+	UserIDMismatch             = "User ID doesn't match the authenticated user"
+	RoomCreationLimited        = "Too many rooms created, try again later"
+	RoomLockedByAnother        = "Room is already locked by another user"
+	FailedToGetPresence        = "Failed to get the connected room members"
+	InvalidRoomMode            = "Room mode must be \"open\" or \"announcement\""
+	AnnouncementRoom           = "Only admins can send messages to an announcement room"
+	InvalidSlowMode            = "Slow mode must be between 0 and 21600 seconds"
+	SlowModeActive             = "Slow mode is on, wait before sending another message"
+
+	// Message errors
+	MessageNotFound = "Message not found"
+	MessageDeleted  = "Message was deleted"
+	MessageRequired = "Message content is required"
+	MessageTooLong  = "Message exceeds the maximum length"
+	RoomLocked      = "Room is locked. Messages cannot be sent."
+	RateLimited     = "Too many messages, try again later"
+	MessageRejected = "Message contains banned words"
+	UserMuted       = "User is muted in the room"
+
+	InvalidMessageFormat   = "Invalid message"
+	UnsupportedMessageType = "Unsupported message type"
+	InvalidHistoryCount    = "history must be a non-negative number of messages"
+
+	NotMessageSender      = "Only the sender can change the message"
+	EditWindowExpired     = "Message can no longer be edited"
+	DeleteWindowExpired   = "Message can no longer be deleted"
+	InvalidMessageWindow  = "Message edit and delete windows can't be negative"
+	FailedToUpdateMessage = "Failed to update message"
+
+	// Report errors
+	ReportReasonRequired  = "Report requires a reason of up to 500 characters"
+	ReportAlreadyExists   = "Message already reported by the user"
+	ReportNotFound        = "Report not found"
+	InvalidReportAction   = "Report action must be dismiss or delete"
+	FailedToGetReports    = "Failed to get reports"
+	FailedToUpdateReports = "Failed to update reports"
+
+	// Purge errors
+	PurgeCriteriaRequired = "Purge requires a user, a time range or a text"
+	PurgeNotConfirmed     = "Purge must be confirmed"
+	FailedToPurgeMessages = "Failed to purge messages"
+
+	// Import errors
+	InvalidImport          = "Imported messages require content, a sender and a timestamp"
+	ImportTooLarge         = "Too many messages to import at once"
+	FailedToImportMessages = "Failed to import messages"
+
+	// Attachment errors
+	AttachmentRequired        = "A file is required"
+	AttachmentTooLarge        = "File exceeds the maximum attachment size"
+	UnsupportedAttachmentType = "File type is not allowed"
+	InvalidAttachment         = "Attachment must be uploaded to the room first"
+	FailedToStoreAttachment   = "Failed to store attachment"
+
+	// Pin errors
+	PinNotFound          = "Pinned message not found"
+	MessageAlreadyPinned = "Message is already pinned"
+	PinLimitReached      = "Room reached the maximum number of pinned messages"
+	InvalidPinOrder      = "message_ids must list every pinned message exactly once"
+	FailedToGetPins      = "Failed to get pinned messages"
+	FailedToUpdatePins   = "Failed to update pinned messages"
+
+	// Read state errors
+	FailedToGetUnreadRooms   = "Failed to get unread rooms"
+	FailedToUpdateReadMarker = "Failed to mark room as read"
 
 	// User errors
 	FailedToGetUsers            = "Failed to get users"
 	UserNotFound                = "User not found"
 	FailedToCreateUser          = "Failed to create user"
 	UserIDRequired              = "User ID is required"
+	NicknameRequired            = "Nickname is required"
+	InvalidMute                 = "Mute requires a user ID and a duration of up to 30 days"
+	UserNotMuted                = "User is not muted in the room"
+	FailedToUpdateMute          = "Failed to update mute"
 	UserNotAuthorizedToLockRoom = "User not authorized to lock room"
 	FailedToUpdateUser          = "Failed to update user"
+	FailedToGetContacts         = "Failed to get contacts"
+
+	// Client errors
+	ClientNotFound       = "Client not found"
+	FailedToGetClients   = "Failed to get clients"
+	FailedToCreateClient = "Failed to create client"
+	FailedToUpdateClient = "Failed to update client"
+	FailedToDeleteClient = "Failed to delete client"
+	ClientKeyRequired    = "A client API key is required"
+	InvalidClient        = "Client requires a name and known scopes"
+
+	// Webhook errors
+	WebhookNotFound       = "Webhook not found"
+	FailedToGetWebhooks   = "Failed to get webhooks"
+	FailedToCreateWebhook = "Failed to create webhook"
+	InvalidWebhook        = "Webhook requires a valid http(s) URL and known events"
+
+	// Invite errors
+	InviteNotFound       = "Invite not found"
+	InviteExpired        = "Invite has expired"
+	InviteExhausted      = "Invite has no uses left"
+	InviteCodeRequired   = "Invite code is required"
+	InvalidInvite        = "Invite expiry and maximum uses can't be negative"
+	FailedToGetInvite    = "Failed to get invite"
+	FailedToCreateInvite = "Failed to create invite"
+	FailedToUpdateInvite = "Failed to update invite"
+
+	// Session errors
+	SessionNotFound       = "Session not found"
+	FailedToGetSessions   = "Failed to get sessions"
+	FailedToCreateSession = "Failed to create session"
+	FailedToDeleteSession = "Failed to delete session"
 
 	// General errors
 	FailedToDecodeBody = "Failed to decode body"
+	InvalidCursor      = "Invalid pagination cursor"
+	MaintenanceMode    = "Service is in maintenance mode, try again later"
+	ShuttingDown       = "Server is shutting down"
+
+	// Admin errors
+	FailedToUpdateMaintenanceMode = "Failed to update maintenance mode"
+	FailedToCreateAuditEntry      = "Failed to create audit entry"
+	FailedToGetAuditLog           = "Failed to get audit log"
+
+	// Connection errors
+	UserConnectionLimit   = "Too many open connections for the user"
+	ServerConnectionLimit = "Server has too many open connections, try again later"
+
+	// Request errors
+	InternalError    = "Internal server error"
+	RouteNotFound    = "Route not found"
+	MethodNotAllowed = "Method not allowed"
+
+	// Authentication errors
+	AuthorizationRequired = "Authorization header required"
+	InvalidToken          = "Invalid or expired token"
+	InvalidTokenClaims    = "Invalid token claims"
+	FailedToVerifyAccount = "Failed to verify account"
+	AccountDisabled       = "Account is disabled"
+	InvalidAPIKey         = "Invalid API key"
+	FailedToVerifyAPIKey  = "Failed to verify API key"
+	ReadOnlyAPIKey        = "API key is read-only"
+	MissingScope          = "API key is missing the required scope"
+	InvalidAdminKey       = "Invalid admin key"
+	CannotAccessOtherUser = "Cannot access another user's data"
+	GuestNotAllowed       = "Guests can't access account endpoints"
+	SessionRevoked        = "Session was revoked or has expired"
+	FailedToVerifySession = "Failed to verify session"
 )
 
 var ErrorMessages = map[string]ErrorMessage{
@@ -55,6 +207,26 @@ var ErrorMessages = map[string]ErrorMessage{
 		ID:      "room_id_required",
 		Code:    400,
 	},
+	InvalidRoomID: {
+		Message: InvalidRoomID,
+		ID:      "invalid_room_id",
+		Code:    400,
+	},
+	RoomLockedByAnother: {
+		Message: RoomLockedByAnother,
+		ID:      "room_locked_by_another",
+		Code:    409,
+	},
+	FailedToGetPresence: {
+		Message: FailedToGetPresence,
+		ID:      "failed_get_presence",
+		Code:    500,
+	},
+	ClientRoomIDsDisabled: {
+		Message: ClientRoomIDsDisabled,
+		ID:      "client_room_ids_disabled",
+		Code:    403,
+	},
 	FailedToGetMessages: {
 		Message: FailedToGetMessages,
 		ID:      "failed_get_messages",
@@ -71,6 +243,274 @@ var ErrorMessages = map[string]ErrorMessage{
 		Code:    500,
 	},
 
+	UserNotRoomMember: {
+		Message: UserNotRoomMember,
+		ID:      "user_not_room_member",
+		Code:    403,
+	},
+
+	RoomHasNoMembers: {
+		Message: RoomHasNoMembers,
+		ID:      "no_members",
+		Code:    403,
+	},
+
+	RoomNotInToken: {
+		Message: RoomNotInToken,
+		ID:      "room_not_in_token",
+		Code:    403,
+	},
+
+	UserIDMismatch: {
+		Message: UserIDMismatch,
+		ID:      "user_id_mismatch",
+		Code:    403,
+	},
+	RoomCreationLimited: {
+		Message: RoomCreationLimited,
+		ID:      "room_creation_limited",
+		Code:    429,
+	},
+
+	// Message errors
+	MessageNotFound: {
+		Message: MessageNotFound,
+		ID:      "message_not_found",
+		Code:    404,
+	},
+	MessageRequired: {
+		Message: MessageRequired,
+		ID:      "message_required",
+		Code:    400,
+	},
+	MessageTooLong: {
+		Message: MessageTooLong,
+		ID:      "message_too_long",
+		Code:    400,
+	},
+	RoomLocked: {
+		Message: RoomLocked,
+		ID:      "room_locked",
+		Code:    423,
+	},
+	RateLimited: {
+		Message: RateLimited,
+		ID:      "rate_limited",
+		Code:    429,
+	},
+	MessageRejected: {
+		Message: MessageRejected,
+		ID:      "message_rejected",
+		Code:    400,
+	},
+	UserMuted: {
+		Message: UserMuted,
+		ID:      "user_muted",
+		Code:    403,
+	},
+	AnnouncementRoom: {
+		Message: AnnouncementRoom,
+		ID:      "announcement_room",
+		Code:    403,
+	},
+	InvalidRoomMode: {
+		Message: InvalidRoomMode,
+		ID:      "invalid_room_mode",
+		Code:    400,
+	},
+	InvalidSlowMode: {
+		Message: InvalidSlowMode,
+		ID:      "invalid_slow_mode",
+		Code:    400,
+	},
+	SlowModeActive: {
+		Message: SlowModeActive,
+		ID:      "slow_mode",
+		Code:    429,
+	},
+	InvalidMessageFormat: {
+		Message: InvalidMessageFormat,
+		ID:      "invalid_message_format",
+		Code:    400,
+	},
+	UnsupportedMessageType: {
+		Message: UnsupportedMessageType,
+		ID:      "unsupported_message_type",
+		Code:    400,
+	},
+	InvalidHistoryCount: {
+		Message: InvalidHistoryCount,
+		ID:      "invalid_history_count",
+		Code:    400,
+	},
+	MessageDeleted: {
+		Message: MessageDeleted,
+		ID:      "message_deleted",
+		Code:    410,
+	},
+	NotMessageSender: {
+		Message: NotMessageSender,
+		ID:      "not_message_sender",
+		Code:    403,
+	},
+	EditWindowExpired: {
+		Message: EditWindowExpired,
+		ID:      "edit_window_expired",
+		Code:    403,
+	},
+	DeleteWindowExpired: {
+		Message: DeleteWindowExpired,
+		ID:      "delete_window_expired",
+		Code:    403,
+	},
+	InvalidMessageWindow: {
+		Message: InvalidMessageWindow,
+		ID:      "invalid_message_window",
+		Code:    400,
+	},
+	FailedToUpdateMessage: {
+		Message: FailedToUpdateMessage,
+		ID:      "failed_to_update_message",
+		Code:    500,
+	},
+
+	// Report errors
+	ReportReasonRequired: {
+		Message: ReportReasonRequired,
+		ID:      "report_reason_required",
+		Code:    400,
+	},
+	ReportAlreadyExists: {
+		Message: ReportAlreadyExists,
+		ID:      "report_already_exists",
+		Code:    409,
+	},
+	ReportNotFound: {
+		Message: ReportNotFound,
+		ID:      "report_not_found",
+		Code:    404,
+	},
+	InvalidReportAction: {
+		Message: InvalidReportAction,
+		ID:      "invalid_report_action",
+		Code:    400,
+	},
+	FailedToGetReports: {
+		Message: FailedToGetReports,
+		ID:      "failed_get_reports",
+		Code:    500,
+	},
+	FailedToUpdateReports: {
+		Message: FailedToUpdateReports,
+		ID:      "failed_update_reports",
+		Code:    500,
+	},
+
+	// Purge errors
+	PurgeCriteriaRequired: {
+		Message: PurgeCriteriaRequired,
+		ID:      "purge_criteria_required",
+		Code:    400,
+	},
+	PurgeNotConfirmed: {
+		Message: PurgeNotConfirmed,
+		ID:      "purge_not_confirmed",
+		Code:    400,
+	},
+	FailedToPurgeMessages: {
+		Message: FailedToPurgeMessages,
+		ID:      "failed_purge_messages",
+		Code:    500,
+	},
+
+	// Import errors
+	InvalidImport: {
+		Message: InvalidImport,
+		ID:      "invalid_import",
+		Code:    400,
+	},
+	ImportTooLarge: {
+		Message: ImportTooLarge,
+		ID:      "import_too_large",
+		Code:    413,
+	},
+	FailedToImportMessages: {
+		Message: FailedToImportMessages,
+		ID:      "failed_import_messages",
+		Code:    500,
+	},
+
+	// Attachment errors
+	AttachmentRequired: {
+		Message: AttachmentRequired,
+		ID:      "attachment_required",
+		Code:    400,
+	},
+	AttachmentTooLarge: {
+		Message: AttachmentTooLarge,
+		ID:      "attachment_too_large",
+		Code:    413,
+	},
+	UnsupportedAttachmentType: {
+		Message: UnsupportedAttachmentType,
+		ID:      "unsupported_attachment_type",
+		Code:    415,
+	},
+	InvalidAttachment: {
+		Message: InvalidAttachment,
+		ID:      "invalid_attachment",
+		Code:    400,
+	},
+	FailedToStoreAttachment: {
+		Message: FailedToStoreAttachment,
+		ID:      "failed_store_attachment",
+		Code:    500,
+	},
+
+	// Pin errors
+	PinNotFound: {
+		Message: PinNotFound,
+		ID:      "pin_not_found",
+		Code:    404,
+	},
+	MessageAlreadyPinned: {
+		Message: MessageAlreadyPinned,
+		ID:      "message_already_pinned",
+		Code:    409,
+	},
+	PinLimitReached: {
+		Message: PinLimitReached,
+		ID:      "pin_limit_reached",
+		Code:    409,
+	},
+	InvalidPinOrder: {
+		Message: InvalidPinOrder,
+		ID:      "invalid_pin_order",
+		Code:    400,
+	},
+	FailedToGetPins: {
+		Message: FailedToGetPins,
+		ID:      "failed_get_pins",
+		Code:    500,
+	},
+	FailedToUpdatePins: {
+		Message: FailedToUpdatePins,
+		ID:      "failed_update_pins",
+		Code:    500,
+	},
+
+	// Read state errors
+	FailedToGetUnreadRooms: {
+		Message: FailedToGetUnreadRooms,
+		ID:      "failed_get_unread_rooms",
+		Code:    500,
+	},
+	FailedToUpdateReadMarker: {
+		Message: FailedToUpdateReadMarker,
+		ID:      "failed_update_read_marker",
+		Code:    500,
+	},
+
 	// User errors
 	FailedToGetUsers: {
 		Message: FailedToGetUsers,
@@ -92,6 +532,26 @@ var ErrorMessages = map[string]ErrorMessage{
 		ID:      "user_id_required",
 		Code:    400,
 	},
+	NicknameRequired: {
+		Message: NicknameRequired,
+		ID:      "nickname_required",
+		Code:    400,
+	},
+	InvalidMute: {
+		Message: InvalidMute,
+		ID:      "invalid_mute",
+		Code:    400,
+	},
+	UserNotMuted: {
+		Message: UserNotMuted,
+		ID:      "user_not_muted",
+		Code:    404,
+	},
+	FailedToUpdateMute: {
+		Message: FailedToUpdateMute,
+		ID:      "failed_update_mute",
+		Code:    500,
+	},
 	UserNotAuthorizedToLockRoom: {
 		Message: UserNotAuthorizedToLockRoom,
 		ID:      "user_not_authorized_to_lock_room",
@@ -102,6 +562,135 @@ var ErrorMessages = map[string]ErrorMessage{
 		ID:      "failed_update_user",
 		Code:    500,
 	},
+	FailedToGetContacts: {
+		Message: FailedToGetContacts,
+		ID:      "failed_get_contacts",
+		Code:    500,
+	},
+
+	// Client errors
+	ClientNotFound: {
+		Message: ClientNotFound,
+		ID:      "client_not_found",
+		Code:    404,
+	},
+	FailedToGetClients: {
+		Message: FailedToGetClients,
+		ID:      "failed_get_clients",
+		Code:    500,
+	},
+	FailedToCreateClient: {
+		Message: FailedToCreateClient,
+		ID:      "failed_create_client",
+		Code:    500,
+	},
+	FailedToUpdateClient: {
+		Message: FailedToUpdateClient,
+		ID:      "failed_update_client",
+		Code:    500,
+	},
+
+	FailedToDeleteClient: {
+		Message: FailedToDeleteClient,
+		ID:      "failed_delete_client",
+		Code:    500,
+	},
+	InvalidClient: {
+		Message: InvalidClient,
+		ID:      "invalid_client",
+		Code:    400,
+	},
+	ClientKeyRequired: {
+		Message: ClientKeyRequired,
+		ID:      "client_key_required",
+		Code:    403,
+	},
+
+	// Webhook errors
+	WebhookNotFound: {
+		Message: WebhookNotFound,
+		ID:      "webhook_not_found",
+		Code:    404,
+	},
+	FailedToGetWebhooks: {
+		Message: FailedToGetWebhooks,
+		ID:      "failed_get_webhooks",
+		Code:    500,
+	},
+	FailedToCreateWebhook: {
+		Message: FailedToCreateWebhook,
+		ID:      "failed_create_webhook",
+		Code:    500,
+	},
+	InvalidWebhook: {
+		Message: InvalidWebhook,
+		ID:      "invalid_webhook",
+		Code:    400,
+	},
+
+	// Invite errors
+	InviteNotFound: {
+		Message: InviteNotFound,
+		ID:      "invite_not_found",
+		Code:    404,
+	},
+	InviteExpired: {
+		Message: InviteExpired,
+		ID:      "invite_expired",
+		Code:    410,
+	},
+	InviteExhausted: {
+		Message: InviteExhausted,
+		ID:      "invite_exhausted",
+		Code:    410,
+	},
+	InviteCodeRequired: {
+		Message: InviteCodeRequired,
+		ID:      "invite_code_required",
+		Code:    400,
+	},
+	InvalidInvite: {
+		Message: InvalidInvite,
+		ID:      "invalid_invite",
+		Code:    400,
+	},
+	FailedToGetInvite: {
+		Message: FailedToGetInvite,
+		ID:      "failed_get_invite",
+		Code:    500,
+	},
+	FailedToCreateInvite: {
+		Message: FailedToCreateInvite,
+		ID:      "failed_create_invite",
+		Code:    500,
+	},
+	FailedToUpdateInvite: {
+		Message: FailedToUpdateInvite,
+		ID:      "failed_update_invite",
+		Code:    500,
+	},
+
+	// Session errors
+	SessionNotFound: {
+		Message: SessionNotFound,
+		ID:      "session_not_found",
+		Code:    404,
+	},
+	FailedToGetSessions: {
+		Message: FailedToGetSessions,
+		ID:      "failed_get_sessions",
+		Code:    500,
+	},
+	FailedToCreateSession: {
+		Message: FailedToCreateSession,
+		ID:      "failed_create_session",
+		Code:    500,
+	},
+	FailedToDeleteSession: {
+		Message: FailedToDeleteSession,
+		ID:      "failed_delete_session",
+		Code:    500,
+	},
 
 	// General errors
 	FailedToDecodeBody: {
@@ -109,4 +698,137 @@ var ErrorMessages = map[string]ErrorMessage{
 		ID:      "failed_decode_body",
 		Code:    400,
 	},
+	InvalidCursor: {
+		Message: InvalidCursor,
+		ID:      "invalid_cursor",
+		Code:    400,
+	},
+	MaintenanceMode: {
+		Message: MaintenanceMode,
+		ID:      "maintenance",
+		Code:    503,
+	},
+	ShuttingDown: {
+		Message: ShuttingDown,
+		ID:      "shutting_down",
+		Code:    503,
+	},
+
+	// Admin errors
+	FailedToUpdateMaintenanceMode: {
+		Message: FailedToUpdateMaintenanceMode,
+		ID:      "failed_update_maintenance_mode",
+		Code:    500,
+	},
+	FailedToCreateAuditEntry: {
+		Message: FailedToCreateAuditEntry,
+		ID:      "failed_create_audit_entry",
+		Code:    500,
+	},
+	FailedToGetAuditLog: {
+		Message: FailedToGetAuditLog,
+		ID:      "failed_get_audit_log",
+		Code:    500,
+	},
+
+	// Connection errors
+	UserConnectionLimit: {
+		Message: UserConnectionLimit,
+		ID:      "user_connection_limit",
+		Code:    429,
+	},
+	ServerConnectionLimit: {
+		Message: ServerConnectionLimit,
+		ID:      "server_connection_limit",
+		Code:    503,
+	},
+
+	// Request errors
+	InternalError: {
+		Message: InternalError,
+		ID:      "internal_error",
+		Code:    500,
+	},
+	RouteNotFound: {
+		Message: RouteNotFound,
+		ID:      "route_not_found",
+		Code:    404,
+	},
+	MethodNotAllowed: {
+		Message: MethodNotAllowed,
+		ID:      "method_not_allowed",
+		Code:    405,
+	},
+
+	// Authentication errors
+	AuthorizationRequired: {
+		Message: AuthorizationRequired,
+		ID:      "authorization_required",
+		Code:    401,
+	},
+	InvalidToken: {
+		Message: InvalidToken,
+		ID:      "invalid_token",
+		Code:    401,
+	},
+	InvalidTokenClaims: {
+		Message: InvalidTokenClaims,
+		ID:      "invalid_token_claims",
+		Code:    401,
+	},
+	FailedToVerifyAccount: {
+		Message: FailedToVerifyAccount,
+		ID:      "failed_verify_account",
+		Code:    500,
+	},
+	AccountDisabled: {
+		Message: AccountDisabled,
+		ID:      "account_disabled",
+		Code:    403,
+	},
+	InvalidAPIKey: {
+		Message: InvalidAPIKey,
+		ID:      "invalid_api_key",
+		Code:    401,
+	},
+	FailedToVerifyAPIKey: {
+		Message: FailedToVerifyAPIKey,
+		ID:      "failed_verify_api_key",
+		Code:    500,
+	},
+	ReadOnlyAPIKey: {
+		Message: ReadOnlyAPIKey,
+		ID:      "read_only_api_key",
+		Code:    403,
+	},
+	MissingScope: {
+		Message: MissingScope,
+		ID:      "missing_scope",
+		Code:    403,
+	},
+	InvalidAdminKey: {
+		Message: InvalidAdminKey,
+		ID:      "invalid_admin_key",
+		Code:    403,
+	},
+	CannotAccessOtherUser: {
+		Message: CannotAccessOtherUser,
+		ID:      "cannot_access_other_user",
+		Code:    403,
+	},
+	GuestNotAllowed: {
+		Message: GuestNotAllowed,
+		ID:      "guest_not_allowed",
+		Code:    403,
+	},
+	SessionRevoked: {
+		Message: SessionRevoked,
+		ID:      "session_revoked",
+		Code:    401,
+	},
+	FailedToVerifySession: {
+		Message: FailedToVerifySession,
+		ID:      "failed_verify_session",
+		Code:    500,
+	},
 }
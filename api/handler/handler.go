@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 
+	"github.com/vit0rr/chat/api/constants"
 	"github.com/vit0rr/chat/pkg/log"
 )
 
@@ -12,7 +13,57 @@ import (
 // way for error handling, logging, etc.
 type Handler func(http.ResponseWriter, *http.Request) (interface{}, error)
 
-func handleError(r *http.Request, err error, w http.ResponseWriter) {}
+// StatusCoder is implemented by the responses answered with another status than 200,
+// like the errors. The handlers never write the status themselves, so it's only written once.
+type StatusCoder interface {
+	StatusCode() int
+}
+
+// Response answers the body with the status
+type Response struct {
+	Status int
+	Body   interface{}
+}
+
+func (r Response) StatusCode() int {
+	return r.Status
+}
+
+// ErrorResponse is the body of every API error, so clients can always display it
+type ErrorResponse struct {
+	Error   string                 `json:"error"`
+	Code    int                    `json:"code"`
+	ErrorID string                 `json:"error_id"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+func (e ErrorResponse) StatusCode() int {
+	return e.Code
+}
+
+// WriteError writes the status code and the JSON body of the error. For the middlewares
+// and the failures that happen outside a Handler.
+func WriteError(w http.ResponseWriter, errKey string, details map[string]interface{}) {
+	errMsg, ok := constants.ErrorMessages[errKey]
+	if !ok {
+		errMsg = constants.ErrorMessages[constants.InternalError]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(errMsg.Code)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Error:   errMsg.Message,
+		Code:    errMsg.Code,
+		ErrorID: errMsg.ID,
+		Details: details,
+	})
+}
+
+// handleError answers the errors the handler couldn't map to a response
+func handleError(r *http.Request, err error, w http.ResponseWriter) {
+	log.Error(r.Context(), "Handler: unhandled error", log.ErrAttr(err))
+	WriteError(w, constants.InternalError, nil)
+}
 
 // ServeHTTP executes the handler function and handles potential errors as well as writing potential responses to http.ResponseWriter
 func (fn Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -22,16 +73,31 @@ func (fn Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if resp != nil {
-		w.WriteHeader(http.StatusOK)
-		res, err := json.Marshal(resp)
-		if err != nil {
-			log.Error(r.Context(), "Handler: failed to marshal response body", log.ErrAttr(err))
-		}
-
-		_, err = w.Write(res)
-		if err != nil {
-			log.Error(r.Context(), "Handler: failed to write response body", log.ErrAttr(err))
-		}
+	// The handler wrote its own response, like a streamed body or a WebSocket upgrade
+	if resp == nil {
+		return
+	}
+
+	status := http.StatusOK
+	if coder, ok := resp.(StatusCoder); ok {
+		status = coder.StatusCode()
+	}
+
+	body := resp
+	if response, ok := resp.(Response); ok {
+		body = response.Body
+	}
+
+	res, err := json.Marshal(body)
+	if err != nil {
+		log.Error(r.Context(), "Handler: failed to marshal response body", log.ErrAttr(err))
+		WriteError(w, constants.InternalError, nil)
+		return
+	}
+
+	w.WriteHeader(status)
+	_, err = w.Write(res)
+	if err != nil {
+		log.Error(r.Context(), "Handler: failed to write response body", log.ErrAttr(err))
 	}
 }
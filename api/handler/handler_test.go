@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vit0rr/chat/api/constants"
+)
+
+// headerCounter counts the WriteHeader calls, the status must be written once
+type headerCounter struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (w *headerCounter) WriteHeader(status int) {
+	w.writes++
+	w.ResponseRecorder.WriteHeader(status)
+}
+
+func TestHandlerStatus(t *testing.T) {
+	internalError := constants.ErrorMessages[constants.InternalError]
+
+	tests := []struct {
+		name       string
+		resp       interface{}
+		err        error
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "plain response",
+			resp:       map[string]string{"status": "ok"},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"status":"ok"}`,
+		},
+		{
+			name:       "response with another status",
+			resp:       Response{Status: http.StatusCreated, Body: map[string]string{"id": "1"}},
+			wantStatus: http.StatusCreated,
+			wantBody:   `{"id":"1"}`,
+		},
+		{
+			name:       "error response",
+			resp:       ErrorResponse{Error: "Room not found", Code: http.StatusNotFound, ErrorID: "room_not_found"},
+			wantStatus: http.StatusNotFound,
+			wantBody:   `{"error":"Room not found","code":404,"error_id":"room_not_found"}`,
+		},
+		{
+			name:       "unhandled error",
+			err:        errors.New("boom"),
+			wantStatus: internalError.Code,
+		},
+		{
+			name:       "body failing to marshal",
+			resp:       map[string]interface{}{"bad": make(chan int)},
+			wantStatus: internalError.Code,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := Handler(func(http.ResponseWriter, *http.Request) (interface{}, error) {
+				return tt.resp, tt.err
+			})
+
+			w := &headerCounter{ResponseRecorder: httptest.NewRecorder()}
+			fn.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if w.writes != 1 {
+				t.Errorf("status written %d times, want once", w.writes)
+			}
+
+			if tt.wantBody != "" {
+				if got := w.Body.String(); got != tt.wantBody {
+					t.Errorf("body = %s, want %s", got, tt.wantBody)
+				}
+				return
+			}
+
+			var errResp ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &errResp); err != nil || errResp.ErrorID != internalError.ID {
+				t.Errorf("body = %s, want the %s error", w.Body.String(), internalError.ID)
+			}
+		})
+	}
+}
+
+func TestHandlerWritingItsOwnResponse(t *testing.T) {
+	fn := Handler(func(w http.ResponseWriter, _ *http.Request) (interface{}, error) {
+		w.WriteHeader(http.StatusSwitchingProtocols)
+		return nil, nil
+	})
+
+	w := &headerCounter{ResponseRecorder: httptest.NewRecorder()}
+	fn.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusSwitchingProtocols || w.writes != 1 {
+		t.Errorf("status = %d written %d times, want the handler's 101 only", w.Code, w.writes)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("body = %s, want none", w.Body.String())
+	}
+}
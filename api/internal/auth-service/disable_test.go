@@ -0,0 +1,62 @@
+package authservice
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDisabledAccountCannotLogIn(t *testing.T) {
+	s, _ := newTestService(t)
+	userID := register(t, s, "alice@example.com")
+
+	if _, err := s.DeactivateSelf(t.Context(), userID, Origin{}); err != nil {
+		t.Fatalf("deactivate: %v", err)
+	}
+
+	if _, err := login(t, s, "alice@example.com"); !errors.Is(err, ErrAccountDisabled) {
+		t.Fatalf("login of a disabled account = %v, want %v", err, ErrAccountDisabled)
+	}
+}
+
+func TestSelfDeactivatedAccountCanBeReactivated(t *testing.T) {
+	s, _ := newTestService(t)
+	userID := register(t, s, "alice@example.com")
+
+	if _, err := s.DeactivateSelf(t.Context(), userID, Origin{}); err != nil {
+		t.Fatalf("deactivate: %v", err)
+	}
+
+	if _, err := reactivate(t, s, "alice@example.com"); err != nil {
+		t.Fatalf("reactivate: %v", err)
+	}
+	if _, err := login(t, s, "alice@example.com"); err != nil {
+		t.Fatalf("login after reactivation: %v", err)
+	}
+}
+
+func TestAdminDeactivatedAccountCannotReactivateItself(t *testing.T) {
+	s, store := newTestService(t)
+	userID := register(t, s, "alice@example.com")
+
+	if _, err := s.DeactivateUser(t.Context(), "admin", userID, Origin{}); err != nil {
+		t.Fatalf("deactivate: %v", err)
+	}
+
+	if _, err := reactivate(t, s, "alice@example.com"); !errors.Is(err, ErrDisabledByAdmin) {
+		t.Fatalf("self reactivation = %v, want %v", err, ErrDisabledByAdmin)
+	}
+	if user, _ := store.GetUser(t.Context(), userID); !user.Disabled {
+		t.Fatal("account reactivated, want it still disabled")
+	}
+	if _, err := login(t, s, "alice@example.com"); !errors.Is(err, ErrAccountDisabled) {
+		t.Fatalf("login = %v, want %v", err, ErrAccountDisabled)
+	}
+
+	// Once an admin reactivated it, the account is the user's again
+	if _, err := s.ReactivateUser(t.Context(), "admin", userID, Origin{}); err != nil {
+		t.Fatalf("admin reactivation: %v", err)
+	}
+	if _, err := login(t, s, "alice@example.com"); err != nil {
+		t.Fatalf("login after admin reactivation: %v", err)
+	}
+}
@@ -0,0 +1,265 @@
+package authservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vit0rr/chat/config"
+	"github.com/vit0rr/chat/pkg/broker"
+	"github.com/vit0rr/chat/pkg/database/repositories"
+	"github.com/vit0rr/chat/pkg/deps"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// memoryStore is an in-memory Store
+type memoryStore struct {
+	mu       sync.Mutex
+	nextID   int
+	users    map[string]repositories.User
+	sessions map[string]repositories.Session
+	audit    []repositories.AuditEntry
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:    make(map[string]repositories.User),
+		sessions: make(map[string]repositories.Session),
+	}
+}
+
+func (m *memoryStore) GetUser(ctx context.Context, userID string) (*repositories.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return nil, nil
+	}
+
+	return &user, nil
+}
+
+func (m *memoryStore) GetUserByEmail(ctx context.Context, email string) (*repositories.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, user := range m.users {
+		if user.Email != "" && user.Email == email {
+			return &user, nil
+		}
+	}
+
+	return nil, mongo.ErrNoDocuments
+}
+
+func (m *memoryStore) CreateUser(ctx context.Context, data repositories.CreateUserData) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextID++
+	id := fmt.Sprintf("user-%d", m.nextID)
+	m.users[id] = repositories.User{
+		Id:        id,
+		Email:     data.Email,
+		Password:  data.Password,
+		Nickname:  data.Nickname,
+		Activity:  data.Activity,
+		IsGuest:   data.IsGuest,
+		ExpiresAt: data.ExpiresAt,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	return id, nil
+}
+
+func (m *memoryStore) SetUserActivity(ctx context.Context, userID string, activity string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if user, ok := m.users[userID]; ok {
+		user.Activity = activity
+		m.users[userID] = user
+	}
+
+	return nil
+}
+
+func (m *memoryStore) UpdateUserPassword(ctx context.Context, userID string, passwordHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if user, ok := m.users[userID]; ok {
+		user.Password = passwordHash
+		m.users[userID] = user
+	}
+
+	return nil
+}
+
+func (m *memoryStore) SetUserDisabled(ctx context.Context, userID string, disabled bool, adminID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return repositories.ErrUserNotFound
+	}
+
+	user.Disabled = disabled
+	user.DisabledBy = ""
+	if disabled {
+		user.DisabledBy = adminID
+	}
+	m.users[userID] = user
+
+	return nil
+}
+
+func (m *memoryStore) DeleteUser(ctx context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.users, userID)
+
+	return nil
+}
+
+func (m *memoryStore) CreateSession(ctx context.Context, data repositories.CreateSessionData) (*repositories.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session := repositories.Session{
+		ID:         data.ID,
+		UserID:     data.UserID,
+		IP:         data.IP,
+		UserAgent:  data.UserAgent,
+		CreatedAt:  time.Now(),
+		LastUsedAt: time.Now(),
+		ExpiresAt:  data.ExpiresAt,
+	}
+	m.sessions[session.ID] = session
+
+	return &session, nil
+}
+
+func (m *memoryStore) GetUserSessions(ctx context.Context, userID string) ([]repositories.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sessions := []repositories.Session{}
+	for _, session := range m.sessions {
+		if session.UserID == userID && session.ExpiresAt.After(time.Now()) {
+			sessions = append(sessions, session)
+		}
+	}
+	slices.SortFunc(sessions, func(a, b repositories.Session) int {
+		return b.LastUsedAt.Compare(a.LastUsedAt)
+	})
+
+	return sessions, nil
+}
+
+func (m *memoryStore) DeleteSession(ctx context.Context, userID string, sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok || session.UserID != userID {
+		return repositories.ErrSessionNotFound
+	}
+	delete(m.sessions, sessionID)
+
+	return nil
+}
+
+func (m *memoryStore) DeleteUserSessions(ctx context.Context, userID string, exceptID string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deleted int64
+	for id, session := range m.sessions {
+		if session.UserID == userID && id != exceptID {
+			delete(m.sessions, id)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+func (m *memoryStore) CreateAuditEntry(ctx context.Context, entry repositories.AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry.CreatedAt = time.Now()
+	m.audit = append(m.audit, entry)
+
+	return nil
+}
+
+// newTestService runs the service on a memoryStore and an in-memory broker, the config is the
+// default one changed by configure
+func newTestService(t *testing.T, configure ...func(*config.Config)) (*Service, *memoryStore) {
+	t.Helper()
+
+	cfg := config.DefaultConfig(config.Config{})
+	cfg.JWT.Secret = "auth-test-secret"
+	cfg.BcryptCost = bcrypt.MinCost
+	for _, apply := range configure {
+		apply(&cfg)
+	}
+
+	store := newMemoryStore()
+	return newService(deps.New(cfg, nil, broker.NewMemory()), store), store
+}
+
+// jsonBody is the request body encoding the value
+func jsonBody(t *testing.T, v interface{}) io.ReadCloser {
+	t.Helper()
+
+	payload, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshal body: %v", err)
+	}
+
+	return io.NopCloser(bytes.NewReader(payload))
+}
+
+// register creates an account with the email and password "password", returning its ID
+func register(t *testing.T, s *Service, email string) string {
+	t.Helper()
+
+	result, err := s.Register(t.Context(), jsonBody(t, RegisterRequest{
+		Email:    email,
+		Password: "password",
+		Nickname: email,
+	}), Origin{})
+	if err != nil {
+		t.Fatalf("register %s: %v", email, err)
+	}
+
+	return result.(AuthResponse).UserID
+}
+
+// login logs in with the email and password "password"
+func login(t *testing.T, s *Service, email string) (interface{}, error) {
+	t.Helper()
+
+	return s.Login(t.Context(), jsonBody(t, LoginRequest{Email: email, Password: "password"}), Origin{})
+}
+
+// reactivate reactivates the account with the email and password "password"
+func reactivate(t *testing.T, s *Service, email string) (interface{}, error) {
+	t.Helper()
+
+	return s.ReactivateSelf(t.Context(), jsonBody(t, LoginRequest{Email: email, Password: "password"}), Origin{})
+}
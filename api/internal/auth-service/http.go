@@ -1,10 +1,17 @@
 package authservice
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/vit0rr/chat/api/handler"
+	"github.com/vit0rr/chat/pkg/database/repositories"
 	"github.com/vit0rr/chat/pkg/deps"
+	"github.com/vit0rr/chat/pkg/middleware"
+	"github.com/vit0rr/chat/pkg/telemetry"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
@@ -13,8 +20,14 @@ type HTTP struct {
 }
 
 type ErrorResponse struct {
-	Error string `json:"error"`
-	Code  int    `json:"code"`
+	Error   string `json:"error"`
+	Code    int    `json:"code"`
+	ErrorID string `json:"error_id"`
+}
+
+// StatusCode is the status the response is answered with
+func (e ErrorResponse) StatusCode() int {
+	return e.Code
 }
 
 func NewHTTP(deps *deps.Deps, db *mongo.Database) *HTTP {
@@ -23,49 +36,259 @@ func NewHTTP(deps *deps.Deps, db *mongo.Database) *HTTP {
 	}
 }
 
+// origin returns where the request comes from. The RealIP middleware already replaced the
+// remote address with the client's, when behind a proxy.
+func origin(r *http.Request) Origin {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	return Origin{IP: ip, UserAgent: r.UserAgent()}
+}
+
 func (h *HTTP) Register(w http.ResponseWriter, r *http.Request) (interface{}, error) {
-	result, err := h.service.Register(r.Context(), r.Body)
+	result, err := h.service.Register(r.Context(), r.Body, origin(r))
+	telemetry.RecordAuthAttempt("register", err)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
 		return ErrorResponse{
-			Error: err.Error(),
-			Code:  http.StatusBadRequest,
+			Error:   err.Error(),
+			Code:    http.StatusBadRequest,
+			ErrorID: "registration_failed",
 		}, nil
 	}
 	return result, nil
 }
 
 func (h *HTTP) Login(w http.ResponseWriter, r *http.Request) (interface{}, error) {
-	result, err := h.service.Login(r.Context(), r.Body)
-
+	// Checked before logging in, so rejected requests don't reach the audit log
 	authHeader := r.Header.Get("Authorization")
-	fmt.Println("authHeader", authHeader)
-	fmt.Println("h.service.deps.Config.APIKey", h.service.deps.Config.APIKey)
 	if authHeader == "" || authHeader != fmt.Sprintf("Bearer %s", h.service.deps.Config.APIKey) {
-		w.WriteHeader(http.StatusUnauthorized)
+		telemetry.RecordAuthAttempt("login", errors.New("authorization header required"))
+		return ErrorResponse{
+			Error:   "Authorization header required",
+			Code:    http.StatusUnauthorized,
+			ErrorID: "authorization_required",
+		}, nil
+	}
+
+	result, err := h.service.Login(r.Context(), r.Body, origin(r))
+	telemetry.RecordAuthAttempt("login", err)
+
+	if errors.Is(err, ErrAccountDisabled) {
+		return ErrorResponse{
+			Error:   err.Error(),
+			Code:    http.StatusForbidden,
+			ErrorID: "account_disabled",
+		}, nil
+	}
+
+	if err != nil {
+		return ErrorResponse{
+			Error:   err.Error(),
+			Code:    http.StatusUnauthorized,
+			ErrorID: "login_failed",
+		}, nil
+	}
+	return result, nil
+}
+
+func (h *HTTP) CreateGuest(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	result, err := h.service.CreateGuest(r.Context(), r.Body)
+	if errors.Is(err, repositories.ErrRoomNotFound) {
+		return ErrorResponse{
+			Error:   err.Error(),
+			Code:    http.StatusNotFound,
+			ErrorID: "room_not_found",
+		}, nil
+	}
+
+	if err != nil {
 		return ErrorResponse{
-			Error: "Authorization header required",
-			Code:  http.StatusUnauthorized,
+			Error:   err.Error(),
+			Code:    http.StatusBadRequest,
+			ErrorID: "guest_failed",
+		}, nil
+	}
+	return handler.Response{Status: http.StatusCreated, Body: result}, nil
+}
+
+func (h *HTTP) DeactivateSelf(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	user, _ := r.Context().Value(middleware.UserContextKey).(middleware.UserClaims)
+
+	result, err := h.service.DeactivateSelf(r.Context(), user.UserID, origin(r))
+	return respondUserUpdate(w, result, err)
+}
+
+func (h *HTTP) ReactivateSelf(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	result, err := h.service.ReactivateSelf(r.Context(), r.Body, origin(r))
+	if errors.Is(err, ErrDisabledByAdmin) {
+		return ErrorResponse{
+			Error:   err.Error(),
+			Code:    http.StatusForbidden,
+			ErrorID: "account_disabled_by_admin",
 		}, nil
 	}
 
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
 		return ErrorResponse{
-			Error: err.Error(),
-			Code:  http.StatusUnauthorized,
+			Error:   err.Error(),
+			Code:    http.StatusUnauthorized,
+			ErrorID: "reactivation_failed",
 		}, nil
 	}
 	return result, nil
 }
 
+func (h *HTTP) DeactivateUser(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	userID := chi.URLParam(r, "userId")
+	admin, _ := r.Context().Value(middleware.UserContextKey).(middleware.UserClaims)
+
+	result, err := h.service.DeactivateUser(r.Context(), admin.UserID, userID, origin(r))
+	return respondUserUpdate(w, result, err)
+}
+
+func (h *HTTP) ReactivateUser(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	userID := chi.URLParam(r, "userId")
+	admin, _ := r.Context().Value(middleware.UserContextKey).(middleware.UserClaims)
+
+	result, err := h.service.ReactivateUser(r.Context(), admin.UserID, userID, origin(r))
+	return respondUserUpdate(w, result, err)
+}
+
+func respondUserUpdate(w http.ResponseWriter, result interface{}, err error) (interface{}, error) {
+	if err != nil {
+		return userError(w, err, "failed_update_user")
+	}
+	return result, nil
+}
+
+// userError answers the errors of the routes acting on a user, which may not exist
+func userError(w http.ResponseWriter, err error, errorID string) (interface{}, error) {
+	code := http.StatusInternalServerError
+	if errors.Is(err, ErrUserNotFound) {
+		code = http.StatusNotFound
+		errorID = "user_not_found"
+	}
+	return ErrorResponse{
+		Error:   err.Error(),
+		Code:    code,
+		ErrorID: errorID,
+	}, nil
+}
+
 func (h *HTTP) DeleteUser(w http.ResponseWriter, r *http.Request) (interface{}, error) {
-	result, err := h.service.DeleteUser(r.Context(), r.Body)
+	user, _ := r.Context().Value(middleware.UserContextKey).(middleware.UserClaims)
+
+	result, err := h.service.DeleteUser(r.Context(), r.Body, user.UserID, middleware.IsAdmin(h.service.deps, r), origin(r))
+	if errors.Is(err, ErrCannotDeleteOtherUser) {
+		return ErrorResponse{
+			Error:   err.Error(),
+			Code:    http.StatusForbidden,
+			ErrorID: "cannot_delete_other_user",
+		}, nil
+	}
+
+	if err != nil {
+		return ErrorResponse{
+			Error:   err.Error(),
+			Code:    http.StatusBadRequest,
+			ErrorID: "failed_delete_user",
+		}, nil
+	}
+	return result, nil
+}
+
+func (h *HTTP) ImpersonateUser(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	userID := chi.URLParam(r, "userId")
+	admin, _ := r.Context().Value(middleware.UserContextKey).(middleware.UserClaims)
+
+	result, err := h.service.ImpersonateUser(r.Context(), admin.UserID, userID, origin(r))
+	if err != nil {
+		return userError(w, err, "failed_impersonate_user")
+	}
+	return result, nil
+}
+
+func (h *HTTP) GetSessions(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	user, _ := r.Context().Value(middleware.UserContextKey).(middleware.UserClaims)
+
+	result, err := h.service.GetSessions(r.Context(), user.UserID, user.SessionID)
+	if err != nil {
+		return sessionError(err, "failed_get_sessions")
+	}
+	return result, nil
+}
+
+func (h *HTTP) RevokeSession(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	user, _ := r.Context().Value(middleware.UserContextKey).(middleware.UserClaims)
+
+	result, err := h.service.RevokeSession(r.Context(), user.UserID, chi.URLParam(r, "sessionId"), origin(r))
+	if err != nil {
+		return sessionError(err, "failed_revoke_session")
+	}
+	return result, nil
+}
+
+func (h *HTTP) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	user, _ := r.Context().Value(middleware.UserContextKey).(middleware.UserClaims)
+
+	result, err := h.service.RevokeOtherSessions(r.Context(), user.UserID, user.SessionID, origin(r))
+	if err != nil {
+		return sessionError(err, "failed_revoke_sessions")
+	}
+	return result, nil
+}
+
+func (h *HTTP) Logout(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	user, _ := r.Context().Value(middleware.UserContextKey).(middleware.UserClaims)
+
+	result, err := h.service.Logout(r.Context(), user.UserID, user.SessionID, origin(r))
+	if err != nil {
+		return sessionError(err, "logout_failed")
+	}
+	return result, nil
+}
+
+// sessionError answers the session errors with their own status, and any other with a 500
+func sessionError(err error, errorID string) (interface{}, error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, repositories.ErrSessionNotFound):
+		code = http.StatusNotFound
+		errorID = "session_not_found"
+	case errors.Is(err, ErrNoSession):
+		code = http.StatusBadRequest
+		errorID = "no_session"
+	}
+	return ErrorResponse{
+		Error:   err.Error(),
+		Code:    code,
+		ErrorID: errorID,
+	}, nil
+}
+
+func (h *HTTP) GetAuditLog(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	result, err := h.service.GetAuditLog(r.Context(), GetAuditLogQuery{
+		UserID:   chi.URLParam(r, "userId"),
+		PageStr:  r.URL.Query().Get("page"),
+		LimitStr: r.URL.Query().Get("limit"),
+		From:     r.URL.Query().Get("from"),
+		To:       r.URL.Query().Get("to"),
+	})
+	if errors.Is(err, ErrInvalidAuditRange) {
+		return ErrorResponse{
+			Error:   err.Error(),
+			Code:    http.StatusBadRequest,
+			ErrorID: "invalid_audit_range",
+		}, nil
+	}
+
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
 		return ErrorResponse{
-			Error: err.Error(),
-			Code:  http.StatusBadRequest,
+			Error:   err.Error(),
+			Code:    http.StatusInternalServerError,
+			ErrorID: "failed_get_audit_log",
 		}, nil
 	}
 	return result, nil
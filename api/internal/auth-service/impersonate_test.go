@@ -0,0 +1,87 @@
+package authservice
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/vit0rr/chat/pkg/database/repositories"
+)
+
+// waitForAudit returns the audit entries once one of the event is recorded, the entries are
+// written in the background
+func waitForAudit(t *testing.T, store *memoryStore, event string) []repositories.AuditEntry {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		store.mu.Lock()
+		entries := append([]repositories.AuditEntry(nil), store.audit...)
+		store.mu.Unlock()
+
+		for _, entry := range entries {
+			if entry.Event == event {
+				return entries
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("no %s audit entry recorded", event)
+	return nil
+}
+
+func TestImpersonateUser(t *testing.T) {
+	s, store := newTestService(t)
+	userID := register(t, s, "alice@example.com")
+
+	result, err := s.ImpersonateUser(t.Context(), "admin", userID, Origin{IP: "10.0.0.1", UserAgent: "admin-cli"})
+	if err != nil {
+		t.Fatalf("impersonate: %v", err)
+	}
+	response := result.(AuthResponse)
+	if response.UserID != userID {
+		t.Errorf("response user = %q, want %q", response.UserID, userID)
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(response.Token, claims, func(*jwt.Token) (interface{}, error) {
+		return []byte(s.deps.Config.JWT.Secret), nil
+	}); err != nil {
+		t.Fatalf("parse token: %v", err)
+	}
+
+	if claims["sub"] != userID {
+		t.Errorf("sub = %v, want %q", claims["sub"], userID)
+	}
+	if act, _ := claims["act"].(map[string]interface{}); act["sub"] != "admin" {
+		t.Errorf("act = %v, want the admin as act.sub", claims["act"])
+	}
+
+	expiresAt, err := claims.GetExpirationTime()
+	if err != nil || expiresAt == nil {
+		t.Fatalf("exp = %v: %v", claims["exp"], err)
+	}
+	if lifetime := time.Until(expiresAt.Time); lifetime < 59*time.Minute || lifetime > time.Hour {
+		t.Errorf("token expires in %s, want about an hour", lifetime)
+	}
+
+	var issued *repositories.AuditEntry
+	for _, entry := range waitForAudit(t, store, repositories.AuditEventTokenIssued) {
+		if entry.Event == repositories.AuditEventTokenIssued {
+			issued = &entry
+		}
+	}
+	if issued.UserID != userID || issued.ActorID != "admin" || issued.IP != "10.0.0.1" || issued.UserAgent != "admin-cli" {
+		t.Errorf("audit entry = %+v, want the token issued to %s by admin", *issued, userID)
+	}
+}
+
+func TestImpersonateMissingUser(t *testing.T) {
+	s, _ := newTestService(t)
+
+	if _, err := s.ImpersonateUser(t.Context(), "admin", "missing", Origin{}); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("impersonate = %v, want %v", err, ErrUserNotFound)
+	}
+}
@@ -2,20 +2,28 @@ package authservice
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/vit0rr/chat/pkg/database/repositories"
 	"github.com/vit0rr/chat/pkg/deps"
+	"github.com/vit0rr/chat/pkg/log"
+	"github.com/vit0rr/chat/pkg/middleware"
 	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type Service struct {
 	deps  *deps.Deps
+	store Store
 	Mongo *mongo.Database
 }
 
@@ -36,14 +44,93 @@ type AuthResponse struct {
 	Nickname string `json:"nickname"`
 }
 
+type GuestRequest struct {
+	RoomID   string `json:"room_id"`
+	Nickname string `json:"nickname"`
+}
+
+// GuestResponse is the token of a guest, scoped to their room and valid until ExpiresAt
+type GuestResponse struct {
+	Token     string    `json:"token"`
+	UserID    string    `json:"user_id"`
+	Nickname  string    `json:"nickname"`
+	RoomID    string    `json:"room_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
 type DeleteUserRequest struct {
 	UserID string `json:"user_id"`
 }
 
+// Origin is where a request comes from, recorded in the audit log
+type Origin struct {
+	IP        string
+	UserAgent string
+}
+
+type GetAuditLogQuery struct {
+	UserID   string
+	PageStr  string
+	LimitStr string
+	From     string // RFC 3339, inclusive
+	To       string // RFC 3339, exclusive
+}
+
+// AuditLog is a page of a user's audit trail, newest first
+type AuditLog struct {
+	Entries []repositories.AuditEntry `json:"entries"`
+	Total   int64                     `json:"total"`
+	Page    int                       `json:"page"`
+	Limit   int                       `json:"limit"`
+}
+
+// SessionDetails is a session of the user, Current when it's the one making the request
+type SessionDetails struct {
+	repositories.Session
+	Current bool `json:"current"`
+}
+
+type SessionsResponse struct {
+	Sessions []SessionDetails `json:"sessions"`
+}
+
+// TokenTTL is how long the user tokens, and their sessions, last
+const TokenTTL = 7 * 24 * time.Hour
+
+// ErrNoSession is returned when logging out with a token that wasn't issued for a session
+var ErrNoSession = errors.New("token has no session, it can't be revoked")
+
+// AuditWriteTimeout bounds the writes of the audit entries, which outlive their request
+const AuditWriteTimeout = 5 * time.Second
+
+// ErrInvalidAuditRange is returned when the audit log dates can't be parsed or are reversed
+var ErrInvalidAuditRange = errors.New("from and to must be RFC 3339 dates, from before to")
+
+// ErrUserNotFound is returned when the target user of an operation doesn't exist
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrAccountDisabled is returned when a disabled account tries to log in
+var ErrAccountDisabled = errors.New("account is disabled")
+
+// ErrDisabledByAdmin is returned when reactivating an account an admin disabled, which only
+// an admin can reactivate
+var ErrDisabledByAdmin = errors.New("account was disabled by an admin")
+
+// ErrCannotDeleteOtherUser is returned when a user tries to delete another account without the admin key
+var ErrCannotDeleteOtherUser = errors.New("cannot delete another user's account")
+
 func NewService(deps *deps.Deps, db *mongo.Database) *Service {
+	service := newService(deps, NewMongoStore(db))
+	service.Mongo = db
+
+	return service
+}
+
+// newService creates the service on the store, without MongoDB for the guests and the audit log
+func newService(deps *deps.Deps, store Store) *Service {
 	return &Service{
 		deps:  deps,
-		Mongo: db,
+		store: store,
 	}
 }
 
@@ -57,7 +144,7 @@ func NewService(deps *deps.Deps, db *mongo.Database) *Service {
 // @failure 400 {object} error "Bad request - Missing required fields or invalid input"
 // @failure 409 {object} error "Conflict - User with this email already exists"
 // @failure 500 {object} error "Internal server error"
-func (s *Service) Register(ctx context.Context, b io.ReadCloser) (interface{}, error) {
+func (s *Service) Register(ctx context.Context, b io.ReadCloser, origin Origin) (interface{}, error) {
 	var req RegisterRequest
 	err := json.NewDecoder(b).Decode(&req)
 	if err != nil {
@@ -65,11 +152,16 @@ func (s *Service) Register(ctx context.Context, b io.ReadCloser) (interface{}, e
 	}
 	defer b.Close()
 
+	req.Email, err = normalizeCredentials(req.Email, req.Password)
+	if err != nil {
+		return nil, err
+	}
+
 	if req.Email == "" || req.Password == "" || req.Nickname == "" {
 		return nil, fmt.Errorf("email, password, and nickname are required")
 	}
 
-	existingUser, err := repositories.GetUserByEmail(ctx, s.Mongo, req.Email)
+	existingUser, err := s.store.GetUserByEmail(ctx, req.Email)
 	if err != nil && err != mongo.ErrNoDocuments {
 		return nil, fmt.Errorf("failed to check existing user: %v", err)
 	}
@@ -78,12 +170,12 @@ func (s *Service) Register(ctx context.Context, b io.ReadCloser) (interface{}, e
 		return nil, fmt.Errorf("user with this email already exists")
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), s.deps.Config.BcryptCost)
 	if err != nil {
 		return nil, fmt.Errorf("failed to hash password: %v", err)
 	}
 
-	newUser, err := repositories.CreateUser(ctx, s.Mongo, repositories.CreateUserData{
+	userID, err := s.store.CreateUser(ctx, repositories.CreateUserData{
 		Email:    req.Email,
 		Password: string(hashedPassword),
 		Nickname: req.Nickname,
@@ -94,10 +186,11 @@ func (s *Service) Register(ctx context.Context, b io.ReadCloser) (interface{}, e
 		return nil, fmt.Errorf("failed to create user: %v", err)
 	}
 
-	userID := newUser.InsertedID.(string)
-	token, err := generateJWT(userID, req.Email, req.Nickname, s.deps.Config.JWT.Secret)
+	s.audit(ctx, repositories.AuditEventRegister, userID, "", origin)
+
+	token, err := s.issueToken(ctx, userID, req.Email, req.Nickname, origin)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate token: %v", err)
+		return nil, err
 	}
 
 	return AuthResponse{
@@ -117,7 +210,7 @@ func (s *Service) Register(ctx context.Context, b io.ReadCloser) (interface{}, e
 // @failure 400 {object} error "Bad request - Missing required fields"
 // @failure 401 {object} error "Unauthorized - Invalid email or password"
 // @failure 500 {object} error "Internal server error"
-func (s *Service) Login(ctx context.Context, b io.ReadCloser) (interface{}, error) {
+func (s *Service) Login(ctx context.Context, b io.ReadCloser, origin Origin) (interface{}, error) {
 	var req LoginRequest
 	err := json.NewDecoder(b).Decode(&req)
 	if err != nil {
@@ -125,11 +218,16 @@ func (s *Service) Login(ctx context.Context, b io.ReadCloser) (interface{}, erro
 	}
 	defer b.Close()
 
+	req.Email, err = normalizeCredentials(req.Email, req.Password)
+	if err != nil {
+		return nil, err
+	}
+
 	if req.Email == "" || req.Password == "" {
 		return nil, fmt.Errorf("email and password are required")
 	}
 
-	user, err := repositories.GetUserByEmail(ctx, s.Mongo, req.Email)
+	user, err := s.store.GetUserByEmail(ctx, req.Email)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return nil, fmt.Errorf("invalid email or password")
@@ -139,18 +237,24 @@ func (s *Service) Login(ctx context.Context, b io.ReadCloser) (interface{}, erro
 
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password))
 	if err != nil {
+		s.audit(ctx, repositories.AuditEventLoginFailed, user.Id, "", origin)
 		return nil, fmt.Errorf("invalid email or password")
 	}
 
-	token, err := generateJWT(user.Id, user.Email, user.Nickname, s.deps.Config.JWT.Secret)
+	// Checked after the password, so it doesn't reveal which accounts are disabled
+	if user.Disabled {
+		return nil, ErrAccountDisabled
+	}
+
+	s.rehashPassword(ctx, user, req.Password)
+	s.audit(ctx, repositories.AuditEventLogin, user.Id, "", origin)
+
+	token, err := s.issueToken(ctx, user.Id, user.Email, user.Nickname, origin)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate token: %v", err)
+		return nil, err
 	}
 
-	repositories.UpdateUser(ctx, s.Mongo, repositories.UpdateUserData{
-		UserID:   user.Id,
-		Activity: &[]string{"online"}[0],
-	})
+	s.store.SetUserActivity(ctx, user.Id, "online")
 
 	return AuthResponse{
 		Token:    token,
@@ -159,11 +263,75 @@ func (s *Service) Login(ctx context.Context, b io.ReadCloser) (interface{}, erro
 	}, nil
 }
 
+// @summary Create Guest
+// @description Creates a guest who chats in a single room without an account, returning a short-lived token for the WebSocket token param. The guest is removed once the token expires, and can't use the account endpoints.
+// @tags auth
+// @router /api/v1/auth/guest [post]
+// @param X-API-Key header string true "API key"
+// @param body body GuestRequest true "Room to join and guest nickname"
+// @produce application/json
+// @success 201 {object} GuestResponse "Guest created with their token"
+// @failure 400 {object} error "Bad request - Missing room ID or nickname"
+// @failure 404 {object} error "Not found - Room doesn't exist"
+// @failure 500 {object} error "Internal server error"
+func (s *Service) CreateGuest(ctx context.Context, b io.ReadCloser) (interface{}, error) {
+	var req GuestRequest
+	err := json.NewDecoder(b).Decode(&req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode request: %v", err)
+	}
+	defer b.Close()
+
+	req.Nickname = strings.TrimSpace(req.Nickname)
+	if req.RoomID == "" || req.Nickname == "" {
+		return nil, fmt.Errorf("room_id and nickname are required")
+	}
+
+	if _, err := repositories.GetRoom(ctx, s.Mongo, repositories.GetRoomData{RoomID: req.RoomID}); err != nil {
+		return nil, err
+	}
+
+	expiresAt := time.Now().Add(time.Duration(s.deps.Config.JWT.GuestTTL) * time.Second)
+	userID, err := s.store.CreateUser(ctx, repositories.CreateUserData{
+		Nickname:  req.Nickname,
+		Activity:  "offline",
+		IsGuest:   true,
+		ExpiresAt: &expiresAt,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create guest: %v", err)
+	}
+
+	if _, err := repositories.CreateRoom(ctx, s.Mongo, repositories.CreateRoomData{
+		UserID:   userID,
+		RoomID:   req.RoomID,
+		Nickname: req.Nickname,
+		Guest:    true,
+		ClientID: middleware.RequestClientID(ctx),
+	}); err != nil {
+		return nil, fmt.Errorf("failed to add guest to room: %v", err)
+	}
+
+	token, err := generateGuestJWT(userID, req.Nickname, req.RoomID, expiresAt, s.deps.Config.JWT.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %v", err)
+	}
+
+	return GuestResponse{
+		Token:     token,
+		UserID:    userID,
+		Nickname:  req.Nickname,
+		RoomID:    req.RoomID,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
 // @summary Delete User Account
-// @description Permanently removes a user account and all associated data
+// @description Permanently removes a user account and all associated data. The user ID defaults to the authenticated user, deleting another account requires the admin key.
 // @tags auth
 // @router /api/v1/auth/user [delete]
 // @param body body DeleteUserRequest true "User ID to delete"
+// @param X-Admin-Key header string false "Admin key, to delete another user"
 // @produce application/json
 // @security JWT
 // @success 200 {object} map[string]string "User successfully deleted"
@@ -172,7 +340,7 @@ func (s *Service) Login(ctx context.Context, b io.ReadCloser) (interface{}, erro
 // @failure 403 {object} error "Forbidden - Not authorized to delete this user"
 // @failure 404 {object} error "Not found - User doesn't exist"
 // @failure 500 {object} error "Internal server error"
-func (s *Service) DeleteUser(ctx context.Context, b io.ReadCloser) (interface{}, error) {
+func (s *Service) DeleteUser(ctx context.Context, b io.ReadCloser, callerID string, isAdmin bool, origin Origin) (interface{}, error) {
 	var req DeleteUserRequest
 	err := json.NewDecoder(b).Decode(&req)
 	if err != nil {
@@ -180,24 +348,481 @@ func (s *Service) DeleteUser(ctx context.Context, b io.ReadCloser) (interface{},
 	}
 	defer b.Close()
 
+	if req.UserID == "" {
+		req.UserID = callerID
+	}
+
 	if req.UserID == "" {
 		return nil, fmt.Errorf("user ID is required")
 	}
 
-	err = repositories.DeleteUser(ctx, s.Mongo, req.UserID)
+	if req.UserID != callerID && !isAdmin {
+		log.Warn(ctx, "Rejected deletion of another user",
+			log.AnyAttr("user_id", callerID),
+			log.AnyAttr("target_user_id", req.UserID))
+		return nil, ErrCannotDeleteOtherUser
+	}
+
+	err = s.store.DeleteUser(ctx, req.UserID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to delete user: %v", err)
 	}
 
+	// The tokens stop working anyway once the sessions expire
+	if _, err := s.store.DeleteUserSessions(ctx, req.UserID, ""); err != nil {
+		log.Error(ctx, "Failed to revoke the sessions of the deleted user", log.ErrAttr(err), log.AnyAttr("user_id", req.UserID))
+	}
+	s.closeConnections(ctx, deps.SessionRevocation{UserID: req.UserID})
+
+	actorID := ""
+	if callerID != req.UserID {
+		actorID = callerID
+	}
+	s.audit(ctx, repositories.AuditEventDeleted, req.UserID, actorID, origin)
+
 	return map[string]string{"message": "User deleted successfully"}, nil
 }
 
-func generateJWT(userID, email, nickname, secret string) (string, error) {
+// @summary Deactivate Own Account
+// @description Disables the account of the authenticated user without deleting any data. It can be reactivated with the account credentials.
+// @tags auth
+// @router /api/v1/auth/user/deactivate [post]
+// @produce application/json
+// @security JWT
+// @success 200 {object} map[string]string "Account deactivated"
+// @failure 401 {object} error "Unauthorized - Missing or invalid authentication"
+// @failure 500 {object} error "Internal server error"
+func (s *Service) DeactivateSelf(ctx context.Context, userID string, origin Origin) (interface{}, error) {
+	return s.SetUserDisabled(ctx, userID, true, "", origin)
+}
+
+// @summary Reactivate Own Account
+// @description Reactivates an account disabled by its user with its credentials and logs in. The accounts disabled by an admin can only be reactivated by an admin.
+// @tags auth
+// @router /api/v1/auth/reactivate [post]
+// @param body body LoginRequest true "Account credentials"
+// @produce application/json
+// @success 200 {object} AuthResponse "Account reactivated, with an authentication token"
+// @failure 401 {object} error "Unauthorized - Invalid email or password"
+// @failure 403 {object} error "Forbidden - Account disabled by an admin"
+// @failure 500 {object} error "Internal server error"
+func (s *Service) ReactivateSelf(ctx context.Context, b io.ReadCloser, origin Origin) (interface{}, error) {
+	var req LoginRequest
+	err := json.NewDecoder(b).Decode(&req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode request: %v", err)
+	}
+	defer b.Close()
+
+	req.Email, err = normalizeCredentials(req.Email, req.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.store.GetUserByEmail(ctx, req.Email)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("invalid email or password")
+		}
+		return nil, fmt.Errorf("failed to get user: %v", err)
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+		s.audit(ctx, repositories.AuditEventLoginFailed, user.Id, "", origin)
+		return nil, fmt.Errorf("invalid email or password")
+	}
+
+	if user.Disabled && user.DisabledBy != "" {
+		log.Warn(ctx, "Rejected reactivation of an account disabled by an admin",
+			log.AnyAttr("user_id", user.Id),
+			log.AnyAttr("admin_id", user.DisabledBy))
+		return nil, ErrDisabledByAdmin
+	}
+
+	if _, err := s.SetUserDisabled(ctx, user.Id, false, "", origin); err != nil {
+		return nil, err
+	}
+	s.audit(ctx, repositories.AuditEventLogin, user.Id, "", origin)
+
+	token, err := s.issueToken(ctx, user.Id, user.Email, user.Nickname, origin)
+	if err != nil {
+		return nil, err
+	}
+
+	return AuthResponse{
+		Token:    token,
+		UserID:   user.Id,
+		Nickname: user.Nickname,
+	}, nil
+}
+
+// @summary Deactivate User
+// @description Disables a user account without deleting any data. Requires the admin key.
+// @tags admin
+// @router /api/v1/admin/users/{userId}/deactivate [post]
+// @param userId path string true "ID of the user to deactivate"
+// @param X-Admin-Key header string true "Admin key"
+// @produce application/json
+// @security JWT
+// @success 200 {object} map[string]string "Account deactivated"
+// @failure 403 {object} error "Forbidden - Invalid admin key"
+// @failure 404 {object} error "Not found - User doesn't exist"
+// @failure 500 {object} error "Internal server error"
+func (s *Service) DeactivateUser(ctx context.Context, adminID string, userID string, origin Origin) (interface{}, error) {
+	log.Warn(ctx, "Admin deactivated user",
+		log.AnyAttr("admin_id", adminID),
+		log.AnyAttr("user_id", userID))
+
+	return s.SetUserDisabled(ctx, userID, true, adminID, origin)
+}
+
+// @summary Reactivate User
+// @description Reactivates a disabled user account. Requires the admin key.
+// @tags admin
+// @router /api/v1/admin/users/{userId}/reactivate [post]
+// @param userId path string true "ID of the user to reactivate"
+// @param X-Admin-Key header string true "Admin key"
+// @produce application/json
+// @security JWT
+// @success 200 {object} map[string]string "Account reactivated"
+// @failure 403 {object} error "Forbidden - Invalid admin key"
+// @failure 404 {object} error "Not found - User doesn't exist"
+// @failure 500 {object} error "Internal server error"
+func (s *Service) ReactivateUser(ctx context.Context, adminID string, userID string, origin Origin) (interface{}, error) {
+	log.Warn(ctx, "Admin reactivated user",
+		log.AnyAttr("admin_id", adminID),
+		log.AnyAttr("user_id", userID))
+
+	return s.SetUserDisabled(ctx, userID, false, adminID, origin)
+}
+
+// SetUserDisabled disables or reactivates the account, on behalf of the admin when actorID is set
+func (s *Service) SetUserDisabled(ctx context.Context, userID string, disabled bool, actorID string, origin Origin) (interface{}, error) {
+	if err := s.store.SetUserDisabled(ctx, userID, disabled, actorID); err != nil {
+		if errors.Is(err, repositories.ErrUserNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("failed to update user: %v", err)
+	}
+
+	if disabled {
+		s.closeConnections(ctx, deps.SessionRevocation{UserID: userID})
+		s.audit(ctx, repositories.AuditEventDeactivated, userID, actorID, origin)
+		return map[string]string{"message": "Account deactivated successfully"}, nil
+	}
+
+	s.audit(ctx, repositories.AuditEventReactivated, userID, actorID, origin)
+	return map[string]string{"message": "Account reactivated successfully"}, nil
+}
+
+// @summary Impersonate User
+// @description Mints a short-lived JWT for the given user, for support and debugging. Requires the admin key. Every call is logged for audit.
+// @tags admin
+// @router /api/v1/admin/users/{userId}/token [post]
+// @param userId path string true "ID of the user to impersonate"
+// @param X-Admin-Key header string true "Admin key"
+// @produce application/json
+// @security JWT
+// @success 200 {object} AuthResponse "Token issued for the target user"
+// @failure 403 {object} error "Forbidden - Invalid admin key"
+// @failure 404 {object} error "Not found - User doesn't exist"
+// @failure 500 {object} error "Internal server error"
+func (s *Service) ImpersonateUser(ctx context.Context, adminID string, userID string, origin Origin) (interface{}, error) {
+	user, err := s.store.GetUser(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %v", err)
+	}
+
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+
+	token, err := generateImpersonationJWT(user.Id, user.Email, user.Nickname, adminID, s.deps.Config.JWT.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %v", err)
+	}
+
+	log.Warn(ctx, "Admin impersonated user",
+		log.AnyAttr("admin_id", adminID),
+		log.AnyAttr("user_id", user.Id))
+	s.audit(ctx, repositories.AuditEventTokenIssued, user.Id, adminID, origin)
+
+	return AuthResponse{
+		Token:    token,
+		UserID:   user.Id,
+		Nickname: user.Nickname,
+	}, nil
+}
+
+// @summary List Own Sessions
+// @description Lists where the authenticated user is logged in: the IP and user agent of each session, when it started, was last used and expires. The session of the request is flagged as current.
+// @tags auth
+// @router /api/v1/auth/sessions [get]
+// @produce application/json
+// @security JWT
+// @success 200 {object} SessionsResponse "Active sessions, most recently used first"
+// @failure 401 {object} error "Unauthorized - Missing or invalid authentication"
+// @failure 500 {object} error "Internal server error"
+func (s *Service) GetSessions(ctx context.Context, userID string, currentSessionID string) (interface{}, error) {
+	sessions, err := s.store.GetUserSessions(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sessions: %v", err)
+	}
+
+	details := make([]SessionDetails, len(sessions))
+	for i, session := range sessions {
+		details[i] = SessionDetails{
+			Session: session,
+			Current: session.ID == currentSessionID,
+		}
+	}
+
+	return SessionsResponse{Sessions: details}, nil
+}
+
+// @summary Revoke Session
+// @description Revokes one of the authenticated user's sessions, its token stops working right away
+// @tags auth
+// @router /api/v1/auth/sessions/{sessionId} [delete]
+// @param sessionId path string true "ID of the session"
+// @produce application/json
+// @security JWT
+// @success 200 {object} map[string]string "Session revoked"
+// @failure 401 {object} error "Unauthorized - Missing or invalid authentication"
+// @failure 404 {object} error "Not found - Session doesn't exist or belongs to another user"
+// @failure 500 {object} error "Internal server error"
+func (s *Service) RevokeSession(ctx context.Context, userID string, sessionID string, origin Origin) (interface{}, error) {
+	if err := s.store.DeleteSession(ctx, userID, sessionID); err != nil {
+		return nil, err
+	}
+
+	s.closeConnections(ctx, deps.SessionRevocation{UserID: userID, SessionID: sessionID})
+	s.audit(ctx, repositories.AuditEventRevoked, userID, "", origin)
+
+	return map[string]string{"message": "Session revoked successfully"}, nil
+}
+
+// @summary Revoke Other Sessions
+// @description Revokes every session of the authenticated user but the one making the request, logging out their other devices
+// @tags auth
+// @router /api/v1/auth/sessions [delete]
+// @produce application/json
+// @security JWT
+// @success 200 {object} map[string]int64 "How many sessions were revoked"
+// @failure 401 {object} error "Unauthorized - Missing or invalid authentication"
+// @failure 500 {object} error "Internal server error"
+func (s *Service) RevokeOtherSessions(ctx context.Context, userID string, currentSessionID string, origin Origin) (interface{}, error) {
+	revoked, err := s.store.DeleteUserSessions(ctx, userID, currentSessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to revoke sessions: %v", err)
+	}
+
+	if revoked > 0 {
+		s.closeConnections(ctx, deps.SessionRevocation{UserID: userID, AllSessions: true, ExceptSessionID: currentSessionID})
+		s.audit(ctx, repositories.AuditEventRevoked, userID, "", origin)
+	}
+
+	return map[string]int64{"revoked": revoked}, nil
+}
+
+// @summary Logout
+// @description Revokes the session of the token making the request, which stops working right away
+// @tags auth
+// @router /api/v1/auth/logout [post]
+// @produce application/json
+// @security JWT
+// @success 200 {object} map[string]string "Logged out"
+// @failure 400 {object} error "Bad request - Token wasn't issued for a session"
+// @failure 401 {object} error "Unauthorized - Missing or invalid authentication"
+// @failure 500 {object} error "Internal server error"
+func (s *Service) Logout(ctx context.Context, userID string, sessionID string, origin Origin) (interface{}, error) {
+	if sessionID == "" {
+		return nil, ErrNoSession
+	}
+
+	if err := s.store.DeleteSession(ctx, userID, sessionID); err != nil {
+		return nil, err
+	}
+
+	s.closeConnections(ctx, deps.SessionRevocation{UserID: userID, SessionID: sessionID})
+	s.audit(ctx, repositories.AuditEventLogout, userID, "", origin)
+
+	return map[string]string{"message": "Logged out successfully"}, nil
+}
+
+// @summary Get User Audit Log
+// @description Returns the account events of the user, newest first: registration, logins and failed logins, deactivation, reactivation, deletion and tokens issued by admins. Requires the admin key.
+// @tags admin
+// @router /api/v1/admin/users/{userId}/audit [get]
+// @param userId path string true "ID of the user"
+// @param X-Admin-Key header string true "Admin key"
+// @param from query string false "Only the events since this RFC 3339 date"
+// @param to query string false "Only the events before this RFC 3339 date"
+// @param page query integer false "Page number (default: 1)" minimum(1)
+// @param limit query integer false "Items per page (default: 50)" minimum(1) maximum(100)
+// @produce application/json
+// @security JWT
+// @success 200 {object} AuditLog "Audit trail of the user"
+// @failure 400 {object} error "Bad request - Invalid dates"
+// @failure 403 {object} error "Forbidden - Invalid admin key"
+// @failure 500 {object} error "Internal server error"
+func (s *Service) GetAuditLog(ctx context.Context, query GetAuditLogQuery) (interface{}, error) {
+	page := 1
+	limit := 50
+
+	if query.PageStr != "" {
+		if p, err := strconv.Atoi(query.PageStr); err == nil && p > 0 {
+			page = p
+		}
+	}
+
+	if query.LimitStr != "" {
+		if l, err := strconv.Atoi(query.LimitStr); err == nil && l > 0 && l <= 100 {
+			limit = l
+		}
+	}
+
+	from, err := parseAuditDate(query.From)
+	if err != nil {
+		return nil, ErrInvalidAuditRange
+	}
+
+	to, err := parseAuditDate(query.To)
+	if err != nil {
+		return nil, ErrInvalidAuditRange
+	}
+
+	if from != nil && to != nil && !from.Before(*to) {
+		return nil, ErrInvalidAuditRange
+	}
+
+	entries, total, err := repositories.GetAuditEntries(ctx, s.Mongo, repositories.GetAuditEntriesData{
+		UserID: query.UserID,
+		From:   from,
+		To:     to,
+		Limit:  int64(limit),
+		Skip:   int64((page - 1) * limit),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get audit log: %v", err)
+	}
+
+	return AuditLog{
+		Entries: entries,
+		Total:   total,
+		Page:    page,
+		Limit:   limit,
+	}, nil
+}
+
+// parseAuditDate parses an optional RFC 3339 date, nil when empty
+func parseAuditDate(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	date, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &date, nil
+}
+
+// closeConnections tells every instance to close the WebSocket connections of the revoked
+// sessions, whose tokens already stop working. Failures are only logged, the connections
+// are then left until they close.
+func (s *Service) closeConnections(ctx context.Context, revocation deps.SessionRevocation) {
+	if err := deps.PublishSessionRevocation(ctx, s.deps.Broker, revocation); err != nil {
+		log.Error(ctx, "Failed to close the connections of the revoked sessions", log.ErrAttr(err),
+			log.AnyAttr("user_id", revocation.UserID))
+	}
+}
+
+// audit records the account event in the background, so the audit log never slows down nor
+// fails the request. Failures are only logged.
+func (s *Service) audit(ctx context.Context, event string, userID string, actorID string, origin Origin) {
+	entry := repositories.AuditEntry{
+		UserID:    userID,
+		Event:     event,
+		ActorID:   actorID,
+		IP:        origin.IP,
+		UserAgent: origin.UserAgent,
+	}
+
+	// The request context is canceled once the response is written
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), AuditWriteTimeout)
+	go func() {
+		defer cancel()
+
+		if err := s.store.CreateAuditEntry(ctx, entry); err != nil {
+			log.Error(ctx, "Failed to record audit entry", log.ErrAttr(err),
+				log.AnyAttr("event", event),
+				log.AnyAttr("user_id", userID))
+		}
+	}()
+}
+
+// normalizeCredentials trims the surrounding whitespace from the email and rejects
+// passwords with leading or trailing whitespace. Passwords are never trimmed, since
+// the whitespace could be intentional.
+func normalizeCredentials(email, password string) (string, error) {
+	email = strings.TrimSpace(email)
+
+	if password != "" && strings.TrimSpace(password) == "" {
+		return "", fmt.Errorf("password cannot be only whitespace")
+	}
+
+	if password != strings.TrimSpace(password) {
+		return "", fmt.Errorf("password cannot start or end with whitespace")
+	}
+
+	return email, nil
+}
+
+// issueToken starts a session for the user and returns a token for it
+func (s *Service) issueToken(ctx context.Context, userID, email, nickname string, origin Origin) (string, error) {
+	sessionID, err := generateSessionID()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate session ID: %v", err)
+	}
+
+	session, err := s.store.CreateSession(ctx, repositories.CreateSessionData{
+		ID:        sessionID,
+		UserID:    userID,
+		IP:        origin.IP,
+		UserAgent: origin.UserAgent,
+		ExpiresAt: time.Now().Add(TokenTTL),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create session: %v", err)
+	}
+
+	token, err := generateJWT(userID, email, nickname, session.ID, session.ExpiresAt, s.deps.Config.JWT.Secret)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
+
+	return token, nil
+}
+
+func generateSessionID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// generateJWT mints a token for the user's session, expiring along with it
+func generateJWT(userID, email, nickname, sessionID string, expiresAt time.Time, secret string) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"sub":      userID,
 		"email":    email,
 		"nickname": nickname,
-		"exp":      time.Now().Add(time.Hour * 24 * 7).Unix(), // 7 days
+		"sid":      sessionID,
+		"exp":      expiresAt.Unix(),
 		"iat":      time.Now().Unix(),
 	})
 
@@ -208,3 +833,63 @@ func generateJWT(userID, email, nickname, secret string) (string, error) {
 
 	return tokenString, nil
 }
+
+// rehashPassword hashes the password again when the user's hash has a lower cost than the
+// configured one, which only the login can do since it has the password. Failures are only
+// logged, the old hash keeps working.
+func (s *Service) rehashPassword(ctx context.Context, user *repositories.User, password string) {
+	if !needsRehash(user.Password, s.deps.Config.BcryptCost) {
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), s.deps.Config.BcryptCost)
+	if err != nil {
+		log.Error(ctx, "Failed to rehash password", log.ErrAttr(err), log.AnyAttr("user_id", user.Id))
+		return
+	}
+
+	if err := s.store.UpdateUserPassword(ctx, user.Id, string(hashedPassword)); err != nil {
+		log.Error(ctx, "Failed to store rehashed password", log.ErrAttr(err), log.AnyAttr("user_id", user.Id))
+		return
+	}
+
+	log.Info(ctx, "Rehashed password with the configured cost",
+		log.AnyAttr("user_id", user.Id),
+		log.AnyAttr("cost", s.deps.Config.BcryptCost))
+}
+
+// needsRehash tells whether the password hash has a lower cost than the given one
+func needsRehash(hash string, cost int) bool {
+	hashCost, err := bcrypt.Cost([]byte(hash))
+	return err == nil && hashCost < cost
+}
+
+// generateGuestJWT mints a token for the guest, scoped to their room with the "rooms" claim
+// and expiring along with the guest. Guests have no email.
+func generateGuestJWT(userID, nickname, roomID string, expiresAt time.Time, secret string) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":      userID,
+		"nickname": nickname,
+		"guest":    true,
+		"rooms":    []string{roomID},
+		"exp":      expiresAt.Unix(),
+		"iat":      time.Now().Unix(),
+	})
+
+	return token.SignedString([]byte(secret))
+}
+
+// generateImpersonationJWT mints a token for the user that expires after an hour
+// and records the admin acting on their behalf in the "act" claim
+func generateImpersonationJWT(userID, email, nickname, adminID, secret string) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":      userID,
+		"email":    email,
+		"nickname": nickname,
+		"act":      map[string]string{"sub": adminID},
+		"exp":      time.Now().Add(time.Hour).Unix(),
+		"iat":      time.Now().Unix(),
+	})
+
+	return token.SignedString([]byte(secret))
+}
@@ -0,0 +1,64 @@
+package authservice
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestNeedsRehash(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost+1)
+	if err != nil {
+		t.Fatalf("hash password: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		hash string
+		cost int
+		want bool
+	}{
+		{"lower cost", string(hash), bcrypt.MinCost + 2, true},
+		{"same cost", string(hash), bcrypt.MinCost + 1, false},
+		{"higher cost", string(hash), bcrypt.MinCost, false},
+		{"malformed hash", "not a bcrypt hash", bcrypt.MaxCost, false},
+		{"empty hash", "", bcrypt.MaxCost, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := needsRehash(tt.hash, tt.cost); got != tt.want {
+				t.Errorf("needsRehash() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeCredentials(t *testing.T) {
+	tests := []struct {
+		name      string
+		email     string
+		password  string
+		wantEmail string
+		wantErr   bool
+	}{
+		{"surrounding email whitespace", "  alice@example.com \t\n", "secret", "alice@example.com", false},
+		{"internal password space", "alice@example.com", "correct horse battery", "alice@example.com", false},
+		{"whitespace-only password", "alice@example.com", " \t ", "", true},
+		{"leading password whitespace", "alice@example.com", " secret", "", true},
+		{"trailing password whitespace", "alice@example.com", "secret\n", "", true},
+		{"empty password", "alice@example.com", "", "alice@example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			email, err := normalizeCredentials(tt.email, tt.password)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeCredentials() error = %v, want error %v", err, tt.wantErr)
+			}
+			if email != tt.wantEmail {
+				t.Errorf("normalizeCredentials() email = %q, want %q", email, tt.wantEmail)
+			}
+		})
+	}
+}
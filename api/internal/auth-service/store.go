@@ -0,0 +1,107 @@
+package authservice
+
+import (
+	"context"
+
+	"github.com/vit0rr/chat/pkg/database/repositories"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Store is the storage of the accounts, their sessions and audit trail. MongoDB backs it, the
+// tests run the service on an in-memory one. The guests' rooms and the audit log queries go to
+// MongoDB through the repositories.
+type Store interface {
+	// GetUser returns the user, nil when they don't exist
+	GetUser(ctx context.Context, userID string) (*repositories.User, error)
+	// GetUserByEmail returns the user registered with the email, or mongo.ErrNoDocuments
+	GetUserByEmail(ctx context.Context, email string) (*repositories.User, error)
+	// CreateUser creates the user, returning their ID
+	CreateUser(ctx context.Context, data repositories.CreateUserData) (string, error)
+	// SetUserActivity sets whether the user is online or offline
+	SetUserActivity(ctx context.Context, userID string, activity string) error
+	// UpdateUserPassword replaces the password hash of the user
+	UpdateUserPassword(ctx context.Context, userID string, passwordHash string) error
+	// SetUserDisabled disables the account, on behalf of the admin when adminID is set, or
+	// reactivates it. It returns repositories.ErrUserNotFound for unknown users.
+	SetUserDisabled(ctx context.Context, userID string, disabled bool, adminID string) error
+	// DeleteUser removes the user
+	DeleteUser(ctx context.Context, userID string) error
+
+	// CreateSession starts a session
+	CreateSession(ctx context.Context, data repositories.CreateSessionData) (*repositories.Session, error)
+	// GetUserSessions returns the sessions of the user that didn't expire, most recently used first
+	GetUserSessions(ctx context.Context, userID string) ([]repositories.Session, error)
+	// DeleteSession revokes the user's session, or returns repositories.ErrSessionNotFound
+	DeleteSession(ctx context.Context, userID string, sessionID string) error
+	// DeleteUserSessions revokes every session of the user but exceptID, returning how many
+	DeleteUserSessions(ctx context.Context, userID string, exceptID string) (int64, error)
+
+	// CreateAuditEntry records the account event
+	CreateAuditEntry(ctx context.Context, entry repositories.AuditEntry) error
+}
+
+// mongoStore is the Store of the repositories
+type mongoStore struct {
+	db *mongo.Database
+}
+
+func NewMongoStore(db *mongo.Database) Store {
+	return &mongoStore{db: db}
+}
+
+func (m *mongoStore) GetUser(ctx context.Context, userID string) (*repositories.User, error) {
+	return repositories.GetUser(ctx, m.db, repositories.GetUserData{UserID: userID})
+}
+
+func (m *mongoStore) GetUserByEmail(ctx context.Context, email string) (*repositories.User, error) {
+	return repositories.GetUserByEmail(ctx, m.db, email)
+}
+
+func (m *mongoStore) CreateUser(ctx context.Context, data repositories.CreateUserData) (string, error) {
+	result, err := repositories.CreateUser(ctx, m.db, data)
+	if err != nil {
+		return "", err
+	}
+
+	return result.InsertedID.(string), nil
+}
+
+func (m *mongoStore) SetUserActivity(ctx context.Context, userID string, activity string) error {
+	_, err := repositories.UpdateUser(ctx, m.db, repositories.UpdateUserData{
+		UserID:   userID,
+		Activity: &activity,
+	})
+	return err
+}
+
+func (m *mongoStore) UpdateUserPassword(ctx context.Context, userID string, passwordHash string) error {
+	return repositories.UpdateUserPassword(ctx, m.db, userID, passwordHash)
+}
+
+func (m *mongoStore) SetUserDisabled(ctx context.Context, userID string, disabled bool, adminID string) error {
+	return repositories.SetUserDisabled(ctx, m.db, userID, disabled, adminID)
+}
+
+func (m *mongoStore) DeleteUser(ctx context.Context, userID string) error {
+	return repositories.DeleteUser(ctx, m.db, userID)
+}
+
+func (m *mongoStore) CreateSession(ctx context.Context, data repositories.CreateSessionData) (*repositories.Session, error) {
+	return repositories.CreateSession(ctx, m.db, data)
+}
+
+func (m *mongoStore) GetUserSessions(ctx context.Context, userID string) ([]repositories.Session, error) {
+	return repositories.GetUserSessions(ctx, m.db, userID)
+}
+
+func (m *mongoStore) DeleteSession(ctx context.Context, userID string, sessionID string) error {
+	return repositories.DeleteSession(ctx, m.db, userID, sessionID)
+}
+
+func (m *mongoStore) DeleteUserSessions(ctx context.Context, userID string, exceptID string) (int64, error) {
+	return repositories.DeleteUserSessions(ctx, m.db, userID, exceptID)
+}
+
+func (m *mongoStore) CreateAuditEntry(ctx context.Context, entry repositories.AuditEntry) error {
+	return repositories.CreateAuditEntry(ctx, m.db, entry)
+}
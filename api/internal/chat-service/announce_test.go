@@ -0,0 +1,74 @@
+package chatservice
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/vit0rr/chat/pkg/middleware"
+)
+
+// isAnnouncement matches the announcement with the content
+func isAnnouncement(content string) func(ChatMessage) bool {
+	return func(msg ChatMessage) bool {
+		return msg.Type == SystemMessage && msg.Content == content && msg.Metadata["event"] == EventAnnouncement
+	}
+}
+
+func (ts *testServer) announce(body AnnounceBody) AnnounceResult {
+	ts.t.Helper()
+
+	result, svcErr := ts.service.Announce(ts.t.Context(), jsonBody(ts.t, body))
+	if svcErr.ErrorMessage != nil {
+		ts.t.Fatalf("announce: %s", errorID(svcErr))
+	}
+
+	return result.(AnnounceResult)
+}
+
+func TestAnnounceToTaggedRooms(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("ops", "alice")
+	ts.store.addRoom("random", "bob")
+	ts.store.setTags("ops", "staff")
+	ts.addUser("alice", middleware.UserClaims{})
+	ts.addUser("bob", middleware.UserClaims{})
+
+	alice := ts.mustDial("alice", "ops")
+	bob := ts.mustDial("bob", "random")
+
+	if result := ts.announce(AnnounceBody{Message: "Staff meeting", Tags: []string{"Staff"}}); result.Rooms != 1 {
+		t.Errorf("announced to %d rooms, want the tagged one", result.Rooms)
+	}
+	alice.receive(isAnnouncement("Staff meeting"))
+	bob.expectNone(200*time.Millisecond, isAnnouncement("Staff meeting"))
+
+	if result := ts.announce(AnnounceBody{Message: "Restarting soon"}); result.Rooms != 2 {
+		t.Errorf("announced to %d rooms, want both", result.Rooms)
+	}
+	alice.receive(isAnnouncement("Restarting soon"))
+	bob.receive(isAnnouncement("Restarting soon"))
+
+	// Announcements are neither stored nor replayed
+	for _, roomID := range []string{"ops", "random"} {
+		for _, msg := range ts.store.roomMessages(roomID, SystemMessage) {
+			if msg.Message == "Staff meeting" || msg.Message == "Restarting soon" {
+				t.Errorf("announcement %q stored in %s", msg.Message, roomID)
+			}
+		}
+
+		entries, err := ts.broker.History(t.Context(), roomID, 0)
+		if err != nil {
+			t.Fatalf("get history: %v", err)
+		}
+		for _, entry := range entries {
+			var msg ChatMessage
+			if err := json.Unmarshal(entry, &msg); err != nil {
+				t.Fatalf("decode history entry: %v", err)
+			}
+			if msg.Metadata["event"] == EventAnnouncement {
+				t.Errorf("announcement %q in the %s history", msg.Content, roomID)
+			}
+		}
+	}
+}
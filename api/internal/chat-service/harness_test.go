@@ -0,0 +1,978 @@
+package chatservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+	"github.com/go-chi/chi/v5"
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/api/handler"
+	"github.com/vit0rr/chat/config"
+	"github.com/vit0rr/chat/pkg/broker"
+	"github.com/vit0rr/chat/pkg/database/repositories"
+	"github.com/vit0rr/chat/pkg/deps"
+	"github.com/vit0rr/chat/pkg/middleware"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryStore is an in-memory Store. The lock and pin updates are conditional like the MongoDB ones.
+type memoryStore struct {
+	mu       sync.Mutex
+	rooms    map[string]repositories.Room
+	users    map[string]repositories.User
+	invites  map[string]repositories.Invite
+	messages []repositories.Message
+	pins     []repositories.Pin
+	// nextPinPosition is the position of the room's next pin, it only grows like the MongoDB one
+	nextPinPosition map[string]int
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		rooms:           make(map[string]repositories.Room),
+		users:           make(map[string]repositories.User),
+		invites:         make(map[string]repositories.Invite),
+		nextPinPosition: make(map[string]int),
+	}
+}
+
+// addRoom creates the room with the users as members
+func (m *memoryStore) addRoom(roomID string, userIDs ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room := repositories.Room{ID: roomID, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	for _, userID := range userIDs {
+		room.Users = append(room.Users, repositories.UserRef{ID: userID, Nickname: userID})
+	}
+	m.rooms[roomID] = room
+}
+
+// addAccount creates the user, like the auth service does when they register
+func (m *memoryStore) addAccount(userID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.users[userID] = repositories.User{Id: userID, Nickname: userID}
+}
+
+// addVerifiedAccount creates the user registered with an email and password
+func (m *memoryStore) addVerifiedAccount(userID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.users[userID] = repositories.User{Id: userID, Nickname: userID, Email: userID + "@example.com", Password: "hash"}
+}
+
+// addInvite creates an invite to the room usable maxUses times, unlimited when 0
+func (m *memoryStore) addInvite(code string, roomID string, maxUses int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.invites[code] = repositories.Invite{Code: code, RoomID: roomID, MaxUses: maxUses, CreatedAt: time.Now()}
+}
+
+// invite returns the invite, failing the test when it doesn't exist
+func (m *memoryStore) invite(t *testing.T, code string) repositories.Invite {
+	t.Helper()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	invite, ok := m.invites[code]
+	if !ok {
+		t.Fatalf("invite %s not found", code)
+	}
+
+	return invite
+}
+
+// removeMember removes the user from the room's members
+func (m *memoryStore) removeMember(roomID string, userID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room := m.rooms[roomID]
+	room.Users = slices.DeleteFunc(slices.Clone(room.Users), func(user repositories.UserRef) bool { return user.ID == userID })
+	m.rooms[roomID] = room
+}
+
+// setSlowMode makes the room's members wait the seconds between their messages
+func (m *memoryStore) setSlowMode(roomID string, seconds int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room := m.rooms[roomID]
+	room.SlowModeSeconds = seconds
+	m.rooms[roomID] = room
+}
+
+// setMessageWindows overrides the edit and delete windows of the room, nil keeps the config's
+func (m *memoryStore) setMessageWindows(roomID string, editWindow *int, deleteWindow *int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room := m.rooms[roomID]
+	room.Settings.EditWindow = editWindow
+	room.Settings.DeleteWindow = deleteWindow
+	m.rooms[roomID] = room
+}
+
+// setTags tags the room, to target its announcements
+func (m *memoryStore) setTags(roomID string, tags ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room := m.rooms[roomID]
+	room.Settings.Tags = tags
+	m.rooms[roomID] = room
+}
+
+// setPresenceMessages turns the join and leave messages of the room on or off
+func (m *memoryStore) setPresenceMessages(roomID string, on bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room := m.rooms[roomID]
+	room.Settings.PresenceMessages = &on
+	m.rooms[roomID] = room
+}
+
+// roomMessages returns the messages of the type stored in the room, oldest first
+func (m *memoryStore) roomMessages(roomID string, messageType MessageType) []repositories.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	messages := []repositories.Message{}
+	for _, msg := range m.messages {
+		if msg.RoomID == roomID && msg.Type == string(messageType) {
+			messages = append(messages, msg)
+		}
+	}
+
+	return messages
+}
+
+func (m *memoryStore) GetRoom(ctx context.Context, roomID string) (*repositories.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return nil, repositories.ErrRoomNotFound
+	}
+	room.Users = slices.Clone(room.Users)
+
+	return &room, nil
+}
+
+func (m *memoryStore) GetUser(ctx context.Context, userID string) (*repositories.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return nil, nil
+	}
+
+	return &user, nil
+}
+
+func (m *memoryStore) GetRoomMembers(ctx context.Context, data repositories.GetRoomMembersData) ([]repositories.UserRef, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[data.RoomID]
+	if !ok {
+		return nil, 0, repositories.ErrRoomNotFound
+	}
+
+	// Sliced like the MongoDB $slice
+	start := min(int(data.Skip), len(room.Users))
+	end := min(start+int(data.Limit), len(room.Users))
+
+	return slices.Clone(room.Users[start:end]), int64(len(room.Users)), nil
+}
+
+func (m *memoryStore) GetVerifiedUsers(ctx context.Context, userIDs []string) (map[string]bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	verified := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		if user, ok := m.users[userID]; ok && user.Verified() {
+			verified[userID] = true
+		}
+	}
+
+	return verified, nil
+}
+
+func (m *memoryStore) SetUserActivity(ctx context.Context, userID string, activity string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user := m.users[userID]
+	user.Id = userID
+	user.Activity = activity
+	m.users[userID] = user
+
+	return nil
+}
+
+func (m *memoryStore) CreateUser(ctx context.Context, data repositories.CreateUserData) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	userID := primitive.NewObjectID().Hex()
+	m.users[userID] = repositories.User{Id: userID, Nickname: data.Nickname, IsGuest: data.IsGuest}
+
+	return userID, nil
+}
+
+func (m *memoryStore) CreateRoom(ctx context.Context, data repositories.CreateRoomData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	room, ok := m.rooms[data.RoomID]
+	if !ok {
+		room = repositories.Room{ID: data.RoomID, CreatedBy: data.UserID, ClientID: data.ClientID, CreatedAt: now}
+	}
+	room.UpdatedAt = now
+
+	member := repositories.UserRef{ID: data.UserID, Nickname: data.Nickname, Guest: data.Guest}
+	if !slices.Contains(room.Users, member) {
+		room.Users = append(slices.Clone(room.Users), member)
+	}
+	m.rooms[data.RoomID] = room
+
+	return nil
+}
+
+func (m *memoryStore) GetRoomIDsByTags(ctx context.Context, tags []string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	roomIDs := []string{}
+	for roomID, room := range m.rooms {
+		if slices.ContainsFunc(room.Settings.Tags, func(tag string) bool { return slices.Contains(tags, tag) }) {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+
+	return roomIDs, nil
+}
+
+// usableInvite returns the invite when it hasn't expired nor run out of uses
+func (m *memoryStore) usableInvite(code string) (repositories.Invite, error) {
+	invite, ok := m.invites[code]
+	if !ok {
+		return invite, repositories.ErrInviteNotFound
+	}
+	if invite.ExpiresAt != nil && !time.Now().Before(*invite.ExpiresAt) {
+		return invite, repositories.ErrInviteExpired
+	}
+	if invite.RemainingUses() == 0 {
+		return invite, repositories.ErrInviteExhausted
+	}
+
+	return invite, nil
+}
+
+func (m *memoryStore) CheckInvite(ctx context.Context, code string) (*repositories.Invite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	invite, err := m.usableInvite(code)
+	if err != nil {
+		return nil, err
+	}
+
+	return &invite, nil
+}
+
+func (m *memoryStore) UseInvite(ctx context.Context, code string) (*repositories.Invite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	invite, err := m.usableInvite(code)
+	if err != nil {
+		return nil, err
+	}
+
+	invite.Uses++
+	m.invites[code] = invite
+
+	return &invite, nil
+}
+
+func (m *memoryStore) ReleaseInvite(ctx context.Context, code string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if invite, ok := m.invites[code]; ok && invite.Uses > 0 {
+		invite.Uses--
+		m.invites[code] = invite
+	}
+
+	return nil
+}
+
+func (m *memoryStore) CreateMessage(ctx context.Context, data repositories.CreateMessageData) (string, error) {
+	// Like the MongoDB driver, nothing is written once the context is done
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	createdAt := data.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+
+	msg := repositories.Message{
+		ID:         primitive.NewObjectID(),
+		RoomID:     data.RoomID,
+		Message:    data.Message,
+		FromUserID: data.FromUserID,
+		Nickname:   data.Nickname,
+		Verified:   data.Verified,
+		Type:       data.Type,
+		Attachment: data.Attachment,
+		CreatedAt:  createdAt,
+		UpdatedAt:  createdAt,
+	}
+	m.messages = append(m.messages, msg)
+
+	return msg.ID.Hex(), nil
+}
+
+func (m *memoryStore) RecentMessages(ctx context.Context, roomID string, limit int64) ([]repositories.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	messages := []repositories.Message{}
+	for i := len(m.messages) - 1; i >= 0 && int64(len(messages)) < limit; i-- {
+		if m.messages[i].RoomID == roomID {
+			messages = append(messages, m.messages[i])
+		}
+	}
+
+	return messages, nil
+}
+
+func (m *memoryStore) GetMessages(ctx context.Context, data repositories.GetMessagesData) ([]repositories.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	messages := []repositories.Message{}
+	for _, msg := range m.messages {
+		if msg.RoomID != data.RoomID || msg.DeletedAt != nil {
+			continue
+		}
+		if data.Before != nil {
+			sameTime := msg.CreatedAt.Equal(*data.Before) && !data.BeforeID.IsZero()
+			if !msg.CreatedAt.Before(*data.Before) && !(sameTime && msg.ID.Hex() < data.BeforeID.Hex()) {
+				continue
+			}
+		}
+		messages = append(messages, msg)
+	}
+
+	// Newest first, the ID orders the messages sent at the same time
+	slices.SortFunc(messages, func(a, b repositories.Message) int {
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(b.ID.Hex(), a.ID.Hex())
+	})
+
+	messages = messages[min(int(data.Skip), len(messages)):]
+	if data.Limit > 0 {
+		messages = messages[:min(int(data.Limit), len(messages))]
+	}
+
+	return messages, nil
+}
+
+func (m *memoryStore) CountMessages(ctx context.Context, roomID string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var total int64
+	for _, msg := range m.messages {
+		if msg.RoomID == roomID && msg.DeletedAt == nil {
+			total++
+		}
+	}
+
+	return total, nil
+}
+
+func (m *memoryStore) GetMessage(ctx context.Context, roomID string, messageID string) (*repositories.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, msg := range m.messages {
+		if msg.RoomID == roomID && msg.ID.Hex() == messageID {
+			if msg.DeletedAt != nil {
+				return nil, repositories.DeletedMessageError{DeletedAt: *msg.DeletedAt}
+			}
+			return &msg, nil
+		}
+	}
+
+	return nil, repositories.ErrMessageNotFound
+}
+
+func (m *memoryStore) GetMessagesByIDs(ctx context.Context, roomID string, messageIDs []string) ([]repositories.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	messages := []repositories.Message{}
+	for _, msg := range m.messages {
+		if msg.RoomID == roomID && msg.DeletedAt == nil && slices.Contains(messageIDs, msg.ID.Hex()) {
+			messages = append(messages, msg)
+		}
+	}
+
+	return messages, nil
+}
+
+func (m *memoryStore) EditMessage(ctx context.Context, roomID string, messageID string, content string) (*repositories.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, msg := range m.messages {
+		if msg.RoomID == roomID && msg.ID.Hex() == messageID && msg.DeletedAt == nil {
+			now := time.Now()
+			m.messages[i].Message = content
+			m.messages[i].EditedAt = &now
+			m.messages[i].UpdatedAt = now
+			edited := m.messages[i]
+			return &edited, nil
+		}
+	}
+
+	return nil, repositories.ErrMessageNotFound
+}
+
+func (m *memoryStore) DeleteMessage(ctx context.Context, roomID string, messageID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, msg := range m.messages {
+		if msg.RoomID == roomID && msg.ID.Hex() == messageID && msg.DeletedAt == nil {
+			now := time.Now()
+			m.messages[i].DeletedAt = &now
+			m.messages[i].UpdatedAt = now
+			return nil
+		}
+	}
+
+	return repositories.ErrMessageNotFound
+}
+
+func (m *memoryStore) CountPurgeableMessages(ctx context.Context, data repositories.PurgeMessagesData) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var count int64
+	for _, msg := range m.messages {
+		if purgeable(msg, data) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (m *memoryStore) PurgeMessages(ctx context.Context, data repositories.PurgeMessagesData) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// The messages are stored oldest first
+	now := time.Now()
+	messageIDs := []string{}
+	for i, msg := range m.messages {
+		if int64(len(messageIDs)) == data.Limit {
+			break
+		}
+		if purgeable(msg, data) {
+			m.messages[i].DeletedAt = &now
+			messageIDs = append(messageIDs, msg.ID.Hex())
+		}
+	}
+
+	return messageIDs, nil
+}
+
+// purgeable matches the MongoDB purge filter
+func purgeable(msg repositories.Message, data repositories.PurgeMessagesData) bool {
+	return msg.RoomID == data.RoomID && msg.DeletedAt == nil &&
+		(data.UserID == "" || msg.FromUserID == data.UserID) &&
+		(data.From == nil || !msg.CreatedAt.Before(*data.From)) &&
+		(data.To == nil || !msg.CreatedAt.After(*data.To)) &&
+		(data.Text == "" || strings.Contains(strings.ToLower(msg.Message), strings.ToLower(data.Text)))
+}
+
+func (m *memoryStore) CreatePin(ctx context.Context, data repositories.CreatePinData) (*repositories.Pin, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.rooms[data.RoomID]; !ok {
+		return nil, repositories.ErrRoomNotFound
+	}
+
+	count := 0
+	for _, pin := range m.pins {
+		if pin.RoomID != data.RoomID {
+			continue
+		}
+		if pin.MessageID == data.MessageID {
+			return nil, repositories.ErrMessageAlreadyPinned
+		}
+		count++
+	}
+
+	if count >= data.Limit {
+		return nil, repositories.ErrPinLimitReached
+	}
+
+	pin := repositories.Pin{
+		ID:        data.RoomID + ":" + data.MessageID,
+		RoomID:    data.RoomID,
+		MessageID: data.MessageID,
+		PinnedBy:  data.PinnedBy,
+		Position:  m.nextPinPosition[data.RoomID],
+		PinnedAt:  time.Now(),
+	}
+	m.nextPinPosition[data.RoomID]++
+	m.pins = append(m.pins, pin)
+
+	return &pin, nil
+}
+
+func (m *memoryStore) GetPins(ctx context.Context, data repositories.GetPinsData) ([]repositories.Pin, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pins := []repositories.Pin{}
+	for _, pin := range m.pins {
+		if pin.RoomID == data.RoomID {
+			pins = append(pins, pin)
+		}
+	}
+
+	// The pins are kept in pin time order, a stable sort keeps it among the same positions
+	if data.Order != repositories.PinOrderPinnedAt {
+		slices.SortStableFunc(pins, func(a, b repositories.Pin) int {
+			return a.Position - b.Position
+		})
+	}
+
+	return pins, nil
+}
+
+func (m *memoryStore) DeletePin(ctx context.Context, roomID string, messageID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, pin := range m.pins {
+		if pin.RoomID == roomID && pin.MessageID == messageID {
+			m.pins = slices.Delete(m.pins, i, i+1)
+			return nil
+		}
+	}
+
+	return repositories.ErrPinNotFound
+}
+
+func (m *memoryStore) ReorderPins(ctx context.Context, roomID string, messageIDs []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, pin := range m.pins {
+		if position := slices.Index(messageIDs, pin.MessageID); pin.RoomID == roomID && position >= 0 {
+			m.pins[i].Position = position
+		}
+	}
+
+	return nil
+}
+
+func (m *memoryStore) LockRoom(ctx context.Context, roomID string, userID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok || room.LockedBy != "" {
+		return false, nil
+	}
+
+	now := time.Now()
+	room.LockedBy = userID
+	room.LockedAt = &now
+	m.rooms[roomID] = room
+
+	return true, nil
+}
+
+func (m *memoryStore) UnlockRoom(ctx context.Context, roomID string, userID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok || room.LockedBy != userID {
+		return false, nil
+	}
+
+	room.LockedBy = ""
+	room.LockedAt = nil
+	m.rooms[roomID] = room
+
+	return true, nil
+}
+
+func (m *memoryStore) ExpireRoomLock(ctx context.Context, roomID string, userID string, cutoff time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok || room.LockedBy != userID || !lockedBefore(room, cutoff) {
+		return false, nil
+	}
+
+	room.LockedBy = ""
+	room.LockedAt = nil
+	m.rooms[roomID] = room
+
+	return true, nil
+}
+
+func (m *memoryStore) GetRoomsWithExpiredLocks(ctx context.Context, cutoff time.Time) ([]repositories.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rooms := []repositories.Room{}
+	for _, room := range m.rooms {
+		if room.LockedBy != "" && lockedBefore(room, cutoff) {
+			rooms = append(rooms, room)
+		}
+	}
+
+	return rooms, nil
+}
+
+// lockedBefore matches the MongoDB filter, the locks taken before lockedAt was tracked are expired
+func lockedBefore(room repositories.Room, cutoff time.Time) bool {
+	return room.LockedAt == nil || room.LockedAt.Before(cutoff)
+}
+
+// testServer runs the service on a memoryStore and an in-memory broker. Requests authenticate
+// with a token, in the token query param like the WebSocket or as a bearer token, mapped to
+// its claims by the claims of the server.
+type testServer struct {
+	t       *testing.T
+	service *Service
+	store   *memoryStore
+	broker  broker.Broker
+	server  *httptest.Server
+
+	mu     sync.Mutex
+	claims map[string]middleware.UserClaims
+}
+
+// newTestServer starts a testServer, the config is the default one changed by configure
+func newTestServer(t *testing.T, configure ...func(*config.Config)) *testServer {
+	t.Helper()
+
+	return newTestServerOn(t, broker.NewMemory(), configure...)
+}
+
+// newTestServerOn starts a testServer on the broker
+func newTestServerOn(t *testing.T, messageBroker broker.Broker, configure ...func(*config.Config)) *testServer {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cfg := config.DefaultConfig(config.Config{})
+	cfg.Attachments.Dir = t.TempDir()
+	for _, apply := range configure {
+		apply(&cfg)
+	}
+
+	store := newMemoryStore()
+	service := newService(ctx, deps.New(cfg, nil, messageBroker), store, messageBroker)
+	go service.monitorConnections(ctx)
+	go service.watchRevokedSessions(ctx)
+
+	ts := &testServer{
+		t:       t,
+		service: service,
+		store:   store,
+		broker:  messageBroker,
+		claims:  make(map[string]middleware.UserClaims),
+	}
+
+	h := &HTTP{service: service}
+	router := chi.NewRouter()
+	router.Use(ts.authenticate)
+	router.Method(http.MethodGet, "/ws", handler.Handler(h.WebSocket))
+	router.Method(http.MethodPost, "/admin/maintenance", handler.Handler(h.SetMaintenanceMode))
+	router.Method(http.MethodPost, "/rooms/{roomId}/lock", handler.Handler(h.LockRoom))
+	router.Method(http.MethodPost, "/rooms/{roomId}/messages", handler.Handler(h.SendMessage))
+	router.Method(http.MethodPost, "/rooms/{roomId}/read", handler.Handler(h.MarkRoomRead))
+
+	ts.server = httptest.NewServer(router)
+	t.Cleanup(func() {
+		ts.server.CloseClientConnections()
+		ts.server.Close()
+		cancel()
+	})
+
+	return ts
+}
+
+// addUser lets the token authenticate the user, with the claims' UserID and Nickname defaulting to it
+func (ts *testServer) addUser(token string, claims middleware.UserClaims) {
+	if claims.UserID == "" {
+		claims.UserID = token
+	}
+	if claims.Nickname == "" {
+		claims.Nickname = claims.UserID
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.claims[token] = claims
+}
+
+func (ts *testServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+
+		ts.mu.Lock()
+		claims, ok := ts.claims[token]
+		ts.mu.Unlock()
+		if !ok {
+			handler.WriteError(w, constants.InvalidToken, nil)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), middleware.UserContextKey, claims)))
+	})
+}
+
+// post sends the JSON body authenticated with the token, returning the response status and
+// the error answered, if any
+func (ts *testServer) post(token string, path string, body interface{}) (int, ErrorResponse) {
+	ts.t.Helper()
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		ts.t.Fatalf("marshal body: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, ts.server.URL+path, strings.NewReader(string(payload)))
+	if err != nil {
+		ts.t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ts.t.Fatalf("POST %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	var errResp ErrorResponse
+	if resp.StatusCode >= http.StatusBadRequest {
+		json.NewDecoder(resp.Body).Decode(&errResp)
+	}
+
+	return resp.StatusCode, errResp
+}
+
+// dial connects to the room with the token, without the history replay. On a rejected
+// handshake the client is nil and the response is returned.
+func (ts *testServer) dial(token string, roomID string) (*testClient, *http.Response) {
+	ts.t.Helper()
+
+	return ts.dialWithHistory(token, roomID, 0)
+}
+
+// dialWithHistory connects to the room with the token, replaying up to history of its recent
+// messages in a single history message
+func (ts *testServer) dialWithHistory(token string, roomID string, history int) (*testClient, *http.Response) {
+	ts.t.Helper()
+
+	return ts.dialQuery("history_batch=true&history=" + strconv.Itoa(history) + "&token=" + token + "&room_id=" + roomID)
+}
+
+// dialQuery connects with the raw query string
+func (ts *testServer) dialQuery(query string) (*testClient, *http.Response) {
+	ts.t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	url := "ws" + strings.TrimPrefix(ts.server.URL, "http") + "/ws?" + query
+	conn, resp, err := websocket.Dial(ctx, url, nil)
+	if err != nil {
+		if resp == nil {
+			ts.t.Fatalf("dial %s: %v", query, err)
+		}
+		return nil, resp
+	}
+
+	client := &testClient{t: ts.t, conn: conn, messages: make(chan ChatMessage, 256)}
+	go client.read()
+	ts.t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+	})
+
+	return client, resp
+}
+
+// mustDial connects to the room, failing the test when the handshake is rejected
+func (ts *testServer) mustDial(token string, roomID string) *testClient {
+	ts.t.Helper()
+
+	client, resp := ts.dial(token, roomID)
+	if client == nil {
+		ts.t.Fatalf("dial %s: status %d", roomID, resp.StatusCode)
+	}
+	client.ready()
+
+	return client
+}
+
+// testClient is a WebSocket client of the testServer. Reads happen in the background, since
+// canceling a read closes the connection.
+type testClient struct {
+	t        *testing.T
+	conn     *websocket.Conn
+	messages chan ChatMessage
+	// readErr is why the connection stopped reading, set once messages is closed
+	readErr error
+}
+
+func (c *testClient) read() {
+	defer close(c.messages)
+
+	for {
+		var msg ChatMessage
+		if err := wsjson.Read(context.Background(), c.conn, &msg); err != nil {
+			c.readErr = err
+			return
+		}
+		c.messages <- msg
+	}
+}
+
+func (c *testClient) send(msg ChatMessage) {
+	c.t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := wsjson.Write(ctx, c.conn, msg); err != nil {
+		c.t.Fatalf("send: %v", err)
+	}
+}
+
+// ready waits for the connection to read the client's messages, by then it's subscribed to
+// the room. The server answers the unsupported message with an error.
+func (c *testClient) ready() {
+	c.t.Helper()
+
+	c.send(ChatMessage{Type: SystemMessage, Content: "ready"})
+	errorID := constants.ErrorMessages[constants.UnsupportedMessageType].ID
+	c.receive(func(msg ChatMessage) bool {
+		return msg.Type == SystemMessage && msg.Metadata["error_id"] == errorID
+	})
+}
+
+// sendText sends a text message, tagged with the client message ID when set
+func (c *testClient) sendText(content string, clientMsgID string) {
+	c.t.Helper()
+
+	msg := ChatMessage{Type: TextMessage, Content: content}
+	if clientMsgID != "" {
+		msg.Metadata = map[string]interface{}{"client_msg_id": clientMsgID}
+	}
+	c.send(msg)
+}
+
+// receive returns the first message matching, skipping the others, and fails the test when
+// none arrives in time
+func (c *testClient) receive(match func(ChatMessage) bool) ChatMessage {
+	c.t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				c.t.Fatal("connection closed before the expected message")
+			}
+			if match(msg) {
+				return msg
+			}
+		case <-timeout:
+			c.t.Fatal("timed out waiting for the expected message")
+		}
+	}
+}
+
+// expectNone fails the test when a message matching arrives within the wait
+func (c *testClient) expectNone(wait time.Duration, match func(ChatMessage) bool) {
+	c.t.Helper()
+
+	timeout := time.After(wait)
+	for {
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				return
+			}
+			if match(msg) {
+				c.t.Fatalf("unexpected message: %+v", msg)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// ofType matches the messages of the type
+func ofType(messageType MessageType) func(ChatMessage) bool {
+	return func(msg ChatMessage) bool {
+		return msg.Type == messageType
+	}
+}
+
+// withContent matches the messages of the type with the content
+func withContent(messageType MessageType, content string) func(ChatMessage) bool {
+	return func(msg ChatMessage) bool {
+		return msg.Type == messageType && msg.Content == content
+	}
+}
@@ -1,60 +1,131 @@
 package chatservice
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/redis/go-redis/v9"
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/api/handler"
+	"github.com/vit0rr/chat/pkg/broker"
 	"github.com/vit0rr/chat/pkg/deps"
 	"github.com/vit0rr/chat/pkg/log"
+	"github.com/vit0rr/chat/pkg/middleware"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type ErrorResponse struct {
-	Error   string `json:"error"`
-	Code    int    `json:"code"`
-	ErrorID string `json:"error_id"`
+	Error   string                 `json:"error"`
+	Code    int                    `json:"code"`
+	ErrorID string                 `json:"error_id"`
+	Details map[string]interface{} `json:"details,omitempty"`
 }
+
+// StatusCode is the status the response is answered with
+func (e ErrorResponse) StatusCode() int {
+	return e.Code
+}
+
 type HTTP struct {
 	service *Service
 }
 
+// ListPage is the envelope of the paginated lists, answered instead of the list when the
+// request sets meta=true
+type ListPage struct {
+	Data    interface{} `json:"data"`
+	Page    int         `json:"page"`
+	Limit   int         `json:"limit"`
+	Total   int64       `json:"total"`
+	HasMore bool        `json:"has_more"`
+}
+
+func newListPage(data interface{}, page int, limit int, total int64) ListPage {
+	return ListPage{
+		Data:    data,
+		Page:    page,
+		Limit:   limit,
+		Total:   total,
+		HasMore: int64(page*limit) < total,
+	}
+}
+
+// wantsListPage tells whether the request asks for the ListPage envelope
+func wantsListPage(r *http.Request) bool {
+	meta, _ := strconv.ParseBool(r.URL.Query().Get("meta"))
+	return meta
+}
+
 type GetRoomsResponse struct {
 	Rooms []RoomDetails `json:"rooms"`
 	Error *int          `json:"error,omitempty"`
 }
 
-func NewHTTP(deps *deps.Deps, db *mongo.Database, redisClient *redis.Client) *HTTP {
+func NewHTTP(ctx context.Context, deps *deps.Deps, db *mongo.Database, messageBroker broker.Broker) *HTTP {
 	return &HTTP{
-		service: NewService(deps, db, redisClient),
+		service: NewService(ctx, deps, db, messageBroker),
+	}
+}
+
+// caller returns the user authenticated by the request's token
+func (h *HTTP) caller(r *http.Request) Caller {
+	user, _ := r.Context().Value(middleware.UserContextKey).(middleware.UserClaims)
+	return Caller{
+		UserID: user.UserID,
+		Admin:  middleware.IsAdmin(h.service.deps, r),
 	}
 }
 
+// Shutdown notifies and closes the WebSocket connections handled by this instance
+func (h *HTTP) Shutdown(ctx context.Context) {
+	h.service.Shutdown(ctx)
+}
+
 func (h *HTTP) WebSocket(w http.ResponseWriter, r *http.Request) (interface{}, error) {
 	result, err := h.service.WebSocket(w, r)
 	if err != nil {
 		log.Error(r.Context(), "WebSocket error", log.ErrAttr(err))
-		w.WriteHeader(http.StatusUnauthorized)
+
+		var svcErr ServiceError
+		if errors.As(err, &svcErr) {
+			return ErrorResponse{
+				Error:   svcErr.Message,
+				Code:    svcErr.Code,
+				ErrorID: svcErr.ID,
+			}, nil
+		}
+
+		errMsg := constants.ErrorMessages[constants.InternalError]
 		return ErrorResponse{
-			Error:   err.Error(),
-			Code:    http.StatusUnauthorized,
-			ErrorID: "websocket_error",
+			Error:   errMsg.Message,
+			Code:    errMsg.Code,
+			ErrorID: errMsg.ID,
 		}, nil
 	}
 
 	return result, nil
 }
 
+func (h *HTTP) CreateRoom(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	result, svcErr := h.service.CreateRoom(r.Context(), r.Body, h.caller(r))
+	if svcErr.ErrorMessage != nil {
+		return respond(w, result, svcErr)
+	}
+
+	return handler.Response{Status: http.StatusCreated, Body: result}, nil
+}
+
 func (h *HTTP) RegisterUser(w http.ResponseWriter, r *http.Request) (interface{}, error) {
 	roomID := chi.URLParam(r, "roomId")
 
-	result, svcErr := h.service.RegisterUser(r.Context(), r.Body, h.service.Mongo, roomID)
+	result, svcErr := h.service.RegisterUser(r.Context(), r.Body, roomID, h.caller(r))
 	if svcErr.ErrorCode != nil {
 		code := http.StatusInternalServerError
 		if svcErr.ErrorCode != nil {
 			code = *svcErr.ErrorCode
 		}
-		w.WriteHeader(code)
 		return ErrorResponse{
 			Error:   *svcErr.ErrorMessage,
 			Code:    code,
@@ -74,13 +145,14 @@ func (h *HTTP) GetMessages(w http.ResponseWriter, r *http.Request) (interface{},
 		RoomID:   roomID,
 		PageStr:  pageStr,
 		LimitStr: limitStr,
+		Cursor:   r.URL.Query().Get("cursor"),
+		Count:    wantsListPage(r),
 	})
 	if svcErr.ErrorMessage != nil {
 		code := http.StatusInternalServerError
 		if svcErr.ErrorCode != nil {
 			code = *svcErr.ErrorCode
 		}
-		w.WriteHeader(code)
 		return ErrorResponse{
 			Error:   *svcErr.ErrorMessage,
 			Code:    code,
@@ -88,30 +160,300 @@ func (h *HTTP) GetMessages(w http.ResponseWriter, r *http.Request) (interface{},
 		}, nil
 	}
 
-	return result, nil
+	if result.NextCursor != "" {
+		w.Header().Set("X-Next-Cursor", result.NextCursor)
+	}
+
+	if wantsListPage(r) {
+		page := newListPage(result.Messages, result.Page, result.Limit, result.Total)
+		// Cursor pages don't have a number, the cursor tells whether one follows
+		if r.URL.Query().Get("cursor") != "" {
+			page.HasMore = result.NextCursor != ""
+		}
+		return page, nil
+	}
+
+	return result.Messages, nil
 }
 
 func (h *HTTP) LockRoom(w http.ResponseWriter, r *http.Request) (interface{}, error) {
 	roomID := chi.URLParam(r, "roomId")
 
-	result, svcErr := h.service.LockRoom(r.Context(), r.Body, roomID)
+	result, svcErr := h.service.LockRoom(r.Context(), r.Body, roomID, h.caller(r))
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) GetRoomMembers(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	result, svcErr := h.service.GetRoomMembers(r.Context(), GetRoomMembersQuery{
+		RoomID:   chi.URLParam(r, "roomId"),
+		PageStr:  r.URL.Query().Get("page"),
+		LimitStr: r.URL.Query().Get("limit"),
+	})
+	if wantsListPage(r) && svcErr.ErrorMessage == nil {
+		return newListPage(result.Members, result.Page, result.Limit, result.Total), nil
+	}
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) GetOnlineRoomMembers(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	result, svcErr := h.service.GetOnlineRoomMembers(r.Context(), chi.URLParam(r, "roomId"))
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) MuteUser(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	roomID := chi.URLParam(r, "roomId")
+
+	result, svcErr := h.service.MuteUser(r.Context(), roomID, r.Body)
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) UnmuteUser(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	roomID := chi.URLParam(r, "roomId")
+
+	result, svcErr := h.service.UnmuteUser(r.Context(), roomID, r.Body)
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) CreateInvite(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	roomID := chi.URLParam(r, "roomId")
+
+	result, svcErr := h.service.CreateInvite(r.Context(), roomID, r.Body)
 	if svcErr.ErrorMessage != nil {
-		code := http.StatusInternalServerError
-		if svcErr.ErrorCode != nil {
-			code = *svcErr.ErrorCode
+		return respond(w, result, svcErr)
+	}
+
+	return handler.Response{Status: http.StatusCreated, Body: result}, nil
+}
+
+func (h *HTTP) JoinRoom(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	result, svcErr := h.service.JoinRoom(r.Context(), r.Body, h.caller(r))
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) SetSlowMode(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	roomID := chi.URLParam(r, "roomId")
+
+	result, svcErr := h.service.SetSlowMode(r.Context(), roomID, r.Body)
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) NicknameAvailable(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	roomID := chi.URLParam(r, "roomId")
+
+	result, svcErr := h.service.NicknameAvailable(r.Context(), roomID, r.URL.Query().Get("nickname"))
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) MarkRoomRead(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	roomID := chi.URLParam(r, "roomId")
+	user, _ := r.Context().Value(middleware.UserContextKey).(middleware.UserClaims)
+
+	result, svcErr := h.service.MarkRoomRead(r.Context(), roomID, user.UserID)
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) GetMyRooms(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	user, _ := r.Context().Value(middleware.UserContextKey).(middleware.UserClaims)
+
+	result, svcErr := h.service.GetMyRooms(r.Context(), user.UserID)
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) ExportMyData(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	user, _ := r.Context().Value(middleware.UserContextKey).(middleware.UserClaims)
+
+	export, svcErr := h.service.ExportUserData(r.Context(), user.UserID)
+	if svcErr.ErrorMessage != nil {
+		return respond(w, nil, svcErr)
+	}
+
+	// The export is streamed, so an error past this point can only cut the download short
+	w.Header().Set("Content-Disposition", `attachment; filename="chat-export.json"`)
+	w.WriteHeader(http.StatusOK)
+	if err := export.Stream(r.Context(), w); err != nil {
+		log.Error(r.Context(), "Failed to write user data export", log.ErrAttr(err), log.AnyAttr("user_id", user.UserID))
+	}
+
+	return nil, nil
+}
+
+func (h *HTTP) GetUnreadRooms(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	result, svcErr := h.service.GetUnreadRooms(r.Context(), GetUnreadRoomsQuery{
+		UserID:   chi.URLParam(r, "userId"),
+		PageStr:  r.URL.Query().Get("page"),
+		LimitStr: r.URL.Query().Get("limit"),
+	})
+	if wantsListPage(r) && svcErr.ErrorMessage == nil {
+		return newListPage(result.Rooms, result.Page, result.Limit, result.Total), nil
+	}
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) GetUserContacts(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	result, svcErr := h.service.GetUserContacts(r.Context(), GetUserContactsQuery{
+		UserID:   chi.URLParam(r, "userId"),
+		PageStr:  r.URL.Query().Get("page"),
+		LimitStr: r.URL.Query().Get("limit"),
+	})
+	if wantsListPage(r) && svcErr.ErrorMessage == nil {
+		return newListPage(result.Contacts, result.Page, result.Limit, result.Total), nil
+	}
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) UploadAttachment(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	roomID := chi.URLParam(r, "roomId")
+	user, _ := r.Context().Value(middleware.UserContextKey).(middleware.UserClaims)
+
+	// Leave some room for the multipart overhead, the file size itself is checked by the service
+	r.Body = http.MaxBytesReader(w, r.Body, h.service.deps.Config.Attachments.MaxSize+1<<20)
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return respond(w, nil, newError(constants.AttachmentTooLarge))
 		}
-		w.WriteHeader(code)
-		return ErrorResponse{
-			Error:   *svcErr.ErrorMessage,
-			Code:    code,
-			ErrorID: *svcErr.ErrorID,
-		}, nil
+		return respond(w, nil, newError(constants.AttachmentRequired))
 	}
-	return result, nil
+	defer file.Close()
+
+	result, svcErr := h.service.UploadAttachment(r.Context(), roomID, user.UserID, file, header.Filename, header.Size)
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) ServerTime(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return h.service.ServerTime(), nil
+}
+
+func (h *HTTP) RemoveRoomMember(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	roomID := chi.URLParam(r, "roomId")
+	userID := chi.URLParam(r, "userId")
+
+	result, svcErr := h.service.RemoveRoomMember(r.Context(), roomID, userID)
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) PurgeMessages(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	roomID := chi.URLParam(r, "roomId")
+
+	result, svcErr := h.service.PurgeMessages(r.Context(), roomID, r.Body)
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) ReportMessage(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	roomID := chi.URLParam(r, "roomId")
+	messageID := chi.URLParam(r, "messageId")
+	user, _ := r.Context().Value(middleware.UserContextKey).(middleware.UserClaims)
+
+	result, svcErr := h.service.ReportMessage(r.Context(), roomID, messageID, user.UserID, r.Body)
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) GetReports(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	result, svcErr := h.service.GetReports(r.Context(), GetReportsQuery{
+		Status:   r.URL.Query().Get("status"),
+		PageStr:  r.URL.Query().Get("page"),
+		LimitStr: r.URL.Query().Get("limit"),
+	})
+	if wantsListPage(r) && svcErr.ErrorMessage == nil {
+		return newListPage(result.Reports, result.Page, result.Limit, result.Total), nil
+	}
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) ResolveReport(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	reportID := chi.URLParam(r, "reportId")
+
+	result, svcErr := h.service.ResolveReport(r.Context(), reportID, r.Body)
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) GetMessage(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	roomID := chi.URLParam(r, "roomId")
+	messageID := chi.URLParam(r, "messageId")
+	user, _ := r.Context().Value(middleware.UserContextKey).(middleware.UserClaims)
+
+	result, svcErr := h.service.GetMessage(r.Context(), roomID, messageID, user.UserID)
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) EditMessage(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	roomID := chi.URLParam(r, "roomId")
+	messageID := chi.URLParam(r, "messageId")
+	user, _ := r.Context().Value(middleware.UserContextKey).(middleware.UserClaims)
+
+	result, svcErr := h.service.EditMessage(r.Context(), roomID, messageID, user.UserID, r.Body)
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) DeleteMessage(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	roomID := chi.URLParam(r, "roomId")
+	messageID := chi.URLParam(r, "messageId")
+
+	result, svcErr := h.service.DeleteMessage(r.Context(), roomID, messageID, h.caller(r))
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) ImportMessages(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	roomID := chi.URLParam(r, "roomId")
+
+	result, svcErr := h.service.ImportMessages(r.Context(), roomID, r.Body)
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) UpdateRoomSettings(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	roomID := chi.URLParam(r, "roomId")
+
+	result, svcErr := h.service.UpdateRoomSettings(r.Context(), roomID, h.caller(r), r.Body)
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) SendMessage(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	roomID := chi.URLParam(r, "roomId")
+
+	result, svcErr := h.service.SendMessage(r.Context(), roomID, h.caller(r), r.Body)
+	if svcErr.ErrorMessage != nil {
+		return respond(w, result, svcErr)
+	}
+
+	return handler.Response{Status: http.StatusCreated, Body: result}, nil
+}
+
+func (h *HTTP) PinMessage(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	roomID := chi.URLParam(r, "roomId")
+	user, _ := r.Context().Value(middleware.UserContextKey).(middleware.UserClaims)
+
+	result, svcErr := h.service.PinMessage(r.Context(), roomID, user.UserID, user.Nickname, r.Body)
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) UnpinMessage(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	roomID := chi.URLParam(r, "roomId")
+	messageID := chi.URLParam(r, "messageId")
+	user, _ := r.Context().Value(middleware.UserContextKey).(middleware.UserClaims)
+
+	result, svcErr := h.service.UnpinMessage(r.Context(), roomID, user.UserID, user.Nickname, messageID)
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) GetPinnedMessages(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	roomID := chi.URLParam(r, "roomId")
+
+	result, svcErr := h.service.GetPinnedMessages(r.Context(), roomID, r.URL.Query().Get("order"))
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) ReorderPins(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	roomID := chi.URLParam(r, "roomId")
+	user, _ := r.Context().Value(middleware.UserContextKey).(middleware.UserClaims)
+
+	result, svcErr := h.service.ReorderPins(r.Context(), roomID, user.UserID, user.Nickname, r.Body)
+	return respond(w, result, svcErr)
 }
 
 func (h *HTTP) UpdateUser(w http.ResponseWriter, r *http.Request) (interface{}, error) {
-	ID := chi.URLParam(r, "id")
+	ID := chi.URLParam(r, "userId")
 
 	_, svcErr := h.service.UpdateUser(r.Context(), ID, r.Body)
 	if svcErr.ErrorMessage != nil {
@@ -119,7 +461,6 @@ func (h *HTTP) UpdateUser(w http.ResponseWriter, r *http.Request) (interface{},
 		if svcErr.ErrorCode != nil {
 			code = *svcErr.ErrorCode
 		}
-		w.WriteHeader(code)
 		return ErrorResponse{
 			Error:   *svcErr.ErrorMessage,
 			Code:    code,
@@ -132,16 +473,27 @@ func (h *HTTP) UpdateUser(w http.ResponseWriter, r *http.Request) (interface{},
 	}, nil
 }
 
+func (h *HTTP) Announce(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	result, svcErr := h.service.Announce(r.Context(), r.Body)
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) SetMaintenanceMode(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	result, svcErr := h.service.SetMaintenanceMode(r.Context(), r.Body)
+	return respond(w, result, svcErr)
+}
+
 func (h *HTTP) GetRoom(w http.ResponseWriter, r *http.Request) (interface{}, error) {
 	roomID := chi.URLParam(r, "roomId")
 
-	result, roomErr := h.service.GetRoom(r.Context(), roomID)
+	countOnly := r.URL.Query().Get("members") == "count"
+
+	result, roomErr := h.service.GetRoom(r.Context(), roomID, countOnly)
 	if roomErr.ErrorMessage != nil {
 		code := http.StatusInternalServerError
 		if roomErr.ErrorCode != nil {
 			code = *roomErr.ErrorCode
 		}
-		w.WriteHeader(code)
 		return ErrorResponse{
 			Error:   *roomErr.ErrorMessage,
 			Code:    code,
@@ -166,7 +518,6 @@ func (h *HTTP) GetRooms(w http.ResponseWriter, r *http.Request) (interface{}, er
 		if roomErr.ErrorCode != nil {
 			code = *roomErr.ErrorCode
 		}
-		w.WriteHeader(code)
 		return ErrorResponse{
 			Error:   *roomErr.ErrorMessage,
 			Code:    code,
@@ -174,9 +525,43 @@ func (h *HTTP) GetRooms(w http.ResponseWriter, r *http.Request) (interface{}, er
 		}, nil
 	}
 
+	if wantsListPage(r) {
+		return newListPage(result.Rooms, result.Page, result.Limit, result.Total), nil
+	}
+
 	return result, nil
 }
 
+func respond(w http.ResponseWriter, result interface{}, svcErr Error) (interface{}, error) {
+	if svcErr.ErrorMessage != nil {
+		code := http.StatusInternalServerError
+		if svcErr.ErrorCode != nil {
+			code = *svcErr.ErrorCode
+		}
+		return ErrorResponse{
+			Error:   *svcErr.ErrorMessage,
+			Code:    code,
+			ErrorID: *svcErr.ErrorID,
+			Details: svcErr.Details,
+		}, nil
+	}
+
+	return result, nil
+}
+
+// ValidateRoomID rejects the requests to a {roomId} that isn't a valid room ID, before
+// it reaches Mongo or Redis
+func ValidateRoomID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validRoomID(chi.URLParam(r, "roomId")) {
+			handler.WriteError(w, constants.InvalidRoomID, nil)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func JSONResponseMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
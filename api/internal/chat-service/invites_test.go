@@ -0,0 +1,48 @@
+package chatservice
+
+import "testing"
+
+// memberIDs returns the IDs of the room members, in join order
+func memberIDs(room RoomDetails) []string {
+	userIDs := make([]string, len(room.Users))
+	for i, user := range room.Users {
+		userIDs[i] = user.ID
+	}
+
+	return userIDs
+}
+
+func TestJoinRoomWithoutUserIDJoinsAsTheCaller(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "bob")
+	ts.store.addAccount("alice")
+	ts.store.addInvite("welcome", "lobby", 2)
+
+	join := func() RoomDetails {
+		t.Helper()
+
+		result, svcErr := ts.service.JoinRoom(t.Context(), jsonBody(t, JoinRoomBody{Code: "welcome", Nickname: "alice"}), Caller{UserID: "alice"})
+		if svcErr.ErrorMessage != nil {
+			t.Fatalf("join: %s", errorID(svcErr))
+		}
+
+		return result.(RoomDetails)
+	}
+
+	room := join()
+	if members := memberIDs(room); len(members) != 2 || members[1] != "alice" {
+		t.Errorf("members = %v, want bob then alice", members)
+	}
+	if uses := ts.store.invite(t, "welcome").Uses; uses != 1 {
+		t.Errorf("invite used %d times, want 1", uses)
+	}
+
+	// Members rejoining don't use the invite
+	room = join()
+	if members := memberIDs(room); len(members) != 2 {
+		t.Errorf("members after rejoining = %v, want bob and alice", members)
+	}
+	if uses := ts.store.invite(t, "welcome").Uses; uses != 1 {
+		t.Errorf("invite used %d times after rejoining, want 1", uses)
+	}
+}
@@ -0,0 +1,204 @@
+package chatservice
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/pkg/middleware"
+)
+
+// countMessages counts the system messages starting with the prefix the client receives within the wait
+func countMessages(c *testClient, wait time.Duration, prefix string) int {
+	count := 0
+	timeout := time.After(wait)
+	for {
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				return count
+			}
+			if msg.Type == SystemMessage && strings.HasPrefix(msg.Content, prefix) {
+				count++
+			}
+		case <-timeout:
+			return count
+		}
+	}
+}
+
+func TestConcurrentLockRoom(t *testing.T) {
+	const members = 8
+
+	ts := newTestServer(t)
+	userIDs := []string{"watcher"}
+	for i := range members {
+		userIDs = append(userIDs, fmt.Sprintf("user-%d", i))
+	}
+	ts.store.addRoom("lobby", userIDs...)
+	for _, userID := range userIDs {
+		ts.addUser(userID, middleware.UserClaims{})
+	}
+
+	watcher := ts.mustDial("watcher", "lobby")
+
+	var wg sync.WaitGroup
+	statuses := make([]int, members)
+	for i, userID := range userIDs[1:] {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i], _ = ts.post(userID, "/rooms/lobby/lock", LockRoomBody{UserID: userID})
+		}()
+	}
+	wg.Wait()
+
+	holder := ""
+	for i, status := range statuses {
+		switch status {
+		case http.StatusOK:
+			if holder != "" {
+				t.Errorf("both %s and %s locked the room", holder, userIDs[i+1])
+			}
+			holder = userIDs[i+1]
+		case http.StatusConflict:
+		default:
+			t.Errorf("lock by %s status = %d, want 200 or 409", userIDs[i+1], status)
+		}
+	}
+	if holder == "" {
+		t.Fatal("no request locked the room")
+	}
+
+	room, err := ts.store.GetRoom(t.Context(), "lobby")
+	if err != nil {
+		t.Fatalf("get room: %v", err)
+	}
+	if room.LockedBy != holder {
+		t.Errorf("room locked by %q, want %q", room.LockedBy, holder)
+	}
+
+	if got := countMessages(watcher, 500*time.Millisecond, "Room has been locked by"); got != 1 {
+		t.Errorf("lock announced %d times, want once", got)
+	}
+}
+
+func TestConcurrentUnlockRoom(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice", "watcher")
+	ts.addUser("alice", middleware.UserClaims{})
+	ts.addUser("watcher", middleware.UserClaims{})
+
+	watcher := ts.mustDial("watcher", "lobby")
+
+	if status, _ := ts.post("alice", "/rooms/lobby/lock", LockRoomBody{UserID: "alice"}); status != http.StatusOK {
+		t.Fatalf("lock status = %d, want 200", status)
+	}
+	watcher.receive(withContent(SystemMessage, "Room has been locked by alice"))
+
+	// Every instance seeing alice leave releases her lock, only one of them announces it
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ts.service.unlockOnLeave(t.Context(), "lobby", "alice", "alice")
+		}()
+	}
+	wg.Wait()
+
+	room, err := ts.store.GetRoom(t.Context(), "lobby")
+	if err != nil {
+		t.Fatalf("get room: %v", err)
+	}
+	if room.LockedBy != "" {
+		t.Errorf("room still locked by %q", room.LockedBy)
+	}
+
+	if got := countMessages(watcher, 500*time.Millisecond, "Room has been unlocked"); got != 1 {
+		t.Errorf("unlock announced %d times, want once", got)
+	}
+
+	// An unlock by a member not holding the lock changes nothing
+	if status, _ := ts.post("watcher", "/rooms/lobby/lock", LockRoomBody{UserID: "watcher"}); status != http.StatusOK {
+		t.Fatalf("lock by watcher status = %d, want 200", status)
+	}
+	ts.service.unlockOnLeave(t.Context(), "lobby", "alice", "alice")
+	if room, _ := ts.store.GetRoom(t.Context(), "lobby"); room.LockedBy != "watcher" {
+		t.Errorf("room locked by %q, want watcher", room.LockedBy)
+	}
+}
+
+func TestSendMessageToLockedRoom(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice", "bob")
+	ts.addUser("alice", middleware.UserClaims{})
+	ts.addUser("bob", middleware.UserClaims{})
+
+	if status, errResp := ts.post("alice", "/rooms/lobby/lock", LockRoomBody{UserID: "alice"}); status != http.StatusOK {
+		t.Fatalf("lock status = %d %q, want 200", status, errResp.ErrorID)
+	}
+
+	status, errResp := ts.post("bob", "/rooms/lobby/messages", SendMessageBody{Content: "hello"})
+	if status != http.StatusLocked || errResp.ErrorID != constants.ErrorMessages[constants.RoomLocked].ID {
+		t.Fatalf("send by bob status = %d %q, want 423 %s", status, errResp.ErrorID, constants.ErrorMessages[constants.RoomLocked].ID)
+	}
+
+	lockedBy, _ := errResp.Details["locked_by"].(map[string]interface{})
+	if lockedBy["user_id"] != "alice" || lockedBy["nickname"] != "alice" {
+		t.Errorf("details.locked_by = %v, want alice", errResp.Details["locked_by"])
+	}
+
+	// The lock holder can still send
+	if status, errResp := ts.post("alice", "/rooms/lobby/messages", SendMessageBody{Content: "hello"}); status != http.StatusCreated {
+		t.Errorf("send by alice status = %d %q, want 201", status, errResp.ErrorID)
+	}
+	if stored := ts.store.roomMessages("lobby", TextMessage); len(stored) != 1 || stored[0].FromUserID != "alice" {
+		t.Errorf("stored %v, want alice's message only", stored)
+	}
+}
+
+func TestLockPublishesRoomUpdates(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice", "watcher")
+	ts.addUser("alice", middleware.UserClaims{})
+	ts.addUser("watcher", middleware.UserClaims{})
+
+	watcher := ts.mustDial("watcher", "lobby")
+	roomUpdate := func(msg ChatMessage) bool {
+		return msg.Type == EventMessage && msg.Metadata["event"] == EventRoomUpdate
+	}
+	expectLockedBy := func(want string) {
+		t.Helper()
+
+		update := watcher.receive(roomUpdate)
+		if fields, _ := update.Metadata["fields"].([]interface{}); len(fields) != 1 || fields[0] != "locked_by" {
+			t.Errorf("fields = %v, want [locked_by]", update.Metadata["fields"])
+		}
+		if changes, _ := update.Metadata["changes"].(map[string]interface{}); changes["locked_by"] != want {
+			t.Errorf("changes = %v, want locked_by %q", update.Metadata["changes"], want)
+		}
+	}
+
+	if status, _ := ts.post("alice", "/rooms/lobby/lock", LockRoomBody{UserID: "alice"}); status != http.StatusOK {
+		t.Fatalf("lock status = %d, want 200", status)
+	}
+	expectLockedBy("alice")
+
+	ts.service.unlockOnLeave(t.Context(), "lobby", "alice", "alice")
+	expectLockedBy("")
+
+	// Locks that fail change nothing, so they publish no update
+	if status, _ := ts.post("watcher", "/rooms/lobby/lock", LockRoomBody{UserID: "watcher"}); status != http.StatusOK {
+		t.Fatalf("lock by watcher status = %d, want 200", status)
+	}
+	expectLockedBy("watcher")
+	if status, _ := ts.post("alice", "/rooms/lobby/lock", LockRoomBody{UserID: "alice"}); status != http.StatusConflict {
+		t.Fatalf("lock of the locked room status = %d, want 409", status)
+	}
+	watcher.expectNone(300*time.Millisecond, roomUpdate)
+}
@@ -0,0 +1,50 @@
+package chatservice
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/pkg/middleware"
+)
+
+func TestMaintenanceModeRejectsSends(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice", "bob")
+	ts.addUser("alice", middleware.UserClaims{})
+	ts.addUser("bob", middleware.UserClaims{})
+	ts.addUser("admin", middleware.UserClaims{})
+	alice := ts.mustDial("alice", "lobby")
+
+	if status, errResp := ts.post("admin", "/admin/maintenance", "garbage"); status != http.StatusBadRequest || errResp.ErrorID != constants.ErrorMessages[constants.FailedToDecodeBody].ID {
+		t.Errorf("malformed body status = %d %q, want 400 %s", status, errResp.ErrorID, constants.ErrorMessages[constants.FailedToDecodeBody].ID)
+	}
+
+	if status, errResp := ts.post("admin", "/admin/maintenance", MaintenanceModeBody{Enabled: true}); status != http.StatusOK {
+		t.Fatalf("enable status = %d %q, want 200", status, errResp.ErrorID)
+	}
+	alice.receive(withContent(SystemMessage, "Chat is entering maintenance mode, messages can't be sent for now"))
+
+	alice.sendText("hello", "")
+	alice.receive(withContent(SystemMessage, constants.ErrorMessages[constants.MaintenanceMode].Message))
+
+	maintenance := constants.ErrorMessages[constants.MaintenanceMode].ID
+	if status, errResp := ts.post("bob", "/rooms/lobby/messages", SendMessageBody{Content: "hello"}); status != http.StatusServiceUnavailable || errResp.ErrorID != maintenance {
+		t.Fatalf("REST send status = %d %q, want 503 %s", status, errResp.ErrorID, maintenance)
+	}
+	if stored := ts.store.roomMessages("lobby", TextMessage); len(stored) != 0 {
+		t.Fatalf("stored %d messages during maintenance, want 0", len(stored))
+	}
+
+	if status, errResp := ts.post("admin", "/admin/maintenance", MaintenanceModeBody{Enabled: false}); status != http.StatusOK {
+		t.Fatalf("disable status = %d %q, want 200", status, errResp.ErrorID)
+	}
+
+	// The rejected sends didn't start the rate limit
+	alice.sendText("hello", "")
+	alice.receive(ofType(AckMessage))
+	if status, errResp := ts.post("bob", "/rooms/lobby/messages", SendMessageBody{Content: "hi"}); status != http.StatusCreated {
+		t.Fatalf("REST send status = %d %q, want 201", status, errResp.ErrorID)
+	}
+	alice.receive(withContent(TextMessage, "hi"))
+}
@@ -0,0 +1,415 @@
+package chatservice
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/config"
+	"github.com/vit0rr/chat/pkg/database/repositories"
+	"github.com/vit0rr/chat/pkg/middleware"
+	"github.com/vit0rr/chat/pkg/pagination"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestGetMessagesRejectsInvalidQueries(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice")
+
+	otherRoomCursor, err := pagination.Encode(pagination.Cursor{
+		Scope:     "other",
+		SortValue: time.Now(),
+		Direction: "desc",
+	}, ts.service.cursorSecrets()[0])
+	if err != nil {
+		t.Fatalf("encode cursor: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		query     GetMessagesQuery
+		wantError string
+	}{
+		{"empty room ID", GetMessagesQuery{}, constants.RoomIDRequired},
+		{"unknown room", GetMessagesQuery{RoomID: "missing"}, constants.RoomNotFound},
+		{"malformed cursor", GetMessagesQuery{RoomID: "lobby", Cursor: "garbage"}, constants.InvalidCursor},
+		{"cursor of another room", GetMessagesQuery{RoomID: "lobby", Cursor: otherRoomCursor}, constants.InvalidCursor},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, svcErr := ts.service.GetMessages(t.Context(), tt.query)
+
+			want := constants.ErrorMessages[tt.wantError]
+			if got := errorID(svcErr); got != want.ID {
+				t.Fatalf("error_id = %q, want %q", got, want.ID)
+			}
+			if *svcErr.ErrorCode != want.Code {
+				t.Errorf("error_code = %d, want %d", *svcErr.ErrorCode, want.Code)
+			}
+		})
+	}
+}
+
+func TestGetMessages(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice")
+
+	// An empty room answers [] rather than null
+	result, svcErr := ts.service.GetMessages(t.Context(), GetMessagesQuery{RoomID: "lobby", Count: true})
+	if svcErr.ErrorMessage != nil {
+		t.Fatalf("get messages: %s", errorID(svcErr))
+	}
+	if body, _ := json.Marshal(result.Messages); string(body) != "[]" {
+		t.Errorf("messages of the empty room = %s, want []", body)
+	}
+	if result.Total != 0 || result.NextCursor != "" {
+		t.Errorf("total = %d, next cursor = %q, want 0 and none", result.Total, result.NextCursor)
+	}
+
+	oldest := ts.storeMessageAt("lobby", "alice", 3*time.Minute)
+	deleted := ts.storeMessageAt("lobby", "alice", 2*time.Minute)
+	newest := ts.storeMessageAt("lobby", "alice", time.Minute)
+	if err := ts.store.DeleteMessage(t.Context(), "lobby", deleted); err != nil {
+		t.Fatalf("delete message: %v", err)
+	}
+
+	// Newest first, without the deleted messages, one page at a time along the cursor
+	messageIDs := []string{}
+	query := GetMessagesQuery{RoomID: "lobby", LimitStr: "1", Count: true}
+	for range 3 {
+		result, svcErr = ts.service.GetMessages(t.Context(), query)
+		if svcErr.ErrorMessage != nil {
+			t.Fatalf("get messages: %s", errorID(svcErr))
+		}
+		if result.Total != 2 {
+			t.Errorf("total = %d, want 2", result.Total)
+		}
+		for _, msg := range result.Messages {
+			messageIDs = append(messageIDs, msg.ID)
+		}
+
+		if result.NextCursor == "" {
+			break
+		}
+		query.Cursor = result.NextCursor
+	}
+
+	if want := []string{newest, oldest}; !slices.Equal(messageIDs, want) {
+		t.Errorf("messages = %v, want %v", messageIDs, want)
+	}
+}
+
+func TestEditedMessageIsReplayedEdited(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice", "bob")
+	ts.addUser("alice", middleware.UserClaims{})
+	ts.addUser("bob", middleware.UserClaims{})
+
+	alice := ts.mustDial("alice", "lobby")
+	alice.sendText("helo", "")
+	ack := alice.receive(ofType(AckMessage))
+
+	body := io.NopCloser(strings.NewReader(`{"content": "hello"}`))
+	if _, svcErr := ts.service.EditMessage(t.Context(), "lobby", ack.ID, "alice", body); svcErr.ErrorMessage != nil {
+		t.Fatalf("edit: %s", *svcErr.ErrorMessage)
+	}
+
+	// Fewer than the history holds, so the replay reads the broker history and not the store
+	bob, resp := ts.dialWithHistory("bob", "lobby", 2)
+	if bob == nil {
+		t.Fatalf("dial: status %d", resp.StatusCode)
+	}
+	history := bob.receive(ofType(HistoryMessage))
+
+	var replayed *ChatMessage
+	for i, msg := range history.Messages {
+		if msg.ID == ack.ID {
+			replayed = &history.Messages[i]
+		}
+	}
+	if replayed == nil {
+		t.Fatalf("replay %+v is missing the edited message %s", history.Messages, ack.ID)
+	}
+	if replayed.Content != "hello" {
+		t.Errorf("replayed content = %q, want the edited hello", replayed.Content)
+	}
+	if _, ok := replayed.Metadata["edited_at"]; !ok {
+		t.Error("replayed message has no edited_at")
+	}
+}
+
+func TestSendMessageUsesTheMemberNickname(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice")
+	ts.addUser("alice", middleware.UserClaims{Nickname: "Alice from the token"})
+
+	// The REST path sends under the nickname the WebSocket uses, not the token's
+	if status, errResp := ts.post("alice", "/rooms/lobby/messages", SendMessageBody{Content: "hello"}); status != http.StatusCreated {
+		t.Fatalf("send status = %d (%+v), want 201", status, errResp)
+	}
+
+	stored := ts.store.roomMessages("lobby", TextMessage)
+	if len(stored) != 1 {
+		t.Fatalf("stored %d messages, want 1", len(stored))
+	}
+	if stored[0].Nickname != "alice" {
+		t.Errorf("stored nickname = %q, want the member nickname alice", stored[0].Nickname)
+	}
+}
+
+// storeMessageAt stores a text message of the user sent the given time ago, returning its ID
+func (ts *testServer) storeMessageAt(roomID string, userID string, age time.Duration) string {
+	ts.t.Helper()
+
+	messageID, err := ts.store.CreateMessage(ts.t.Context(), repositories.CreateMessageData{
+		RoomID:     roomID,
+		Message:    "hello",
+		FromUserID: userID,
+		Nickname:   userID,
+		Type:       string(TextMessage),
+		CreatedAt:  time.Now().Add(-age),
+	})
+	if err != nil {
+		ts.t.Fatalf("store message: %v", err)
+	}
+
+	return messageID
+}
+
+// withMessageWindows sets the chat edit and delete windows to a minute
+func withMessageWindows(cfg *config.Config) {
+	editWindow := 60
+	cfg.Chat.EditWindow = &editWindow
+	cfg.Chat.DeleteWindow = 60
+}
+
+func TestEditWindow(t *testing.T) {
+	seconds := func(s int) *int { return &s }
+
+	tests := []struct {
+		name       string
+		age        time.Duration
+		roomWindow *int
+		wantError  string
+	}{
+		{"within the window", 59 * time.Second, nil, ""},
+		{"past the window", 61 * time.Second, nil, constants.EditWindowExpired},
+		{"within the room window", 61 * time.Second, seconds(120), ""},
+		{"past the room window", 31 * time.Second, seconds(30), constants.EditWindowExpired},
+		{"unlimited room window", time.Hour, seconds(0), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, withMessageWindows)
+			ts.store.addRoom("lobby", "alice")
+			ts.store.setMessageWindows("lobby", tt.roomWindow, nil)
+			messageID := ts.storeMessageAt("lobby", "alice", tt.age)
+
+			body := io.NopCloser(strings.NewReader(`{"content": "hello again"}`))
+			_, svcErr := ts.service.EditMessage(t.Context(), "lobby", messageID, "alice", body)
+
+			want := ""
+			if tt.wantError != "" {
+				want = constants.ErrorMessages[tt.wantError].ID
+			}
+			if got := errorID(svcErr); got != want {
+				t.Fatalf("error_id = %q, want %q", got, want)
+			}
+			if want != "" && *svcErr.ErrorCode != http.StatusForbidden {
+				t.Errorf("error_code = %d, want %d", *svcErr.ErrorCode, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestDeleteWindow(t *testing.T) {
+	seconds := func(s int) *int { return &s }
+
+	tests := []struct {
+		name       string
+		age        time.Duration
+		roomWindow *int
+		caller     Caller
+		wantError  string
+	}{
+		{"sender within the window", 59 * time.Second, nil, Caller{UserID: "alice"}, ""},
+		{"sender past the window", 61 * time.Second, nil, Caller{UserID: "alice"}, constants.DeleteWindowExpired},
+		{"sender within the room window", 61 * time.Second, seconds(120), Caller{UserID: "alice"}, ""},
+		{"sender with an unlimited room window", time.Hour, seconds(0), Caller{UserID: "alice"}, ""},
+		{"another member", 59 * time.Second, nil, Caller{UserID: "bob"}, constants.NotMessageSender},
+		{"admin past the window", time.Hour, nil, Caller{Admin: true}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, withMessageWindows)
+			ts.store.addRoom("lobby", "alice", "bob")
+			ts.store.setMessageWindows("lobby", nil, tt.roomWindow)
+			messageID := ts.storeMessageAt("lobby", "alice", tt.age)
+
+			_, svcErr := ts.service.DeleteMessage(t.Context(), "lobby", messageID, tt.caller)
+
+			if tt.wantError != "" {
+				if want := constants.ErrorMessages[tt.wantError].ID; errorID(svcErr) != want {
+					t.Fatalf("error_id = %q, want %q", errorID(svcErr), want)
+				}
+				if deleted := ts.deletedIDs("lobby"); len(deleted) != 0 {
+					t.Errorf("deleted %v, want none", deleted)
+				}
+				return
+			}
+
+			if svcErr.ErrorMessage != nil {
+				t.Fatalf("delete: %s", errorID(svcErr))
+			}
+			if deleted := ts.deletedIDs("lobby"); len(deleted) != 1 || deleted[0] != messageID {
+				t.Errorf("deleted %v, want %s", deleted, messageID)
+			}
+		})
+	}
+}
+
+func TestDeletedMessageIsGone(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice")
+	deletedID := ts.storeMessageAt("lobby", "alice", time.Minute)
+	if _, svcErr := ts.service.DeleteMessage(t.Context(), "lobby", deletedID, Caller{UserID: "alice"}); svcErr.ErrorMessage != nil {
+		t.Fatalf("delete: %s", errorID(svcErr))
+	}
+
+	lookups := []struct {
+		name   string
+		lookup func(messageID string) Error
+	}{
+		{"get", func(messageID string) Error {
+			_, svcErr := ts.service.GetMessage(t.Context(), "lobby", messageID, "alice")
+			return svcErr
+		}},
+		{"edit", func(messageID string) Error {
+			body := io.NopCloser(strings.NewReader(`{"content": "hello again"}`))
+			_, svcErr := ts.service.EditMessage(t.Context(), "lobby", messageID, "alice", body)
+			return svcErr
+		}},
+		{"delete", func(messageID string) Error {
+			_, svcErr := ts.service.DeleteMessage(t.Context(), "lobby", messageID, Caller{UserID: "alice"})
+			return svcErr
+		}},
+	}
+
+	for _, tt := range lookups {
+		t.Run(tt.name+" deleted", func(t *testing.T) {
+			svcErr := tt.lookup(deletedID)
+			if want := constants.ErrorMessages[constants.MessageDeleted]; errorID(svcErr) != want.ID || *svcErr.ErrorCode != http.StatusGone {
+				t.Fatalf("error = %d %q, want 410 %s", *svcErr.ErrorCode, errorID(svcErr), want.ID)
+			}
+			if deletedAt, _ := svcErr.Details["deleted_at"].(time.Time); deletedAt.IsZero() {
+				t.Errorf("details.deleted_at = %v, want the deletion time", svcErr.Details["deleted_at"])
+			}
+		})
+
+		t.Run(tt.name+" missing", func(t *testing.T) {
+			for _, messageID := range []string{primitive.NewObjectID().Hex(), "garbage"} {
+				svcErr := tt.lookup(messageID)
+				if want := constants.ErrorMessages[constants.MessageNotFound].ID; errorID(svcErr) != want || *svcErr.ErrorCode != http.StatusNotFound {
+					t.Fatalf("error for %s = %d %q, want 404 %s", messageID, *svcErr.ErrorCode, errorID(svcErr), want)
+				}
+				if svcErr.Details != nil {
+					t.Errorf("details for %s = %v, want none", messageID, svcErr.Details)
+				}
+			}
+		})
+	}
+}
+
+func TestBroadcastsAreStoredAndKeptInTheHistory(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice", "bob")
+	ts.addUser("alice", middleware.UserClaims{})
+	alice := ts.mustDial("alice", "lobby")
+
+	// A message, then the system messages of a lock and a mute
+	alice.sendText("hello", "")
+	alice.receive(ofType(AckMessage))
+	if status, errResp := ts.post("alice", "/rooms/lobby/lock", LockRoomBody{UserID: "alice"}); status != http.StatusOK {
+		t.Fatalf("lock status = %d %q, want 200", status, errResp.ErrorID)
+	}
+	if _, svcErr := ts.service.MuteUser(t.Context(), "lobby", jsonBody(t, MuteUserBody{UserID: "bob", DurationSeconds: 60})); svcErr.ErrorMessage != nil {
+		t.Fatalf("mute: %s", errorID(svcErr))
+	}
+	alice.receive(withContent(SystemMessage, "bob has been muted for 1m0s"))
+
+	stored := []string{}
+	for _, messageType := range []MessageType{TextMessage, SystemMessage} {
+		for _, msg := range ts.store.roomMessages("lobby", messageType) {
+			stored = append(stored, msg.ID.Hex())
+		}
+	}
+	slices.Sort(stored)
+
+	history := ts.historyIDs("lobby")
+	slices.Sort(history)
+
+	if len(stored) != 3 || !slices.Equal(stored, history) {
+		t.Errorf("stored %v, history %v, want the same 3 messages", stored, history)
+	}
+}
+
+func TestBroadcastOutlivesTheSendersContext(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice", "bob")
+	ts.addUser("bob", middleware.UserClaims{})
+	bob := ts.mustDial("bob", "lobby")
+
+	// The sender disconnected right after sending, canceling the request
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	sent, _ := ts.service.broadcastToRoom(ctx, "lobby", ChatMessage{
+		Type:      TextMessage,
+		RoomId:    "lobby",
+		SenderId:  "alice",
+		Nickname:  "alice",
+		Content:   "bye",
+		Timestamp: time.Now(),
+	})
+	if sent.ID == "" {
+		t.Fatal("message not stored")
+	}
+
+	bob.receive(withContent(TextMessage, "bye"))
+	if history := ts.historyIDs("lobby"); !slices.Equal(history, []string{sent.ID}) {
+		t.Errorf("history = %v, want %s", history, sent.ID)
+	}
+}
+
+func TestBroadcastCountsTheConnectionsThatReceivedIt(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice", "bob")
+	ts.store.addRoom("other", "alice")
+	ts.addUser("alice", middleware.UserClaims{})
+	ts.addUser("bob", middleware.UserClaims{})
+
+	// Every connection counts, the ones of another room don't
+	ts.mustDial("alice", "lobby")
+	ts.mustDial("alice", "lobby")
+	ts.mustDial("bob", "lobby")
+	ts.mustDial("alice", "other")
+
+	_, receivers := ts.service.broadcastToRoom(t.Context(), "lobby", ChatMessage{
+		Type:      SystemMessage,
+		RoomId:    "lobby",
+		Content:   "hello everyone",
+		Timestamp: time.Now(),
+	})
+	if receivers != 3 {
+		t.Errorf("receivers = %d, want the 3 connections to the room", receivers)
+	}
+}
@@ -0,0 +1,61 @@
+package chatservice
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/pkg/middleware"
+)
+
+func TestMutedUserCanReadButNotSend(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice", "bob")
+	ts.addUser("alice", middleware.UserClaims{})
+	ts.addUser("bob", middleware.UserClaims{})
+
+	alice := ts.mustDial("alice", "lobby")
+	bob := ts.mustDial("bob", "lobby")
+
+	if _, svcErr := ts.service.MuteUser(t.Context(), "lobby", jsonBody(t, MuteUserBody{UserID: "bob", DurationSeconds: 60})); svcErr.ErrorMessage != nil {
+		t.Fatalf("mute: %s", errorID(svcErr))
+	}
+	alice.receive(withContent(SystemMessage, "bob has been muted for 1m0s"))
+
+	muted := constants.ErrorMessages[constants.UserMuted].ID
+	bob.sendText("let me talk", "")
+	notice := bob.receive(func(msg ChatMessage) bool {
+		return msg.Type == SystemMessage && msg.Metadata["error_id"] == muted
+	})
+	if remaining, _ := notice.Metadata["remaining_seconds"].(float64); remaining <= 0 || remaining > 60 {
+		t.Errorf("WebSocket remaining_seconds = %v, want up to 60", notice.Metadata["remaining_seconds"])
+	}
+
+	status, errResp := ts.post("bob", "/rooms/lobby/messages", SendMessageBody{Content: "let me talk"})
+	if status != http.StatusForbidden || errResp.ErrorID != muted {
+		t.Fatalf("REST send status = %d %q, want 403 %s", status, errResp.ErrorID, muted)
+	}
+	if remaining, _ := errResp.Details["remaining_seconds"].(float64); remaining <= 0 || remaining > 60 {
+		t.Errorf("REST details.remaining_seconds = %v, want up to 60", errResp.Details["remaining_seconds"])
+	}
+
+	if stored := ts.store.roomMessages("lobby", TextMessage); len(stored) != 0 {
+		t.Fatalf("stored %d messages of the muted user, want 0", len(stored))
+	}
+
+	// Muted users still connect and read the room
+	reconnected := ts.mustDial("bob", "lobby")
+	alice.sendText("hello", "")
+	alice.receive(ofType(AckMessage))
+	bob.receive(withContent(TextMessage, "hello"))
+	reconnected.receive(withContent(TextMessage, "hello"))
+
+	if _, svcErr := ts.service.UnmuteUser(t.Context(), "lobby", jsonBody(t, UnmuteUserBody{UserID: "bob"})); svcErr.ErrorMessage != nil {
+		t.Fatalf("unmute: %s", errorID(svcErr))
+	}
+
+	// The rejected messages didn't start the rate limit
+	bob.sendText("thanks", "")
+	bob.receive(ofType(AckMessage))
+	alice.receive(withContent(TextMessage, "thanks"))
+}
@@ -0,0 +1,232 @@
+package chatservice
+
+import (
+	"encoding/json"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/config"
+	"github.com/vit0rr/chat/pkg/database/repositories"
+)
+
+// jsonBody encodes the body like a request's
+func jsonBody(t *testing.T, body interface{}) io.ReadCloser {
+	t.Helper()
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("marshal body: %v", err)
+	}
+
+	return io.NopCloser(strings.NewReader(string(payload)))
+}
+
+// storeMessages stores count messages of alice in the room, returning their IDs
+func storeMessages(t *testing.T, ts *testServer, roomID string, count int) []string {
+	t.Helper()
+
+	messageIDs := make([]string, count)
+	for i := range messageIDs {
+		id, err := ts.store.CreateMessage(t.Context(), repositories.CreateMessageData{
+			RoomID:     roomID,
+			Message:    "message",
+			FromUserID: "alice",
+			Type:       string(TextMessage),
+		})
+		if err != nil {
+			t.Fatalf("create message: %v", err)
+		}
+		messageIDs[i] = id
+	}
+
+	return messageIDs
+}
+
+// errorID returns the ID of the error, empty when there's none
+func errorID(svcErr Error) string {
+	if svcErr.ErrorID == nil {
+		return ""
+	}
+	return *svcErr.ErrorID
+}
+
+func (ts *testServer) pin(roomID string, messageID string) Error {
+	_, svcErr := ts.service.PinMessage(ts.t.Context(), roomID, "alice", "alice", jsonBody(ts.t, PinMessageBody{MessageID: messageID}))
+	return svcErr
+}
+
+// pinnedIDs returns the IDs of the messages pinned in the room, in the manual order
+func (ts *testServer) pinnedIDs(roomID string) []string {
+	ts.t.Helper()
+
+	list, svcErr := ts.service.GetPinnedMessages(ts.t.Context(), roomID, repositories.PinOrderPosition)
+	if svcErr.ErrorMessage != nil {
+		ts.t.Fatalf("get pins: %s", errorID(svcErr))
+	}
+
+	messageIDs := make([]string, len(list.Pins))
+	for i, pin := range list.Pins {
+		messageIDs[i] = pin.MessageID
+		if pin.Message == nil {
+			ts.t.Errorf("pin of %s has no message", pin.MessageID)
+		}
+	}
+
+	return messageIDs
+}
+
+func maxPins(limit int) func(*config.Config) {
+	return func(cfg *config.Config) {
+		cfg.Chat.MaxPinsPerRoom = limit
+	}
+}
+
+func TestPinLimit(t *testing.T) {
+	ts := newTestServer(t, maxPins(2))
+	ts.store.addRoom("lobby", "alice")
+	messageIDs := storeMessages(t, ts, "lobby", 3)
+
+	for _, messageID := range messageIDs[:2] {
+		if svcErr := ts.pin("lobby", messageID); svcErr.ErrorMessage != nil {
+			t.Fatalf("pin below the limit: %s", errorID(svcErr))
+		}
+	}
+
+	if got, want := errorID(ts.pin("lobby", messageIDs[2])), constants.ErrorMessages[constants.PinLimitReached].ID; got != want {
+		t.Fatalf("pin at the limit error_id = %q, want %q", got, want)
+	}
+
+	// Unpinning frees a slot, and a message is only pinned once
+	if _, svcErr := ts.service.UnpinMessage(t.Context(), "lobby", "alice", "alice", messageIDs[0]); svcErr.ErrorMessage != nil {
+		t.Fatalf("unpin: %s", errorID(svcErr))
+	}
+	if got, want := errorID(ts.pin("lobby", messageIDs[1])), constants.ErrorMessages[constants.MessageAlreadyPinned].ID; got != want {
+		t.Fatalf("pin of a pinned message error_id = %q, want %q", got, want)
+	}
+	if svcErr := ts.pin("lobby", messageIDs[2]); svcErr.ErrorMessage != nil {
+		t.Fatalf("pin after an unpin: %s", errorID(svcErr))
+	}
+
+	if got, want := ts.pinnedIDs("lobby"), []string{messageIDs[1], messageIDs[2]}; !slices.Equal(got, want) {
+		t.Errorf("pins = %v, want %v", got, want)
+	}
+}
+
+func TestPinLimitIgnoresOtherRooms(t *testing.T) {
+	ts := newTestServer(t, maxPins(1))
+	ts.store.addRoom("lobby", "alice")
+	ts.store.addRoom("other", "alice")
+	lobby := storeMessages(t, ts, "lobby", 1)
+	other := storeMessages(t, ts, "other", 1)
+
+	if svcErr := ts.pin("lobby", lobby[0]); svcErr.ErrorMessage != nil {
+		t.Fatalf("pin in lobby: %s", errorID(svcErr))
+	}
+	if svcErr := ts.pin("other", other[0]); svcErr.ErrorMessage != nil {
+		t.Fatalf("pin in other: %s", errorID(svcErr))
+	}
+}
+
+func TestConcurrentPinsStayWithinLimit(t *testing.T) {
+	const limit = 3
+
+	ts := newTestServer(t, maxPins(limit))
+	ts.store.addRoom("lobby", "alice")
+	messageIDs := storeMessages(t, ts, "lobby", 10)
+
+	var wg sync.WaitGroup
+	errs := make([]Error, len(messageIDs))
+	for i, messageID := range messageIDs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = ts.pin("lobby", messageID)
+		}()
+	}
+	wg.Wait()
+
+	pinned := 0
+	for _, svcErr := range errs {
+		switch errorID(svcErr) {
+		case "":
+			pinned++
+		case constants.ErrorMessages[constants.PinLimitReached].ID:
+		default:
+			t.Errorf("pin error_id = %q, want none or the pin limit", errorID(svcErr))
+		}
+	}
+	if pinned != limit {
+		t.Errorf("pinned %d messages, want %d", pinned, limit)
+	}
+
+	pins := ts.pinnedIDs("lobby")
+	if len(pins) != limit {
+		t.Fatalf("room has %d pins, want %d", len(pins), limit)
+	}
+
+	positions := make(map[int]bool)
+	stored, _ := ts.store.GetPins(t.Context(), repositories.GetPinsData{RoomID: "lobby"})
+	for _, pin := range stored {
+		if positions[pin.Position] {
+			t.Errorf("position %d given to two pins", pin.Position)
+		}
+		positions[pin.Position] = true
+	}
+}
+
+func TestReorderPins(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice")
+	messageIDs := storeMessages(t, ts, "lobby", 4)
+
+	for _, messageID := range messageIDs[:3] {
+		if svcErr := ts.pin("lobby", messageID); svcErr.ErrorMessage != nil {
+			t.Fatalf("pin: %s", errorID(svcErr))
+		}
+	}
+
+	order := []string{messageIDs[2], messageIDs[0], messageIDs[1]}
+	result, svcErr := ts.service.ReorderPins(t.Context(), "lobby", "alice", "alice", jsonBody(t, ReorderPinsBody{MessageIDs: order}))
+	if svcErr.ErrorMessage != nil {
+		t.Fatalf("reorder: %s", errorID(svcErr))
+	}
+
+	list := result.(PinnedMessagesList)
+	returned := make([]string, len(list.Pins))
+	for i, pin := range list.Pins {
+		returned[i] = pin.MessageID
+	}
+	if !slices.Equal(returned, order) {
+		t.Errorf("reorder returned %v, want %v", returned, order)
+	}
+
+	// A message pinned after the reorder goes last
+	if svcErr := ts.pin("lobby", messageIDs[3]); svcErr.ErrorMessage != nil {
+		t.Fatalf("pin after the reorder: %s", errorID(svcErr))
+	}
+	if got, want := ts.pinnedIDs("lobby"), append(slices.Clone(order), messageIDs[3]); !slices.Equal(got, want) {
+		t.Errorf("pins = %v, want %v", got, want)
+	}
+
+	invalid := []struct {
+		name       string
+		messageIDs []string
+	}{
+		{"missing a pin", order},
+		{"duplicate", []string{messageIDs[0], messageIDs[0], messageIDs[1], messageIDs[2]}},
+		{"not pinned", []string{messageIDs[0], messageIDs[1], messageIDs[2], "000000000000000000000000"}},
+	}
+
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			_, svcErr := ts.service.ReorderPins(t.Context(), "lobby", "alice", "alice", jsonBody(t, ReorderPinsBody{MessageIDs: tt.messageIDs}))
+			if got, want := errorID(svcErr), constants.ErrorMessages[constants.InvalidPinOrder].ID; got != want {
+				t.Errorf("error_id = %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package chatservice
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/pkg/broker"
+	"github.com/vit0rr/chat/pkg/middleware"
+)
+
+// onlineMemberIDs returns the IDs of the room members GetOnlineRoomMembers lists
+func (ts *testServer) onlineMemberIDs(roomID string) []string {
+	ts.t.Helper()
+
+	list, svcErr := ts.service.GetOnlineRoomMembers(ts.t.Context(), roomID)
+	if svcErr.ErrorMessage != nil {
+		ts.t.Fatalf("get online members: %s", errorID(svcErr))
+	}
+
+	userIDs := make([]string, len(list.Members))
+	for i, member := range list.Members {
+		userIDs[i] = member.ID
+	}
+	slices.Sort(userIDs)
+
+	return userIDs
+}
+
+func TestOnlineRoomMembersFollowLivePresence(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice", "bob", "carol")
+	ts.addUser("alice", middleware.UserClaims{})
+	ts.addUser("bob", middleware.UserClaims{})
+
+	ts.mustDial("alice", "lobby")
+	bob := ts.mustDial("bob", "lobby")
+
+	if got, want := ts.onlineMemberIDs("lobby"), []string{"alice", "bob"}; !slices.Equal(got, want) {
+		t.Fatalf("online members = %v, want %v", got, want)
+	}
+
+	// Carol's instance crashed: she is still online in the store, but her connection was
+	// never released and stopped being refreshed
+	if err := ts.store.SetUserActivity(t.Context(), "carol", "online"); err != nil {
+		t.Fatalf("set activity: %v", err)
+	}
+	if _, err := ts.broker.RegisterConnection(t.Context(), broker.Connection{
+		UserID:       "carol",
+		RoomID:       "lobby",
+		Nickname:     "carol",
+		ConnectionID: "crashed",
+		LastSeen:     time.Now(),
+	}, 50*time.Millisecond); err != nil {
+		t.Fatalf("register connection: %v", err)
+	}
+
+	if got, want := ts.onlineMemberIDs("lobby"), []string{"alice", "bob", "carol"}; !slices.Equal(got, want) {
+		t.Fatalf("online members = %v, want %v", got, want)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if got, want := ts.onlineMemberIDs("lobby"), []string{"alice", "bob"}; !slices.Equal(got, want) {
+		t.Errorf("online members after the crash = %v, want %v", got, want)
+	}
+
+	// A closed connection is released right away
+	bob.conn.CloseNow()
+	deadline := time.Now().Add(5 * time.Second)
+	for !slices.Equal(ts.onlineMemberIDs("lobby"), []string{"alice"}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("online members = %v after bob left, want [alice]", ts.onlineMemberIDs("lobby"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOnlineRoomMembersOfUnknownRoom(t *testing.T) {
+	ts := newTestServer(t)
+
+	_, svcErr := ts.service.GetOnlineRoomMembers(t.Context(), "missing")
+	if got, want := errorID(svcErr), constants.ErrorMessages[constants.RoomNotFound].ID; got != want {
+		t.Errorf("error_id = %q, want %q", got, want)
+	}
+}
+
+// isPresence matches the presence message of the event about the user
+func isPresence(event string, userID string) func(ChatMessage) bool {
+	return func(msg ChatMessage) bool {
+		return msg.Type == SystemMessage && msg.Metadata["event"] == event && msg.Metadata["user_id"] == userID
+	}
+}
+
+func TestPresenceMessagesAreAnnouncedOnce(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice", "bob")
+	ts.addUser("alice", middleware.UserClaims{})
+	ts.addUser("bob", middleware.UserClaims{})
+
+	alice := ts.mustDial("alice", "lobby")
+	bob := ts.mustDial("bob", "lobby")
+	alice.receive(isPresence(MemberEventJoined, "bob"))
+
+	if err := bob.conn.Close(websocket.StatusNormalClosure, ""); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if got := countMessages(alice, 500*time.Millisecond, "bob left the room"); got != 1 {
+		t.Errorf("leave announced %d times, want once", got)
+	}
+
+	// They're only for the connected clients, not stored nor replayed
+	if stored := ts.store.roomMessages("lobby", SystemMessage); len(stored) != 0 {
+		t.Errorf("stored %d presence messages, want 0", len(stored))
+	}
+	if history := ts.historyIDs("lobby"); len(history) != 0 {
+		t.Errorf("history = %v, want it empty", history)
+	}
+}
+
+func TestPresenceMessagesTurnedOff(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice", "bob")
+	ts.store.setPresenceMessages("lobby", false)
+	ts.addUser("alice", middleware.UserClaims{})
+	ts.addUser("bob", middleware.UserClaims{})
+
+	alice := ts.mustDial("alice", "lobby")
+	bob := ts.mustDial("bob", "lobby")
+	alice.expectNone(200*time.Millisecond, isPresence(MemberEventJoined, "bob"))
+
+	bob.conn.Close(websocket.StatusNormalClosure, "")
+	alice.expectNone(200*time.Millisecond, isPresence(MemberEventLeft, "bob"))
+}
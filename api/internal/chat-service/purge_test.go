@@ -0,0 +1,153 @@
+package chatservice
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/vit0rr/chat/api/constants"
+)
+
+// broadcastText sends the text of the user to the room at the time, storing it and adding it
+// to the room history, and returns its ID
+func (ts *testServer) broadcastText(roomID string, userID string, content string, at time.Time) string {
+	ts.t.Helper()
+
+	msg, _ := ts.service.broadcastToRoom(ts.t.Context(), roomID, ChatMessage{
+		Type:      TextMessage,
+		RoomId:    roomID,
+		SenderId:  userID,
+		Nickname:  userID,
+		Content:   content,
+		Timestamp: at,
+	})
+	if msg.ID == "" {
+		ts.t.Fatal("broadcast message has no ID")
+	}
+
+	return msg.ID
+}
+
+// historyIDs returns the IDs of the messages in the room history, oldest first
+func (ts *testServer) historyIDs(roomID string) []string {
+	ts.t.Helper()
+
+	entries, err := ts.broker.History(ts.t.Context(), roomID, 0)
+	if err != nil {
+		ts.t.Fatalf("get history: %v", err)
+	}
+
+	messageIDs := []string{}
+	for _, entry := range entries {
+		var msg ChatMessage
+		if err := json.Unmarshal(entry, &msg); err != nil {
+			ts.t.Fatalf("decode history entry: %v", err)
+		}
+		messageIDs = append(messageIDs, msg.ID)
+	}
+
+	return messageIDs
+}
+
+// deletedIDs returns the IDs of the soft-deleted text messages of the room
+func (ts *testServer) deletedIDs(roomID string) []string {
+	messageIDs := []string{}
+	for _, msg := range ts.store.roomMessages(roomID, TextMessage) {
+		if msg.DeletedAt != nil {
+			messageIDs = append(messageIDs, msg.ID.Hex())
+		}
+	}
+
+	return messageIDs
+}
+
+func (ts *testServer) purge(roomID string, body PurgeMessagesBody) (PurgeMessagesResult, Error) {
+	ts.t.Helper()
+
+	result, svcErr := ts.service.PurgeMessages(ts.t.Context(), roomID, jsonBody(ts.t, body))
+	if svcErr.ErrorMessage != nil {
+		return PurgeMessagesResult{}, svcErr
+	}
+
+	return result.(PurgeMessagesResult), svcErr
+}
+
+func TestPurgeMessagesByUser(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice", "bob")
+
+	now := time.Now()
+	hi := ts.broadcastText("lobby", "alice", "hi", now.Add(-4*time.Minute))
+	spam := ts.broadcastText("lobby", "bob", "buy now", now.Add(-3*time.Minute))
+	moreSpam := ts.broadcastText("lobby", "bob", "buy now", now.Add(-2*time.Minute))
+	bye := ts.broadcastText("lobby", "alice", "bye", now.Add(-time.Minute))
+
+	result, svcErr := ts.purge("lobby", PurgeMessagesBody{UserID: "bob", Confirm: true})
+	if svcErr.ErrorMessage != nil {
+		t.Fatalf("purge: %s", errorID(svcErr))
+	}
+
+	if want := []string{spam, moreSpam}; result.Purged != 2 || !slices.Equal(result.MessageIDs, want) || result.More {
+		t.Errorf("purge result = %+v, want %v purged", result, want)
+	}
+	if deleted := ts.deletedIDs("lobby"); !slices.Equal(deleted, result.MessageIDs) {
+		t.Errorf("deleted %v, want the purged %v", deleted, result.MessageIDs)
+	}
+	if history := ts.historyIDs("lobby"); !slices.Equal(history, []string{hi, bye}) {
+		t.Errorf("history = %v, want alice's %v", history, []string{hi, bye})
+	}
+}
+
+func TestPurgeMessagesByRange(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice")
+
+	now := time.Now()
+	before := ts.broadcastText("lobby", "alice", "before", now.Add(-3*time.Hour))
+	first := ts.broadcastText("lobby", "alice", "first", now.Add(-2*time.Hour))
+	second := ts.broadcastText("lobby", "alice", "second", now.Add(-time.Hour))
+	after := ts.broadcastText("lobby", "alice", "after", now)
+
+	// Both bounds are inclusive
+	from := now.Add(-2 * time.Hour)
+	to := now.Add(-time.Hour)
+	result, svcErr := ts.purge("lobby", PurgeMessagesBody{From: &from, To: &to, Confirm: true})
+	if svcErr.ErrorMessage != nil {
+		t.Fatalf("purge: %s", errorID(svcErr))
+	}
+
+	if want := []string{first, second}; !slices.Equal(result.MessageIDs, want) {
+		t.Errorf("purged %v, want %v", result.MessageIDs, want)
+	}
+	if history := ts.historyIDs("lobby"); !slices.Equal(history, []string{before, after}) {
+		t.Errorf("history = %v, want the messages out of the range %v", history, []string{before, after})
+	}
+}
+
+func TestPurgeMessagesRequiresConfirmation(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice", "bob")
+
+	now := time.Now()
+	ts.broadcastText("lobby", "alice", "hi", now.Add(-2*time.Minute))
+	ts.broadcastText("lobby", "bob", "buy now", now.Add(-time.Minute))
+	ts.broadcastText("lobby", "bob", "BUY NOW", now)
+	history := ts.historyIDs("lobby")
+
+	_, svcErr := ts.purge("lobby", PurgeMessagesBody{Text: "buy now"})
+	if want := constants.ErrorMessages[constants.PurgeNotConfirmed].ID; errorID(svcErr) != want {
+		t.Fatalf("unconfirmed purge error = %q, want %q", errorID(svcErr), want)
+	}
+	if matched := svcErr.Details["matched"]; matched != int64(2) {
+		t.Errorf("details.matched = %v, want 2", matched)
+	}
+
+	// Nothing is deleted until the purge is confirmed
+	if deleted := ts.deletedIDs("lobby"); len(deleted) != 0 {
+		t.Errorf("deleted %v, want none", deleted)
+	}
+	if got := ts.historyIDs("lobby"); !slices.Equal(got, history) {
+		t.Errorf("history = %v, want it unchanged %v", got, history)
+	}
+}
@@ -0,0 +1,21 @@
+package chatservice
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/pkg/middleware"
+)
+
+func TestMarkRoomReadRejectsOtherUsersRooms(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("bobs-room", "bob")
+	ts.addUser("alice", middleware.UserClaims{})
+
+	// The read marker is always the token's user's, a room of another user is out of reach
+	status, errResp := ts.post("alice", "/rooms/bobs-room/read", nil)
+	if want := constants.ErrorMessages[constants.UserNotRoomMember].ID; status != http.StatusForbidden || errResp.ErrorID != want {
+		t.Fatalf("got %d %q, want 403 %q", status, errResp.ErrorID, want)
+	}
+}
@@ -0,0 +1,133 @@
+package chatservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/pkg/middleware"
+)
+
+func TestCreateRoomRegistersTheCaller(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addAccount("alice")
+
+	result, svcErr := ts.service.CreateRoom(t.Context(), jsonBody(t, RegisterUserBody{Nickname: "alice"}), Caller{UserID: "alice"})
+	if svcErr.ErrorMessage != nil {
+		t.Fatalf("create room: %s", errorID(svcErr))
+	}
+	room := result.(RoomDetails)
+
+	if _, err := uuid.Parse(room.RoomId); err != nil {
+		t.Errorf("room ID %q is not a UUID: %v", room.RoomId, err)
+	}
+	if members := memberIDs(room); !slices.Equal(members, []string{"alice"}) {
+		t.Errorf("members = %v, want alice", members)
+	}
+	if room.CreatedBy != "alice" {
+		t.Errorf("created by %q, want alice", room.CreatedBy)
+	}
+
+	// Every room gets its own ID
+	result, svcErr = ts.service.CreateRoom(t.Context(), jsonBody(t, RegisterUserBody{Nickname: "alice"}), Caller{UserID: "alice"})
+	if svcErr.ErrorMessage != nil {
+		t.Fatalf("create second room: %s", errorID(svcErr))
+	}
+	if other := result.(RoomDetails).RoomId; other == room.RoomId {
+		t.Errorf("second room got the same ID %q", other)
+	}
+}
+
+func TestGetMissingRoomIsNotFound(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice")
+
+	if _, svcErr := ts.service.GetRoom(t.Context(), "lobby", false); svcErr.ErrorMessage != nil {
+		t.Fatalf("get room: %s", errorID(svcErr))
+	}
+
+	// Rooms aren't soft-deleted, a missing room is never gone
+	_, svcErr := ts.service.GetRoom(t.Context(), "missing", false)
+	if want := constants.ErrorMessages[constants.RoomNotFound].ID; errorID(svcErr) != want || *svcErr.ErrorCode != http.StatusNotFound {
+		t.Fatalf("error = %d %q, want 404 %s", *svcErr.ErrorCode, errorID(svcErr), want)
+	}
+	if svcErr.Details != nil {
+		t.Errorf("details = %v, want none", svcErr.Details)
+	}
+}
+
+func TestRegisterUserReturnsTheRoomDetails(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "bob")
+	ts.store.addAccount("alice")
+
+	result, svcErr := ts.service.RegisterUser(t.Context(), jsonBody(t, RegisterUserBody{UserID: "alice", Nickname: "alice"}), "lobby", Caller{UserID: "alice"})
+	if svcErr.ErrorMessage != nil {
+		t.Fatalf("register: %s", errorID(svcErr))
+	}
+	registered, ok := result.(RoomDetails)
+	if !ok {
+		t.Fatalf("register returned %T, want RoomDetails", result)
+	}
+
+	if members := memberIDs(registered); !slices.Equal(members, []string{"bob", "alice"}) || registered.MemberCount != 2 {
+		t.Errorf("members = %v (count %d), want bob then alice", members, registered.MemberCount)
+	}
+
+	// The same shape GetRoom returns
+	room, svcErr := ts.service.GetRoom(t.Context(), "lobby", false)
+	if svcErr.ErrorMessage != nil {
+		t.Fatalf("get room: %s", errorID(svcErr))
+	}
+	got, _ := json.Marshal(registered)
+	want, _ := json.Marshal(room)
+	if string(got) != string(want) {
+		t.Errorf("register returned %s, want the room details %s", got, want)
+	}
+}
+
+func TestGetRoomMembersPages(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "u1", "u2", "u3", "u4", "u5")
+	ts.store.addVerifiedAccount("u3")
+	ts.store.addAccount("u4")
+	ts.addUser("u3", middleware.UserClaims{})
+	ts.mustDial("u3", "lobby")
+
+	list, svcErr := ts.service.GetRoomMembers(t.Context(), GetRoomMembersQuery{RoomID: "lobby", PageStr: "2", LimitStr: "2"})
+	if svcErr.ErrorMessage != nil {
+		t.Fatalf("get members: %s", errorID(svcErr))
+	}
+
+	want := []RoomMember{
+		{ID: "u3", Nickname: "u3", Online: true, Verified: true},
+		{ID: "u4", Nickname: "u4"},
+	}
+	if !slices.Equal(list.Members, want) || list.Total != 5 || list.Page != 2 || list.Limit != 2 {
+		t.Errorf("page = %+v, want %+v of 5 members", list, want)
+	}
+
+	// The last page holds the rest, an invalid limit falls back to the default
+	if list, _ := ts.service.GetRoomMembers(t.Context(), GetRoomMembersQuery{RoomID: "lobby", PageStr: "3", LimitStr: "2"}); len(list.Members) != 1 || list.Members[0].ID != "u5" {
+		t.Errorf("last page = %+v, want u5", list.Members)
+	}
+	if list, _ := ts.service.GetRoomMembers(t.Context(), GetRoomMembersQuery{RoomID: "lobby", LimitStr: "500"}); len(list.Members) != 5 || list.Limit != 50 {
+		t.Errorf("page with an invalid limit = %d members, limit %d, want 5 and 50", len(list.Members), list.Limit)
+	}
+
+	if _, svcErr := ts.service.GetRoomMembers(t.Context(), GetRoomMembersQuery{RoomID: "missing"}); errorID(svcErr) != constants.ErrorMessages[constants.RoomNotFound].ID {
+		t.Errorf("unknown room error = %q, want %s", errorID(svcErr), constants.ErrorMessages[constants.RoomNotFound].ID)
+	}
+
+	// The count-only room details leave the members out
+	room, svcErr := ts.service.GetRoom(t.Context(), "lobby", true)
+	if svcErr.ErrorMessage != nil {
+		t.Fatalf("get room: %s", errorID(svcErr))
+	}
+	if room.Users != nil || room.MemberCount != 5 {
+		t.Errorf("count-only room = %d users, count %d, want none and 5", len(room.Users), room.MemberCount)
+	}
+}
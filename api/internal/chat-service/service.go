@@ -1,69 +1,148 @@
 package chatservice
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	_ "image/gif"  // Registers the GIF decoder for the attachments dimensions
+	_ "image/jpeg" // Registers the JPEG decoder for the attachments dimensions
+	_ "image/png"  // Registers the PNG decoder for the attachments dimensions
 	"io"
+	"math"
+	"mime"
 	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coder/websocket"
 	"github.com/coder/websocket/wsjson"
 	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/config"
 
 	"github.com/google/uuid"
-	"github.com/redis/go-redis/v9"
+	"github.com/vit0rr/chat/pkg/broker"
 	"github.com/vit0rr/chat/pkg/database/repositories"
 	"github.com/vit0rr/chat/pkg/deps"
 	"github.com/vit0rr/chat/pkg/log"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/vit0rr/chat/pkg/middleware"
+	"github.com/vit0rr/chat/pkg/moderation"
+	"github.com/vit0rr/chat/pkg/pagination"
+	"github.com/vit0rr/chat/pkg/storage"
+	"github.com/vit0rr/chat/pkg/telemetry"
+	"github.com/vit0rr/chat/pkg/thumbnail"
+	"github.com/vit0rr/chat/pkg/webhooks"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // Client represents a connected websocket client with associated metadata
 type Client struct {
-	conn            *websocket.Conn // WebSocket connection
-	roomID          string          // ID of the room client is connected to
-	userID          string          // Unique identifier for the client
-	nickname        string          // Display name of the client
-	mu              sync.Mutex      // Mutex for thread-safe operations
-	isOnline        bool            // Online status of the client
-	lastMessageTime time.Time       // Timestamp of the last message sent by this client
-	connectionID    string          // Unique connection ID
+	conn            *websocket.Conn  // WebSocket connection
+	roomID          string           // ID of the room client is connected to
+	userID          string           // Unique identifier for the client
+	nickname        string           // Display name of the client
+	verified        bool             // Registered user, not a guest
+	admin           bool             // Connected with the admin key, may send to announcement rooms
+	mu              sync.Mutex       // Mutex for thread-safe operations
+	isOnline        bool             // Online status of the client
+	lastMessageTime time.Time        // Timestamp of the last message sent by this client
+	connectionID    string           // Unique connection ID
+	sessionID       string           // Session of the token the client connected with, empty for the tokens without one
+	send            chan ChatMessage // Outbound queue for regular messages
+	sendSystem      chan ChatMessage // Outbound queue for system messages and acks, always drained first
+	dropped         int              // Messages dropped since the last successful write
+	pending         atomic.Int64     // Messages queued or being written
+	lastActive      atomic.Int64     // Unix nanoseconds of the last message or pong received
 }
 
 // MessageType defines the type of messages that can be sent
 type MessageType string
 
 const (
-	TextMessage   MessageType = "text"   // Regular chat messages
-	SystemMessage MessageType = "system" // System notifications and alerts
+	TextMessage       MessageType = "text"       // Regular chat messages
+	SystemMessage     MessageType = "system"     // System notifications and alerts
+	AttachmentMessage MessageType = "attachment" // Files shared in the room, described by the "attachment" metadata
+	EventMessage      MessageType = "event"      // Updates to earlier messages, described by the metadata. Not persisted
+	AckMessage        MessageType = "ack"        // Sent back to the sender once their message is stored, with its ID
+	HistoryMessage    MessageType = "history"    // Replay of the recent messages on connect, listed in messages
 	MaxMessageLen             = 5000     // Maximum characters allowed per message
-	MessageDelay              = 1500 * time.Millisecond // 1.5 second delay between messages
+	MessageDelay              = config.MessageDelay     // 1.5 second delay between messages
+	SendBufferSize            = 64                      // Outbound messages buffered per client
+	MaxDroppedMessages        = 32                      // Dropped messages tolerated before a slow client is disconnected
+	WriteTimeout              = 10 * time.Second        // Maximum time to write a single message to a client
+	// MaxFrameSize leaves room for the JSON envelope, escaping and metadata, so content just over
+	// MaxMessageLen still gets a friendly error while bigger frames close the connection unread
+	MaxFrameSize = MaxMessageLen*4 + 4096
+	BroadcastTimeout          = 5 * time.Second         // Maximum time to persist and publish a message
+	MessageDedupeWindow       = 5 * time.Minute         // How long a client_msg_id is remembered to drop resent messages
+	MaxClientMsgIDLen         = 128                     // Longer client_msg_id are ignored
+	MaxRoomIDLen              = 64                      // Room IDs are client supplied and used as the _id
 )
 
+// roomIDPattern keeps the room IDs safe to use in URLs, Redis keys and channel names
+var roomIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// validRoomID tells whether the room ID is non-empty, short enough and only uses the allowed characters
+func validRoomID(roomID string) bool {
+	return len(roomID) <= MaxRoomIDLen && roomIDPattern.MatchString(roomID)
+}
+
 // ChatMessage represents a message in the chat system
 type ChatMessage struct {
+	ID        string      `json:"id,omitempty"` // ID of the persisted message, set once it's stored
 	Type      MessageType `json:"type"`      // Type of message (text/system)
 	Content   string      `json:"content"`   // Actual message content
 	RoomId    string      `json:"room_id"`   // Room the message belongs to
 	SenderId  string      `json:"sender_id"` // ID of message sender
 	Nickname  string      `json:"nickname"`  // Sender's display name
+	Verified  bool        `json:"verified"`  // Sender is a registered user, not a guest reusing the nickname
 	Timestamp time.Time   `json:"timestamp"` // When message was sent
 	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	Messages  []ChatMessage          `json:"messages,omitempty"` // Replayed messages of a history message, oldest first
 }
 
 // Service handles the chat service operations including WebSocket,
-// MongoDB, and Redis interactions
+// MongoDB, and broker interactions
 type Service struct {
-	deps  *deps.Deps
-	Mongo *mongo.Database
-	redis *redis.Client
+	deps   *deps.Deps
+	Mongo  *mongo.Database
+	store  Store         // Rooms, locks and messages of the real-time path
+	broker broker.Broker // Fans the messages out and keeps the presence, shared by every instance
+
+	droppedMessages atomic.Int64 // Messages dropped because clients were too slow to receive them
+
+	clientsMu sync.Mutex         // Guards clients and draining
+	clients   map[string]*Client // Clients connected to this instance, by connection ID
+	draining  bool               // Set once Shutdown starts, the new connections are refused
+
+	webhooks   *webhooks.Dispatcher // Delivers events to the clients' webhooks
+	storage    storage.Storage      // Stores the uploaded attachments
+	moderation *moderation.Filter   // Banned words filter, nil when nothing is banned
+}
+
+// Caller is the user a request is made by. Only admins act on behalf of other users.
+type Caller struct {
+	UserID string
+	Admin  bool
+}
+
+// CanActAs tells whether the caller may act as the given user
+func (c Caller) CanActAs(userID string) bool {
+	return c.Admin || (c.UserID != "" && c.UserID == userID)
 }
 
 // RegisterUserBody is the body of the register user
@@ -76,6 +155,17 @@ type GetMessagesQuery struct {
 	RoomID   string `json:"room_id"`
 	PageStr  string `json:"page_str"`
 	LimitStr string `json:"limit_str"`
+	Cursor   string `json:"cursor"`
+	Count    bool   `json:"count"` // Counts the room messages, which costs another query
+}
+
+// MessagesList is a page of the room messages, newest first
+type MessagesList struct {
+	Messages   []ChatMessage
+	NextCursor string // Empty on the last page
+	Total      int64  // Only set when the query asks for the count
+	Page       int
+	Limit      int
 }
 
 type GetRoomsQuery struct {
@@ -89,29 +179,373 @@ type LockRoomBody struct {
 	UserID string `json:"user_id"`
 }
 
+// ServerTimeResponse is the server's current time, used by clients to correct their clocks
+type ServerTimeResponse struct {
+	Time time.Time `json:"time"` // RFC3339, in UTC
+}
+
+// SendMessageBody is the body of the send message
+type SendMessageBody struct {
+	Content  string                 `json:"content"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// ImportedMessage is a historical message imported to a room
+type ImportedMessage struct {
+	// ImportID identifies the message in the source system, so importing it twice is a no-op.
+	// When empty it's derived from the sender, timestamp and content.
+	ImportID  string      `json:"import_id"`
+	Type      MessageType `json:"type"` // Defaults to text
+	Content   string      `json:"content"`
+	SenderID  string      `json:"sender_id"`
+	Nickname  string      `json:"nickname"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+// ImportMessagesResult reports what happened to the imported messages
+type ImportMessagesResult struct {
+	Inserted int `json:"inserted"`
+	Skipped  int `json:"skipped"` // Already imported
+	Expired  int `json:"expired"` // Older than the messages retention, they would be deleted right away
+}
+
+// PurgeMessagesBody selects the messages to purge, every set criteria must match.
+// Without confirm nothing is purged and the error details tell how many messages match.
+type PurgeMessagesBody struct {
+	UserID  string     `json:"user_id"`
+	From    *time.Time `json:"from"`
+	To      *time.Time `json:"to"`
+	Text    string     `json:"text"` // Case-insensitive substring of the message
+	Confirm bool       `json:"confirm"`
+}
+
+type PurgeMessagesResult struct {
+	Purged     int      `json:"purged"`
+	MessageIDs []string `json:"message_ids"`
+	More       bool     `json:"more"` // More messages match, purge again to delete them
+}
+
+// MaxPurgeMessages is how many messages can be purged in a single request
+const MaxPurgeMessages = 10000
+
+// EventMessagesDeleted is published to the room with the IDs of the deleted messages
+const EventMessagesDeleted = "messages.deleted"
+
+// EventMessageEdited is published to the room with the ID and new content of an edited message
+const EventMessageEdited = "message.edited"
+
+// EditMessageBody is the body of the edit message
+type EditMessageBody struct {
+	Content string `json:"content"`
+}
+
+// MaxImportMessages is how many messages can be imported in a single request
+const MaxImportMessages = 10000
+
+// MaxReportReasonLen is the maximum characters allowed in a report reason
+const MaxReportReasonLen = 500
+
+// Report resolution actions
+const (
+	ReportActionDismiss = "dismiss" // Keep the message
+	ReportActionDelete  = "delete"  // Delete the message
+)
+
+type ReportMessageBody struct {
+	Reason string `json:"reason"`
+}
+
+type ResolveReportBody struct {
+	Action string `json:"action"`
+}
+
+type GetReportsQuery struct {
+	Status   string `json:"status"`
+	PageStr  string `json:"page_str"`
+	LimitStr string `json:"limit_str"`
+}
+
+// ReportDetails is a report along with the reported message, which is missing once deleted
+type ReportDetails struct {
+	repositories.Report
+	Message *ChatMessage `json:"message,omitempty"`
+}
+
+type ReportsList struct {
+	Reports []ReportDetails `json:"reports"`
+	Total   int64           `json:"total"`
+	Page    int             `json:"page"`
+	Limit   int             `json:"limit"`
+}
+
+// PinMessageBody is the body of the pin message
+type PinMessageBody struct {
+	MessageID string `json:"message_id"`
+}
+
+// ReorderPinsBody is the body of the pins reorder, listing every pinned message in the new order
+type ReorderPinsBody struct {
+	MessageIDs []string `json:"message_ids"`
+}
+
+// PinnedMessage is a pin along with the message it points to
+type PinnedMessage struct {
+	repositories.Pin
+	Message *ChatMessage `json:"message,omitempty"` // Absent when the message expired
+}
+
+type PinnedMessagesList struct {
+	Pins []PinnedMessage `json:"pins"`
+}
+
+// Events broadcast to the room when its pins change, in the system message metadata
+const (
+	PinEventPinned    = "message.pinned"
+	PinEventUnpinned  = "message.unpinned"
+	PinEventReordered = "pins.reordered"
+)
+
+// MemberEventRemoved is broadcast to the room when a member is removed, in the
+// system message metadata. The removed member's connections are closed on it.
+const MemberEventRemoved = "member.removed"
+
+// MaintenanceModeBody is the body of the maintenance mode toggle
+type MaintenanceModeBody struct {
+	Enabled bool `json:"enabled"`
+}
+
+// AnnounceBody is the body of the announcement. Without room IDs or tags, every room
+// with connected members receives it.
+type AnnounceBody struct {
+	Message string   `json:"message"`
+	RoomIDs []string `json:"room_ids"`
+	Tags    []string `json:"tags"` // Rooms with any of the tags in their settings
+}
+
+type AnnounceResult struct {
+	Rooms     int   `json:"rooms"`     // Rooms with connected members the announcement was published to
+	Receivers int64 `json:"receivers"` // Connections that received it
+}
+
+// EventAnnouncement marks the system messages sent with the admin announcements
+const EventAnnouncement = "announcement"
+
 type Error struct {
-	ErrorMessage *string `json:"error_message"`
-	ErrorID      *string `json:"error_id"`
-	ErrorCode    *int    `json:"error_code"`
+	ErrorMessage *string                `json:"error_message"`
+	ErrorID      *string                `json:"error_id"`
+	ErrorCode    *int                   `json:"error_code"`
+	Details      map[string]interface{} `json:"details,omitempty"` // Context about the error, e.g. who locked the room
 }
 
 type RoomsList struct {
 	Rooms []RoomListDetails `json:"rooms"`
+	Total int64             `json:"total"`
+	Page  int               `json:"page"`
+	Limit int               `json:"limit"`
 }
 
 // Create the types to the GetRoom now
 type RoomDetails struct {
-	RoomId    string                 `json:"room_id"`
-	Users     []repositories.UserRef `json:"users"`
-	LockedBy  *string                `json:"locked_by,omitempty"`
-	CreatedAt time.Time              `json:"created_at"`
-	UpdatedAt time.Time              `json:"updated_at"`
+	RoomId      string                    `json:"room_id"`
+	Users       []repositories.UserRef    `json:"users,omitempty"` // Omitted in count-only mode, see GET /rooms/{roomId}/members
+	MemberCount int                       `json:"member_count"`
+	LockedBy    *string                   `json:"locked_by,omitempty"`
+	Settings    repositories.RoomSettings `json:"settings"`
+	Mode        string                    `json:"mode"`                 // "open" or "announcement"
+	SlowMode    int                       `json:"slow_mode_seconds"`    // Seconds members wait between their messages, off when 0
+	CreatedBy   string                    `json:"created_by,omitempty"` // User who created the room
+	CreatedAt   time.Time                 `json:"created_at"`
+	UpdatedAt   time.Time                 `json:"updated_at"`
+}
+
+// RoomSettingsBody is the body of the room settings update, only the set fields are updated
+type RoomSettingsBody struct {
+	ProfanityFilter  *bool     `json:"profanity_filter"`  // Overrides moderation.enabled for the room
+	Tags             *[]string `json:"tags"`              // Replaces the room tags
+	EditWindow       *int      `json:"edit_window"`       // Overrides chat.edit_window for the room, in seconds. Unlimited when 0
+	DeleteWindow     *int      `json:"delete_window"`     // Overrides chat.delete_window for the room, in seconds. Unlimited when 0
+	PresenceMessages *bool     `json:"presence_messages"` // Broadcasts the join and leave system messages, on by default
+	Mode             *string   `json:"mode"`              // "open", or "announcement" so only admins can send messages
+}
+
+type GetRoomMembersQuery struct {
+	RoomID   string `json:"room_id"`
+	PageStr  string `json:"page_str"`
+	LimitStr string `json:"limit_str"`
+}
+
+// RoomMember is a member of a room along with its presence in the room
+type RoomMember struct {
+	ID       string `json:"id"`
+	Nickname string `json:"nickname"`
+	Online   bool   `json:"online"`   // Connected to the room right now
+	Verified bool   `json:"verified"` // Registered user, not a guest
+}
+
+// OnlineMembersList lists the room members connected to it, in join order
+type OnlineMembersList struct {
+	Members []repositories.UserRef `json:"members"`
+}
+
+type RoomMembersList struct {
+	Members []RoomMember `json:"members"`
+	Total   int64        `json:"total"`
+	Page    int          `json:"page"`
+	Limit   int          `json:"limit"`
+}
+
+// MuteUserBody is the body of the mute
+type MuteUserBody struct {
+	UserID          string `json:"user_id"`
+	DurationSeconds int    `json:"duration_seconds"`
+}
+
+// UnmuteUserBody is the body of the unmute
+type UnmuteUserBody struct {
+	UserID string `json:"user_id"`
+}
+
+// MaxMuteDuration is the longest a user can be muted at once
+const MaxMuteDuration = 30 * 24 * time.Hour
+
+// CreateInviteBody is the body of the invite creation
+type CreateInviteBody struct {
+	ExpiresIn int `json:"expires_in"` // Seconds until the invite expires, never when 0
+	MaxUses   int `json:"max_uses"`   // Times the invite can be used, unlimited when 0
+}
+
+// JoinRoomBody is the body of the join with an invite code
+type JoinRoomBody struct {
+	Code     string `json:"code"`
+	UserID   string `json:"user_id"` // Defaults to the authenticated user, creates a new user when neither is set
+	Nickname string `json:"nickname"`
+}
+
+// InviteDetails is a room invite along with how many uses it has left
+type InviteDetails struct {
+	repositories.Invite
+	RemainingUses int `json:"remaining_uses"` // -1 when unlimited
+}
+
+// SlowModeBody is the body of the slow mode update
+type SlowModeBody struct {
+	Seconds int `json:"seconds"` // Seconds members wait between their messages, 0 turns slow mode off
+}
+
+// MaxSlowMode is the longest cooldown of a room in slow mode
+const MaxSlowMode = 6 * time.Hour
+
+// RoomEventSlowMode is broadcast to the room when its slow mode changes, in the system message metadata
+const RoomEventSlowMode = "room.slow_mode"
+
+// Events broadcast to the room when a member is muted or unmuted, in the system message metadata
+const (
+	MemberEventMuted   = "member.muted"
+	MemberEventUnmuted = "member.unmuted"
+	// Broadcast when the user's first connection to the room opens, and the last one closes
+	MemberEventJoined = "member.joined"
+	MemberEventLeft   = "member.left"
+)
+
+// NicknameAvailability tells whether a nickname is free in a room
+type NicknameAvailability struct {
+	Nickname  string `json:"nickname"`
+	Available bool   `json:"available"`
+}
+
+type GetUserContactsQuery struct {
+	UserID   string `json:"user_id"`
+	PageStr  string `json:"page_str"`
+	LimitStr string `json:"limit_str"`
+}
+
+type GetUnreadRoomsQuery struct {
+	UserID   string `json:"user_id"`
+	PageStr  string `json:"page_str"`
+	LimitStr string `json:"limit_str"`
+}
+
+// MyRoom is a room of the authenticated user with its live presence and unread count
+type MyRoom struct {
+	RoomID       string                    `json:"room_id"`
+	OnlineCount  int64                     `json:"online_count"` // Members connected right now
+	UnreadCount  int64                     `json:"unread_count"` // Capped at repositories.MaxUnreadCount
+	LastUnreadAt *time.Time                `json:"last_unread_at,omitempty"`
+	LockedBy     string                    `json:"locked_by,omitempty"`
+	Settings     repositories.RoomSettings `json:"settings"`
+	CreatedAt    time.Time                 `json:"created_at"`
+	UpdatedAt    time.Time                 `json:"updated_at"`
+}
+
+type MyRoomsList struct {
+	Rooms []MyRoom `json:"rooms"`
+}
+
+// ExportedProfile is the user's profile in their data export, without the password hash
+type ExportedProfile struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email,omitempty"`
+	Nickname  string    `json:"nickname"`
+	Activity  string    `json:"activity"`
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ExportedRoom is a room membership in the user's data export
+type ExportedRoom struct {
+	RoomID    string    `json:"room_id"`
+	Nickname  string    `json:"nickname"` // Nickname the user registered in the room with
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ExportedMessage is a message sent by the user in their data export
+type ExportedMessage struct {
+	ID         string                   `json:"id"`
+	RoomID     string                   `json:"room_id"`
+	Type       string                   `json:"type"`
+	Content    string                   `json:"content"`
+	Nickname   string                   `json:"nickname"`
+	Attachment *repositories.Attachment `json:"attachment,omitempty"`
+	CreatedAt  time.Time                `json:"created_at"`
+	UpdatedAt  time.Time                `json:"updated_at"`
+	DeletedAt  *time.Time               `json:"deleted_at,omitempty"`
+}
+
+// UserExport is the JSON document of the user's data export
+type UserExport struct {
+	ExportedAt time.Time         `json:"exported_at"`
+	Profile    ExportedProfile   `json:"profile"`
+	Rooms      []ExportedRoom    `json:"rooms"`
+	Messages   []ExportedMessage `json:"messages"`
+}
+
+// UserDataExport is a UserExport ready to be written, its messages are streamed
+// from the database
+type UserDataExport struct {
+	export   UserExport
+	messages *mongo.Cursor
+}
+
+type ContactsList struct {
+	Contacts []repositories.Contact `json:"contacts"`
+	Total    int64                  `json:"total"`
+	Page     int                    `json:"page"`
+	Limit    int                    `json:"limit"`
+}
+
+type UnreadRoomsList struct {
+	Rooms []repositories.UnreadRoom `json:"rooms"`
+	Total int64                     `json:"total"`
+	Page  int                       `json:"page"`
+	Limit int                       `json:"limit"`
 }
 
 type RoomListDetails struct {
 	RoomID    string         `json:"room_id"`
 	Users     []RoomListUser `json:"users"`
 	LockedBy  *string        `json:"locked_by,omitempty"`
+	CreatedBy string         `json:"created_by,omitempty"`
 	CreatedAt time.Time      `json:"created_at"`
 	UpdatedAt time.Time      `json:"updated_at"`
 }
@@ -146,16 +580,37 @@ func NewServiceError(key string) error {
 	}
 }
 
-// NewService creates a new chat service
-func NewService(deps *deps.Deps, db *mongo.Database, redisClient *redis.Client) *Service {
+// NewService creates a new chat service. The background connection monitor, and the
+// closing of the connections of revoked sessions, run until ctx is done.
+func NewService(ctx context.Context, deps *deps.Deps, db *mongo.Database, messageBroker broker.Broker) *Service {
+	service := newService(ctx, deps, NewMongoStore(db), messageBroker)
+	service.Mongo = db
+	service.webhooks = webhooks.NewDispatcher(ctx, db)
+
+	go service.monitorConnections(ctx)
+	go service.watchRevokedSessions(ctx)
+
+	return service
+}
+
+// newService creates the service on the store, without MongoDB nor webhooks. The caller
+// starts the connection monitor once the service is complete.
+func newService(ctx context.Context, deps *deps.Deps, store Store, messageBroker broker.Broker) *Service {
 	service := &Service{
-		deps:  deps,
-		Mongo: db,
-		redis: redisClient,
+		deps:    deps,
+		store:   store,
+		broker:  messageBroker,
+		clients: make(map[string]*Client),
+		storage: storage.NewLocal(deps.Config.Attachments.Dir, deps.Config.Attachments.BaseURL),
 	}
-	
-	go service.monitorConnections()
-	
+
+	filter, err := moderation.New(deps.Config.Moderation.BannedWords, deps.Config.Moderation.BannedPatterns, deps.Config.Moderation.Leetspeak)
+	if err != nil {
+		log.Error(ctx, "Invalid moderation config, messages won't be filtered", log.ErrAttr(err))
+	} else if !filter.Empty() {
+		service.moderation = filter
+	}
+
 	return service
 }
 
@@ -164,67 +619,111 @@ func NewService(deps *deps.Deps, db *mongo.Database, redisClient *redis.Client)
 // @tags websocket,rooms
 // @router /api/v1/ws [get]
 // @param token query string true "Authentication token (required)"
-// @param user_id query string true "User ID (required)"
+// @param user_id query string false "User ID, must be the authenticated user when set"
 // @param room_id query string true "Room ID (required)"
-// @param nickname query string true "User's display name (required)"
+// @param nickname query string false "Ignored, the nickname registered in the room is used"
+// @param history query integer false "How many recent messages to replay, 50 by default and clamped to the server max. Set to 0 to skip the replay and only receive live messages"
+// @param skip_history query boolean false "Set to true to skip the history replay, same as history=0"
+// @param history_batch query boolean false "Set to true to replay the history as a single history message listing the messages, instead of one frame per message"
 // @produce application/json
 // @success 101 {object} ChatMessage "WebSocket connection successfully upgraded"
-// @failure 400 {string} string "Missing required parameters or invalid request"
-// @failure 401 {string} string "Unauthorized - Missing or invalid token"
-// @failure 403 {string} string "Forbidden - User not authorized to join room"
-// @failure 404 {string} string "Room not found"
-// @failure 500 {string} string "Internal server error"
+// @failure 400 {string} string "Not a WebSocket handshake"
+// @failure 401 {object} ErrorResponse "Unauthorized - Missing or invalid token"
+// @failure 403 {object} ErrorResponse "Forbidden - User not authorized to join room"
+// @failure 404 {object} ErrorResponse "Room not found"
+// @failure 429 {object} ErrorResponse "Too many connections for the user, see Retry-After"
+// @failure 500 {object} ErrorResponse "Internal server error"
+// @failure 503 {object} ErrorResponse "Too many connections on the server, see Retry-After"
 func (s *Service) WebSocket(w http.ResponseWriter, r *http.Request) (interface{}, error) {
 	ctx := r.Context()
 
 	token := r.URL.Query().Get("token")
-	log.Info(ctx, "Token", log.AnyAttr("token", token))
 	if token == "" {
-		log.Error(ctx, "Missing authentication token", log.AnyAttr("token", token))
-		return nil, fmt.Errorf("missing authentication token")
+		log.Error(ctx, "Missing authentication token")
+		return nil, NewServiceError(constants.AuthorizationRequired)
 	}
-	
-	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		InsecureSkipVerify: true,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("websocket accept error: %v", err)
+
+	// The clients reconnect to another instance
+	if s.isDraining() {
+		return nil, NewServiceError(constants.ShuttingDown)
 	}
-	requestedUserID := r.URL.Query().Get("user_id")
 
-	roomID := r.URL.Query().Get("room_id")
-	nickname := r.URL.Query().Get("nickname")
+	// Scoped tokens are rejected before the upgrade, so the client gets a proper 403
+	claims, _ := ctx.Value(middleware.UserContextKey).(middleware.UserClaims)
+	if !claims.CanAccessRoom(r.URL.Query().Get("room_id")) {
+		log.Warn(ctx, "Token not allowed to access the room",
+			log.AnyAttr("user_id", claims.UserID),
+			log.AnyAttr("room_id", r.URL.Query().Get("room_id")))
+		return nil, NewServiceError(constants.RoomNotInToken)
+	}
 
-	room, err := repositories.GetRooms(ctx, s.Mongo, repositories.GetRoomData{
-		RoomID: roomID,
-	})
+	if errKey, retryAfter := s.connectionLimitError(ctx, claims.UserID); errKey != "" {
+		log.Warn(ctx, "Connection limit reached",
+			log.AnyAttr("user_id", claims.UserID),
+			log.AnyAttr("reason", errKey))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		return nil, NewServiceError(errKey)
+	}
 
-	if err != nil {
-		log.Error(ctx, "Failed to get room", log.ErrAttr(err))
-		conn.Close(websocket.StatusInternalError, "Failed to get room")
-		return nil, fmt.Errorf("failed to get room: %v", err)
+	// The user is always the authenticated one, user_id is only kept for compatibility
+	if queryUserID := r.URL.Query().Get("user_id"); queryUserID != "" && queryUserID != claims.UserID {
+		log.Warn(ctx, "User ID doesn't match the token",
+			log.AnyAttr("user_id", claims.UserID),
+			log.AnyAttr("requested_user_id", queryUserID))
+		return nil, NewServiceError(constants.UserIDMismatch)
 	}
+	requestedUserID := claims.UserID
 
-	if room == nil {
+	roomID := r.URL.Query().Get("room_id")
+	historyCount, ok := s.historyCount(r.URL.Query())
+	if !ok {
+		return nil, NewServiceError(constants.InvalidHistoryCount)
+	}
+	batchHistory, _ := strconv.ParseBool(r.URL.Query().Get("history_batch"))
+
+	if !validRoomID(roomID) {
+		return nil, NewServiceError(constants.InvalidRoomID)
+	}
+
+	// The room is checked before the upgrade too, so the client gets a JSON error it can display
+	room, err := s.store.GetRoom(ctx, roomID)
+	if errors.Is(err, repositories.ErrRoomNotFound) {
 		log.Error(ctx, "Room not found", log.AnyAttr("room_id", roomID))
-		conn.Close(websocket.StatusInternalError, "Room not found")
-		return nil, fmt.Errorf("room not found")
+		return nil, NewServiceError(constants.RoomNotFound)
 	}
 
-	userAuthorized := false
-	for _, user := range room.Users {
-		if user.ID == requestedUserID {
-			userAuthorized = true
-			break
-		}
+	if err != nil {
+		log.Error(ctx, "Failed to get room", log.ErrAttr(err))
+		return nil, NewServiceError(constants.FailedToGetRooms)
 	}
 
-	if !userAuthorized {
+	if errKey := membershipError(room, requestedUserID); errKey != "" {
 		log.Error(ctx, "User not authorized to join room",
 			log.AnyAttr("room_id", roomID),
-			log.AnyAttr("user_id", requestedUserID))
-		conn.Close(websocket.StatusInternalError, "User not authorized to join room")
-		return nil, fmt.Errorf("user not authorized to join room")
+			log.AnyAttr("user_id", requestedUserID),
+			log.AnyAttr("reason", errKey))
+		return nil, NewServiceError(errKey)
+	}
+
+	// Past the upgrade the connection is hijacked, the errors are only reported with close frames
+	acceptOptions := &websocket.AcceptOptions{
+		OriginPatterns:     s.deps.Config.CORS.WebSocketOriginPatterns(),
+		InsecureSkipVerify: s.deps.Config.CORS.InsecureWebSocketOrigins,
+	}
+	if s.deps.Config.Chat.Compression {
+		acceptOptions.CompressionMode = websocket.CompressionNoContextTakeover
+	}
+	conn, err := websocket.Accept(w, r, acceptOptions)
+	if err != nil {
+		// Accept already wrote the error response
+		log.Error(ctx, "Failed to accept WebSocket connection", log.ErrAttr(err))
+		return nil, nil
+	}
+
+	// The nickname query param is ignored, so members can't pose as each other
+	nickname, _ := memberNickname(room, requestedUserID)
+	if nickname == "" {
+		nickname = claims.Nickname
 	}
 
 	connectionID := uuid.New().String()
@@ -234,77 +733,135 @@ func (s *Service) WebSocket(w http.ResponseWriter, r *http.Request) (interface{}
 		userID:          requestedUserID,
 		nickname:        nickname,
 		connectionID:    connectionID,
+		sessionID:       claims.SessionID,
 		mu:              sync.Mutex{},
 		isOnline:        true,
 		lastMessageTime: time.Now(),
+		send:            make(chan ChatMessage, SendBufferSize),
+		sendSystem:      make(chan ChatMessage, SendBufferSize),
+		verified:        s.isVerified(ctx, requestedUserID),
+		admin:           middleware.IsAdmin(s.deps, r),
 	}
 
-	if err := registerClient(ctx, s.redis, client); err != nil {
+	presence, err := s.broker.RegisterConnection(ctx, client.presence(), s.presenceTTL())
+	if err != nil {
 		log.Error(ctx, "Failed to register client", log.ErrAttr(err))
 		conn.Close(websocket.StatusInternalError, "Failed to initialize connection")
-		return nil, err
+		return nil, nil
+	}
+
+	// Other tabs of the user already announced them
+	if presence.InRoom == 1 {
+		s.announcePresence(ctx, room, MemberEventJoined, requestedUserID, fmt.Sprintf("%s joined the room", nickname))
 	}
 
 	heartbeatCtx, cancelHeartbeat := context.WithCancel(ctx)
-	go startHeartbeat(heartbeatCtx, s.redis, client)
+	go s.startHeartbeat(heartbeatCtx, client)
+	go s.monitorMembership(heartbeatCtx, client)
 
+	conn.SetReadLimit(MaxFrameSize)
+
+	writerCtx, cancelWriter := context.WithCancel(ctx)
+	go client.writePump(writerCtx)
+
+	// Canceling the read closes the connection, which is how idle connections are dropped
+	readCtx, cancelRead := context.WithCancel(ctx)
+	defer cancelRead()
+	client.touch()
+	go s.keepAlive(heartbeatCtx, client, cancelRead)
+
+	if !s.addClient(client) {
+		// The shutdown started during the handshake, the read below fails once it's closed
+		client.conn.Close(websocket.StatusGoingAway, "Server is restarting")
+	}
+	telemetry.ActiveConnections.Inc()
+	s.emitEvent(ctx, webhooks.EventMemberJoined, roomID, map[string]string{"user_id": requestedUserID, "nickname": nickname})
 	defer func() {
+		telemetry.ActiveConnections.Dec()
+		s.removeClient(client)
+		s.emitEvent(ctx, webhooks.EventMemberLeft, roomID, map[string]string{"user_id": requestedUserID, "nickname": nickname})
+		cancelWriter()
 		cancelHeartbeat()
-		unregisterClient(ctx, s.redis, client)
-		
-		repositories.UpdateUser(ctx, s.Mongo, repositories.UpdateUserData{
-			UserID:   requestedUserID,
-			Activity: &[]string{"offline"}[0],
-		})
+
+		// The user stays online while another tab or device is connected
+		presence, err := s.broker.ReleaseConnection(ctx, client.userID, client.connectionID, client.roomID)
+		if err != nil {
+			log.Error(ctx, "Failed to unregister client", log.ErrAttr(err))
+		}
+
+		// Dropped as stale before, the monitor announced the leave
+		if err == nil && presence.Released && presence.InRoom == 0 {
+			s.announcePresence(ctx, room, MemberEventLeft, requestedUserID, fmt.Sprintf("%s left the room", nickname))
+			s.unlockOnLeave(ctx, roomID, requestedUserID, nickname)
+		}
+
+		if err == nil && presence.Total > 0 {
+			return
+		}
+
+		s.store.SetUserActivity(ctx, requestedUserID, "offline")
 	}()
 
-	pubsub := s.redis.Subscribe(ctx, roomID)
-	defer pubsub.Close()
+	subscription := s.broker.Subscribe(ctx, roomID)
+	defer subscription.Close()
 
-	go func() {
-		historyKey := fmt.Sprintf("room:%s:history", roomID)
-		messages, err := s.redis.ZRevRangeByScore(ctx, historyKey, &redis.ZRangeBy{
-			Min: "-inf",
-			Max: "+inf",
-			Count: 50, 
-		}).Result()
-		
-		if err == nil && len(messages) > 0 {
-			for i := len(messages) - 1; i >= 0; i-- {
-				var msg ChatMessage
-				if err := json.Unmarshal([]byte(messages[i]), &msg); err != nil {
-					continue
+	// Clients that cache the messages on their own can skip the replay
+	if historyCount > 0 {
+		go func() {
+			replayed, err := s.recentMessages(ctx, roomID, historyCount)
+			if err != nil {
+				log.Error(ctx, "Failed to get the messages to replay",
+					log.AnyAttr("room_id", roomID),
+					log.ErrAttr(err))
+				return
+			}
+
+			if len(replayed) > 0 {
+				// A single frame for the whole replay compresses far better than a frame per message
+				if batchHistory {
+					replayed = []ChatMessage{{
+						Type:      HistoryMessage,
+						RoomId:    roomID,
+						Timestamp: time.Now(),
+						Messages:  replayed,
+					}}
+				}
+
+				for _, msg := range replayed {
+					if !s.enqueue(ctx, client, msg) {
+						s.disconnectSlowClient(ctx, client)
+						return
+					}
 				}
-				
-				client.mu.Lock()
-				wsjson.Write(ctx, conn, msg)
-				client.mu.Unlock()
 			}
-		}
-	}()
+		}()
+	}
 
 	go func() {
-		ch := pubsub.Channel()
-		for msg := range ch {
+		for payload := range subscription.Messages() {
 			var chatMsg ChatMessage
-			if err := json.Unmarshal([]byte(msg.Payload), &chatMsg); err != nil {
+			if err := json.Unmarshal(payload, &chatMsg); err != nil {
 				log.Error(ctx, "Failed to unmarshal message", log.ErrAttr(err))
 				continue
 			}
 			
-			if chatMsg.SenderId == requestedUserID && 
-			   chatMsg.Type != SystemMessage &&
-			   chatMsg.Metadata != nil && 
-			   chatMsg.Metadata["connectionID"] == connectionID {
+			// The sending connection already got the ack, other connections of the user get the message
+			if chatMsg.SenderId == requestedUserID &&
+				chatMsg.Type != SystemMessage &&
+				chatMsg.Metadata[senderConnectionKey] == connectionID {
 				continue
 			}
+			delete(chatMsg.Metadata, senderConnectionKey)
 			
-			client.mu.Lock()
-			err := wsjson.Write(ctx, conn, chatMsg)
-			client.mu.Unlock()
+			if chatMsg.Type == SystemMessage &&
+				chatMsg.Metadata["event"] == MemberEventRemoved &&
+				chatMsg.Metadata["user_id"] == requestedUserID {
+				s.disconnectNonMember(ctx, client)
+				return
+			}
 
-			if err != nil {
-				log.Error(ctx, "Failed to send message to client", log.ErrAttr(err))
+			if !s.enqueue(ctx, client, chatMsg) {
+				s.disconnectSlowClient(ctx, client)
 				return
 			}
 		}
@@ -312,102 +869,312 @@ func (s *Service) WebSocket(w http.ResponseWriter, r *http.Request) (interface{}
 
 	// Handle WebSocket messages
 	for {
-		var message ChatMessage
-		err := wsjson.Read(ctx, conn, &message)
+		frameType, data, err := conn.Read(readCtx)
 		if err != nil {
-			if websocket.CloseStatus(err) != websocket.StatusNormalClosure {
+			if websocket.CloseStatus(err) == websocket.StatusMessageTooBig || strings.Contains(err.Error(), "read limited") {
+				log.Warn(ctx, "Closing connection sending an oversized frame",
+					log.AnyAttr("user_id", requestedUserID),
+					log.AnyAttr("limit", MaxFrameSize))
+			} else if websocket.CloseStatus(err) != websocket.StatusNormalClosure {
 				log.Error(ctx, "Error reading message", log.ErrAttr(err))
 			}
-			return nil, err
+			return nil, nil
+		}
+		client.touch()
+
+		// A malformed message is the client's bug, it's reported without dropping the connection
+		message, errKey, detail := decodeClientMessage(frameType, data)
+		if errKey != "" {
+			s.enqueue(ctx, client, ChatMessage{
+				Type:      SystemMessage,
+				Content:   fmt.Sprintf("%s: %s", constants.ErrorMessages[errKey].Message, detail),
+				RoomId:    roomID,
+				Timestamp: time.Now(),
+				Metadata:  map[string]interface{}{"error_id": constants.ErrorMessages[errKey].ID},
+			})
+			continue
 		}
 
 		if len(message.Content) > MaxMessageLen {
-			client.mu.Lock()
-			wsjson.Write(ctx, conn, ChatMessage{
+			s.enqueue(ctx, client, ChatMessage{
 				Type:      SystemMessage,
 				Content:   fmt.Sprintf("Message exceeds maximum length of %d characters", MaxMessageLen),
 				RoomId:    roomID,
 				Timestamp: time.Now(),
 			})
-			client.mu.Unlock()
 			continue
 		}
 
-		canSend, timeToWait := deps.CheckAndUpdateMessageRateLimit(ctx, s.redis, requestedUserID, MessageDelay)
-		if !canSend {
-			broadcastMessage(ctx, s.redis, ChatMessage{
+		if message.Type == AttachmentMessage {
+			attachment, ok := s.validAttachment(ctx, roomID, message.Metadata)
+			if !ok {
+				s.enqueue(ctx, client, ChatMessage{
+					Type:      SystemMessage,
+					Content:   constants.ErrorMessages[constants.InvalidAttachment].Message,
+					RoomId:    roomID,
+					Timestamp: time.Now(),
+				})
+				continue
+			}
+			message.Metadata["attachment"] = attachment
+		}
+
+		if muted := s.muteRemaining(ctx, roomID, requestedUserID); muted > 0 {
+			s.enqueue(ctx, client, ChatMessage{
 				Type:      SystemMessage,
-				Content:   fmt.Sprintf("Please wait %.1f seconds before sending another message", timeToWait),
+				Content:   fmt.Sprintf("You are muted in this room for %s", muted),
 				RoomId:    roomID,
 				Timestamp: time.Now(),
+				Metadata:  map[string]interface{}{"error_id": constants.ErrorMessages[constants.UserMuted].ID, "remaining_seconds": int(muted.Seconds())},
 			})
 			continue
 		}
-		
+
+		// Resends only get the stored message back, the limits don't apply to them
+		resend := s.isResend(ctx, requestedUserID, message.Metadata)
+
 		// Check room lock status
-		room, err := repositories.GetRooms(ctx, s.Mongo, repositories.GetRoomData{
-			RoomID: roomID,
-		})
-		if err != nil {
+		room, err := s.store.GetRoom(ctx, roomID)
+		if err != nil && !errors.Is(err, repositories.ErrRoomNotFound) {
 			log.Error(ctx, "Failed to check room lock status", log.ErrAttr(err))
 			continue
 		}
 
-		// If the room is locked by this user, unlock it when they send any message
-		if room.LockedBy == requestedUserID {
-			collection := s.Mongo.Collection(constants.RoomsCollection)
-			_, err = collection.UpdateOne(ctx,
-				bson.M{"_id": roomID},
-				bson.M{"$set": bson.M{"lockedBy": ""}})
-			if err != nil {
-				log.Error(ctx, "Failed to unlock room", log.ErrAttr(err))
-				continue
-			}
+		// Membership is only checked at connect, the user could have been removed since
+		if room == nil || !isRoomMember(room, requestedUserID) {
+			s.disconnectNonMember(ctx, client)
+			return nil, nil
+		}
+
+		locked, err := s.checkRoomLock(ctx, room, requestedUserID, nickname)
+		if err != nil {
+			continue
+		}
 
-			// Broadcast unlock message
-			s.broadcastToRoom(ctx, roomID, ChatMessage{
+		// Check if user can send message
+		if locked {
+			s.enqueue(ctx, client, ChatMessage{
 				Type:      SystemMessage,
-				Content:   fmt.Sprintf("Room has been unlocked by %s", nickname),
+				Content:   constants.ErrorMessages[constants.RoomLocked].Message,
 				RoomId:    roomID,
 				Timestamp: time.Now(),
 			})
+			continue
 		}
 
-		// Check if user can send message
-		if room.LockedBy != "" && room.LockedBy != requestedUserID {
-			client.mu.Lock()
-			wsjson.Write(ctx, conn, ChatMessage{
+		if !canSendToRoom(room, client.admin) {
+			s.enqueue(ctx, client, ChatMessage{
 				Type:      SystemMessage,
-				Content:   "Room is locked. Messages cannot be sent.",
+				Content:   constants.ErrorMessages[constants.AnnouncementRoom].Message,
 				RoomId:    roomID,
 				Timestamp: time.Now(),
 			})
-			client.mu.Unlock()
 			continue
 		}
 
-		message.Timestamp = time.Now()
-		message.SenderId = requestedUserID
-		message.Nickname = nickname
-		message.RoomId = roomID
-
-		// Broadcast message using Redis
-		s.broadcastToRoom(ctx, roomID, message)
-	}
-}
+		if maintenance, _ := deps.IsMaintenanceMode(ctx, s.broker); maintenance {
+			s.enqueue(ctx, client, ChatMessage{
+				Type:      SystemMessage,
+				Content:   constants.ErrorMessages[constants.MaintenanceMode].Message,
+				RoomId:    roomID,
+				Timestamp: time.Now(),
+			})
+			continue
+		}
 
-// @summary Register User to Room
-// @description Adds a user to a chat room. Creates new user if needed. Returns existing room if user already registered.
-// @tags rooms,users
-// @router /api/v1/rooms/{roomId}/register-user [post]
+		if wait := s.slowModeRemaining(ctx, room, requestedUserID, client.admin); wait > 0 && !resend {
+			s.enqueue(ctx, client, ChatMessage{
+				Type:      SystemMessage,
+				Content:   fmt.Sprintf("Slow mode is on, wait %d seconds before sending another message", int(math.Ceil(wait.Seconds()))),
+				RoomId:    roomID,
+				Timestamp: time.Now(),
+				Metadata:  map[string]interface{}{"error_id": constants.ErrorMessages[constants.SlowModeActive].ID, "retry_after_seconds": math.Ceil(wait.Seconds())},
+			})
+			continue
+		}
+
+		canSend, timeToWait := true, 0.0
+		if !resend {
+			canSend, timeToWait = deps.CheckAndUpdateMessageRateLimit(ctx, s.broker, requestedUserID, MessageDelay, s.rateLimitTTL())
+		}
+		if !canSend {
+			telemetry.RateLimitRejections.Inc()
+			s.enqueue(ctx, client, ChatMessage{
+				Type:      SystemMessage,
+				Content:   fmt.Sprintf("Please wait %.1f seconds before sending another message", timeToWait),
+				RoomId:    roomID,
+				Timestamp: time.Now(),
+			})
+			continue
+		}
+
+		if !s.moderateMessage(room, &message) {
+			s.enqueue(ctx, client, ChatMessage{
+				Type:      SystemMessage,
+				Content:   constants.ErrorMessages[constants.MessageRejected].Message,
+				RoomId:    roomID,
+				Timestamp: time.Now(),
+			})
+			continue
+		}
+
+		message.Timestamp = time.Now()
+		message.SenderId = requestedUserID
+		message.Nickname = nickname
+		message.Verified = client.verified
+		message.RoomId = roomID
+
+		// Tag the message so this connection doesn't receive its own echo
+		clientMetadata := message.Metadata
+		message.Metadata = withSenderConnection(clientMetadata, connectionID)
+
+		// Broadcast message using Redis
+		sent, duplicate := s.sendMessage(ctx, roomID, message)
+		if sent.RoomId == "" {
+			// The first send is still being stored, its ack is on the way
+			continue
+		}
+
+		s.acknowledge(ctx, client, sent, clientMetadata)
+		if !duplicate {
+			s.recordSlowMode(ctx, room, requestedUserID, client.admin)
+			sent.Metadata = clientMetadata
+			s.emitEvent(ctx, webhooks.EventMessageCreated, roomID, sent)
+		}
+	}
+}
+
+// senderConnectionKey is the metadata key tagging a message with the connection that sent
+// it, so that connection skips the echo. It's removed before the message reaches clients.
+const senderConnectionKey = "connectionID"
+
+// withSenderConnection returns a copy of the metadata tagged with the sending connection,
+// leaving the client's metadata untouched
+func withSenderConnection(metadata map[string]interface{}, connectionID string) map[string]interface{} {
+	tagged := make(map[string]interface{}, len(metadata)+1)
+	for key, value := range metadata {
+		tagged[key] = value
+	}
+	tagged[senderConnectionKey] = connectionID
+
+	return tagged
+}
+
+// clientMessageTypes are the message types clients can send over the WebSocket.
+// System and event messages are only sent by the server.
+var clientMessageTypes = []MessageType{TextMessage, AttachmentMessage}
+
+// decodeClientMessage parses a message sent by a client over the WebSocket. Clients
+// send JSON text frames shaped like:
+//
+//	{"type": "text", "content": "hello", "metadata": {}}
+//
+// The type defaults to text, which requires a content. Attachments are described
+// by their metadata. On error, the constants key and a description for the client
+// are returned.
+func decodeClientMessage(frameType websocket.MessageType, data []byte) (ChatMessage, string, string) {
+	var message ChatMessage
+
+	if frameType != websocket.MessageText {
+		return message, constants.InvalidMessageFormat, "binary frames are not supported"
+	}
+
+	if err := json.Unmarshal(data, &message); err != nil {
+		return message, constants.InvalidMessageFormat, jsonErrorDetail(err)
+	}
+
+	if message.Type == "" {
+		message.Type = TextMessage
+	}
+
+	if !slices.Contains(clientMessageTypes, message.Type) {
+		return message, constants.UnsupportedMessageType, fmt.Sprintf("%q, expected one of %q", message.Type, clientMessageTypes)
+	}
+
+	if message.Type == TextMessage && strings.TrimSpace(message.Content) == "" {
+		return message, constants.InvalidMessageFormat, "content is required"
+	}
+
+	return message, "", ""
+}
+
+// jsonErrorDetail describes a JSON decoding error without echoing the Go types
+func jsonErrorDetail(err error) string {
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return fmt.Sprintf("invalid JSON at offset %d", syntaxErr.Offset)
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		if typeErr.Field == "" {
+			return "expected a JSON object"
+		}
+		return fmt.Sprintf("%s must be %s", typeErr.Field, jsonTypeName(typeErr.Type.Kind().String()))
+	}
+
+	return "invalid JSON"
+}
+
+// jsonTypeName names a Go kind the way JSON does
+func jsonTypeName(kind string) string {
+	switch kind {
+	case "map", "struct":
+		return "an object"
+	case "slice", "array":
+		return "an array"
+	case "bool":
+		return "a boolean"
+	case "string":
+		return "a string"
+	default:
+		return "a number"
+	}
+}
+
+// @summary Create Room
+// @description Creates a room with a server-generated ID and registers the user to it, the authenticated user when user_id is unset. The only way to create rooms when chat.server_room_ids is on.
+// @tags rooms,users
+// @router /api/v1/rooms [post]
+// @param body body RegisterUserBody true "User information for registration"
+// @produce application/json
+// @success 201 {object} RoomDetails "Room created with the user registered"
+// @failure 400 {object} Error "Bad request or invalid input"
+// @failure 403 {object} Error "User ID doesn't match the authenticated user"
+// @failure 429 {object} Error "The API client created too many rooms, details.retry_after_seconds tells when to retry"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) CreateRoom(ctx context.Context, b io.ReadCloser, caller Caller) (interface{}, Error) {
+	defer b.Close()
+
+	var body RegisterUserBody
+	if err := json.NewDecoder(b).Decode(&body); err != nil {
+		log.Error(ctx, "Failed to decode RegisterUserBody", log.ErrAttr(err))
+		return nil, newError(constants.FailedToDecodeBody)
+	}
+
+	// Creating the room as the authenticated user, who exists already
+	if body.UserID == "" {
+		body.UserID = caller.UserID
+	}
+
+	// Random UUIDs can't be guessed or squatted by other clients
+	return s.registerUser(ctx, body, uuid.NewString(), caller, true)
+}
+
+// @summary Register User to Room
+// @description Adds a user to a chat room. Creates new user if needed. Returns existing room if user already registered. Creates the room when it doesn't exist, unless chat.server_room_ids is on.
+// @tags rooms,users
+// @router /api/v1/rooms/{roomId}/register-user [post]
 // @param roomId path string true "Room ID (required)"
 // @param body body RegisterUserBody true "User information for registration"
 // @produce application/json
-// @success 200 {object} repositories.Room "User successfully registered to room"
+// @success 200 {object} RoomDetails "User successfully registered to room"
 // @failure 400 {object} Error "Bad request or invalid input"
+// @failure 403 {object} Error "User ID doesn't match the authenticated user, or rooms must be created with POST /rooms"
 // @failure 404 {object} Error "Room not found"
+// @failure 429 {object} Error "The API client created too many rooms, details.retry_after_seconds tells when to retry"
 // @failure 500 {object} Error "Internal server error"
-func (s *Service) RegisterUser(c context.Context, b io.ReadCloser, db *mongo.Database, roomID string) (interface{}, Error) {
+func (s *Service) RegisterUser(c context.Context, b io.ReadCloser, roomID string, caller Caller) (interface{}, Error) {
 	var body RegisterUserBody
 	err := json.NewDecoder(b).Decode(&body)
 	if err != nil {
@@ -422,30 +1189,32 @@ func (s *Service) RegisterUser(c context.Context, b io.ReadCloser, db *mongo.Dat
 			}
 		}
 
-		return nil, newError("failed_decode_body")
+		return nil, newError(constants.FailedToDecodeBody)
 	}
 	defer b.Close()
 
+	return s.registerUser(c, body, roomID, caller, false)
+}
+
+// registerUser adds the user to the room, creating the room when it doesn't exist. Rooms with
+// client supplied IDs can't be created when chat.server_room_ids is on.
+func (s *Service) registerUser(c context.Context, body RegisterUserBody, roomID string, caller Caller, generatedID bool) (interface{}, Error) {
+	if body.UserID != "" && !caller.CanActAs(body.UserID) {
+		log.Warn(c, "Rejected registration on behalf of another user",
+			log.AnyAttr("user_id", caller.UserID),
+			log.AnyAttr("target_user_id", body.UserID))
+		return nil, newError(constants.UserIDMismatch)
+	}
+
 	// Check if user exists
 	var user *repositories.User
+	var err error
 	if body.UserID != "" {
-		user, err = repositories.GetUser(c, db, repositories.GetUserData{
-			UserID: body.UserID,
-		})
+		user, err = s.store.GetUser(c, body.UserID)
 	}
 
 	if err != nil {
-		if svcErr := NewServiceError(err.Error()); svcErr != nil {
-			if serviceErr, ok := svcErr.(ServiceError); ok {
-				return nil, Error{
-					ErrorMessage: &serviceErr.Message,
-					ErrorID:      &serviceErr.ID,
-					ErrorCode:    &serviceErr.Code,
-				}
-			}
-		}
-
-		return nil, newError("failed_to_get_user")
+		return nil, newError(repositories.ErrorKey(err))
 	}
 
 	var userID string
@@ -456,42 +1225,25 @@ func (s *Service) RegisterUser(c context.Context, b io.ReadCloser, db *mongo.Dat
 		userID = body.UserID
 	} else {
 		// Create new user
-		newUser, err := repositories.CreateUser(c, db, repositories.CreateUserData{
+		userID, err = s.store.CreateUser(c, repositories.CreateUserData{
 			Nickname: body.Nickname,
 		})
 
 		if err != nil {
 			log.Error(c, "Failed to create user", log.ErrAttr(err))
-			return nil, newError("failed_to_create_user")
-		}
-
-		// Safely convert ObjectID to string
-		if oid, ok := newUser.InsertedID.(primitive.ObjectID); ok {
-			userID = oid.Hex()
-		} else {
-			log.Error(c, "Invalid InsertedID type", log.AnyAttr("type", fmt.Sprintf("%T", newUser.InsertedID)))
-			return nil, newError("failed_to_create_user")
+			return nil, newError(constants.FailedToCreateUser)
 		}
 	}
 
 	// Check if user is already registered in the room
-	existingRoom, err := repositories.GetRooms(c, db, repositories.GetRoomData{
-		RoomID: roomID,
-	})
+	existingRoom, err := s.store.GetRoom(c, roomID)
+	if errors.Is(err, repositories.ErrRoomNotFound) {
+		existingRoom, err = nil, nil
+	}
 
 	if err != nil {
 		log.Error(c, constants.ErrorMessages[constants.FailedToCheckExistingRoom].Message, log.ErrAttr(err))
-		if svcErr := NewServiceError(err.Error()); svcErr != nil {
-			if serviceErr, ok := svcErr.(ServiceError); ok {
-				return nil, Error{
-					ErrorMessage: &serviceErr.Message,
-					ErrorID:      &serviceErr.ID,
-					ErrorCode:    &serviceErr.Code,
-				}
-			}
-		}
-
-		return nil, newError("failed_to_check_existing_room")
+		return nil, newError(repositories.ErrorKey(err))
 	}
 
 	if existingRoom != nil {
@@ -501,57 +1253,177 @@ func (s *Service) RegisterUser(c context.Context, b io.ReadCloser, db *mongo.Dat
 				log.Info(c, "User rejoining existing room",
 					log.AnyAttr("room_id", roomID),
 					log.AnyAttr("user_id", body.UserID))
-				return existingRoom, Error{}
+				return newRoomDetails(existingRoom), Error{}
 			}
 		}
 	}
 
+	if existingRoom == nil {
+		if s.deps.Config.Chat.ServerRoomIDs && !generatedID {
+			log.Warn(c, "Rejected room creation with a client supplied ID", log.AnyAttr("room_id", roomID))
+			return nil, newError(constants.ClientRoomIDsDisabled)
+		}
+
+		if svcErr := s.checkRoomCreationLimit(c, roomID); svcErr.ErrorMessage != nil {
+			return nil, svcErr
+		}
+	}
+
 	// Register new user in room
-	_, err = repositories.CreateRoom(c, db, repositories.CreateRoomData{
+	err = s.store.CreateRoom(c, repositories.CreateRoomData{
 		UserID:   userID,
 		RoomID:   roomID,
 		Nickname: body.Nickname,
+		ClientID: middleware.RequestClientID(c),
 	})
 
 	if err != nil {
 		log.Error(c, constants.ErrorMessages[constants.FailedToCreateOrUpdateRoom].Message, log.ErrAttr(err))
-		if svcErr := NewServiceError(err.Error()); svcErr != nil {
-			if serviceErr, ok := svcErr.(ServiceError); ok {
-				return nil, Error{
-					ErrorMessage: &serviceErr.Message,
-					ErrorID:      &serviceErr.ID,
-					ErrorCode:    &serviceErr.Code,
-				}
-			}
-		}
-
-		return nil, newError("failed_to_create_or_update_room")
+		return nil, newError(repositories.ErrorKey(err))
 	}
 
 	// Get the updated room to return
-	updatedRoom, err := repositories.GetRooms(c, db, repositories.GetRoomData{
-		RoomID: roomID,
-	})
+	updatedRoom, err := s.store.GetRoom(c, roomID)
 	if err != nil {
 		log.Error(c, "Failed to get updated room", log.ErrAttr(err))
-		if svcErr := NewServiceError(err.Error()); svcErr != nil {
-			if serviceErr, ok := svcErr.(ServiceError); ok {
-				return nil, Error{
-					ErrorMessage: &serviceErr.Message,
-					ErrorID:      &serviceErr.ID,
-					ErrorCode:    &serviceErr.Code,
-				}
-			}
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	return newRoomDetails(updatedRoom), Error{}
+}
+
+// @summary Create Room Invite
+// @description Creates an invite code that lets users join the room on their own with POST /rooms/join, optionally expiring or limited to a number of uses. Requires the admin key.
+// @tags rooms
+// @router /api/v1/rooms/{roomId}/invites [post]
+// @param roomId path string true "Room ID (required)"
+// @param X-Admin-Key header string true "Admin key"
+// @param body body CreateInviteBody true "Invite expiry and maximum uses"
+// @produce application/json
+// @success 201 {object} InviteDetails "Invite created"
+// @failure 400 {object} Error "Bad request or negative expiry or uses"
+// @failure 404 {object} Error "Room not found"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) CreateInvite(ctx context.Context, roomID string, b io.ReadCloser) (interface{}, Error) {
+	defer b.Close()
+
+	var body CreateInviteBody
+	if err := json.NewDecoder(b).Decode(&body); err != nil {
+		log.Error(ctx, "Failed to decode CreateInviteBody", log.ErrAttr(err))
+		return nil, newError(constants.FailedToDecodeBody)
+	}
+
+	if body.ExpiresIn < 0 || body.MaxUses < 0 {
+		return nil, newError(constants.InvalidInvite)
+	}
+
+	if _, err := repositories.GetRoom(ctx, s.Mongo, repositories.GetRoomData{RoomID: roomID}); err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	code, err := generateInviteCode()
+	if err != nil {
+		log.Error(ctx, "Failed to generate invite code", log.ErrAttr(err))
+		return nil, newError(constants.FailedToCreateInvite)
+	}
+
+	data := repositories.CreateInviteData{
+		Code:    code,
+		RoomID:  roomID,
+		MaxUses: body.MaxUses,
+	}
+	if body.ExpiresIn > 0 {
+		expiresAt := time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+		data.ExpiresAt = &expiresAt
+	}
+
+	invite, err := repositories.CreateInvite(ctx, s.Mongo, data)
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	return InviteDetails{Invite: *invite, RemainingUses: invite.RemainingUses()}, Error{}
+}
+
+// @summary Join Room With Invite
+// @description Registers the user to the room of the invite code, like POST /rooms/{roomId}/register-user, using one of the invite uses. Members rejoining don't use the invite.
+// @tags rooms,users
+// @router /api/v1/rooms/join [post]
+// @param body body JoinRoomBody true "Invite code and user information"
+// @produce application/json
+// @success 200 {object} RoomDetails "User registered to the room"
+// @failure 400 {object} Error "Bad request or missing code"
+// @failure 403 {object} Error "User ID doesn't match the authenticated user"
+// @failure 404 {object} Error "Invite or room not found"
+// @failure 410 {object} Error "Invite expired or has no uses left"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) JoinRoom(ctx context.Context, b io.ReadCloser, caller Caller) (interface{}, Error) {
+	defer b.Close()
+
+	var body JoinRoomBody
+	if err := json.NewDecoder(b).Decode(&body); err != nil {
+		log.Error(ctx, "Failed to decode JoinRoomBody", log.ErrAttr(err))
+		return nil, newError(constants.FailedToDecodeBody)
+	}
+
+	if body.Code == "" {
+		return nil, newError(constants.InviteCodeRequired)
+	}
+
+	// Joining as the authenticated user, who exists already
+	if body.UserID == "" {
+		body.UserID = caller.UserID
+	}
+
+	if body.UserID != "" && !caller.CanActAs(body.UserID) {
+		return nil, newError(constants.UserIDMismatch)
+	}
+
+	invite, err := s.store.CheckInvite(ctx, body.Code)
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	// The room was deleted since, it isn't created again
+	room, err := s.store.GetRoom(ctx, invite.RoomID)
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	registration := RegisterUserBody{UserID: body.UserID, Nickname: body.Nickname}
+	if body.UserID != "" && isRoomMember(room, body.UserID) {
+		return s.registerUser(ctx, registration, room.ID, caller, false)
+	}
+
+	if _, err := s.store.UseInvite(ctx, body.Code); err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	result, svcErr := s.registerUser(ctx, registration, room.ID, caller, false)
+	if svcErr.ErrorMessage != nil {
+		if err := s.store.ReleaseInvite(ctx, body.Code); err != nil {
+			log.Error(ctx, "Failed to release invite use", log.ErrAttr(err), log.AnyAttr("room_id", room.ID))
 		}
+		return nil, svcErr
+	}
+
+	log.Info(ctx, "User joined room with invite", log.AnyAttr("room_id", room.ID))
 
-		return nil, newError("failed_to_get_updated_room")
+	return result, Error{}
+}
+
+// generateInviteCode returns a random invite code with 96 bits of entropy
+func generateInviteCode() (string, error) {
+	code := make([]byte, 12)
+	if _, err := rand.Read(code); err != nil {
+		return "", err
 	}
 
-	return updatedRoom, Error{}
+	return hex.EncodeToString(code), nil
 }
 
 // @summary Lock or Unlock Room
-// @description Controls the lock status of a chat room. Locks room for exclusive use by a user or unlocks if already locked by same user.
+// @description Controls the lock status of a chat room. Locks room for exclusive use by a user or unlocks if already locked by same user. Locks expire after the lock TTL, or once their holder's last connection to the room closes.
 // @tags rooms
 // @router /api/v1/rooms/{roomId}/lock [post]
 // @param roomId path string true "Room ID (required)"
@@ -561,8 +1433,9 @@ func (s *Service) RegisterUser(c context.Context, b io.ReadCloser, db *mongo.Dat
 // @failure 400 {object} Error "Bad request or missing required fields"
 // @failure 403 {object} Error "User not authorized to lock room"
 // @failure 404 {object} Error "Room not found"
+// @failure 409 {object} Error "Room already locked by another user"
 // @failure 500 {object} Error "Internal server error"
-func (s *Service) LockRoom(c context.Context, b io.ReadCloser, roomID string) (interface{}, Error) {
+func (s *Service) LockRoom(c context.Context, b io.ReadCloser, roomID string, caller Caller) (interface{}, Error) {
 	var body LockRoomBody
 	err := json.NewDecoder(b).Decode(&body)
 	if err != nil {
@@ -577,7 +1450,7 @@ func (s *Service) LockRoom(c context.Context, b io.ReadCloser, roomID string) (i
 			}
 		}
 
-		return nil, newError("failed_to_decode_body")
+		return nil, newError(constants.FailedToDecodeBody)
 	}
 	defer b.Close()
 
@@ -592,24 +1465,19 @@ func (s *Service) LockRoom(c context.Context, b io.ReadCloser, roomID string) (i
 			}
 		}
 
-		return nil, newError("user_id_required")
+		return nil, newError(constants.UserIDRequired)
 	}
 
-	room, err := repositories.GetRooms(c, s.Mongo, repositories.GetRoomData{
-		RoomID: roomID,
-	})
-	if err != nil {
-		if svcErr := NewServiceError(err.Error()); svcErr != nil {
-			if serviceErr, ok := svcErr.(ServiceError); ok {
-				return nil, Error{
-					ErrorMessage: &serviceErr.Message,
-					ErrorID:      &serviceErr.ID,
-					ErrorCode:    &serviceErr.Code,
-				}
-			}
-		}
+	if !caller.CanActAs(body.UserID) {
+		log.Warn(c, "Rejected room lock on behalf of another user",
+			log.AnyAttr("user_id", caller.UserID),
+			log.AnyAttr("target_user_id", body.UserID))
+		return nil, newError(constants.UserIDMismatch)
+	}
 
-		return nil, newError("failed_to_get_room")
+	room, err := s.store.GetRoom(c, roomID)
+	if err != nil && !errors.Is(err, repositories.ErrRoomNotFound) {
+		return nil, newError(repositories.ErrorKey(err))
 	}
 
 	if room == nil {
@@ -623,18 +1491,14 @@ func (s *Service) LockRoom(c context.Context, b io.ReadCloser, roomID string) (i
 			}
 		}
 
-		return nil, newError("room_not_found")
+		return nil, newError(constants.RoomNotFound)
 	}
 
-	userAuthorized := false
-	for _, user := range room.Users {
-		if user.ID == body.UserID {
-			userAuthorized = true
-			break
-		}
+	if len(room.Users) == 0 {
+		return nil, newError(constants.RoomHasNoMembers)
 	}
 
-	if !userAuthorized {
+	if !isRoomMember(room, body.UserID) {
 		if svcErr := NewServiceError(constants.UserNotAuthorizedToLockRoom); svcErr != nil {
 			if serviceErr, ok := svcErr.(ServiceError); ok {
 				return nil, Error{
@@ -645,87 +1509,52 @@ func (s *Service) LockRoom(c context.Context, b io.ReadCloser, roomID string) (i
 			}
 		}
 
-		return nil, newError("user_not_authorized_to_lock_room")
-	}
-
-	collection := s.Mongo.Collection(constants.RoomsCollection)
-	_, err = collection.UpdateOne(c,
-		bson.M{"_id": roomID},
-		bson.M{"$set": bson.M{"lockedBy": body.UserID}})
-	if err != nil {
-		if svcErr := NewServiceError(err.Error()); svcErr != nil {
-			if serviceErr, ok := svcErr.(ServiceError); ok {
-				return nil, Error{
-					ErrorMessage: &serviceErr.Message,
-					ErrorID:      &serviceErr.ID,
-					ErrorCode:    &serviceErr.Code,
-				}
-			}
-		}
-
-		return nil, newError("failed_to_lock_room")
-	}
-
-	roomToLock, err := repositories.GetRooms(c, s.Mongo, repositories.GetRoomData{
-		RoomID: roomID,
-	})
-	if err != nil {
-		if svcErr := NewServiceError(err.Error()); svcErr != nil {
-			if serviceErr, ok := svcErr.(ServiceError); ok {
-				return nil, Error{
-					ErrorMessage: &serviceErr.Message,
-					ErrorID:      &serviceErr.ID,
-					ErrorCode:    &serviceErr.Code,
-				}
-			}
-		}
-
-		return nil, newError("failed_to_get_room_to_lock")
+		return nil, newError(constants.UserNotAuthorizedToLockRoom)
 	}
 
 	userNickname := ""
-	for _, user := range roomToLock.Users {
+	for _, user := range room.Users {
 		if user.ID == body.UserID {
 			userNickname = user.Nickname
 		}
 	}
 
-	// Check if room is already locked by this user
+	// The lock holder toggles it off. The state read above may be stale, so both transitions
+	// are conditional updates, and only the request that changed the lock announces it.
 	if room.LockedBy == body.UserID {
-		// Unlock the room
-		_, err = collection.UpdateOne(c,
-			bson.M{"_id": roomID},
-			bson.M{"$set": bson.M{"lockedBy": ""}})
+		released, err := s.store.UnlockRoom(c, roomID, body.UserID)
 		if err != nil {
-			if svcErr := NewServiceError(err.Error()); svcErr != nil {
-				if serviceErr, ok := svcErr.(ServiceError); ok {
-					return nil, Error{
-						ErrorMessage: &serviceErr.Message,
-						ErrorID:      &serviceErr.ID,
-						ErrorCode:    &serviceErr.Code,
-					}
-				}
-			}
-
-			return nil, newError("failed_to_unlock_room")
+			return nil, newError(repositories.ErrorKey(err))
 		}
 
-		s.broadcastToRoom(c, roomID, ChatMessage{
-			Type:      SystemMessage,
-			Content:   fmt.Sprintf("Room has been unlocked by %s", userNickname),
-			RoomId:    roomID,
-			Timestamp: time.Now(),
-		})
+		if released {
+			s.announceUnlocked(c, roomID, body.UserID, fmt.Sprintf("Room has been unlocked by %s", userNickname))
+		}
 
 		return map[string]string{"status": "room unlocked"}, Error{}
 	}
 
+	if s.lockExpired(room) {
+		s.expireRoomLock(c, room)
+	}
+
+	locked, err := s.store.LockRoom(c, roomID, body.UserID)
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	if !locked {
+		return nil, newError(constants.RoomLockedByAnother)
+	}
+
 	s.broadcastToRoom(c, roomID, ChatMessage{
 		Type:      SystemMessage,
 		Content:   fmt.Sprintf("Room has been locked by %s", userNickname),
 		RoomId:    roomID,
 		Timestamp: time.Now(),
 	})
+	s.emitEvent(c, webhooks.EventRoomLocked, roomID, map[string]string{"user_id": body.UserID})
+	s.publishRoomUpdate(c, roomID, map[string]interface{}{"locked_by": body.UserID})
 
 	return map[string]string{"status": "room locked"}, Error{}
 }
@@ -737,41 +1566,27 @@ func (s *Service) LockRoom(c context.Context, b io.ReadCloser, roomID string) (i
 // @param roomId path string true "Room ID (required)"
 // @param page query integer false "Page number (default: 1)" minimum(1)
 // @param limit query integer false "Items per page (default: 50)" minimum(1) maximum(100)
+// @param cursor query string false "Opaque cursor from the X-Next-Cursor header of the previous page. Takes precedence over page"
 // @produce application/json
+// @param meta query boolean false "Set to true to answer a ListPage envelope listing the messages in data, with the total count"
 // @success 200 {array} ChatMessage "Messages retrieved successfully"
+// @header 200 {string} X-Next-Cursor "Cursor of the next page, absent on the last page"
 // @failure 400 {object} Error "Bad request or missing room ID"
 // @failure 404 {object} Error "Room not found"
 // @failure 500 {object} Error "Internal server error"
-func (s *Service) GetMessages(ctx context.Context, query GetMessagesQuery) ([]ChatMessage, Error) {
+func (s *Service) GetMessages(ctx context.Context, query GetMessagesQuery) (MessagesList, Error) {
 	if query.RoomID == "" {
-		if svcErr := NewServiceError(constants.RoomIDRequired); svcErr != nil {
-			if serviceErr, ok := svcErr.(ServiceError); ok {
-				return nil, Error{
-					ErrorMessage: &serviceErr.Message,
-					ErrorID:      &serviceErr.ID,
-					ErrorCode:    &serviceErr.Code,
-				}
-			}
-		}
+		return MessagesList{}, newError(constants.RoomIDRequired)
 	}
 
-	room, err := repositories.GetRoom(ctx, s.Mongo, repositories.GetRoomData{
-		RoomID: query.RoomID,
-	})
-	if err != nil {
-		if svcErr := NewServiceError(err.Error()); svcErr != nil {
-			if serviceErr, ok := svcErr.(ServiceError); ok {
-				return nil, Error{
-					ErrorMessage: &serviceErr.Message,
-					ErrorID:      &serviceErr.ID,
-					ErrorCode:    &serviceErr.Code,
-				}
-			}
-		}
+	// A missing room is a 404, any other failure to get it a 500
+	room, err := s.store.GetRoom(ctx, query.RoomID)
+	if err != nil && !errors.Is(err, repositories.ErrRoomNotFound) {
+		return MessagesList{}, newError(constants.FailedToGetRooms)
 	}
 
 	if room == nil {
-		return nil, newError("room_not_found")
+		return MessagesList{}, newError(constants.RoomNotFound)
 	}
 
 	page := 1
@@ -790,363 +1605,3382 @@ func (s *Service) GetMessages(ctx context.Context, query GetMessagesQuery) ([]Ch
 	}
 
 	skip := int64((page - 1) * limit)
-	cursor, err := repositories.GetMessages(ctx, s.Mongo, repositories.GetMessagesData{
-		RoomID: query.RoomID,
-		Limit:  int64(limit),
-		Skip:   skip,
+	var before *time.Time
+	var beforeID primitive.ObjectID
+	if query.Cursor != "" {
+		pageCursor, err := pagination.Decode(query.Cursor, s.cursorSecrets()...)
+		if err != nil || pageCursor.Scope != query.RoomID {
+			return MessagesList{}, newError(constants.InvalidCursor)
+		}
+
+		// The cursors issued before the ID was added only have the time
+		if pageCursor.ID != "" {
+			beforeID, err = primitive.ObjectIDFromHex(pageCursor.ID)
+			if err != nil {
+				return MessagesList{}, newError(constants.InvalidCursor)
+			}
+		}
+
+		skip = 0
+		before = &pageCursor.SortValue
+	}
+
+	stored, err := s.store.GetMessages(ctx, repositories.GetMessagesData{
+		RoomID:   query.RoomID,
+		Limit:    int64(limit),
+		Skip:     skip,
+		Before:   before,
+		BeforeID: beforeID,
 	})
 	if err != nil {
-		if svcErr := NewServiceError(err.Error()); svcErr != nil {
-			if serviceErr, ok := svcErr.(ServiceError); ok {
-				return nil, Error{
-					ErrorMessage: &serviceErr.Message,
-					ErrorID:      &serviceErr.ID,
-					ErrorCode:    &serviceErr.Code,
-				}
-			}
+		return MessagesList{}, newError(constants.FailedToGetMessages)
+	}
+
+	// Never nil, an empty room answers [] rather than null
+	messages := make([]ChatMessage, len(stored))
+	for i, msg := range stored {
+		messages[i] = newChatMessage(msg)
+	}
+
+	nextCursor := ""
+	if len(messages) == limit {
+		last := messages[len(messages)-1]
+		nextCursor, err = pagination.Encode(pagination.Cursor{
+			Scope:     query.RoomID,
+			SortValue: last.Timestamp,
+			ID:        last.ID,
+			Direction: "desc",
+		}, s.cursorSecrets()[0])
+		if err != nil {
+			log.Error(ctx, "Failed to encode messages cursor", log.ErrAttr(err))
 		}
+	}
 
-		return nil, newError("failed_to_get_messages")
+	var total int64
+	if query.Count {
+		total, err = s.store.CountMessages(ctx, query.RoomID)
+		if err != nil {
+			return MessagesList{}, newError(constants.FailedToGetMessages)
+		}
 	}
-	defer cursor.Close(ctx)
 
-	var messages []ChatMessage
-	for cursor.Next(ctx) {
-		var msg repositories.Message
-		if err := cursor.Decode(&msg); err != nil {
-			log.Error(ctx, "Failed to decode message", log.ErrAttr(err))
-			continue
+	return MessagesList{
+		Messages:   messages,
+		NextCursor: nextCursor,
+		Total:      total,
+		Page:       page,
+		Limit:      limit,
+	}, Error{}
+}
+
+// checkRoomLock runs before a user sends a message to the room. The lock holder
+// sending any message unlocks the room, anyone else is locked out.
+func (s *Service) checkRoomLock(ctx context.Context, room *repositories.Room, userID string, nickname string) (bool, error) {
+	if room.LockedBy == "" {
+		return false, nil
+	}
+
+	if room.LockedBy != userID {
+		// Checked here too, so a room isn't kept locked until the next monitor run
+		if s.lockExpired(room) {
+			s.expireRoomLock(ctx, room)
+			return false, nil
 		}
+		return true, nil
+	}
 
-		messages = append(messages, ChatMessage{
-			Type:      TextMessage,
-			Content:   msg.Message,
-			RoomId:    msg.RoomID,
-			Nickname:  msg.Nickname,
-			SenderId:  msg.FromUserID,
-			Timestamp: msg.CreatedAt,
-		})
+	// An explicit unlock may have released it meanwhile, then it was already announced
+	released, err := s.store.UnlockRoom(ctx, room.ID, userID)
+	if err != nil {
+		log.Error(ctx, "Failed to unlock room", log.ErrAttr(err))
+		return false, err
 	}
 
-	return messages, Error{}
+	if !released {
+		return false, nil
+	}
+
+	s.announceUnlocked(ctx, room.ID, userID, fmt.Sprintf("Room has been unlocked by %s", nickname))
+
+	return false, nil
 }
 
-func (s *Service) UpdateUser(ctx context.Context, ID string, body io.ReadCloser) (interface{}, Error) {
-	defer body.Close()
+// lockTTL is how long a room stays locked unless its holder unlocks it sooner
+func (s *Service) lockTTL() time.Duration {
+	return time.Duration(s.deps.Config.Chat.LockTTL) * time.Second
+}
 
-	var user repositories.UpdateUserData
-	err := json.NewDecoder(body).Decode(&user)
+// lockExpired tells whether the room lock outlived the lock TTL. The locks taken before the
+// lock time was tracked are expired right away.
+func (s *Service) lockExpired(room *repositories.Room) bool {
+	return room.LockedBy != "" && (room.LockedAt == nil || time.Since(*room.LockedAt) > s.lockTTL())
+}
+
+// expireRoomLock releases the room lock once it outlived the lock TTL, and tells the room.
+// Every instance may try to, only the one releasing it announces it.
+func (s *Service) expireRoomLock(ctx context.Context, room *repositories.Room) {
+	released, err := s.store.ExpireRoomLock(ctx, room.ID, room.LockedBy, time.Now().Add(-s.lockTTL()))
 	if err != nil {
-		log.Error(ctx, constants.ErrorMessages[constants.FailedToDecodeBody].Message, log.ErrAttr(err))
-		if svcErr := NewServiceError(constants.FailedToDecodeBody); svcErr != nil {
-			if serviceErr, ok := svcErr.(ServiceError); ok {
-				return nil, Error{
-					ErrorMessage: &serviceErr.Message,
-					ErrorID:      &serviceErr.ID,
-					ErrorCode:    &serviceErr.Code,
-				}
-			}
-		}
+		log.Error(ctx, "Failed to expire room lock", log.ErrAttr(err), log.AnyAttr("room_id", room.ID))
+		return
+	}
 
-		return nil, newError("failed_to_decode_body")
+	if !released {
+		return
 	}
 
-	user.UserID = ID
+	s.announceUnlocked(ctx, room.ID, room.LockedBy, "Room lock has expired")
+}
 
-	result, err := repositories.UpdateUser(ctx, s.Mongo, user)
+// expireRoomLocks releases the locks that outlived the lock TTL, it runs with the connections monitor
+func (s *Service) expireRoomLocks(ctx context.Context) {
+	rooms, err := s.store.GetRoomsWithExpiredLocks(ctx, time.Now().Add(-s.lockTTL()))
 	if err != nil {
-		log.Error(ctx, constants.ErrorMessages[constants.FailedToUpdateUser].Message, log.ErrAttr(err))
-		if svcErr := NewServiceError(constants.FailedToUpdateUser); svcErr != nil {
-			if serviceErr, ok := svcErr.(ServiceError); ok {
-				return nil, Error{
-					ErrorMessage: &serviceErr.Message,
-					ErrorID:      &serviceErr.ID,
-					ErrorCode:    &serviceErr.Code,
-				}
-			}
-		}
+		log.Error(ctx, "Failed to get rooms with expired locks", log.ErrAttr(err))
+		return
+	}
 
-		return nil, newError("failed_to_update_user")
+	for i := range rooms {
+		s.expireRoomLock(ctx, &rooms[i])
 	}
+}
 
-	return result, Error{}
+// unlockOnLeave releases the user's lock on the room once their last connection to it is
+// closed, so a user who disconnects doesn't keep the room locked
+func (s *Service) unlockOnLeave(ctx context.Context, roomID string, userID string, nickname string) {
+	released, err := s.store.UnlockRoom(ctx, roomID, userID)
+	if err != nil {
+		log.Error(ctx, "Failed to release the lock of the leaving user", log.ErrAttr(err), log.AnyAttr("room_id", roomID))
+		return
+	}
+
+	if !released {
+		return
+	}
+
+	s.announceUnlocked(ctx, roomID, userID, fmt.Sprintf("Room has been unlocked as %s left", nickname))
 }
 
-// @summary Get Room Details
-// @description Returns detailed information about a specific chat room by ID
-// @tags rooms
-// @router /api/v1/rooms/{roomId} [get]
-// @param roomId path string true "Room ID (required)"
-// @produce application/json
-// @success 200 {object} RoomDetails "Room details retrieved successfully"
-// @failure 400 {object} Error "Bad request"
-// @failure 404 {object} Error "Room not found"
-// @failure 500 {object} Error "Internal server error"
-func (s *Service) GetRoom(ctx context.Context, roomID string) (RoomDetails, Error) {
-	room, err := repositories.GetRoom(ctx, s.Mongo, repositories.GetRoomData{
-		RoomID: roomID,
+// announceUnlocked tells the room and the webhooks that the user's lock was released
+func (s *Service) announceUnlocked(ctx context.Context, roomID string, userID string, content string) {
+	s.broadcastToRoom(ctx, roomID, ChatMessage{
+		Type:      SystemMessage,
+		Content:   content,
+		RoomId:    roomID,
+		Timestamp: time.Now(),
 	})
+	s.emitEvent(ctx, webhooks.EventRoomUnlocked, roomID, map[string]string{"user_id": userID})
+	s.publishRoomUpdate(ctx, roomID, map[string]interface{}{"locked_by": ""})
+}
 
-	if err != nil {
-		if svcErr := NewServiceError(err.Error()); svcErr != nil {
-			if serviceErr, ok := svcErr.(ServiceError); ok {
-				return RoomDetails{}, Error{
-					ErrorMessage: &serviceErr.Message,
-					ErrorID:      &serviceErr.ID,
-					ErrorCode:    &serviceErr.Code,
-				}
-			}
-		}
+// moderateMessage applies the banned words filter to the message, when enabled for the room.
+// In mask mode the banned words are masked in place, in reject mode it returns false
+// when the message has banned words.
+func (s *Service) moderateMessage(room *repositories.Room, message *ChatMessage) bool {
+	if s.moderation == nil {
+		return true
+	}
 
-		return RoomDetails{}, newError("failed_to_get_room")
+	enabled := s.deps.Config.Moderation.Enabled
+	if room.Settings.ProfanityFilter != nil {
+		enabled = *room.Settings.ProfanityFilter
+	}
 
+	if !enabled {
+		return true
 	}
 
-	if room == nil {
-		return RoomDetails{}, newError("room_not_found")
+	if s.deps.Config.Moderation.Mode == moderation.ModeReject {
+		return !s.moderation.Contains(message.Content)
 	}
 
-	return RoomDetails{
-		RoomId:    room.ID,
-		Users:     room.Users,
-		LockedBy:  &room.LockedBy,
-		CreatedAt: room.CreatedAt,
-		UpdatedAt: room.UpdatedAt,
-	}, Error{}
+	message.Content = s.moderation.Mask(message.Content)
+	return true
 }
 
-// @summary List All Chat Rooms
-// @description Returns a paginated list of all available chat rooms with their users and status
+// @summary Update Room Settings
+// @description Updates the room settings, overriding the chat config for the room. Only the set fields are updated. Requires the admin key.
 // @tags rooms
-// @router /api/v1/rooms [get]
-// @param page query integer false "Page number (default: 1)" minimum(1)
-// @param limit query integer false "Items per page (default: 50)" minimum(1) maximum(100)
+// @router /api/v1/rooms/{roomId}/settings [patch]
+// @param roomId path string true "Room ID (required)"
+// @param body body RoomSettingsBody true "Settings to update"
 // @produce application/json
-// @success 200 {object} RoomsList "List of chat rooms retrieved successfully"
-// @failure 400 {object} Error "Bad request"
-// @failure 401 {object} Error "Unauthorized"
+// @success 200 {object} RoomDetails "Room updated"
+// @param X-Admin-Key header string true "Admin key"
+// @failure 400 {object} Error "Bad request, negative windows or unknown mode"
+// @failure 403 {object} Error "Missing admin key"
+// @failure 404 {object} Error "Room not found"
 // @failure 500 {object} Error "Internal server error"
-func (s *Service) GetRooms(ctx context.Context, query GetRoomsQuery) (RoomsList, Error) {
-	page := 1
-	limit := 50
+func (s *Service) UpdateRoomSettings(ctx context.Context, roomID string, caller Caller, b io.ReadCloser) (interface{}, Error) {
+	defer b.Close()
 
-	if query.PageStr != "" {
-		if p, err := strconv.Atoi(query.PageStr); err == nil && p > 0 {
-			page = p
-		}
+	var body RoomSettingsBody
+	if err := json.NewDecoder(b).Decode(&body); err != nil {
+		log.Error(ctx, "Failed to decode RoomSettingsBody", log.ErrAttr(err))
+		return nil, newError(constants.FailedToDecodeBody)
 	}
 
-	if query.LimitStr != "" {
-		if l, err := strconv.Atoi(query.LimitStr); err == nil && l > 0 {
-			limit = l
-		}
+	if body.Tags != nil {
+		tags := normalizeTags(*body.Tags)
+		body.Tags = &tags
 	}
 
-	cursor, err := repositories.GetRoomsCursor(ctx, s.Mongo, repositories.GetRoomsCursorData{
-		Limit: int64(limit),
-		Skip:  int64((page - 1) * limit),
-	})
-	if err != nil {
-		if svcErr := NewServiceError(err.Error()); svcErr != nil {
-			if serviceErr, ok := svcErr.(ServiceError); ok {
-				return RoomsList{}, Error{
-					ErrorMessage: &serviceErr.Message,
-					ErrorID:      &serviceErr.ID,
-					ErrorCode:    &serviceErr.Code,
-				}
-			}
-		}
+	// The settings moderate the room, so members can't change them
+	if !caller.Admin {
+		log.Warn(ctx, "Rejected room settings change without the admin key",
+			log.AnyAttr("room_id", roomID),
+			log.AnyAttr("user_id", caller.UserID))
+		return nil, newError(constants.InvalidAdminKey)
+	}
 
-		return RoomsList{}, newError("failed_to_get_rooms")
+	if (body.EditWindow != nil && *body.EditWindow < 0) || (body.DeleteWindow != nil && *body.DeleteWindow < 0) {
+		return nil, newError(constants.InvalidMessageWindow)
 	}
 
-	var rooms []repositories.Room
-	for cursor.Next(ctx) {
-		var room repositories.Room
-		if err := cursor.Decode(&room); err != nil {
-			log.Error(ctx, "Failed to decode room", log.ErrAttr(err))
-			continue
-		}
+	if body.Mode != nil && *body.Mode != repositories.RoomModeOpen && *body.Mode != repositories.RoomModeAnnouncement {
+		return nil, newError(constants.InvalidRoomMode)
+	}
 
-		rooms = append(rooms, room)
+	if err := repositories.UpdateRoomSettings(ctx, s.Mongo, repositories.UpdateRoomSettingsData{
+		RoomID:           roomID,
+		ProfanityFilter:  body.ProfanityFilter,
+		Tags:             body.Tags,
+		EditWindow:       body.EditWindow,
+		DeleteWindow:     body.DeleteWindow,
+		PresenceMessages: body.PresenceMessages,
+		Mode:             body.Mode,
+	}); err != nil {
+		return nil, newError(repositories.ErrorKey(err))
 	}
 
-	responseRooms := []RoomListDetails{}
-	for _, room := range rooms {
-		responseUsers := []RoomListUser{}
-		for _, user := range room.Users {
-			responseUsers = append(responseUsers, RoomListUser{
-				Id:       user.ID,
-				Nickname: user.Nickname,
-			})
-		}
+	room, err := repositories.GetRoom(ctx, s.Mongo, repositories.GetRoomData{RoomID: roomID})
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
 
-		responseRooms = append(responseRooms, RoomListDetails{
-			RoomID:    room.ID,
-			Users:     responseUsers,
-			LockedBy:  &room.LockedBy,
-			CreatedAt: room.CreatedAt,
-			UpdatedAt: room.UpdatedAt,
-		})
+	s.publishRoomUpdate(ctx, roomID, map[string]interface{}{"settings": room.Settings, "mode": roomMode(room)})
+
+	return newRoomDetails(room), Error{}
+}
+
+// roomMode returns the mode of the room, the rooms without one are open
+func roomMode(room *repositories.Room) string {
+	if room.Mode == "" {
+		return repositories.RoomModeOpen
 	}
 
-	return RoomsList{
-		Rooms: responseRooms,
-	}, Error{}
+	return room.Mode
 }
 
-// broadcastToRoom sends a message to all clients in a room by:
-// 1. Saving the message to MongoDB for persistence
-// 2. Publishing the message to Redis for real-time distribution
-func (s *Service) broadcastToRoom(ctx context.Context, roomID string, message ChatMessage) {
-	// Save message to MongoDB
-	_, err := repositories.CreateMessage(ctx, s.Mongo, repositories.CreateMessageData{
-		RoomID:     message.RoomId,
-		Message:    message.Content,
-		FromUserID: message.SenderId,
-		Nickname:   message.Nickname,
-	})
+// canSendToRoom tells whether messages can be sent to the room, only admins send to
+// announcement rooms
+func canSendToRoom(room *repositories.Room, admin bool) bool {
+	return admin || roomMode(room) != repositories.RoomModeAnnouncement
+}
 
-	if err != nil {
-		log.Error(ctx, "Failed to save message to database",
-			log.AnyAttr("room_id", roomID),
-			log.AnyAttr("error", err))
+// checkRoomCreationLimit records a room created by the request's API client, rejecting it
+// when the client already created its limit of rooms over the window. Requests made with
+// the configured API key share the default limit.
+func (s *Service) checkRoomCreationLimit(ctx context.Context, roomID string) Error {
+	clientID, tier := "default", ""
+	if client, ok := ctx.Value(middleware.ClientContextKey).(*repositories.Client); ok {
+		clientID, tier = client.ID, client.Tier
 	}
 
-	// Publish message to Redis channel
-	messageJSON, err := json.Marshal(message)
-	if err != nil {
-		log.Error(ctx, "Failed to marshal message",
-			log.AnyAttr("room_id", roomID),
-			log.AnyAttr("error", err))
-		return
+	cfg := s.deps.Config.RoomCreation
+	limit := cfg.LimitFor(tier)
+	if limit == 0 {
+		return Error{}
 	}
 
-	err = s.redis.Publish(ctx, roomID, messageJSON).Err()
-	if err != nil {
-		log.Error(ctx, "Failed to publish message to Redis",
-			log.AnyAttr("room_id", roomID),
-			log.AnyAttr("error", err))
+	allowed, retryAfter := deps.CheckAndRecordRoomCreation(ctx, s.broker, clientID, roomID, limit, time.Duration(cfg.Window)*time.Second)
+	if allowed {
+		return Error{}
 	}
+
+	log.Warn(ctx, "Client reached the room creation limit",
+		log.AnyAttr("client_id", clientID),
+		log.AnyAttr("tier", tier),
+		log.AnyAttr("limit", limit),
+		log.AnyAttr("window_seconds", cfg.Window),
+		log.AnyAttr("room_id", roomID))
+
+	svcErr := newError(constants.RoomCreationLimited)
+	svcErr.Details = map[string]interface{}{"retry_after_seconds": math.Ceil(retryAfter.Seconds())}
+	return svcErr
 }
 
-func newError(errKey string) Error {
-	errMsg := constants.ErrorMessages[errKey]
-	return Error{
-		ErrorMessage: &errMsg.Message,
-		ErrorID:      &errMsg.ID,
-		ErrorCode:    &errMsg.Code,
+// normalizeTags lowercases and trims the tags, dropping the blank and repeated ones
+func normalizeTags(tags []string) []string {
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" && !slices.Contains(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
 	}
-}
 
-func registerClient(ctx context.Context, redis *redis.Client, client *Client) error {
-	clientKey := fmt.Sprintf("client:%s", client.userID)
-	roomKey := fmt.Sprintf("room:%s:members", client.roomID)
-	
-	pipe := redis.Pipeline()
-	
-	pipe.HSet(ctx, clientKey, map[string]interface{}{
-		"roomID": client.roomID,
-		"nickname": client.nickname,
-		"connectionID": client.connectionID,
-		"lastSeen": time.Now().Unix(),
-	})
-	pipe.Expire(ctx, clientKey, 24*time.Hour)
-	
-	pipe.SAdd(ctx, roomKey, client.userID)
-	pipe.Expire(ctx, roomKey, 24*time.Hour)
-	
-	pipe.SAdd(ctx, "users:online", client.userID)
-	
-	_, err := pipe.Exec(ctx)
-	return err
+	return normalized
 }
 
-func unregisterClient(ctx context.Context, redis *redis.Client, client *Client) error {
-	clientKey := fmt.Sprintf("client:%s", client.userID)
-	roomKey := fmt.Sprintf("room:%s:members", client.roomID)
-	
-	pipe := redis.Pipeline()
-	pipe.Del(ctx, clientKey)
-	pipe.SRem(ctx, roomKey, client.userID)
-	pipe.SRem(ctx, "users:online", client.userID)
-	
-	_, err := pipe.Exec(ctx)
-	return err
-}
+// @summary Send Message
+// @description Sends a text message to the room as the authenticated user, with the same checks as the WebSocket
+// @tags messages,rooms
+// @router /api/v1/rooms/{roomId}/messages [post]
+// @param roomId path string true "Room ID (required)"
+// @param body body SendMessageBody true "Message content and optional metadata"
+// @produce application/json
+// @success 201 {object} ChatMessage "Message sent"
+// @failure 400 {object} Error "Empty or too long message"
+// @failure 403 {object} Error "User is not a member of the room, or the room is an announcement room and the caller isn't an admin"
+// @failure 404 {object} Error "Room not found"
+// @failure 423 {object} Error "Room is locked by another user, details.locked_by tells who"
+// @failure 429 {object} Error "Rate limited, or slowed down by the room slow mode"
+// @failure 503 {object} Error "Maintenance mode"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) SendMessage(ctx context.Context, roomID string, caller Caller, b io.ReadCloser) (interface{}, Error) {
+	defer b.Close()
+	userID := caller.UserID
 
-func heartbeat(ctx context.Context, redis *redis.Client, userID string) error {
-	clientKey := fmt.Sprintf("client:%s", userID)
-	return redis.HSet(ctx, clientKey, "lastSeen", time.Now().Unix()).Err()
-}
+	var body SendMessageBody
+	if err := json.NewDecoder(b).Decode(&body); err != nil {
+		log.Error(ctx, "Failed to decode SendMessageBody", log.ErrAttr(err))
+		return nil, newError(constants.FailedToDecodeBody)
+	}
 
-func startHeartbeat(ctx context.Context, redis *redis.Client, client *Client) {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-	
-	for {
-		select {
-		case <-ticker.C:
-			heartbeat(ctx, redis, client.userID)
-		case <-ctx.Done():
-			return
-		}
+	if strings.TrimSpace(body.Content) == "" {
+		return nil, newError(constants.MessageRequired)
 	}
-}
 
-func broadcastMessage(ctx context.Context, redisClient *redis.Client, message ChatMessage) error {
-	message.Metadata = map[string]interface{}{
-		"timestamp": time.Now().Unix(),
+	if len(body.Content) > MaxMessageLen {
+		return nil, newError(constants.MessageTooLong)
 	}
-	
-	payload, err := json.Marshal(message)
+
+	room, err := s.store.GetRoom(ctx, roomID)
 	if err != nil {
-		return err
+		return nil, newError(repositories.ErrorKey(err))
 	}
-	
-	if err := redisClient.Publish(ctx, message.RoomId, payload).Err(); err != nil {
-		return err
+
+	if errKey := membershipError(room, userID); errKey != "" {
+		return nil, newError(errKey)
+	}
+
+	// Sent under the member nickname, like over the WebSocket
+	nickname, _ := memberNickname(room, userID)
+
+	if maintenance, _ := deps.IsMaintenanceMode(ctx, s.broker); maintenance {
+		return nil, newError(constants.MaintenanceMode)
+	}
+
+	locked, err := s.checkRoomLock(ctx, room, userID, nickname)
+	if err != nil {
+		return nil, newError(constants.FailedToCreateOrUpdateRoom)
+	}
+
+	if locked {
+		lockedBy := map[string]interface{}{"user_id": room.LockedBy}
+		if nickname, ok := memberNickname(room, room.LockedBy); ok {
+			lockedBy["nickname"] = nickname
+		}
+
+		svcErr := newError(constants.RoomLocked)
+		svcErr.Details = map[string]interface{}{"locked_by": lockedBy}
+		return nil, svcErr
+	}
+
+	if !canSendToRoom(room, caller.Admin) {
+		return nil, newError(constants.AnnouncementRoom)
+	}
+
+	if muted := s.muteRemaining(ctx, roomID, userID); muted > 0 {
+		svcErr := newError(constants.UserMuted)
+		svcErr.Details = map[string]interface{}{"remaining_seconds": int(muted.Seconds())}
+		return nil, svcErr
+	}
+
+	// Resends only get the stored message back, the limits don't apply to them
+	resend := s.isResend(ctx, userID, body.Metadata)
+
+	if wait := s.slowModeRemaining(ctx, room, userID, caller.Admin); wait > 0 && !resend {
+		svcErr := newError(constants.SlowModeActive)
+		svcErr.Details = map[string]interface{}{"retry_after_seconds": math.Ceil(wait.Seconds())}
+		return nil, svcErr
+	}
+
+	canSend, timeToWait := true, 0.0
+	if !resend {
+		canSend, timeToWait = deps.CheckAndUpdateMessageRateLimit(ctx, s.broker, userID, MessageDelay, s.rateLimitTTL())
+	}
+	if !canSend {
+		telemetry.RateLimitRejections.Inc()
+		svcErr := newError(constants.RateLimited)
+		svcErr.Details = map[string]interface{}{"retry_after_seconds": timeToWait}
+		return nil, svcErr
+	}
+
+	message := ChatMessage{
+		Type:      TextMessage,
+		Content:   body.Content,
+		RoomId:    roomID,
+		SenderId:  userID,
+		Nickname:  nickname,
+		Verified:  s.isVerified(ctx, userID),
+		Timestamp: time.Now(),
+		Metadata:  body.Metadata,
+	}
+
+	if !s.moderateMessage(room, &message) {
+		return nil, newError(constants.MessageRejected)
+	}
+
+	sent, duplicate := s.sendMessage(ctx, roomID, message)
+	if sent.RoomId == "" {
+		// The first send is still being stored
+		return message, Error{}
+	}
+
+	if !duplicate {
+		s.recordSlowMode(ctx, room, userID, caller.Admin)
+		s.emitEvent(ctx, webhooks.EventMessageCreated, roomID, sent)
+	}
+
+	return sent, Error{}
+}
+
+// @summary Purge Messages
+// @description Soft-deletes the room messages sent by a user, within a time range or containing a text, and tells the connected clients which messages were deleted. Requires the admin key and confirm set to true.
+// @tags messages,rooms
+// @router /api/v1/rooms/{roomId}/messages/purge [post]
+// @param roomId path string true "Room ID (required)"
+// @param X-Admin-Key header string true "Admin key"
+// @param body body PurgeMessagesBody true "Purge criteria and confirmation"
+// @produce application/json
+// @success 200 {object} PurgeMessagesResult "Messages purged"
+// @failure 400 {object} Error "Missing criteria, or purge not confirmed with details.matched telling how many messages match"
+// @failure 403 {object} Error "Invalid admin key"
+// @failure 404 {object} Error "Room not found"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) PurgeMessages(ctx context.Context, roomID string, b io.ReadCloser) (interface{}, Error) {
+	defer b.Close()
+
+	var body PurgeMessagesBody
+	if err := json.NewDecoder(b).Decode(&body); err != nil {
+		log.Error(ctx, "Failed to decode PurgeMessagesBody", log.ErrAttr(err))
+		return nil, newError(constants.FailedToDecodeBody)
+	}
+
+	if body.UserID == "" && body.From == nil && body.To == nil && strings.TrimSpace(body.Text) == "" {
+		return nil, newError(constants.PurgeCriteriaRequired)
+	}
+
+	if _, err := s.store.GetRoom(ctx, roomID); err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	data := repositories.PurgeMessagesData{
+		RoomID: roomID,
+		UserID: body.UserID,
+		From:   body.From,
+		To:     body.To,
+		Text:   strings.TrimSpace(body.Text),
+		Limit:  MaxPurgeMessages,
+	}
+
+	if !body.Confirm {
+		matched, err := s.store.CountPurgeableMessages(ctx, data)
+		if err != nil {
+			return nil, newError(repositories.ErrorKey(err))
+		}
+
+		svcErr := newError(constants.PurgeNotConfirmed)
+		svcErr.Details = map[string]interface{}{"matched": matched}
+		return nil, svcErr
+	}
+
+	messageIDs, err := s.store.PurgeMessages(ctx, data)
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	s.purgeHistory(ctx, roomID, messageIDs)
+
+	if len(messageIDs) > 0 {
+		s.publishEvent(ctx, roomID, EventMessagesDeleted, map[string]interface{}{"message_ids": messageIDs})
+	}
+
+	log.Warn(ctx, "Purged messages",
+		log.AnyAttr("room_id", roomID),
+		log.AnyAttr("user_id", body.UserID),
+		log.AnyAttr("purged", len(messageIDs)))
+
+	return PurgeMessagesResult{
+		Purged:     len(messageIDs),
+		MessageIDs: messageIDs,
+		More:       len(messageIDs) == MaxPurgeMessages,
+	}, Error{}
+}
+
+// purgeHistory removes the deleted messages from the room history by their IDs, so they
+// aren't replayed
+func (s *Service) purgeHistory(ctx context.Context, roomID string, messageIDs []string) {
+	if len(messageIDs) == 0 {
+		return
+	}
+
+	entries, err := s.broker.History(ctx, roomID, 0)
+	if err != nil {
+		log.Error(ctx, "Failed to get room history", log.ErrAttr(err))
+		return
+	}
+
+	purged := [][]byte{}
+	for _, entry := range entries {
+		var msg ChatMessage
+		if err := json.Unmarshal(entry, &msg); err != nil {
+			continue
+		}
+
+		if msg.ID != "" && slices.Contains(messageIDs, msg.ID) {
+			purged = append(purged, entry)
+		}
+	}
+
+	if len(purged) == 0 {
+		return
+	}
+
+	if err := s.broker.RemoveHistory(ctx, roomID, purged); err != nil {
+		log.Error(ctx, "Failed to purge room history", log.ErrAttr(err))
+	}
+}
+
+// editHistory replaces the message in the live history with its edited content, so the
+// clients connecting later replay it edited
+func (s *Service) editHistory(ctx context.Context, edited *repositories.Message) {
+	entries, err := s.broker.History(ctx, edited.RoomID, 0)
+	if err != nil {
+		log.Error(ctx, "Failed to get room history", log.ErrAttr(err))
+		return
+	}
+
+	messageID := edited.ID.Hex()
+	for _, entry := range entries {
+		var msg ChatMessage
+		if err := json.Unmarshal(entry, &msg); err != nil || msg.ID != messageID {
+			continue
+		}
+
+		msg.Content = edited.Message
+		if msg.Metadata == nil {
+			msg.Metadata = map[string]interface{}{}
+		}
+		msg.Metadata["edited_at"] = edited.EditedAt
+
+		replacement, err := json.Marshal(msg)
+		if err != nil {
+			log.Error(ctx, "Failed to marshal edited message", log.ErrAttr(err))
+			return
+		}
+
+		if err := s.broker.ReplaceHistory(ctx, edited.RoomID, entry, replacement); err != nil {
+			log.Error(ctx, "Failed to replace edited message in room history", log.ErrAttr(err))
+		}
+		return
+	}
+}
+
+// @summary Report Message
+// @description Reports a message of the room to the moderators. A user can report a message only once.
+// @tags messages,rooms
+// @router /api/v1/rooms/{roomId}/messages/{messageId}/report [post]
+// @param roomId path string true "Room ID (required)"
+// @param messageId path string true "Message ID (required)"
+// @param body body ReportMessageBody true "Reason of the report"
+// @produce application/json
+// @success 200 {object} repositories.Report "Report created"
+// @failure 400 {object} Error "Missing or too long reason"
+// @failure 403 {object} Error "User is not a member of the room"
+// @failure 404 {object} Error "Room or message not found"
+// @failure 409 {object} Error "Message already reported by the user"
+// @failure 410 {object} Error "Message was deleted, details.deleted_at tells when"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) ReportMessage(ctx context.Context, roomID string, messageID string, userID string, b io.ReadCloser) (interface{}, Error) {
+	defer b.Close()
+
+	var body ReportMessageBody
+	if err := json.NewDecoder(b).Decode(&body); err != nil {
+		log.Error(ctx, "Failed to decode ReportMessageBody", log.ErrAttr(err))
+		return nil, newError(constants.FailedToDecodeBody)
+	}
+
+	reason := strings.TrimSpace(body.Reason)
+	if reason == "" || len(reason) > MaxReportReasonLen {
+		return nil, newError(constants.ReportReasonRequired)
+	}
+
+	if svcErr := s.checkRoomMember(ctx, roomID, userID); svcErr.ErrorMessage != nil {
+		return nil, svcErr
+	}
+
+	if _, err := repositories.GetMessage(ctx, s.Mongo, roomID, messageID); err != nil {
+		return nil, messageError(err)
+	}
+
+	report, err := repositories.CreateReport(ctx, s.Mongo, repositories.CreateReportData{
+		RoomID:     roomID,
+		MessageID:  messageID,
+		ReporterID: userID,
+		Reason:     reason,
+	})
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	log.Info(ctx, "Message reported",
+		log.AnyAttr("room_id", roomID),
+		log.AnyAttr("message_id", messageID),
+		log.AnyAttr("reporter_id", userID))
+
+	return report, Error{}
+}
+
+// @summary Get Reports
+// @description Returns a page of the reports, oldest first, with the reported messages. Requires the admin key.
+// @tags reports
+// @router /api/v1/reports [get]
+// @param X-Admin-Key header string true "Admin key"
+// @param status query string false "Report status: open, dismissed or deleted (default: open)"
+// @param page query integer false "Page number (default: 1)" minimum(1)
+// @param limit query integer false "Items per page (default: 20)" minimum(1) maximum(100)
+// @param meta query boolean false "Set to true to answer a ListPage envelope listing the reports in data"
+// @produce application/json
+// @success 200 {object} ReportsList "Reports"
+// @failure 403 {object} Error "Invalid admin key"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) GetReports(ctx context.Context, query GetReportsQuery) (ReportsList, Error) {
+	page := 1
+	limit := 20
+	status := repositories.ReportStatusOpen
+
+	if query.Status != "" {
+		status = query.Status
+	}
+
+	if query.PageStr != "" {
+		if p, err := strconv.Atoi(query.PageStr); err == nil && p > 0 {
+			page = p
+		}
+	}
+
+	if query.LimitStr != "" {
+		if l, err := strconv.Atoi(query.LimitStr); err == nil && l > 0 && l <= 100 {
+			limit = l
+		}
+	}
+
+	reports, total, err := repositories.GetReports(ctx, s.Mongo, repositories.GetReportsData{
+		Status: status,
+		Limit:  int64(limit),
+		Skip:   int64((page - 1) * limit),
+	})
+	if err != nil {
+		return ReportsList{}, newError(repositories.ErrorKey(err))
+	}
+
+	// Fetch the reported messages with a query per room
+	roomMessageIDs := map[string][]string{}
+	for _, report := range reports {
+		roomMessageIDs[report.RoomID] = append(roomMessageIDs[report.RoomID], report.MessageID)
+	}
+
+	messages := map[string]ChatMessage{}
+	for roomID, messageIDs := range roomMessageIDs {
+		roomMessages, err := repositories.GetMessagesByIDs(ctx, s.Mongo, roomID, messageIDs)
+		if err != nil {
+			return ReportsList{}, newError(repositories.ErrorKey(err))
+		}
+		for _, msg := range roomMessages {
+			messages[msg.ID.Hex()] = newChatMessage(msg)
+		}
+	}
+
+	details := make([]ReportDetails, 0, len(reports))
+	for _, report := range reports {
+		detail := ReportDetails{Report: report}
+		if msg, ok := messages[report.MessageID]; ok {
+			detail.Message = &msg
+		}
+		details = append(details, detail)
+	}
+
+	return ReportsList{
+		Reports: details,
+		Total:   total,
+		Page:    page,
+		Limit:   limit,
+	}, Error{}
+}
+
+// @summary Resolve Report
+// @description Resolves the report by dismissing it or deleting the reported message. Every open report of the message is resolved with it. Requires the admin key.
+// @tags reports
+// @router /api/v1/reports/{reportId}/resolve [post]
+// @param reportId path string true "Report ID"
+// @param X-Admin-Key header string true "Admin key"
+// @param body body ResolveReportBody true "Action: dismiss or delete"
+// @produce application/json
+// @success 200 {object} repositories.Report "Report resolved"
+// @failure 400 {object} Error "Invalid action"
+// @failure 403 {object} Error "Invalid admin key"
+// @failure 404 {object} Error "Report not found"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) ResolveReport(ctx context.Context, reportID string, b io.ReadCloser) (interface{}, Error) {
+	defer b.Close()
+
+	var body ResolveReportBody
+	if err := json.NewDecoder(b).Decode(&body); err != nil {
+		log.Error(ctx, "Failed to decode ResolveReportBody", log.ErrAttr(err))
+		return nil, newError(constants.FailedToDecodeBody)
+	}
+
+	if body.Action != ReportActionDismiss && body.Action != ReportActionDelete {
+		return nil, newError(constants.InvalidReportAction)
+	}
+
+	report, err := repositories.GetReport(ctx, s.Mongo, reportID)
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	status := repositories.ReportStatusDismissed
+	if body.Action == ReportActionDelete {
+		status = repositories.ReportStatusDeleted
+
+		if svcErr := s.deleteReportedMessage(ctx, report.RoomID, report.MessageID); svcErr.ErrorMessage != nil {
+			return nil, svcErr
+		}
+	}
+
+	if err := repositories.ResolveReports(ctx, s.Mongo, report.RoomID, report.MessageID, status); err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	log.Warn(ctx, "Report resolved",
+		log.AnyAttr("report_id", reportID),
+		log.AnyAttr("message_id", report.MessageID),
+		log.AnyAttr("status", status))
+
+	resolved, err := repositories.GetReport(ctx, s.Mongo, reportID)
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	return resolved, Error{}
+}
+
+// @summary Edit Message
+// @description Replaces the content of a message. Only its sender can edit it, within the edit window of the room.
+// @tags messages,rooms
+// @router /api/v1/rooms/{roomId}/messages/{messageId} [patch]
+// @param roomId path string true "Room ID (required)"
+// @param messageId path string true "Message ID (required)"
+// @param body body EditMessageBody true "New message content"
+// @produce application/json
+// @success 200 {object} ChatMessage "Message edited"
+// @failure 400 {object} Error "Empty, too long or rejected content"
+// @failure 403 {object} Error "Not the sender, or the edit window expired"
+// @failure 404 {object} Error "Message not found"
+// @failure 410 {object} Error "Message was deleted, details.deleted_at tells when"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) EditMessage(ctx context.Context, roomID string, messageID string, userID string, b io.ReadCloser) (interface{}, Error) {
+	defer b.Close()
+
+	var body EditMessageBody
+	if err := json.NewDecoder(b).Decode(&body); err != nil {
+		log.Error(ctx, "Failed to decode EditMessageBody", log.ErrAttr(err))
+		return nil, newError(constants.FailedToDecodeBody)
+	}
+
+	if strings.TrimSpace(body.Content) == "" {
+		return nil, newError(constants.MessageRequired)
+	}
+
+	if len(body.Content) > MaxMessageLen {
+		return nil, newError(constants.MessageTooLong)
+	}
+
+	room, err := s.store.GetRoom(ctx, roomID)
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	msg, err := s.store.GetMessage(ctx, roomID, messageID)
+	if err != nil {
+		return nil, messageError(err)
+	}
+
+	if msg.FromUserID != userID {
+		return nil, newError(constants.NotMessageSender)
+	}
+
+	editWindow, _ := s.messageWindows(room)
+	if !withinWindow(msg.CreatedAt, editWindow) {
+		return nil, newError(constants.EditWindowExpired)
+	}
+
+	message := ChatMessage{Content: body.Content}
+	if !s.moderateMessage(room, &message) {
+		return nil, newError(constants.MessageRejected)
+	}
+
+	edited, err := s.store.EditMessage(ctx, roomID, messageID, message.Content)
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	s.editHistory(ctx, edited)
+
+	s.publishEvent(ctx, roomID, EventMessageEdited, map[string]interface{}{
+		"message_id": messageID,
+		"content":    edited.Message,
+		"edited_at":  edited.EditedAt,
+	})
+
+	return newChatMessage(*edited), Error{}
+}
+
+// @summary Delete Message
+// @description Deletes a message. Its sender can delete it within the delete window of the room, admins can delete any message at any time.
+// @tags messages,rooms
+// @router /api/v1/rooms/{roomId}/messages/{messageId} [delete]
+// @param roomId path string true "Room ID (required)"
+// @param messageId path string true "Message ID (required)"
+// @param X-Admin-Key header string false "Admin key, to delete other users' messages"
+// @produce application/json
+// @success 200 {object} map[string]string "Message deleted"
+// @failure 403 {object} Error "Not the sender, or the delete window expired"
+// @failure 404 {object} Error "Message not found"
+// @failure 410 {object} Error "Message was deleted, details.deleted_at tells when"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) DeleteMessage(ctx context.Context, roomID string, messageID string, caller Caller) (interface{}, Error) {
+	msg, err := s.store.GetMessage(ctx, roomID, messageID)
+	if err != nil {
+		return nil, messageError(err)
+	}
+
+	if !caller.CanActAs(msg.FromUserID) {
+		return nil, newError(constants.NotMessageSender)
+	}
+
+	if !caller.Admin {
+		room, err := s.store.GetRoom(ctx, roomID)
+		if err != nil {
+			return nil, newError(repositories.ErrorKey(err))
+		}
+
+		if _, deleteWindow := s.messageWindows(room); !withinWindow(msg.CreatedAt, deleteWindow) {
+			return nil, newError(constants.DeleteWindowExpired)
+		}
+	}
+
+	if svcErr := s.deleteMessage(ctx, msg); svcErr.ErrorMessage != nil {
+		return nil, svcErr
+	}
+
+	return map[string]string{"message": "Message deleted successfully"}, Error{}
+}
+
+// messageError maps a message lookup error. A deleted message is gone, with the time
+// it was deleted in the details.
+func messageError(err error) Error {
+	svcErr := newError(repositories.ErrorKey(err))
+
+	var deleted repositories.DeletedMessageError
+	if errors.As(err, &deleted) {
+		svcErr.Details = map[string]interface{}{"deleted_at": deleted.DeletedAt}
+	}
+
+	return svcErr
+}
+
+// @summary Get Message
+// @description Returns a message of the room by its ID
+// @tags messages,rooms
+// @router /api/v1/rooms/{roomId}/messages/{messageId} [get]
+// @param roomId path string true "Room ID (required)"
+// @param messageId path string true "Message ID (required)"
+// @produce application/json
+// @success 200 {object} ChatMessage "Message"
+// @failure 403 {object} Error "User is not a member of the room"
+// @failure 404 {object} Error "Message not found"
+// @failure 410 {object} Error "Message was deleted, details.deleted_at tells when"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) GetMessage(ctx context.Context, roomID string, messageID string, userID string) (interface{}, Error) {
+	if svcErr := s.checkRoomMember(ctx, roomID, userID); svcErr.ErrorMessage != nil {
+		return nil, svcErr
+	}
+
+	msg, err := s.store.GetMessage(ctx, roomID, messageID)
+	if err != nil {
+		return nil, messageError(err)
+	}
+
+	return newChatMessage(*msg), Error{}
+}
+
+// messageWindows returns how long after sending them senders can edit and delete
+// their messages in the room, 0 when unlimited
+func (s *Service) messageWindows(room *repositories.Room) (time.Duration, time.Duration) {
+	editWindow := s.deps.Config.Chat.EditWindowSeconds()
+	if room.Settings.EditWindow != nil {
+		editWindow = *room.Settings.EditWindow
+	}
+
+	deleteWindow := s.deps.Config.Chat.DeleteWindow
+	if room.Settings.DeleteWindow != nil {
+		deleteWindow = *room.Settings.DeleteWindow
+	}
+
+	return time.Duration(editWindow) * time.Second, time.Duration(deleteWindow) * time.Second
+}
+
+// withinWindow tells whether a message sent at the given time can still be changed
+func withinWindow(sentAt time.Time, window time.Duration) bool {
+	return window == 0 || time.Since(sentAt) <= window
+}
+
+// deleteReportedMessage deletes the message and removes it from the room history.
+// A message already deleted is not an error, so its reports can still be resolved.
+func (s *Service) deleteReportedMessage(ctx context.Context, roomID string, messageID string) Error {
+	msg, err := repositories.GetMessage(ctx, s.Mongo, roomID, messageID)
+	if err != nil {
+		var deleted repositories.DeletedMessageError
+		if errors.Is(err, repositories.ErrMessageNotFound) || errors.As(err, &deleted) {
+			return Error{}
+		}
+		return newError(repositories.ErrorKey(err))
+	}
+
+	return s.deleteMessage(ctx, msg)
+}
+
+// deleteMessage soft-deletes the message, drops it from the live history and tells the room
+func (s *Service) deleteMessage(ctx context.Context, msg *repositories.Message) Error {
+	messageID := msg.ID.Hex()
+	if err := s.store.DeleteMessage(ctx, msg.RoomID, messageID); err != nil {
+		return newError(repositories.ErrorKey(err))
+	}
+
+	s.purgeHistory(ctx, msg.RoomID, []string{messageID})
+
+	s.publishEvent(ctx, msg.RoomID, EventMessagesDeleted, map[string]interface{}{"message_ids": []string{messageID}})
+
+	return Error{}
+}
+
+// @summary Import Messages
+// @description Seeds the room with historical messages, keeping their timestamps. Senders missing from the room are added as members, and the room is created if needed. Messages already imported are skipped. Requires the admin key.
+// @tags messages,rooms
+// @router /api/v1/rooms/{roomId}/import [post]
+// @param roomId path string true "Room ID (required)"
+// @param X-Admin-Key header string true "Admin key"
+// @param body body []ImportedMessage true "Messages to import"
+// @produce application/json
+// @success 200 {object} ImportMessagesResult "Import counts"
+// @failure 400 {object} Error "Invalid message, details.index tells which"
+// @failure 403 {object} Error "Invalid admin key"
+// @failure 413 {object} Error "Too many messages"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) ImportMessages(ctx context.Context, roomID string, b io.ReadCloser) (interface{}, Error) {
+	defer b.Close()
+
+	var body []ImportedMessage
+	if err := json.NewDecoder(b).Decode(&body); err != nil {
+		log.Error(ctx, "Failed to decode ImportedMessage list", log.ErrAttr(err))
+		return nil, newError(constants.FailedToDecodeBody)
+	}
+
+	if roomID == "" {
+		return nil, newError(constants.RoomIDRequired)
+	}
+
+	if len(body) > MaxImportMessages {
+		return nil, newError(constants.ImportTooLarge)
+	}
+
+	result := ImportMessagesResult{}
+	retention := time.Now().Add(-deps.MessagesTTL)
+	senders := map[string]string{}
+	seen := map[string]bool{}
+	messages := make([]repositories.Message, 0, len(body))
+
+	for i, imported := range body {
+		if imported.Type == "" {
+			imported.Type = TextMessage
+		}
+
+		if strings.TrimSpace(imported.Content) == "" || imported.SenderID == "" || imported.Timestamp.IsZero() ||
+			(imported.Type != TextMessage && imported.Type != SystemMessage) {
+			svcErr := newError(constants.InvalidImport)
+			svcErr.Details = map[string]interface{}{"index": i}
+			return nil, svcErr
+		}
+
+		if imported.Timestamp.Before(retention) {
+			result.Expired++
+			continue
+		}
+
+		if imported.ImportID == "" {
+			hash := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%s", imported.SenderID, imported.Timestamp.UnixNano(), imported.Content)))
+			imported.ImportID = hex.EncodeToString(hash[:])
+		}
+
+		if seen[imported.ImportID] {
+			result.Skipped++
+			continue
+		}
+		seen[imported.ImportID] = true
+
+		if senders[imported.SenderID] == "" {
+			senders[imported.SenderID] = imported.Nickname
+		}
+
+		messages = append(messages, repositories.Message{
+			RoomID:     roomID,
+			Message:    imported.Content,
+			FromUserID: imported.SenderID,
+			Nickname:   imported.Nickname,
+			Type:       string(imported.Type),
+			ImportID:   imported.ImportID,
+			CreatedAt:  imported.Timestamp,
+			UpdatedAt:  imported.Timestamp,
+		})
+	}
+
+	if svcErr := s.addImportedSenders(ctx, roomID, senders); svcErr.ErrorMessage != nil {
+		return nil, svcErr
+	}
+
+	inserted, err := repositories.ImportMessages(ctx, s.Mongo, messages)
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	result.Inserted = inserted
+	result.Skipped += len(messages) - inserted
+
+	log.Info(ctx, "Imported messages",
+		log.AnyAttr("room_id", roomID),
+		log.AnyAttr("inserted", result.Inserted),
+		log.AnyAttr("skipped", result.Skipped),
+		log.AnyAttr("expired", result.Expired))
+
+	return result, Error{}
+}
+
+// addImportedSenders adds the senders missing from the room as members, creating the room
+// if needed. Senders with an account keep their nickname, the others get a placeholder
+// member with the imported nickname.
+func (s *Service) addImportedSenders(ctx context.Context, roomID string, senders map[string]string) Error {
+	room, err := repositories.GetRooms(ctx, s.Mongo, repositories.GetRoomData{RoomID: roomID})
+	if err != nil {
+		return newError(repositories.ErrorKey(err))
+	}
+
+	for senderID, nickname := range senders {
+		if room != nil && isRoomMember(room, senderID) {
+			continue
+		}
+
+		user, err := repositories.GetUser(ctx, s.Mongo, repositories.GetUserData{UserID: senderID})
+		if err != nil {
+			return newError(repositories.ErrorKey(err))
+		}
+
+		if user != nil {
+			nickname = user.Nickname
+		} else if nickname == "" {
+			nickname = senderID
+		}
+
+		if _, err := repositories.CreateRoom(ctx, s.Mongo, repositories.CreateRoomData{
+			RoomID:   roomID,
+			UserID:   senderID,
+			Nickname: nickname,
+		}); err != nil {
+			return newError(repositories.ErrorKey(err))
+		}
+	}
+
+	return Error{}
+}
+
+// @summary Pin Message
+// @description Pins a message of the room after the last pinned one. Rooms are limited to a configurable number of pins.
+// @tags messages,rooms
+// @router /api/v1/rooms/{roomId}/pins [post]
+// @param roomId path string true "Room ID (required)"
+// @param body body PinMessageBody true "Message to pin"
+// @produce application/json
+// @success 200 {object} repositories.Pin "Message pinned"
+// @failure 403 {object} Error "User is not a member of the room"
+// @failure 404 {object} Error "Room or message not found"
+// @failure 409 {object} Error "Message already pinned or pin limit reached"
+// @failure 410 {object} Error "Message was deleted, details.deleted_at tells when"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) PinMessage(ctx context.Context, roomID string, userID string, nickname string, b io.ReadCloser) (interface{}, Error) {
+	defer b.Close()
+
+	var body PinMessageBody
+	if err := json.NewDecoder(b).Decode(&body); err != nil {
+		log.Error(ctx, "Failed to decode PinMessageBody", log.ErrAttr(err))
+		return nil, newError(constants.FailedToDecodeBody)
+	}
+
+	if svcErr := s.checkRoomMember(ctx, roomID, userID); svcErr.ErrorMessage != nil {
+		return nil, svcErr
+	}
+
+	if _, err := s.store.GetMessage(ctx, roomID, body.MessageID); err != nil {
+		return nil, messageError(err)
+	}
+
+	// The limit is checked by the pin itself, a count beforehand would let concurrent pins past it
+	pin, err := s.store.CreatePin(ctx, repositories.CreatePinData{
+		RoomID:    roomID,
+		MessageID: body.MessageID,
+		PinnedBy:  userID,
+		Limit:     s.deps.Config.Chat.MaxPinsPerRoom,
+	})
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	s.broadcastToRoom(ctx, roomID, ChatMessage{
+		Type:      SystemMessage,
+		Content:   fmt.Sprintf("%s pinned a message", nickname),
+		RoomId:    roomID,
+		Timestamp: time.Now(),
+		Metadata:  map[string]interface{}{"event": PinEventPinned, "message_id": body.MessageID},
+	})
+
+	return pin, Error{}
+}
+
+// @summary Unpin Message
+// @description Unpins a message of the room
+// @tags messages,rooms
+// @router /api/v1/rooms/{roomId}/pins/{messageId} [delete]
+// @param roomId path string true "Room ID (required)"
+// @param messageId path string true "Pinned message ID (required)"
+// @produce application/json
+// @success 200 {object} map[string]string "Message unpinned"
+// @failure 403 {object} Error "User is not a member of the room"
+// @failure 404 {object} Error "Room or pin not found"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) UnpinMessage(ctx context.Context, roomID string, userID string, nickname string, messageID string) (interface{}, Error) {
+	if svcErr := s.checkRoomMember(ctx, roomID, userID); svcErr.ErrorMessage != nil {
+		return nil, svcErr
+	}
+
+	if err := s.store.DeletePin(ctx, roomID, messageID); err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	s.broadcastToRoom(ctx, roomID, ChatMessage{
+		Type:      SystemMessage,
+		Content:   fmt.Sprintf("%s unpinned a message", nickname),
+		RoomId:    roomID,
+		Timestamp: time.Now(),
+		Metadata:  map[string]interface{}{"event": PinEventUnpinned, "message_id": messageID},
+	})
+
+	return map[string]string{"message": "Message unpinned successfully"}, Error{}
+}
+
+// @summary List Pinned Messages
+// @description Lists the pinned messages of the room, in manual order or by pin time
+// @tags messages,rooms
+// @router /api/v1/rooms/{roomId}/pins [get]
+// @param roomId path string true "Room ID (required)"
+// @param order query string false "position (default) or pinned_at"
+// @produce application/json
+// @success 200 {object} PinnedMessagesList "Pinned messages"
+// @failure 404 {object} Error "Room not found"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) GetPinnedMessages(ctx context.Context, roomID string, order string) (PinnedMessagesList, Error) {
+	if _, err := s.store.GetRoom(ctx, roomID); err != nil {
+		return PinnedMessagesList{}, newError(repositories.ErrorKey(err))
+	}
+
+	pins, err := s.store.GetPins(ctx, repositories.GetPinsData{
+		RoomID: roomID,
+		Order:  order,
+	})
+	if err != nil {
+		return PinnedMessagesList{}, newError(repositories.ErrorKey(err))
+	}
+
+	messageIDs := make([]string, len(pins))
+	for i, pin := range pins {
+		messageIDs[i] = pin.MessageID
+	}
+
+	messages, err := s.store.GetMessagesByIDs(ctx, roomID, messageIDs)
+	if err != nil {
+		return PinnedMessagesList{}, newError(repositories.ErrorKey(err))
+	}
+
+	messagesByID := make(map[string]repositories.Message, len(messages))
+	for _, msg := range messages {
+		messagesByID[msg.ID.Hex()] = msg
+	}
+
+	pinned := make([]PinnedMessage, len(pins))
+	for i, pin := range pins {
+		pinned[i] = PinnedMessage{Pin: pin}
+
+		if msg, ok := messagesByID[pin.MessageID]; ok {
+			message := newChatMessage(msg)
+			pinned[i].Message = &message
+		}
+	}
+
+	return PinnedMessagesList{Pins: pinned}, Error{}
+}
+
+// @summary Reorder Pinned Messages
+// @description Sets the manual order of the pinned messages. message_ids must list every pinned message exactly once.
+// @tags messages,rooms
+// @router /api/v1/rooms/{roomId}/pins [patch]
+// @param roomId path string true "Room ID (required)"
+// @param body body ReorderPinsBody true "Pinned message IDs in the new order"
+// @produce application/json
+// @success 200 {object} PinnedMessagesList "Pinned messages in the new order"
+// @failure 400 {object} Error "message_ids doesn't match the pinned messages"
+// @failure 403 {object} Error "User is not a member of the room"
+// @failure 404 {object} Error "Room not found"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) ReorderPins(ctx context.Context, roomID string, userID string, nickname string, b io.ReadCloser) (interface{}, Error) {
+	defer b.Close()
+
+	var body ReorderPinsBody
+	if err := json.NewDecoder(b).Decode(&body); err != nil {
+		log.Error(ctx, "Failed to decode ReorderPinsBody", log.ErrAttr(err))
+		return nil, newError(constants.FailedToDecodeBody)
+	}
+
+	if svcErr := s.checkRoomMember(ctx, roomID, userID); svcErr.ErrorMessage != nil {
+		return nil, svcErr
+	}
+
+	pins, err := s.store.GetPins(ctx, repositories.GetPinsData{RoomID: roomID})
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	if !samePins(pins, body.MessageIDs) {
+		return nil, newError(constants.InvalidPinOrder)
+	}
+
+	if err := s.store.ReorderPins(ctx, roomID, body.MessageIDs); err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	s.broadcastToRoom(ctx, roomID, ChatMessage{
+		Type:      SystemMessage,
+		Content:   fmt.Sprintf("%s reordered the pinned messages", nickname),
+		RoomId:    roomID,
+		Timestamp: time.Now(),
+		Metadata:  map[string]interface{}{"event": PinEventReordered, "message_ids": body.MessageIDs},
+	})
+
+	return s.GetPinnedMessages(ctx, roomID, repositories.PinOrderPosition)
+}
+
+// samePins reports whether messageIDs lists every pinned message exactly once
+func samePins(pins []repositories.Pin, messageIDs []string) bool {
+	if len(pins) != len(messageIDs) {
+		return false
+	}
+
+	pinned := make(map[string]bool, len(pins))
+	for _, pin := range pins {
+		pinned[pin.MessageID] = true
+	}
+
+	for _, messageID := range messageIDs {
+		if !pinned[messageID] {
+			return false
+		}
+		// Remove it so duplicates are rejected
+		delete(pinned, messageID)
+	}
+
+	return true
+}
+
+// checkRoomMember returns an error unless the room exists and the user is registered in it
+func (s *Service) checkRoomMember(ctx context.Context, roomID string, userID string) Error {
+	room, err := s.store.GetRoom(ctx, roomID)
+	if err != nil {
+		return newError(repositories.ErrorKey(err))
+	}
+
+	if errKey := membershipError(room, userID); errKey != "" {
+		return newError(errKey)
+	}
+
+	return Error{}
+}
+
+// membershipError returns the error key telling why the user can't act in the room, or
+// an empty string for members. A room left without members is told apart from a
+// non-member, such rooms are kept along with their history.
+func membershipError(room *repositories.Room, userID string) string {
+	if len(room.Users) == 0 {
+		return constants.RoomHasNoMembers
+	}
+
+	if !isRoomMember(room, userID) {
+		return constants.UserNotRoomMember
+	}
+
+	return ""
+}
+
+func isRoomMember(room *repositories.Room, userID string) bool {
+	return slices.ContainsFunc(room.Users, func(user repositories.UserRef) bool { return user.ID == userID })
+}
+
+// @summary Remove Room Member
+// @description Removes a user from the room, closing their open connections to it. Requires the admin key.
+// @tags rooms,users
+// @router /api/v1/rooms/{roomId}/members/{userId} [delete]
+// @param roomId path string true "Room ID (required)"
+// @param userId path string true "ID of the user to remove"
+// @param X-Admin-Key header string true "Admin key"
+// @produce application/json
+// @success 200 {object} map[string]string "Member removed"
+// @failure 403 {object} Error "User is not a member of the room"
+// @failure 404 {object} Error "Room not found"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) RemoveRoomMember(ctx context.Context, roomID string, userID string) (interface{}, Error) {
+	room, err := repositories.GetRoom(ctx, s.Mongo, repositories.GetRoomData{RoomID: roomID})
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	if err := repositories.RemoveRoomMember(ctx, s.Mongo, roomID, userID); err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	nickname, ok := memberNickname(room, userID)
+	if !ok {
+		nickname = userID
+	}
+
+	s.broadcastToRoom(ctx, roomID, ChatMessage{
+		Type:      SystemMessage,
+		Content:   fmt.Sprintf("%s was removed from the room", nickname),
+		RoomId:    roomID,
+		Timestamp: time.Now(),
+		Metadata:  map[string]interface{}{"event": MemberEventRemoved, "user_id": userID},
+	})
+
+	return map[string]string{"message": "Member removed successfully"}, Error{}
+}
+
+// @summary Server Time
+// @description Returns the server's current UTC time so clients can correct their clocks
+// @tags time
+// @router /api/v1/time [get]
+// @produce application/json
+// @success 200 {object} ServerTimeResponse "Server time"
+func (s *Service) ServerTime() ServerTimeResponse {
+	return ServerTimeResponse{Time: time.Now().UTC()}
+}
+
+// @summary Upload Attachment
+// @description Stores a file shared in the room. The returned attachment goes in the "attachment" metadata of an attachment message sent through the WebSocket.
+// @tags messages,rooms
+// @router /api/v1/rooms/{roomId}/attachments [post]
+// @param roomId path string true "Room ID (required)"
+// @param file formData file true "File to upload"
+// @accept multipart/form-data
+// @produce application/json
+// @success 200 {object} repositories.Attachment "Attachment stored"
+// @failure 400 {object} Error "Missing file"
+// @failure 403 {object} Error "User is not a member of the room"
+// @failure 404 {object} Error "Room not found"
+// @failure 413 {object} Error "File too large"
+// @failure 415 {object} Error "File type not allowed"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) UploadAttachment(ctx context.Context, roomID string, userID string, file io.ReadSeeker, filename string, size int64) (interface{}, Error) {
+	if svcErr := s.checkRoomMember(ctx, roomID, userID); svcErr.ErrorMessage != nil {
+		return nil, svcErr
+	}
+
+	if size > s.deps.Config.Attachments.MaxSize {
+		return nil, newError(constants.AttachmentTooLarge)
+	}
+
+	// The type is sniffed from the content, the one sent by the client can't be trusted
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, newError(constants.AttachmentRequired)
+	}
+
+	mimeType, _, err := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	if err != nil || !slices.Contains(s.deps.Config.Attachments.AllowedMimeTypes, mimeType) {
+		return nil, newError(constants.UnsupportedAttachmentType)
+	}
+
+	attachment := repositories.Attachment{
+		MimeType: mimeType,
+		Size:     size,
+		Filename: filepath.Base(filename),
+	}
+
+	if strings.HasPrefix(mimeType, "image/") {
+		if _, err := file.Seek(0, io.SeekStart); err == nil {
+			if imageConfig, _, err := image.DecodeConfig(file); err == nil {
+				attachment.Width = imageConfig.Width
+				attachment.Height = imageConfig.Height
+			}
+		}
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, newError(constants.FailedToStoreAttachment)
+	}
+
+	// Images are kept in memory for the thumbnail, which is generated once the upload is stored
+	var content io.Reader = file
+	var imageData []byte
+	if thumbnail.Supported(mimeType) {
+		imageData, err = io.ReadAll(file)
+		if err != nil {
+			return nil, newError(constants.FailedToStoreAttachment)
+		}
+		content = bytes.NewReader(imageData)
+	}
+
+	name := uuid.New().String()
+	key := fmt.Sprintf("%s/%s%s", url.PathEscape(roomID), name, attachmentExtension(mimeType))
+	attachment.URL, err = s.storage.Save(ctx, key, content)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToStoreAttachment].Message, log.ErrAttr(err))
+		return nil, newError(constants.FailedToStoreAttachment)
+	}
+
+	if imageData != nil {
+		thumbnailKey := fmt.Sprintf("%s/%s_thumb", url.PathEscape(roomID), name)
+		go s.generateThumbnail(context.WithoutCancel(ctx), roomID, attachment.URL, thumbnailKey, imageData, mimeType)
+	}
+
+	return attachment, Error{}
+}
+
+// ThumbnailTTL is how long a thumbnail is remembered for the attachment messages not sent yet
+const ThumbnailTTL = 24 * time.Hour
+
+// EventAttachmentThumbnail is published to the room when the thumbnail of an attachment is ready
+const EventAttachmentThumbnail = "attachment.thumbnail"
+
+// generateThumbnail stores the image thumbnail and sets it on the attachment. The messages
+// already sent get updated and the room notified, the ones sent later pick it up from the broker.
+func (s *Service) generateThumbnail(ctx context.Context, roomID string, attachmentURL string, key string, data []byte, mimeType string) {
+	thumb, thumbMimeType, err := thumbnail.Generate(data, mimeType)
+	if err != nil {
+		log.Warn(ctx, "Skipping attachment thumbnail",
+			log.AnyAttr("url", attachmentURL),
+			log.ErrAttr(err))
+		return
+	}
+
+	thumbnailURL, err := s.storage.Save(ctx, key+attachmentExtension(thumbMimeType), bytes.NewReader(thumb))
+	if err != nil {
+		log.Error(ctx, "Failed to store attachment thumbnail", log.ErrAttr(err))
+		return
+	}
+
+	if err := s.broker.Set(ctx, thumbnailKey(attachmentURL), thumbnailURL, ThumbnailTTL); err != nil {
+		log.Error(ctx, "Failed to save attachment thumbnail", log.ErrAttr(err))
+	}
+
+	if err := repositories.SetAttachmentThumbnail(ctx, s.Mongo, roomID, attachmentURL, thumbnailURL); err != nil {
+		return
+	}
+
+	s.publishEvent(ctx, roomID, EventAttachmentThumbnail, map[string]interface{}{
+		"url":           attachmentURL,
+		"thumbnail_url": thumbnailURL,
+	})
+}
+
+func thumbnailKey(attachmentURL string) string {
+	return fmt.Sprintf("attachment:thumbnail:%s", attachmentURL)
+}
+
+// attachmentExtensions keeps the usual extension of the common types, since the
+// stored files are served with the type matching their extension
+var attachmentExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+	"text/plain":      ".txt",
+}
+
+func attachmentExtension(mimeType string) string {
+	if extension, ok := attachmentExtensions[mimeType]; ok {
+		return extension
+	}
+
+	if extensions, err := mime.ExtensionsByType(mimeType); err == nil && len(extensions) > 0 {
+		return extensions[0]
+	}
+
+	return ""
+}
+
+// validAttachment returns the attachment described by the message metadata,
+// if it was uploaded to the room and is within the configured limits
+func (s *Service) validAttachment(ctx context.Context, roomID string, metadata map[string]interface{}) (*repositories.Attachment, bool) {
+	attachment := metadataAttachment(metadata)
+	if attachment == nil {
+		return nil, false
+	}
+
+	config := s.deps.Config.Attachments
+	roomURL := fmt.Sprintf("%s/%s/", config.BaseURL, url.PathEscape(roomID))
+	if !strings.HasPrefix(attachment.URL, roomURL) || strings.Contains(attachment.URL, "..") {
+		return nil, false
+	}
+
+	if attachment.Size <= 0 || attachment.Size > config.MaxSize || !slices.Contains(config.AllowedMimeTypes, attachment.MimeType) {
+		return nil, false
+	}
+
+	// The thumbnail comes from the server, it's empty until it's ready
+	attachment.ThumbnailURL, _ = s.broker.Get(ctx, thumbnailKey(attachment.URL))
+
+	return attachment, true
+}
+
+// metadataAttachment decodes the "attachment" metadata, or returns nil when there's none
+func metadataAttachment(metadata map[string]interface{}) *repositories.Attachment {
+	value, ok := metadata["attachment"]
+	if !ok {
+		return nil
+	}
+
+	// Decoded from JSON as a map, so it goes through JSON again to get the struct
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+
+	var attachment repositories.Attachment
+	if err := json.Unmarshal(encoded, &attachment); err != nil {
+		return nil
+	}
+
+	return &attachment
+}
+
+// messageAttachment returns the attachment persisted with the message
+func messageAttachment(message ChatMessage) *repositories.Attachment {
+	if message.Type != AttachmentMessage {
+		return nil
+	}
+
+	return metadataAttachment(message.Metadata)
+}
+
+// newChatMessage converts a persisted message to the shape sent to the clients
+func newChatMessage(msg repositories.Message) ChatMessage {
+	message := ChatMessage{
+		ID:        msg.ID.Hex(),
+		Type:      TextMessage,
+		Content:   msg.Message,
+		RoomId:    msg.RoomID,
+		SenderId:  msg.FromUserID,
+		Nickname:  msg.Nickname,
+		Verified:  msg.Verified,
+		Timestamp: msg.CreatedAt,
+	}
+
+	if msg.Type != "" {
+		message.Type = MessageType(msg.Type)
+	}
+
+	if msg.Attachment != nil {
+		message.Metadata = map[string]interface{}{"attachment": msg.Attachment}
+	}
+
+	if msg.EditedAt != nil {
+		if message.Metadata == nil {
+			message.Metadata = map[string]interface{}{}
+		}
+		message.Metadata["edited_at"] = *msg.EditedAt
+	}
+
+	return message
+}
+
+// historyCount returns how many messages to replay on connect: the history query parameter
+// clamped to the server max, or the default when it's unset. It's false when the parameter
+// isn't a non-negative number.
+func (s *Service) historyCount(query url.Values) (int64, bool) {
+	if skip, _ := strconv.ParseBool(query.Get("skip_history")); skip {
+		return 0, true
+	}
+
+	value := query.Get("history")
+	if value == "" {
+		return s.deps.Config.Chat.HistoryReplay, true
+	}
+
+	count, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || count < 0 {
+		return 0, false
+	}
+
+	return min(count, s.deps.Config.Chat.MaxHistoryReplay), true
+}
+
+// recentMessages returns up to count of the most recent messages of the room, oldest first.
+// They're read from the broker history, or from MongoDB when the history holds fewer, which
+// happens once count exceeds the history size or after the history was lost.
+func (s *Service) recentMessages(ctx context.Context, roomID string, count int64) ([]ChatMessage, error) {
+	entries, err := s.broker.History(ctx, roomID, count)
+	if err != nil {
+		log.Error(ctx, "Failed to get room history, falling back to MongoDB", log.ErrAttr(err))
+	}
+
+	if err == nil && int64(len(entries)) >= count {
+		messages := make([]ChatMessage, 0, len(entries))
+		for _, entry := range entries {
+			var msg ChatMessage
+			if err := json.Unmarshal(entry, &msg); err != nil {
+				continue
+			}
+			delete(msg.Metadata, senderConnectionKey)
+			messages = append(messages, msg)
+		}
+
+		return messages, nil
+	}
+
+	stored, err := s.store.RecentMessages(ctx, roomID, count)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]ChatMessage, 0, len(stored))
+	for _, msg := range stored {
+		messages = append(messages, newChatMessage(msg))
+	}
+
+	// Read newest first
+	slices.Reverse(messages)
+
+	return messages, nil
+}
+
+// cursorSecrets are the keys verifying the pagination cursors, the first one signs them. They're
+// derived from the JWT secrets, so rotating the JWT secret rotates them too.
+func (s *Service) cursorSecrets() [][]byte {
+	secrets := [][]byte{}
+	for _, secret := range s.deps.Config.JWT.VerificationSecrets() {
+		secrets = append(secrets, pagination.DeriveKey(secret))
+	}
+
+	return secrets
+}
+
+func (s *Service) UpdateUser(ctx context.Context, ID string, body io.ReadCloser) (interface{}, Error) {
+	defer body.Close()
+
+	var user repositories.UpdateUserData
+	err := json.NewDecoder(body).Decode(&user)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToDecodeBody].Message, log.ErrAttr(err))
+		if svcErr := NewServiceError(constants.FailedToDecodeBody); svcErr != nil {
+			if serviceErr, ok := svcErr.(ServiceError); ok {
+				return nil, Error{
+					ErrorMessage: &serviceErr.Message,
+					ErrorID:      &serviceErr.ID,
+					ErrorCode:    &serviceErr.Code,
+				}
+			}
+		}
+
+		return nil, newError(constants.FailedToDecodeBody)
+	}
+
+	user.UserID = ID
+
+	result, err := repositories.UpdateUser(ctx, s.Mongo, user)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToUpdateUser].Message, log.ErrAttr(err))
+		if svcErr := NewServiceError(constants.FailedToUpdateUser); svcErr != nil {
+			if serviceErr, ok := svcErr.(ServiceError); ok {
+				return nil, Error{
+					ErrorMessage: &serviceErr.Message,
+					ErrorID:      &serviceErr.ID,
+					ErrorCode:    &serviceErr.Code,
+				}
+			}
+		}
+
+		return nil, newError(constants.FailedToUpdateUser)
+	}
+
+	return result, Error{}
+}
+
+// @summary Get Room Details
+// @description Returns detailed information about a specific chat room by ID
+// @tags rooms
+// @router /api/v1/rooms/{roomId} [get]
+// @param roomId path string true "Room ID (required)"
+// @param members query string false "Set to count to omit the member list and only return member_count"
+// @produce application/json
+// @success 200 {object} RoomDetails "Room details retrieved successfully"
+// @failure 400 {object} Error "Bad request"
+// @failure 404 {object} Error "Room not found"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) GetRoom(ctx context.Context, roomID string, countOnly bool) (RoomDetails, Error) {
+	room, err := s.store.GetRoom(ctx, roomID)
+	if err != nil {
+		return RoomDetails{}, newError(repositories.ErrorKey(err))
+	}
+
+	details := newRoomDetails(room)
+	if countOnly {
+		details.Users = nil
+	}
+
+	return details, Error{}
+}
+
+// newRoomDetails builds the room shape returned by every room endpoint
+func newRoomDetails(room *repositories.Room) RoomDetails {
+	return RoomDetails{
+		RoomId:      room.ID,
+		Users:       room.Users,
+		MemberCount: len(room.Users),
+		LockedBy:    &room.LockedBy,
+		Settings:    room.Settings,
+		Mode:        roomMode(room),
+		SlowMode:    room.SlowModeSeconds,
+		CreatedBy:   room.CreatedBy,
+		CreatedAt:   room.CreatedAt,
+		UpdatedAt:   room.UpdatedAt,
+	}
+}
+
+// @summary Mute Room Member
+// @description Stops a member from sending messages to the room for a while. Muted members still connect and receive messages. Requires the admin key.
+// @tags rooms,users
+// @router /api/v1/rooms/{roomId}/mute [post]
+// @param roomId path string true "Room ID (required)"
+// @param X-Admin-Key header string true "Admin key"
+// @param body body MuteUserBody true "User to mute and for how long"
+// @produce application/json
+// @success 200 {object} map[string]interface{} "Member muted"
+// @failure 400 {object} Error "Missing user or invalid duration"
+// @failure 403 {object} Error "User is not a member of the room"
+// @failure 404 {object} Error "Room not found"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) MuteUser(ctx context.Context, roomID string, b io.ReadCloser) (interface{}, Error) {
+	defer b.Close()
+
+	var body MuteUserBody
+	if err := json.NewDecoder(b).Decode(&body); err != nil {
+		log.Error(ctx, "Failed to decode MuteUserBody", log.ErrAttr(err))
+		return nil, newError(constants.FailedToDecodeBody)
+	}
+
+	duration := time.Duration(body.DurationSeconds) * time.Second
+	if body.UserID == "" || duration <= 0 || duration > MaxMuteDuration {
+		return nil, newError(constants.InvalidMute)
+	}
+
+	room, err := s.store.GetRoom(ctx, roomID)
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	nickname, ok := memberNickname(room, body.UserID)
+	if !ok {
+		return nil, newError(constants.UserNotRoomMember)
+	}
+
+	if err := deps.MuteUser(ctx, s.broker, roomID, body.UserID, duration); err != nil {
+		log.Error(ctx, "Failed to mute user", log.ErrAttr(err))
+		return nil, newError(constants.FailedToUpdateMute)
+	}
+
+	s.broadcastToRoom(ctx, roomID, ChatMessage{
+		Type:      SystemMessage,
+		Content:   fmt.Sprintf("%s has been muted for %s", nickname, duration),
+		RoomId:    roomID,
+		Timestamp: time.Now(),
+		Metadata:  map[string]interface{}{"event": MemberEventMuted, "user_id": body.UserID, "duration_seconds": body.DurationSeconds},
+	})
+
+	return map[string]interface{}{
+		"user_id":     body.UserID,
+		"muted_until": time.Now().Add(duration).UTC(),
+	}, Error{}
+}
+
+// @summary Unmute Room Member
+// @description Lets a muted member send messages to the room again. Requires the admin key.
+// @tags rooms,users
+// @router /api/v1/rooms/{roomId}/unmute [post]
+// @param roomId path string true "Room ID (required)"
+// @param X-Admin-Key header string true "Admin key"
+// @param body body UnmuteUserBody true "User to unmute"
+// @produce application/json
+// @success 200 {object} map[string]string "Member unmuted"
+// @failure 400 {object} Error "Missing user"
+// @failure 404 {object} Error "Room not found or user not muted"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) UnmuteUser(ctx context.Context, roomID string, b io.ReadCloser) (interface{}, Error) {
+	defer b.Close()
+
+	var body UnmuteUserBody
+	if err := json.NewDecoder(b).Decode(&body); err != nil {
+		log.Error(ctx, "Failed to decode UnmuteUserBody", log.ErrAttr(err))
+		return nil, newError(constants.FailedToDecodeBody)
+	}
+
+	if body.UserID == "" {
+		return nil, newError(constants.InvalidMute)
+	}
+
+	room, err := s.store.GetRoom(ctx, roomID)
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	unmuted, err := deps.UnmuteUser(ctx, s.broker, roomID, body.UserID)
+	if err != nil {
+		log.Error(ctx, "Failed to unmute user", log.ErrAttr(err))
+		return nil, newError(constants.FailedToUpdateMute)
+	}
+
+	if !unmuted {
+		return nil, newError(constants.UserNotMuted)
+	}
+
+	nickname, ok := memberNickname(room, body.UserID)
+	if !ok {
+		nickname = body.UserID
+	}
+
+	s.broadcastToRoom(ctx, roomID, ChatMessage{
+		Type:      SystemMessage,
+		Content:   fmt.Sprintf("%s has been unmuted", nickname),
+		RoomId:    roomID,
+		Timestamp: time.Now(),
+		Metadata:  map[string]interface{}{"event": MemberEventUnmuted, "user_id": body.UserID},
+	})
+
+	return map[string]string{"message": "Member unmuted successfully"}, Error{}
+}
+
+// muteRemaining returns how long the user stays muted in the room, rounded up to the second
+func (s *Service) muteRemaining(ctx context.Context, roomID string, userID string) time.Duration {
+	remaining, err := deps.MuteRemaining(ctx, s.broker, roomID, userID)
+	if err != nil {
+		// Failing open, like the rate limit, so a Redis hiccup doesn't silence everyone
+		log.Error(ctx, "Failed to check mute", log.ErrAttr(err))
+		return 0
+	}
+
+	return remaining.Round(time.Second)
+}
+
+// slowModeRemaining returns how long until the user can send another message to the room when
+// it's in slow mode and they must wait first. Admins aren't slowed down.
+func (s *Service) slowModeRemaining(ctx context.Context, room *repositories.Room, userID string, admin bool) time.Duration {
+	if admin || room.SlowModeSeconds <= 0 {
+		return 0
+	}
+
+	return deps.SlowModeRemaining(ctx, s.broker, room.ID, userID)
+}
+
+// recordSlowMode starts the user's cooldown once their message to the room is stored, so the
+// rejected messages and the resends don't count
+func (s *Service) recordSlowMode(ctx context.Context, room *repositories.Room, userID string, admin bool) {
+	if admin || room.SlowModeSeconds <= 0 {
+		return
+	}
+
+	deps.RecordSlowMode(ctx, s.broker, room.ID, userID, time.Duration(room.SlowModeSeconds)*time.Second)
+}
+
+// @summary Set Room Slow Mode
+// @description Makes each member wait between their messages to the room, or turns slow mode off with 0 seconds. Admins aren't slowed down. The change is announced to the room. Requires the admin key.
+// @tags rooms
+// @router /api/v1/rooms/{roomId}/slow-mode [post]
+// @param roomId path string true "Room ID (required)"
+// @param X-Admin-Key header string true "Admin key"
+// @param body body SlowModeBody true "Seconds between messages"
+// @produce application/json
+// @success 200 {object} RoomDetails "Slow mode updated"
+// @failure 400 {object} Error "Bad request or seconds out of range"
+// @failure 404 {object} Error "Room not found"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) SetSlowMode(ctx context.Context, roomID string, b io.ReadCloser) (interface{}, Error) {
+	defer b.Close()
+
+	var body SlowModeBody
+	if err := json.NewDecoder(b).Decode(&body); err != nil {
+		log.Error(ctx, "Failed to decode SlowModeBody", log.ErrAttr(err))
+		return nil, newError(constants.FailedToDecodeBody)
+	}
+
+	if body.Seconds < 0 || time.Duration(body.Seconds)*time.Second > MaxSlowMode {
+		return nil, newError(constants.InvalidSlowMode)
+	}
+
+	changed, err := repositories.SetRoomSlowMode(ctx, s.Mongo, roomID, body.Seconds)
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	room, err := repositories.GetRoom(ctx, s.Mongo, repositories.GetRoomData{RoomID: roomID})
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	if changed {
+		content := "Slow mode is off"
+		if body.Seconds > 0 {
+			content = fmt.Sprintf("Slow mode is on, members can send a message every %s", time.Duration(body.Seconds)*time.Second)
+		}
+
+		s.broadcastToRoom(ctx, roomID, ChatMessage{
+			Type:      SystemMessage,
+			Content:   content,
+			RoomId:    roomID,
+			Timestamp: time.Now(),
+			Metadata:  map[string]interface{}{"event": RoomEventSlowMode, "seconds": body.Seconds},
+		})
+		s.publishRoomUpdate(ctx, roomID, map[string]interface{}{"slow_mode_seconds": body.Seconds})
+	}
+
+	return newRoomDetails(room), Error{}
+}
+
+// isVerified tells whether the user registered with an email and password. Lookup failures
+// count as unverified, the badge is never shown by mistake.
+func (s *Service) isVerified(ctx context.Context, userID string) bool {
+	user, err := s.store.GetUser(ctx, userID)
+	if err != nil || user == nil {
+		return false
+	}
+
+	return user.Verified()
+}
+
+// memberNickname returns the nickname of the room member
+func memberNickname(room *repositories.Room, userID string) (string, bool) {
+	for _, user := range room.Users {
+		if user.ID == userID {
+			return user.Nickname, true
+		}
+	}
+
+	return "", false
+}
+
+// @summary Check Nickname Availability
+// @description Tells whether a nickname is free in the room, for hints before joining. Nicknames are compared ignoring case and surrounding spaces. Rooms that don't exist yet have every nickname available.
+// @tags rooms,users
+// @router /api/v1/rooms/{roomId}/nickname-available [get]
+// @param roomId path string true "Room ID (required)"
+// @param nickname query string true "Nickname to check"
+// @produce application/json
+// @success 200 {object} NicknameAvailability "Nickname availability"
+// @failure 400 {object} Error "Missing nickname"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) NicknameAvailable(ctx context.Context, roomID string, nickname string) (interface{}, Error) {
+	nickname = strings.TrimSpace(nickname)
+	if nickname == "" {
+		return nil, newError(constants.NicknameRequired)
+	}
+
+	room, err := repositories.GetRooms(ctx, s.Mongo, repositories.GetRoomData{RoomID: roomID})
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	available := true
+	if room != nil {
+		for _, user := range room.Users {
+			if sameNickname(user.Nickname, nickname) {
+				available = false
+				break
+			}
+		}
+	}
+
+	return NicknameAvailability{Nickname: nickname, Available: available}, Error{}
+}
+
+// sameNickname reports whether two nicknames are the same, ignoring case and surrounding spaces
+func sameNickname(a string, b string) bool {
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
+
+// @summary Mark Room as Read
+// @description Marks every message of the room sent so far as read by the authenticated user
+// @tags rooms,messages
+// @router /api/v1/rooms/{roomId}/read [post]
+// @param roomId path string true "Room ID (required)"
+// @produce application/json
+// @success 200 {object} repositories.ReadMarker "Room marked as read"
+// @failure 403 {object} Error "User is not a member of the room"
+// @failure 404 {object} Error "Room not found"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) MarkRoomRead(ctx context.Context, roomID string, userID string) (interface{}, Error) {
+	if svcErr := s.checkRoomMember(ctx, roomID, userID); svcErr.ErrorMessage != nil {
+		return nil, svcErr
+	}
+
+	now := time.Now()
+	if err := repositories.SetReadMarker(ctx, s.Mongo, roomID, userID, now); err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	return repositories.ReadMarker{
+		RoomID:     roomID,
+		UserID:     userID,
+		LastReadAt: now,
+	}, Error{}
+}
+
+// @summary Get Unread Rooms
+// @description Returns a page of the user's rooms with unread messages from others, most recent unread message first
+// @tags rooms,users
+// @router /api/v1/users/{userId}/rooms/unread [get]
+// @param userId path string true "User ID"
+// @param page query integer false "Page number (default: 1)" minimum(1)
+// @param limit query integer false "Items per page (default: 20)" minimum(1) maximum(100)
+// @param meta query boolean false "Set to true to answer a ListPage envelope listing the rooms in data"
+// @produce application/json
+// @success 200 {object} UnreadRoomsList "Rooms with unread messages"
+// @failure 403 {object} Error "Cannot access another user's data"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) GetUnreadRooms(ctx context.Context, query GetUnreadRoomsQuery) (UnreadRoomsList, Error) {
+	page := 1
+	limit := 20
+
+	if query.PageStr != "" {
+		if p, err := strconv.Atoi(query.PageStr); err == nil && p > 0 {
+			page = p
+		}
+	}
+
+	if query.LimitStr != "" {
+		if l, err := strconv.Atoi(query.LimitStr); err == nil && l > 0 && l <= 100 {
+			limit = l
+		}
+	}
+
+	rooms, total, err := repositories.GetUnreadRooms(ctx, s.Mongo, repositories.GetUnreadRoomsData{
+		UserID: query.UserID,
+		Limit:  int64(limit),
+		Skip:   int64((page - 1) * limit),
+	})
+	if err != nil {
+		return UnreadRoomsList{}, newError(repositories.ErrorKey(err))
+	}
+
+	return UnreadRoomsList{
+		Rooms: rooms,
+		Total: total,
+		Page:  page,
+		Limit: limit,
+	}, Error{}
+}
+
+// @summary Get User Contacts
+// @description Returns a page of the users sharing at least one room with the user, sorted by nickname
+// @tags users
+// @router /api/v1/users/{userId}/contacts [get]
+// @param userId path string true "User ID"
+// @param page query integer false "Page number (default: 1)" minimum(1)
+// @param limit query integer false "Items per page (default: 50)" minimum(1) maximum(100)
+// @param meta query boolean false "Set to true to answer a ListPage envelope listing the contacts in data"
+// @produce application/json
+// @success 200 {object} ContactsList "Contacts of the user"
+// @failure 403 {object} Error "Cannot access another user's data"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) GetUserContacts(ctx context.Context, query GetUserContactsQuery) (ContactsList, Error) {
+	page := 1
+	limit := 50
+
+	if query.PageStr != "" {
+		if p, err := strconv.Atoi(query.PageStr); err == nil && p > 0 {
+			page = p
+		}
+	}
+
+	if query.LimitStr != "" {
+		if l, err := strconv.Atoi(query.LimitStr); err == nil && l > 0 && l <= 100 {
+			limit = l
+		}
+	}
+
+	contacts, total, err := repositories.GetUserContacts(ctx, s.Mongo, repositories.GetUserContactsData{
+		UserID: query.UserID,
+		Limit:  int64(limit),
+		Skip:   int64((page - 1) * limit),
+	})
+	if err != nil {
+		return ContactsList{}, newError(repositories.ErrorKey(err))
+	}
+
+	return ContactsList{
+		Contacts: contacts,
+		Total:    total,
+		Page:     page,
+		Limit:    limit,
+	}, Error{}
+}
+
+// @summary Get My Rooms
+// @description Returns the rooms of the authenticated user with their online member and unread message counts
+// @tags rooms,users
+// @router /api/v1/me/rooms [get]
+// @produce application/json
+// @security JWT
+// @success 200 {object} MyRoomsList "Rooms of the user"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) GetMyRooms(ctx context.Context, userID string) (MyRoomsList, Error) {
+	rooms, err := repositories.GetAllRoomsWhereUserIsRegistered(ctx, s.Mongo, repositories.GetUserData{UserID: userID})
+	if err != nil {
+		return MyRoomsList{}, newError(constants.FailedToGetRooms)
+	}
+
+	if len(rooms) == 0 {
+		return MyRoomsList{Rooms: []MyRoom{}}, Error{}
+	}
+
+	unreadRooms, _, err := repositories.GetUnreadRooms(ctx, s.Mongo, repositories.GetUnreadRoomsData{
+		UserID: userID,
+		Limit:  int64(len(rooms)),
+	})
+	if err != nil {
+		return MyRoomsList{}, newError(repositories.ErrorKey(err))
+	}
+
+	unread := make(map[string]repositories.UnreadRoom, len(unreadRooms))
+	for _, room := range unreadRooms {
+		unread[room.RoomID] = room
+	}
+
+	roomIDs := make([]string, len(rooms))
+	for i, room := range rooms {
+		roomIDs[i] = room.ID
+	}
+
+	// The counts are still useful without the presence
+	online, err := s.broker.CountRoomMembers(ctx, roomIDs)
+	if err != nil {
+		log.Error(ctx, "Failed to get connected room members", log.ErrAttr(err))
+		online = make([]int64, len(rooms))
+	}
+
+	myRooms := make([]MyRoom, len(rooms))
+	for i, room := range rooms {
+		myRooms[i] = MyRoom{
+			RoomID:      room.ID,
+			OnlineCount: online[i],
+			LockedBy:    room.LockedBy,
+			Settings:    room.Settings,
+			CreatedAt:   room.CreatedAt,
+			UpdatedAt:   room.UpdatedAt,
+		}
+
+		if unreadRoom, ok := unread[room.ID]; ok {
+			myRooms[i].UnreadCount = unreadRoom.UnreadCount
+			myRooms[i].LastUnreadAt = &unreadRoom.LastUnreadAt
+		}
+	}
+
+	return MyRoomsList{Rooms: myRooms}, Error{}
+}
+
+// @summary Export My Data
+// @description Downloads all the data associated with the authenticated user: their profile, room memberships and sent messages, including the deleted ones still stored
+// @tags users
+// @router /api/v1/me/export [get]
+// @produce application/json
+// @security JWT
+// @success 200 {object} UserExport "User data export"
+// @failure 404 {object} Error "User not found"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) ExportUserData(ctx context.Context, userID string) (*UserDataExport, Error) {
+	user, err := repositories.GetUser(ctx, s.Mongo, repositories.GetUserData{UserID: userID})
+	if err != nil {
+		return nil, newError(constants.FailedToGetUsers)
+	}
+
+	if user == nil {
+		return nil, newError(constants.UserNotFound)
+	}
+
+	memberships, err := repositories.GetUserMemberships(ctx, s.Mongo, userID)
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	rooms := make([]ExportedRoom, 0, len(memberships))
+	for _, room := range memberships {
+		exported := ExportedRoom{RoomID: room.ID, CreatedAt: room.CreatedAt}
+		if len(room.Users) > 0 {
+			exported.Nickname = room.Users[0].Nickname
+		}
+		rooms = append(rooms, exported)
+	}
+
+	// Messages are the bulk of the export, they are read while the response is written
+	messages, err := repositories.GetUserMessages(ctx, s.Mongo, userID)
+	if err != nil {
+		return nil, newError(constants.FailedToGetMessages)
+	}
+
+	log.Info(ctx, "User data exported", log.AnyAttr("user_id", userID))
+
+	return &UserDataExport{
+		export: UserExport{
+			ExportedAt: time.Now(),
+			Profile: ExportedProfile{
+				ID:        user.Id,
+				Email:     user.Email,
+				Nickname:  user.Nickname,
+				Activity:  user.Activity,
+				Disabled:  user.Disabled,
+				CreatedAt: user.CreatedAt,
+				UpdatedAt: user.UpdatedAt,
+			},
+			Rooms: rooms,
+		},
+		messages: messages,
+	}, Error{}
+}
+
+// Stream writes the export as a UserExport JSON document, encoding the messages one
+// at a time so they are never all held in memory
+func (e *UserDataExport) Stream(ctx context.Context, w io.Writer) error {
+	defer e.messages.Close(ctx)
+
+	bw := bufio.NewWriter(w)
+	write := func(prefix string, v interface{}) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		bw.WriteString(prefix)
+		_, err = bw.Write(data)
+		return err
+	}
+
+	if err := write(`{"exported_at":`, e.export.ExportedAt); err != nil {
+		return err
+	}
+	if err := write(`,"profile":`, e.export.Profile); err != nil {
+		return err
+	}
+	if err := write(`,"rooms":`, e.export.Rooms); err != nil {
+		return err
+	}
+
+	bw.WriteString(`,"messages":[`)
+	for first := true; e.messages.Next(ctx); first = false {
+		var msg repositories.Message
+		if err := e.messages.Decode(&msg); err != nil {
+			return err
+		}
+
+		separator := ","
+		if first {
+			separator = ""
+		}
+
+		if msg.Type == "" {
+			msg.Type = string(TextMessage)
+		}
+
+		if err := write(separator, ExportedMessage{
+			ID:         msg.ID.Hex(),
+			RoomID:     msg.RoomID,
+			Type:       msg.Type,
+			Content:    msg.Message,
+			Nickname:   msg.Nickname,
+			Attachment: msg.Attachment,
+			CreatedAt:  msg.CreatedAt,
+			UpdatedAt:  msg.UpdatedAt,
+			DeletedAt:  msg.DeletedAt,
+		}); err != nil {
+			return err
+		}
+	}
+	if err := e.messages.Err(); err != nil {
+		return err
+	}
+	bw.WriteString("]}")
+
+	return bw.Flush()
+}
+
+// @summary Get Room Members
+// @description Returns a page of the room members, in join order, with their online status
+// @tags rooms,users
+// @router /api/v1/rooms/{roomId}/members [get]
+// @param roomId path string true "Room ID (required)"
+// @param page query integer false "Page number (default: 1)" minimum(1)
+// @param limit query integer false "Items per page (default: 50)" minimum(1) maximum(100)
+// @param meta query boolean false "Set to true to answer a ListPage envelope listing the members in data"
+// @produce application/json
+// @success 200 {object} RoomMembersList "Room members"
+// @failure 404 {object} Error "Room not found"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) GetRoomMembers(ctx context.Context, query GetRoomMembersQuery) (RoomMembersList, Error) {
+	page := 1
+	limit := 50
+
+	if query.PageStr != "" {
+		if p, err := strconv.Atoi(query.PageStr); err == nil && p > 0 {
+			page = p
+		}
+	}
+
+	if query.LimitStr != "" {
+		if l, err := strconv.Atoi(query.LimitStr); err == nil && l > 0 && l <= 100 {
+			limit = l
+		}
+	}
+
+	users, total, err := s.store.GetRoomMembers(ctx, repositories.GetRoomMembersData{
+		RoomID: query.RoomID,
+		Limit:  int64(limit),
+		Skip:   int64((page - 1) * limit),
+	})
+	if err != nil {
+		return RoomMembersList{}, newError(repositories.ErrorKey(err))
+	}
+
+	connected, err := s.broker.RoomMembers(ctx, query.RoomID)
+	if err != nil {
+		// The members are still useful without their presence
+		log.Error(ctx, "Failed to get connected room members", log.ErrAttr(err))
+	}
+
+	online := make(map[string]bool, len(connected))
+	for _, userID := range connected {
+		online[userID] = true
+	}
+
+	userIDs := make([]string, len(users))
+	for i, user := range users {
+		userIDs[i] = user.ID
+	}
+
+	verified, err := s.store.GetVerifiedUsers(ctx, userIDs)
+	if err != nil {
+		return RoomMembersList{}, newError(repositories.ErrorKey(err))
+	}
+
+	members := make([]RoomMember, len(users))
+	for i, user := range users {
+		members[i] = RoomMember{
+			ID:       user.ID,
+			Nickname: user.Nickname,
+			Online:   online[user.ID],
+			Verified: verified[user.ID],
+		}
+	}
+
+	return RoomMembersList{
+		Members: members,
+		Total:   total,
+		Page:    page,
+		Limit:   limit,
+	}, Error{}
+}
+
+// @summary Get Online Room Members
+// @description Returns the room members connected to the room right now. It's read from the live connections rather than the users' activity, which stays online after an unclean disconnect until the cleanup runs.
+// @tags rooms,users
+// @router /api/v1/rooms/{roomId}/online [get]
+// @param roomId path string true "Room ID (required)"
+// @produce application/json
+// @success 200 {object} OnlineMembersList "Connected room members"
+// @failure 404 {object} Error "Room not found"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) GetOnlineRoomMembers(ctx context.Context, roomID string) (OnlineMembersList, Error) {
+	room, err := s.store.GetRoom(ctx, roomID)
+	if err != nil {
+		return OnlineMembersList{}, newError(repositories.ErrorKey(err))
+	}
+
+	connected, err := s.broker.RoomMembers(ctx, roomID)
+	if err != nil {
+		log.Error(ctx, "Failed to get connected room members", log.ErrAttr(err))
+		return OnlineMembersList{}, newError(constants.FailedToGetPresence)
+	}
+
+	// Users removed from the room may still be connected until their connection notices
+	members := []repositories.UserRef{}
+	for _, user := range room.Users {
+		if slices.Contains(connected, user.ID) {
+			members = append(members, user)
+		}
+	}
+
+	return OnlineMembersList{Members: members}, Error{}
+}
+
+// @summary List All Chat Rooms
+// @description Returns a paginated list of all available chat rooms with their users and status
+// @tags rooms
+// @router /api/v1/rooms [get]
+// @param page query integer false "Page number (default: 1)" minimum(1)
+// @param limit query integer false "Items per page (default: 50)" minimum(1) maximum(100)
+// @param meta query boolean false "Set to true to answer a ListPage envelope listing the rooms in data"
+// @produce application/json
+// @success 200 {object} RoomsList "List of chat rooms retrieved successfully"
+// @failure 400 {object} Error "Bad request"
+// @failure 401 {object} Error "Unauthorized"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) GetRooms(ctx context.Context, query GetRoomsQuery) (RoomsList, Error) {
+	page := 1
+	limit := 50
+
+	if query.PageStr != "" {
+		if p, err := strconv.Atoi(query.PageStr); err == nil && p > 0 {
+			page = p
+		}
+	}
+
+	if query.LimitStr != "" {
+		if l, err := strconv.Atoi(query.LimitStr); err == nil && l > 0 {
+			limit = l
+		}
+	}
+
+	cursor, err := repositories.GetRoomsCursor(ctx, s.Mongo, repositories.GetRoomsCursorData{
+		Limit: int64(limit),
+		Skip:  int64((page - 1) * limit),
+	})
+	if err != nil {
+		return RoomsList{}, newError(repositories.ErrorKey(err))
+	}
+
+	var rooms []repositories.Room
+	for cursor.Next(ctx) {
+		var room repositories.Room
+		if err := cursor.Decode(&room); err != nil {
+			log.Error(ctx, "Failed to decode room", log.ErrAttr(err))
+			continue
+		}
+
+		rooms = append(rooms, room)
+	}
+
+	responseRooms := []RoomListDetails{}
+	for _, room := range rooms {
+		responseUsers := []RoomListUser{}
+		for _, user := range room.Users {
+			responseUsers = append(responseUsers, RoomListUser{
+				Id:       user.ID,
+				Nickname: user.Nickname,
+			})
+		}
+
+		responseRooms = append(responseRooms, RoomListDetails{
+			RoomID:    room.ID,
+			Users:     responseUsers,
+			LockedBy:  &room.LockedBy,
+			CreatedBy: room.CreatedBy,
+			CreatedAt: room.CreatedAt,
+			UpdatedAt: room.UpdatedAt,
+		})
+	}
+
+	total, err := repositories.CountRooms(ctx, s.Mongo)
+	if err != nil {
+		return RoomsList{}, newError(constants.FailedToGetRooms)
+	}
+
+	return RoomsList{
+		Rooms: responseRooms,
+		Total: total,
+		Page:  page,
+		Limit: limit,
+	}, Error{}
+}
+
+// @summary Toggle Maintenance Mode
+// @description Enables or disables the maintenance mode, which rejects every write with a 503 while allowing reads. Connected rooms are notified when it's enabled.
+// @tags admin
+// @router /api/v1/admin/maintenance [post]
+// @param X-Admin-Key header string true "Admin key"
+// @param body body MaintenanceModeBody true "Maintenance mode state"
+// @produce application/json
+// @security JWT
+// @success 200 {object} map[string]bool "Maintenance mode updated"
+// @failure 400 {object} Error "Bad request"
+// @failure 403 {object} Error "Invalid admin key"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) SetMaintenanceMode(ctx context.Context, b io.ReadCloser) (interface{}, Error) {
+	defer b.Close()
+
+	var body MaintenanceModeBody
+	if err := json.NewDecoder(b).Decode(&body); err != nil {
+		log.Error(ctx, "Failed to decode MaintenanceModeBody", log.ErrAttr(err))
+		return nil, newError(constants.FailedToDecodeBody)
+	}
+
+	if err := deps.SetMaintenanceMode(ctx, s.broker, body.Enabled); err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToUpdateMaintenanceMode].Message, log.ErrAttr(err))
+		return nil, newError(constants.FailedToUpdateMaintenanceMode)
+	}
+
+	log.Warn(ctx, "Maintenance mode updated", log.AnyAttr("enabled", body.Enabled))
+
+	if body.Enabled {
+		s.broadcastToConnectedRooms(ctx, "Chat is entering maintenance mode, messages can't be sent for now")
+	}
+
+	return map[string]bool{"maintenance": body.Enabled}, Error{}
+}
+
+// @summary Announce
+// @description Publishes a system announcement to the rooms with connected members, all of them or the targeted ones. Announcements aren't persisted nor replayed. Requires the admin key.
+// @tags admin
+// @router /api/v1/admin/announce [post]
+// @param X-Admin-Key header string true "Admin key"
+// @param body body AnnounceBody true "Announcement and optional targets"
+// @produce application/json
+// @security JWT
+// @success 200 {object} AnnounceResult "Announcement published"
+// @failure 400 {object} Error "Empty or too long message"
+// @failure 403 {object} Error "Invalid admin key"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) Announce(ctx context.Context, b io.ReadCloser) (interface{}, Error) {
+	defer b.Close()
+
+	var body AnnounceBody
+	if err := json.NewDecoder(b).Decode(&body); err != nil {
+		log.Error(ctx, "Failed to decode AnnounceBody", log.ErrAttr(err))
+		return nil, newError(constants.FailedToDecodeBody)
+	}
+
+	body.Message = strings.TrimSpace(body.Message)
+	if body.Message == "" {
+		return nil, newError(constants.MessageRequired)
+	}
+
+	if len(body.Message) > MaxMessageLen {
+		return nil, newError(constants.MessageTooLong)
+	}
+
+	roomIDs, err := s.connectedRooms(ctx)
+	if err != nil {
+		return nil, newError(constants.FailedToGetRooms)
+	}
+
+	if len(body.RoomIDs) > 0 || len(body.Tags) > 0 {
+		targets := body.RoomIDs
+		if tags := normalizeTags(body.Tags); len(tags) > 0 {
+			tagged, err := s.store.GetRoomIDsByTags(ctx, tags)
+			if err != nil {
+				return nil, newError(repositories.ErrorKey(err))
+			}
+			targets = append(targets, tagged...)
+		}
+
+		roomIDs = slices.DeleteFunc(roomIDs, func(roomID string) bool { return !slices.Contains(targets, roomID) })
+	}
+
+	result := AnnounceResult{}
+	for _, roomID := range roomIDs {
+		payload, err := json.Marshal(ChatMessage{
+			Type:      SystemMessage,
+			Content:   body.Message,
+			RoomId:    roomID,
+			Timestamp: time.Now(),
+			Metadata:  map[string]interface{}{"event": EventAnnouncement},
+		})
+		if err != nil {
+			log.Error(ctx, "Failed to marshal announcement", log.ErrAttr(err))
+			return nil, newError(constants.FailedToGetRooms)
+		}
+
+		receivers, err := s.broker.Publish(ctx, roomID, payload)
+		if err != nil {
+			telemetry.RedisPublishErrors.Inc()
+			log.Error(ctx, "Failed to publish announcement",
+				log.AnyAttr("room_id", roomID),
+				log.ErrAttr(err))
+			continue
+		}
+
+		result.Rooms++
+		result.Receivers += receivers
+	}
+
+	log.Warn(ctx, "Announcement published",
+		log.AnyAttr("message", body.Message),
+		log.AnyAttr("room_ids", body.RoomIDs),
+		log.AnyAttr("tags", body.Tags),
+		log.AnyAttr("rooms", result.Rooms),
+		log.AnyAttr("receivers", result.Receivers))
+
+	return result, Error{}
+}
+
+// broadcastToConnectedRooms sends a system message to every room with connected members, on any instance
+func (s *Service) broadcastToConnectedRooms(ctx context.Context, content string) {
+	roomIDs, err := s.connectedRooms(ctx)
+	if err != nil {
+		return
+	}
+
+	for _, roomID := range roomIDs {
+		s.broadcastToRoom(ctx, roomID, ChatMessage{
+			Type:      SystemMessage,
+			Content:   content,
+			RoomId:    roomID,
+			Timestamp: time.Now(),
+		})
+	}
+}
+
+// connectedRooms returns the IDs of the rooms with connected members, on any instance
+func (s *Service) connectedRooms(ctx context.Context) ([]string, error) {
+	roomIDs, err := s.broker.ConnectedRooms(ctx)
+	if err != nil {
+		log.Error(ctx, "Failed to list connected rooms", log.ErrAttr(err))
+		return nil, err
+	}
+
+	return roomIDs, nil
+}
+
+// publishEvent notifies the clients connected to the room about an update to earlier
+// messages. Unlike broadcastToRoom, it's neither persisted nor kept in the history.
+func (s *Service) publishEvent(ctx context.Context, roomID string, event string, data map[string]interface{}) {
+	metadata := map[string]interface{}{"event": event}
+	for key, value := range data {
+		metadata[key] = value
+	}
+
+	payload, err := json.Marshal(ChatMessage{
+		Type:      EventMessage,
+		RoomId:    roomID,
+		Timestamp: time.Now(),
+		Metadata:  metadata,
+	})
+	if err != nil {
+		log.Error(ctx, "Failed to marshal event", log.ErrAttr(err))
+		return
+	}
+
+	if _, err := s.broker.Publish(ctx, roomID, payload); err != nil {
+		telemetry.RedisPublishErrors.Inc()
+		log.Error(ctx, "Failed to publish event",
+			log.AnyAttr("room_id", roomID),
+			log.ErrAttr(err))
+	}
+}
+
+// EventRoomUpdate is published to the room when its attributes change
+const EventRoomUpdate = "room_update"
+
+// publishRoomUpdate tells the connected clients which room attributes changed and their
+// new values, so they can update without fetching the room. Every endpoint changing the
+// room attributes calls it, with the attributes named as in RoomDetails.
+func (s *Service) publishRoomUpdate(ctx context.Context, roomID string, changes map[string]interface{}) {
+	fields := make([]string, 0, len(changes))
+	for field := range changes {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+
+	s.publishEvent(ctx, roomID, EventRoomUpdate, map[string]interface{}{
+		"fields":  fields,
+		"changes": changes,
+	})
+}
+
+// emitEvent sends the event to the subscribed webhooks without blocking the caller
+func (s *Service) emitEvent(ctx context.Context, event string, roomID string, data interface{}) {
+	// Services created without MongoDB have no webhooks
+	if s.webhooks == nil {
+		return
+	}
+
+	go s.webhooks.Emit(context.WithoutCancel(ctx), webhooks.Event{
+		Event:     event,
+		RoomID:    roomID,
+		Data:      data,
+		Timestamp: time.Now(),
+	})
+}
+
+// broadcastToRoom is the single path used to deliver messages to a room. It:
+// 1. Saves the message to MongoDB for persistence
+// 2. Publishes the message to the broker for real-time distribution
+// 3. Appends the message to the bounded room history used for live replay
+//
+// It returns the message as published, with the ID and timestamp it was stored with, and
+// how many subscribers received it, as reported by the broker. Every connection
+// subscribes on its own, so it's the number of connections in the room.
+func (s *Service) broadcastToRoom(ctx context.Context, roomID string, message ChatMessage) (ChatMessage, int64) {
+	start := time.Now()
+	defer func() {
+		telemetry.BroadcastLatency.Observe(time.Since(start).Seconds())
+	}()
+	telemetry.MessagesSent.WithLabelValues(string(message.Type)).Inc()
+
+	// A message that passed validation must not be lost because the sender
+	// disconnected right after sending it, so it's delivered on a detached context
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), BroadcastTimeout)
+	defer cancel()
+
+	// Save message to MongoDB
+	messageID, err := s.store.CreateMessage(ctx, repositories.CreateMessageData{
+		RoomID:     message.RoomId,
+		Message:    message.Content,
+		FromUserID: message.SenderId,
+		Nickname:   message.Nickname,
+		Verified:   message.Verified,
+		Type:       string(message.Type),
+		Attachment: messageAttachment(message),
+		CreatedAt:  message.Timestamp,
+	})
+
+	if err != nil {
+		log.Error(ctx, "Failed to save message to database",
+			log.AnyAttr("room_id", roomID),
+			log.AnyAttr("error", err))
+	} else {
+		message.ID = messageID
+	}
+
+	// Publish message to the room channel
+	messageJSON, err := json.Marshal(message)
+	if err != nil {
+		log.Error(ctx, "Failed to marshal message",
+			log.AnyAttr("room_id", roomID),
+			log.AnyAttr("error", err))
+		return message, 0
+	}
+
+	receivers, err := s.broker.PublishWithHistory(ctx, roomID, message.Timestamp, messageJSON, s.deps.Config.Chat.HistorySize)
+	if err != nil {
+		telemetry.RedisPublishErrors.Inc()
+		log.Error(ctx, "Failed to publish message",
+			log.AnyAttr("room_id", roomID),
+			log.AnyAttr("error", err))
+		return message, 0
+	}
+
+	log.Debug(ctx, "Message broadcast",
+		log.AnyAttr("room_id", roomID),
+		log.AnyAttr("sender_id", message.SenderId),
+		log.AnyAttr("receivers", receivers))
+
+	return message, receivers
+}
+
+// clientMessageID returns the client_msg_id of the message metadata, empty when it's unset or
+// too long to be used
+func clientMessageID(metadata map[string]interface{}) string {
+	clientMsgID, _ := metadata["client_msg_id"].(string)
+	if len(clientMsgID) > MaxClientMsgIDLen {
+		return ""
+	}
+
+	return clientMsgID
+}
+
+// isResend tells whether the user already sent the message with its client_msg_id within the
+// dedupe window, then sendMessage only returns the stored one
+func (s *Service) isResend(ctx context.Context, userID string, metadata map[string]interface{}) bool {
+	clientMsgID := clientMessageID(metadata)
+	if clientMsgID == "" {
+		return false
+	}
+
+	_, err := s.broker.Get(ctx, dedupeKey(userID, clientMsgID))
+	return err == nil
+}
+
+// sendMessage broadcasts a message sent by a user once per client_msg_id, so a message
+// resent after a reconnect isn't stored twice. A resent message within the dedupe window
+// returns the message stored the first time with duplicate set, or a zero message when
+// the first send is still in progress. Messages without a client_msg_id are always sent.
+func (s *Service) sendMessage(ctx context.Context, roomID string, message ChatMessage) (ChatMessage, bool) {
+	clientMsgID := clientMessageID(message.Metadata)
+	if clientMsgID == "" {
+		sent, _ := s.broadcastToRoom(ctx, roomID, message)
+		return sent, false
+	}
+
+	key := dedupeKey(message.SenderId, clientMsgID)
+
+	// Dedupe is best effort, the message is sent when the broker fails
+	first, err := s.broker.SetNX(ctx, key, "", MessageDedupeWindow)
+	if err != nil {
+		log.Error(ctx, "Failed to check message dedupe key", log.ErrAttr(err))
+		first = true
+	}
+
+	if !first {
+		log.Info(ctx, "Dropped resent message",
+			log.AnyAttr("room_id", roomID),
+			log.AnyAttr("user_id", message.SenderId),
+			log.AnyAttr("client_msg_id", clientMsgID))
+
+		var sent ChatMessage
+		if stored, err := s.broker.Get(ctx, key); err == nil && len(stored) > 0 {
+			if err := json.Unmarshal([]byte(stored), &sent); err != nil {
+				log.Error(ctx, "Failed to unmarshal deduped message", log.ErrAttr(err))
+			}
+		}
+		return sent, true
+	}
+
+	sent, _ := s.broadcastToRoom(ctx, roomID, message)
+
+	// Resends get the message as stored, the key keeps its expiration
+	if stored, err := json.Marshal(sent); err == nil {
+		if err := s.broker.Replace(ctx, key, string(stored)); err != nil {
+			log.Error(ctx, "Failed to store deduped message", log.ErrAttr(err))
+		}
+	}
+
+	return sent, false
+}
+
+func dedupeKey(userID string, clientMsgID string) string {
+	return fmt.Sprintf("dedupe:%s:%s", userID, clientMsgID)
+}
+
+// acknowledge tells the sender their message was handled, with the ID and timestamp
+// it was stored with. The client_msg_id the client sent in the metadata is echoed
+// back so it can match the ack with its pending message. Without an ID the message
+// wasn't stored.
+func (s *Service) acknowledge(ctx context.Context, client *Client, sent ChatMessage, clientMetadata map[string]interface{}) {
+	metadata := map[string]interface{}{}
+	if clientMsgID, ok := clientMetadata["client_msg_id"]; ok {
+		metadata["client_msg_id"] = clientMsgID
+	}
+
+	if !s.enqueue(ctx, client, ChatMessage{
+		ID:        sent.ID,
+		Type:      AckMessage,
+		RoomId:    sent.RoomId,
+		Timestamp: sent.Timestamp,
+		Metadata:  metadata,
+	}) {
+		log.Warn(ctx, "Failed to queue message ack", log.AnyAttr("user_id", client.userID))
+	}
+}
+
+// enqueue queues a message for delivery to the client without blocking the caller.
+// When the regular queue is full the oldest queued message is dropped to make room.
+// It returns false when the client is too slow to keep up and should be disconnected.
+func (s *Service) enqueue(ctx context.Context, client *Client, msg ChatMessage) bool {
+	// Counted first, so the writer never finishes it before
+	client.pending.Add(1)
+
+	if msg.Type == SystemMessage || msg.Type == AckMessage {
+		select {
+		case client.sendSystem <- msg:
+			return true
+		default:
+			client.pending.Add(-1)
+			return false
+		}
+	}
+
+	for {
+		select {
+		case client.send <- msg:
+			return true
+		default:
+		}
+
+		select {
+		case <-client.send:
+			client.pending.Add(-1)
+			total := s.droppedMessages.Add(1)
+			telemetry.DroppedMessages.Inc()
+
+			client.mu.Lock()
+			client.dropped++
+			tooSlow := client.dropped > MaxDroppedMessages
+			client.mu.Unlock()
+
+			log.Warn(ctx, "Dropped message for slow client",
+				log.AnyAttr("room_id", client.roomID),
+				log.AnyAttr("user_id", client.userID),
+				log.AnyAttr("dropped_messages_total", total))
+
+			if tooSlow {
+				client.pending.Add(-1)
+				return false
+			}
+		default:
+		}
+	}
+}
+
+// addClient tracks the client, unless the connections are being drained. It reports whether
+// it's tracked.
+func (s *Service) addClient(client *Client) bool {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	if s.draining {
+		return false
+	}
+
+	s.clients[client.connectionID] = client
+	return true
+}
+
+// isDraining tells whether Shutdown started
+func (s *Service) isDraining() bool {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	return s.draining
+}
+
+func (s *Service) removeClient(client *Client) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	delete(s.clients, client.connectionID)
+}
+
+// Shutdown tells every client connected to this instance that the server is going away,
+// waits for the notice to be written and closes the connections with StatusGoingAway,
+// so clients can schedule a reconnect. It gives up when ctx is done.
+func (s *Service) Shutdown(ctx context.Context) {
+	s.clientsMu.Lock()
+	s.draining = true
+	clients := make([]*Client, 0, len(s.clients))
+	for _, client := range s.clients {
+		clients = append(clients, client)
+	}
+	s.clientsMu.Unlock()
+
+	log.Info(ctx, "Draining WebSocket connections", log.AnyAttr("connections", len(clients)))
+
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *Client) {
+			defer wg.Done()
+
+			s.enqueue(ctx, client, ChatMessage{
+				Type:      SystemMessage,
+				Content:   "Server is restarting, please reconnect",
+				RoomId:    client.roomID,
+				Timestamp: time.Now(),
+			})
+			client.waitForFlush(ctx)
+			client.conn.Close(websocket.StatusGoingAway, "Server is restarting")
+		}(client)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warn(ctx, "Timed out draining WebSocket connections")
+	}
+}
+
+// waitForFlush blocks until the client's queued messages are written or ctx is done
+func (c *Client) waitForFlush(ctx context.Context) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for c.pending.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DroppedMessages returns how many messages were dropped because clients were too slow to receive them
+func (s *Service) DroppedMessages() int64 {
+	return s.droppedMessages.Load()
+}
+
+func (s *Service) disconnectSlowClient(ctx context.Context, client *Client) {
+	log.Warn(ctx, "Disconnecting slow client",
+		log.AnyAttr("room_id", client.roomID),
+		log.AnyAttr("user_id", client.userID))
+	client.conn.Close(websocket.StatusPolicyViolation, "Client too slow to receive messages")
+}
+
+// disconnectNonMember closes the connection of a user no longer in the room,
+// telling them why first
+func (s *Service) disconnectNonMember(ctx context.Context, client *Client) {
+	log.Warn(ctx, "Disconnecting user removed from the room",
+		log.AnyAttr("room_id", client.roomID),
+		log.AnyAttr("user_id", client.userID))
+
+	s.closeWithError(ctx, client, constants.UserNotRoomMember)
+}
+
+// closeWithError queues the error on the client's system messages, waits for writePump to
+// write it and closes the connection with StatusPolicyViolation
+func (s *Service) closeWithError(ctx context.Context, client *Client, errKey string) {
+	errMsg := constants.ErrorMessages[errKey]
+
+	flushCtx, cancel := context.WithTimeout(ctx, WriteTimeout)
+	defer cancel()
+
+	queued := s.enqueue(flushCtx, client, ChatMessage{
+		Type:      SystemMessage,
+		Content:   errMsg.Message,
+		RoomId:    client.roomID,
+		Timestamp: time.Now(),
+		Metadata:  map[string]interface{}{"error_id": errMsg.ID},
+	})
+	if queued {
+		client.waitForFlush(flushCtx)
+	}
+
+	client.conn.Close(websocket.StatusPolicyViolation, errMsg.Message)
+}
+
+// watchRevokedSessions closes the connections of the sessions revoked on any instance until ctx is done
+func (s *Service) watchRevokedSessions(ctx context.Context) {
+	deps.SubscribeSessionRevocations(ctx, s.broker, s.closeRevokedSessions)
+}
+
+// closeRevokedSessions closes the connections to this instance opened with the tokens of the
+// revoked sessions, which otherwise stay open after the tokens stop working
+func (s *Service) closeRevokedSessions(revocation deps.SessionRevocation) {
+	s.clientsMu.Lock()
+	revoked := []*Client{}
+	for _, client := range s.clients {
+		if revocation.Revokes(client.userID, client.sessionID) {
+			revoked = append(revoked, client)
+		}
+	}
+	s.clientsMu.Unlock()
+
+	for _, client := range revoked {
+		go s.disconnectRevoked(context.Background(), client)
+	}
+}
+
+// disconnectRevoked closes the connection of a revoked session, telling the client why first
+func (s *Service) disconnectRevoked(ctx context.Context, client *Client) {
+	log.Warn(ctx, "Disconnecting client of a revoked session",
+		log.AnyAttr("room_id", client.roomID),
+		log.AnyAttr("user_id", client.userID),
+		log.AnyAttr("session_id", client.sessionID))
+
+	s.closeWithError(ctx, client, constants.SessionRevoked)
+}
+
+// monitorMembership periodically checks that the client is still a member of the room,
+// so connections that only listen are closed too once the user is removed
+func (s *Service) monitorMembership(ctx context.Context, client *Client) {
+	ticker := time.NewTicker(time.Duration(s.deps.Config.Chat.MembershipCheckInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			room, err := s.store.GetRoom(ctx, client.roomID)
+			if err != nil && !errors.Is(err, repositories.ErrRoomNotFound) {
+				continue
+			}
+
+			if room == nil || !isRoomMember(room, client.userID) {
+				s.disconnectNonMember(ctx, client)
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// keepAlive pings the client and cancels its reads once it has been idle, neither sending
+// messages nor answering the pings, for longer than the idle timeout
+func (s *Service) keepAlive(ctx context.Context, client *Client, cancelRead context.CancelFunc) {
+	idleTimeout := time.Duration(s.deps.Config.Chat.IdleTimeout) * time.Second
+
+	ticker := time.NewTicker(time.Duration(s.deps.Config.Chat.PingInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// The pong is received by the read loop, Ping returns once it arrives
+		pingCtx, cancel := context.WithTimeout(ctx, WriteTimeout)
+		if err := client.conn.Ping(pingCtx); err == nil {
+			client.touch()
+		}
+		cancel()
+
+		if idle := time.Since(time.Unix(0, client.lastActive.Load())); idle > idleTimeout {
+			log.Info(ctx, "Closing idle connection",
+				log.AnyAttr("user_id", client.userID),
+				log.AnyAttr("room_id", client.roomID),
+				log.AnyAttr("idle", idle.Round(time.Second).String()))
+			cancelRead()
+			return
+		}
+	}
+}
+
+// touch records activity from the client
+func (c *Client) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// writePump is the only goroutine writing to the client's connection.
+// System messages are always written before regular ones.
+func (c *Client) writePump(ctx context.Context) {
+	for {
+		select {
+		case msg := <-c.sendSystem:
+			if !c.write(ctx, msg) {
+				return
+			}
+			continue
+		default:
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-c.sendSystem:
+			if !c.write(ctx, msg) {
+				return
+			}
+		case msg := <-c.send:
+			if !c.write(ctx, msg) {
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) write(ctx context.Context, msg ChatMessage) bool {
+	defer c.pending.Add(-1)
+
+	writeCtx, cancel := context.WithTimeout(ctx, WriteTimeout)
+	defer cancel()
+
+	if err := wsjson.Write(writeCtx, c.conn, msg); err != nil {
+		if ctx.Err() != nil {
+			return false
+		}
+		log.Error(ctx, "Failed to send message to client", log.ErrAttr(err))
+		c.conn.Close(websocket.StatusPolicyViolation, "Client too slow to receive messages")
+		return false
+	}
+
+	c.mu.Lock()
+	c.dropped = 0
+	c.mu.Unlock()
+
+	return true
+}
+
+func newError(errKey string) Error {
+	errMsg := constants.ErrorMessages[errKey]
+	return Error{
+		ErrorMessage: &errMsg.Message,
+		ErrorID:      &errMsg.ID,
+		ErrorCode:    &errMsg.Code,
+	}
+}
+
+// connectionLimitError returns the error key of the connection limit the user would exceed
+// by opening another connection, and how many seconds to wait before retrying. The limits are
+// checked before the upgrade so the client gets an HTTP error it can back off from.
+func (s *Service) connectionLimitError(ctx context.Context, userID string) (string, int) {
+	if limit := s.deps.Config.Chat.MaxConnections; limit > 0 {
+		s.clientsMu.Lock()
+		connections := len(s.clients)
+		s.clientsMu.Unlock()
+
+		if connections >= limit {
+			return constants.ServerConnectionLimit, config.HeartbeatInterval
+		}
+	}
+
+	if limit := s.deps.Config.Chat.MaxConnectionsPerUser; limit > 0 {
+		connections, err := s.broker.CountUserConnections(ctx, userID)
+		if err != nil {
+			// Don't lock users out because the count can't be read
+			log.Error(ctx, "Failed to count user connections", log.ErrAttr(err))
+			return "", 0
+		}
+
+		if connections >= int64(limit) {
+			// Connections that died without closing are released once flagged stale
+			return constants.UserConnectionLimit, s.deps.Config.Chat.StaleClientTimeout
+		}
+	}
+
+	return "", 0
+}
+
+// presenceTTL is how long the presence keys of a connection live without a heartbeat
+func (s *Service) presenceTTL() time.Duration {
+	return time.Duration(s.deps.Config.Chat.PresenceTTL) * time.Second
+}
+
+// rateLimitTTL is how long the last message time of a user is kept
+func (s *Service) rateLimitTTL() time.Duration {
+	return time.Duration(s.deps.Config.Chat.RateLimitTTL) * time.Second
+}
+
+// presence is the presence of the client's connection, seen now
+func (c *Client) presence() broker.Connection {
+	return broker.Connection{
+		UserID:       c.userID,
+		RoomID:       c.roomID,
+		Nickname:     c.nickname,
+		ConnectionID: c.connectionID,
+		LastSeen:     time.Now(),
+	}
+}
+
+// announcePresence tells the connected clients about a member joining or leaving the room,
+// unless the room turned the presence messages off. Like publishEvent, it's neither persisted
+// nor kept in the history, so reconnecting clients don't replay the comings and goings.
+func (s *Service) announcePresence(ctx context.Context, room *repositories.Room, event string, userID string, content string) {
+	if room.Settings.PresenceMessages != nil && !*room.Settings.PresenceMessages {
+		return
+	}
+
+	payload, err := json.Marshal(ChatMessage{
+		Type:      SystemMessage,
+		Content:   content,
+		RoomId:    room.ID,
+		Timestamp: time.Now(),
+		Metadata:  map[string]interface{}{"event": event, "user_id": userID},
+	})
+	if err != nil {
+		log.Error(ctx, "Failed to marshal presence message", log.ErrAttr(err))
+		return
+	}
+
+	if _, err := s.broker.Publish(ctx, room.ID, payload); err != nil {
+		telemetry.RedisPublishErrors.Inc()
+		log.Error(ctx, "Failed to publish presence message",
+			log.AnyAttr("room_id", room.ID),
+			log.ErrAttr(err))
 	}
-	
-	historyKey := fmt.Sprintf("room:%s:history", message.RoomId)
-	return redisClient.ZAdd(ctx, historyKey, redis.Z{
-		Score:  float64(message.Timestamp.Unix()),
-		Member: payload,
-	}).Err()
 }
 
-func (s *Service) monitorConnections() {
-	ticker := time.NewTicker(1 * time.Minute)
+// startHeartbeat records the connection as alive and extends its presence until ctx is done
+func (s *Service) startHeartbeat(ctx context.Context, client *Client) {
+	ticker := time.NewTicker(config.HeartbeatInterval * time.Second)
 	defer ticker.Stop()
 	
-	for range ticker.C {
-		ctx := context.Background()
-		now := time.Now().Unix()
-		
-		iter := s.redis.Scan(ctx, 0, "client:*", 1000).Iterator()
-		for iter.Next(ctx) {
-			clientKey := iter.Val()
-			clientData, err := s.redis.HGetAll(ctx, clientKey).Result()
+	for {
+		select {
+		case <-ticker.C:
+			s.broker.RefreshConnection(ctx, client.presence(), s.presenceTTL())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// monitorConnections periodically removes the clients that stopped sending heartbeats
+func (s *Service) monitorConnections(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(s.deps.Config.Chat.MonitorInterval) * time.Second)
+	defer ticker.Stop()
+
+	staleTimeout := time.Duration(s.deps.Config.Chat.StaleClientTimeout) * time.Second
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.expireRoomLocks(ctx)
+
+		connections, err := s.broker.Connections(ctx)
+		if err != nil {
+			log.Error(ctx, "Failed to list connections", log.ErrAttr(err))
+			continue
+		}
+
+		now := time.Now()
+		for _, conn := range connections {
+			if now.Sub(conn.LastSeen) <= staleTimeout {
+				continue
+			}
+
+			counts, err := s.broker.ReleaseConnection(ctx, conn.UserID, conn.ConnectionID, conn.RoomID)
 			if err != nil {
+				log.Error(ctx, "Failed to drop stale client", log.ErrAttr(err))
 				continue
 			}
-			
-			lastSeen, _ := strconv.ParseInt(clientData["lastSeen"], 10, 64)
-			if now - lastSeen > 120 { 
-				userID := strings.TrimPrefix(clientKey, "client:")
-				roomID := clientData["roomID"]
-				
-				s.redis.Del(ctx, clientKey)
-				s.redis.SRem(ctx, fmt.Sprintf("room:%s:members", roomID), userID)
-				s.redis.SRem(ctx, "users:online", userID)
-				
-				broadcastMessage(ctx, s.redis, ChatMessage{
-					Type:      SystemMessage,
-					Content:   fmt.Sprintf("%s has disconnected (timeout)", clientData["nickname"]),
-					RoomId:    roomID,
-					Timestamp: time.Now(),
-				})
+
+			// Closed meanwhile, which announced the leave, or still in the room from another connection
+			if !counts.Released || counts.InRoom > 0 {
+				continue
+			}
+
+			room, err := s.store.GetRoom(ctx, conn.RoomID)
+			if err != nil {
+				continue
 			}
+
+			s.announcePresence(ctx, room, MemberEventLeft, conn.UserID,
+				fmt.Sprintf("%s has disconnected (timeout)", conn.Nickname))
+			s.unlockOnLeave(ctx, conn.RoomID, conn.UserID, conn.Nickname)
 		}
 	}
 }
\ No newline at end of file
@@ -0,0 +1,80 @@
+package chatservice
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/pkg/deps"
+	"github.com/vit0rr/chat/pkg/middleware"
+)
+
+// expectRevoked waits for the client to be told its session was revoked and disconnected
+func expectRevoked(t *testing.T, c *testClient) {
+	t.Helper()
+
+	errorID := constants.ErrorMessages[constants.SessionRevoked].ID
+	c.receive(func(msg ChatMessage) bool {
+		return msg.Type == SystemMessage && msg.Metadata["error_id"] == errorID
+	})
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-c.messages:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("connection still open after the revocation")
+		}
+	}
+}
+
+func TestRevokedSessionConnectionsAreClosed(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice", "bob")
+	ts.addUser("phone", middleware.UserClaims{UserID: "alice", SessionID: "phone-session"})
+	ts.addUser("laptop", middleware.UserClaims{UserID: "alice", SessionID: "laptop-session"})
+	ts.addUser("bob", middleware.UserClaims{SessionID: "phone-session"})
+
+	phone := ts.mustDial("phone", "lobby")
+	laptop := ts.mustDial("laptop", "lobby")
+	bob := ts.mustDial("bob", "lobby")
+
+	err := deps.PublishSessionRevocation(t.Context(), ts.broker, deps.SessionRevocation{UserID: "alice", SessionID: "phone-session"})
+	if err != nil {
+		t.Fatalf("publish revocation: %v", err)
+	}
+	expectRevoked(t, phone)
+
+	// The user's other sessions, and the other users, stay connected
+	laptop.ready()
+	bob.ready()
+
+	// Revoking every other session closes the rest but the kept one
+	err = deps.PublishSessionRevocation(t.Context(), ts.broker, deps.SessionRevocation{UserID: "alice", AllSessions: true, ExceptSessionID: "phone-session"})
+	if err != nil {
+		t.Fatalf("publish revocation: %v", err)
+	}
+	expectRevoked(t, laptop)
+	bob.ready()
+}
+
+func TestDisabledAccountConnectionsAreClosed(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice")
+	ts.addUser("alice", middleware.UserClaims{})
+	ts.addUser("impersonated", middleware.UserClaims{UserID: "alice"})
+
+	alice := ts.mustDial("alice", "lobby")
+	impersonated := ts.mustDial("impersonated", "lobby")
+
+	if err := deps.PublishSessionRevocation(t.Context(), ts.broker, deps.SessionRevocation{UserID: "alice"}); err != nil {
+		t.Fatalf("publish revocation: %v", err)
+	}
+
+	// Tokens without a session are closed too
+	expectRevoked(t, alice)
+	expectRevoked(t, impersonated)
+}
@@ -0,0 +1,41 @@
+package chatservice
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/vit0rr/chat/api/constants"
+)
+
+func TestUpdateRoomSettingsRequiresAdmin(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice")
+
+	tests := []struct {
+		name   string
+		caller Caller
+		body   string
+	}{
+		{"mode by a member", Caller{UserID: "alice"}, `{"mode": "announcement"}`},
+		{"profanity filter by a member", Caller{UserID: "alice"}, `{"profanity_filter": false}`},
+		{"profanity filter by a non-member", Caller{UserID: "mallory"}, `{"profanity_filter": false}`},
+		{"windows by a non-member", Caller{UserID: "mallory"}, `{"edit_window": 0, "delete_window": 0}`},
+		{"tags by a non-member", Caller{UserID: "mallory"}, `{"tags": ["spam"]}`},
+		{"presence messages by a non-member", Caller{UserID: "mallory"}, `{"presence_messages": false}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := io.NopCloser(strings.NewReader(tt.body))
+			_, svcErr := ts.service.UpdateRoomSettings(t.Context(), "lobby", tt.caller, body)
+
+			if svcErr.ErrorID == nil || *svcErr.ErrorID != constants.ErrorMessages[constants.InvalidAdminKey].ID {
+				t.Fatalf("settings change = %+v, want %s", svcErr, constants.ErrorMessages[constants.InvalidAdminKey].ID)
+			}
+			if *svcErr.ErrorCode != 403 {
+				t.Errorf("status = %d, want 403", *svcErr.ErrorCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package chatservice
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/config"
+	"github.com/vit0rr/chat/pkg/middleware"
+	"github.com/vit0rr/chat/pkg/moderation"
+)
+
+// newSlowModeServer runs a server rejecting the messages containing "darn", with alice in a
+// lobby in slow mode
+func newSlowModeServer(t *testing.T) *testServer {
+	ts := newTestServer(t, func(cfg *config.Config) {
+		cfg.Moderation.Enabled = true
+		cfg.Moderation.Mode = moderation.ModeReject
+		cfg.Moderation.BannedWords = []string{"darn"}
+	})
+	ts.store.addRoom("lobby", "alice")
+	ts.store.setSlowMode("lobby", 60)
+	ts.addUser("alice", middleware.UserClaims{})
+
+	return ts
+}
+
+func TestSlowModeStartsOnceTheMessageIsSent(t *testing.T) {
+	ts := newSlowModeServer(t)
+
+	status, errResp := ts.post("alice", "/rooms/lobby/messages", SendMessageBody{Content: "darn it"})
+	if status != http.StatusBadRequest || errResp.ErrorID != constants.ErrorMessages[constants.MessageRejected].ID {
+		t.Fatalf("rejected message status = %d %q, want 400 %s", status, errResp.ErrorID, constants.ErrorMessages[constants.MessageRejected].ID)
+	}
+
+	// The rejected message didn't start the cooldown, only the global rate limit applies
+	time.Sleep(MessageDelay)
+
+	metadata := map[string]interface{}{"client_msg_id": "msg-1"}
+	if status, errResp := ts.post("alice", "/rooms/lobby/messages", SendMessageBody{Content: "hello", Metadata: metadata}); status != http.StatusCreated {
+		t.Fatalf("first message status = %d %q, want 201", status, errResp.ErrorID)
+	}
+
+	// Resends get the stored message back
+	if status, errResp := ts.post("alice", "/rooms/lobby/messages", SendMessageBody{Content: "hello", Metadata: metadata}); status != http.StatusCreated {
+		t.Errorf("resend status = %d %q, want 201", status, errResp.ErrorID)
+	}
+
+	status, errResp = ts.post("alice", "/rooms/lobby/messages", SendMessageBody{Content: "again"})
+	if status != http.StatusTooManyRequests || errResp.ErrorID != constants.ErrorMessages[constants.SlowModeActive].ID {
+		t.Errorf("next message status = %d %q, want 429 %s", status, errResp.ErrorID, constants.ErrorMessages[constants.SlowModeActive].ID)
+	}
+
+	if stored := ts.store.roomMessages("lobby", TextMessage); len(stored) != 1 {
+		t.Errorf("stored %d messages, want 1", len(stored))
+	}
+}
+
+func TestWebSocketSlowModeStartsOnceTheMessageIsSent(t *testing.T) {
+	ts := newSlowModeServer(t)
+	alice := ts.mustDial("alice", "lobby")
+
+	alice.sendText("darn it", "")
+	alice.receive(withContent(SystemMessage, constants.ErrorMessages[constants.MessageRejected].Message))
+
+	time.Sleep(MessageDelay)
+	alice.sendText("hello", "msg-1")
+	first := alice.receive(ofType(AckMessage))
+
+	alice.sendText("hello", "msg-1")
+	if resent := alice.receive(ofType(AckMessage)); resent.ID != first.ID {
+		t.Errorf("resend acked %q, want the first message %q", resent.ID, first.ID)
+	}
+
+	// Past the global rate limit, the slow mode still applies
+	time.Sleep(MessageDelay)
+	slowMode := constants.ErrorMessages[constants.SlowModeActive].ID
+	alice.sendText("again", "")
+	alice.receive(func(msg ChatMessage) bool {
+		return msg.Type == SystemMessage && msg.Metadata["error_id"] == slowMode
+	})
+}
+
+func TestWebSocketRejectedMessagesDontStartTheRateLimit(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice", "bob")
+	ts.addUser("bob", middleware.UserClaims{})
+	bob := ts.mustDial("bob", "lobby")
+
+	if locked, err := ts.store.LockRoom(t.Context(), "lobby", "alice"); err != nil || !locked {
+		t.Fatalf("lock room: %v", err)
+	}
+	bob.sendText("hello", "")
+	bob.receive(withContent(SystemMessage, constants.ErrorMessages[constants.RoomLocked].Message))
+
+	if unlocked, err := ts.store.UnlockRoom(t.Context(), "lobby", "alice"); err != nil || !unlocked {
+		t.Fatalf("unlock room: %v", err)
+	}
+
+	// Sent within the message delay, only a sent message starts it
+	bob.sendText("hello", "")
+	bob.receive(ofType(AckMessage))
+}
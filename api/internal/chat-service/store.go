@@ -0,0 +1,270 @@
+package chatservice
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/vit0rr/chat/pkg/database/repositories"
+	"github.com/vit0rr/chat/pkg/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Store is the storage behind the real-time path of the service: the rooms clients join,
+// connect and send to, their locks, the messages sent and the ones pinned. MongoDB backs it,
+// the tests run the service on an in-memory one. The other endpoints query MongoDB through
+// the repositories.
+type Store interface {
+	// GetRoom returns the room, or repositories.ErrRoomNotFound
+	GetRoom(ctx context.Context, roomID string) (*repositories.Room, error)
+	// GetRoomMembers returns a page of the room members, in join order, along with the total
+	// number of members, or repositories.ErrRoomNotFound
+	GetRoomMembers(ctx context.Context, data repositories.GetRoomMembersData) ([]repositories.UserRef, int64, error)
+	// GetUser returns the user, nil when they don't exist
+	GetUser(ctx context.Context, userID string) (*repositories.User, error)
+	// GetVerifiedUsers returns which of the users registered with an email and password
+	GetVerifiedUsers(ctx context.Context, userIDs []string) (map[string]bool, error)
+	// SetUserActivity sets whether the user is online or offline
+	SetUserActivity(ctx context.Context, userID string, activity string) error
+	// CreateUser creates the user, returning their ID
+	CreateUser(ctx context.Context, data repositories.CreateUserData) (string, error)
+	// CreateRoom adds the user to the room, creating the room when it doesn't exist
+	CreateRoom(ctx context.Context, data repositories.CreateRoomData) error
+
+	// GetRoomIDsByTags returns the IDs of the rooms with any of the tags
+	GetRoomIDsByTags(ctx context.Context, tags []string) ([]string, error)
+
+	// CheckInvite returns the invite when it can be used now, without using it
+	CheckInvite(ctx context.Context, code string) (*repositories.Invite, error)
+	// UseInvite uses the invite once unless it expired or ran out of uses, also under
+	// concurrent joins, and returns it updated
+	UseInvite(ctx context.Context, code string) (*repositories.Invite, error)
+	// ReleaseInvite gives back a use of the invite
+	ReleaseInvite(ctx context.Context, code string) error
+
+	// CreateMessage stores the message, returning its ID
+	CreateMessage(ctx context.Context, data repositories.CreateMessageData) (string, error)
+	// RecentMessages returns up to limit of the most recent messages of the room, newest first
+	RecentMessages(ctx context.Context, roomID string, limit int64) ([]repositories.Message, error)
+	// GetMessages returns a page of the messages of the room that aren't deleted, newest first
+	GetMessages(ctx context.Context, data repositories.GetMessagesData) ([]repositories.Message, error)
+	// CountMessages returns how many messages of the room aren't deleted
+	CountMessages(ctx context.Context, roomID string) (int64, error)
+	// GetMessage returns the message of the room, or repositories.ErrMessageNotFound, or a
+	// repositories.DeletedMessageError when it was deleted
+	GetMessage(ctx context.Context, roomID string, messageID string) (*repositories.Message, error)
+	// GetMessagesByIDs returns the messages of the room among the IDs, skipping the deleted ones
+	GetMessagesByIDs(ctx context.Context, roomID string, messageIDs []string) ([]repositories.Message, error)
+	// EditMessage replaces the content of the message, returning it edited, or
+	// repositories.ErrMessageNotFound when it doesn't exist or was deleted
+	EditMessage(ctx context.Context, roomID string, messageID string, content string) (*repositories.Message, error)
+	// DeleteMessage soft-deletes the message, or returns repositories.ErrMessageNotFound when it
+	// doesn't exist or was already deleted
+	DeleteMessage(ctx context.Context, roomID string, messageID string) error
+	// CountPurgeableMessages returns how many messages a purge would delete
+	CountPurgeableMessages(ctx context.Context, data repositories.PurgeMessagesData) (int64, error)
+	// PurgeMessages soft-deletes up to data.Limit of the selected messages, oldest first,
+	// and returns their IDs
+	PurgeMessages(ctx context.Context, data repositories.PurgeMessagesData) ([]string, error)
+
+	// CreatePin pins the message after the last pin, or returns repositories.ErrPinLimitReached
+	// when the room already has data.Limit pins. Concurrent pins never go past the limit.
+	CreatePin(ctx context.Context, data repositories.CreatePinData) (*repositories.Pin, error)
+	// GetPins returns the pins of the room in the order
+	GetPins(ctx context.Context, data repositories.GetPinsData) ([]repositories.Pin, error)
+	// DeletePin unpins the message, or returns repositories.ErrPinNotFound
+	DeletePin(ctx context.Context, roomID string, messageID string) error
+	// ReorderPins sets the position of every pin to its index in messageIDs
+	ReorderPins(ctx context.Context, roomID string, messageIDs []string) error
+
+	// LockRoom locks the room for the user unless it's already locked, reporting whether it did
+	LockRoom(ctx context.Context, roomID string, userID string) (bool, error)
+	// UnlockRoom releases the user's lock on the room, reporting whether they held it
+	UnlockRoom(ctx context.Context, roomID string, userID string) (bool, error)
+	// ExpireRoomLock releases the user's lock when taken before the cutoff, reporting whether it did
+	ExpireRoomLock(ctx context.Context, roomID string, userID string, cutoff time.Time) (bool, error)
+	// GetRoomsWithExpiredLocks returns the rooms locked before the cutoff
+	GetRoomsWithExpiredLocks(ctx context.Context, cutoff time.Time) ([]repositories.Room, error)
+}
+
+// mongoStore is the Store of the repositories
+type mongoStore struct {
+	db *mongo.Database
+}
+
+func NewMongoStore(db *mongo.Database) Store {
+	return &mongoStore{db: db}
+}
+
+func (m *mongoStore) GetRoom(ctx context.Context, roomID string) (*repositories.Room, error) {
+	return repositories.GetRoom(ctx, m.db, repositories.GetRoomData{RoomID: roomID})
+}
+
+func (m *mongoStore) GetUser(ctx context.Context, userID string) (*repositories.User, error) {
+	return repositories.GetUser(ctx, m.db, repositories.GetUserData{UserID: userID})
+}
+
+func (m *mongoStore) GetRoomMembers(ctx context.Context, data repositories.GetRoomMembersData) ([]repositories.UserRef, int64, error) {
+	return repositories.GetRoomMembers(ctx, m.db, data)
+}
+
+func (m *mongoStore) GetVerifiedUsers(ctx context.Context, userIDs []string) (map[string]bool, error) {
+	return repositories.GetVerifiedUsers(ctx, m.db, userIDs)
+}
+
+func (m *mongoStore) SetUserActivity(ctx context.Context, userID string, activity string) error {
+	_, err := repositories.UpdateUser(ctx, m.db, repositories.UpdateUserData{
+		UserID:   userID,
+		Activity: &activity,
+	})
+	return err
+}
+
+func (m *mongoStore) CreateUser(ctx context.Context, data repositories.CreateUserData) (string, error) {
+	result, err := repositories.CreateUser(ctx, m.db, data)
+	if err != nil {
+		return "", err
+	}
+
+	// The users' IDs are hex strings, not ObjectIDs like the other documents'
+	userID, ok := result.InsertedID.(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected user ID type %T", result.InsertedID)
+	}
+
+	return userID, nil
+}
+
+func (m *mongoStore) CreateRoom(ctx context.Context, data repositories.CreateRoomData) error {
+	_, err := repositories.CreateRoom(ctx, m.db, data)
+	return err
+}
+
+func (m *mongoStore) GetRoomIDsByTags(ctx context.Context, tags []string) ([]string, error) {
+	return repositories.GetRoomIDsByTags(ctx, m.db, tags)
+}
+
+func (m *mongoStore) CheckInvite(ctx context.Context, code string) (*repositories.Invite, error) {
+	return repositories.CheckInvite(ctx, m.db, code)
+}
+
+func (m *mongoStore) UseInvite(ctx context.Context, code string) (*repositories.Invite, error) {
+	return repositories.UseInvite(ctx, m.db, code)
+}
+
+func (m *mongoStore) ReleaseInvite(ctx context.Context, code string) error {
+	return repositories.ReleaseInvite(ctx, m.db, code)
+}
+
+func (m *mongoStore) CreateMessage(ctx context.Context, data repositories.CreateMessageData) (string, error) {
+	result, err := repositories.CreateMessage(ctx, m.db, data)
+	if err != nil {
+		return "", err
+	}
+
+	oid, ok := result.InsertedID.(primitive.ObjectID)
+	if !ok {
+		return "", nil
+	}
+
+	return oid.Hex(), nil
+}
+
+func (m *mongoStore) RecentMessages(ctx context.Context, roomID string, limit int64) ([]repositories.Message, error) {
+	cursor, err := repositories.GetMessages(ctx, m.db, repositories.GetMessagesData{
+		RoomID: roomID,
+		Limit:  limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []repositories.Message{}
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+func (m *mongoStore) GetMessages(ctx context.Context, data repositories.GetMessagesData) ([]repositories.Message, error) {
+	cursor, err := repositories.GetMessages(ctx, m.db, data)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	messages := []repositories.Message{}
+	for cursor.Next(ctx) {
+		var msg repositories.Message
+		if err := cursor.Decode(&msg); err != nil {
+			log.Error(ctx, "Failed to decode message", log.ErrAttr(err))
+			continue
+		}
+
+		messages = append(messages, msg)
+	}
+
+	return messages, nil
+}
+
+func (m *mongoStore) CountMessages(ctx context.Context, roomID string) (int64, error) {
+	return repositories.CountRoomMessages(ctx, m.db, repositories.GetTotalMessagesSentInARoomData{RoomID: roomID})
+}
+
+func (m *mongoStore) GetMessage(ctx context.Context, roomID string, messageID string) (*repositories.Message, error) {
+	return repositories.GetMessage(ctx, m.db, roomID, messageID)
+}
+
+func (m *mongoStore) GetMessagesByIDs(ctx context.Context, roomID string, messageIDs []string) ([]repositories.Message, error) {
+	return repositories.GetMessagesByIDs(ctx, m.db, roomID, messageIDs)
+}
+
+func (m *mongoStore) EditMessage(ctx context.Context, roomID string, messageID string, content string) (*repositories.Message, error) {
+	return repositories.EditMessage(ctx, m.db, roomID, messageID, content)
+}
+
+func (m *mongoStore) DeleteMessage(ctx context.Context, roomID string, messageID string) error {
+	return repositories.DeleteMessage(ctx, m.db, roomID, messageID)
+}
+
+func (m *mongoStore) CountPurgeableMessages(ctx context.Context, data repositories.PurgeMessagesData) (int64, error) {
+	return repositories.CountPurgeableMessages(ctx, m.db, data)
+}
+
+func (m *mongoStore) PurgeMessages(ctx context.Context, data repositories.PurgeMessagesData) ([]string, error) {
+	return repositories.PurgeMessages(ctx, m.db, data)
+}
+
+func (m *mongoStore) CreatePin(ctx context.Context, data repositories.CreatePinData) (*repositories.Pin, error) {
+	return repositories.CreatePin(ctx, m.db, data)
+}
+
+func (m *mongoStore) GetPins(ctx context.Context, data repositories.GetPinsData) ([]repositories.Pin, error) {
+	return repositories.GetPins(ctx, m.db, data)
+}
+
+func (m *mongoStore) DeletePin(ctx context.Context, roomID string, messageID string) error {
+	return repositories.DeletePin(ctx, m.db, roomID, messageID)
+}
+
+func (m *mongoStore) ReorderPins(ctx context.Context, roomID string, messageIDs []string) error {
+	return repositories.ReorderPins(ctx, m.db, roomID, messageIDs)
+}
+
+func (m *mongoStore) LockRoom(ctx context.Context, roomID string, userID string) (bool, error) {
+	return repositories.LockRoom(ctx, m.db, roomID, userID)
+}
+
+func (m *mongoStore) UnlockRoom(ctx context.Context, roomID string, userID string) (bool, error) {
+	return repositories.UnlockRoom(ctx, m.db, roomID, userID)
+}
+
+func (m *mongoStore) ExpireRoomLock(ctx context.Context, roomID string, userID string, cutoff time.Time) (bool, error) {
+	return repositories.ExpireRoomLock(ctx, m.db, roomID, userID, cutoff)
+}
+
+func (m *mongoStore) GetRoomsWithExpiredLocks(ctx context.Context, cutoff time.Time) ([]repositories.Room, error) {
+	return repositories.GetRoomsWithExpiredLocks(ctx, m.db, cutoff)
+}
@@ -0,0 +1,51 @@
+package chatservice
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/vit0rr/chat/config"
+	"github.com/vit0rr/chat/pkg/broker"
+	"github.com/vit0rr/chat/pkg/middleware"
+)
+
+func TestConfiguredTTLsAreAppliedToRedisKeys(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	ts := newTestServerOn(t, broker.NewRedis(client), func(c *config.Config) {
+		c.Chat.PresenceTTL = 600
+		c.Chat.RateLimitTTL = 7
+	})
+	ts.store.addRoom("lobby", "alice")
+	ts.addUser("alice", middleware.UserClaims{})
+
+	alice := ts.mustDial("alice", "lobby")
+	alice.sendText("hello", "")
+	alice.receive(ofType(AckMessage))
+
+	if got := mr.TTL("rate_limit:alice:last_msg"); got != 7*time.Second {
+		t.Errorf("rate limit key TTL = %s, want 7s", got)
+	}
+
+	// The connection hash is named after the connection ID
+	presenceKeys := []string{"user:alice:connections", "room:lobby:members", "room:lobby:connections"}
+	for _, key := range mr.Keys() {
+		if strings.HasPrefix(key, "client:alice:") {
+			presenceKeys = append(presenceKeys, key)
+		}
+	}
+	if len(presenceKeys) != 4 {
+		t.Fatalf("keys = %v, want the connection hash of alice", mr.Keys())
+	}
+
+	for _, key := range presenceKeys {
+		if got := mr.TTL(key); got != 10*time.Minute {
+			t.Errorf("%s TTL = %s, want 10m", key, got)
+		}
+	}
+}
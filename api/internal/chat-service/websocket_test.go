@@ -0,0 +1,470 @@
+package chatservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/config"
+	"github.com/vit0rr/chat/pkg/middleware"
+)
+
+func TestWebSocketMessageIsStoredAndDelivered(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice", "bob")
+	ts.addUser("alice", middleware.UserClaims{})
+	ts.addUser("bob", middleware.UserClaims{})
+
+	alice := ts.mustDial("alice", "lobby")
+	bob := ts.mustDial("bob", "lobby")
+
+	alice.sendText("hello", "msg-1")
+
+	ack := alice.receive(ofType(AckMessage))
+	if ack.ID == "" {
+		t.Fatal("ack has no message ID")
+	}
+	if ack.Metadata["client_msg_id"] != "msg-1" {
+		t.Errorf("ack client_msg_id = %v, want msg-1", ack.Metadata["client_msg_id"])
+	}
+
+	received := bob.receive(withContent(TextMessage, "hello"))
+	if received.ID != ack.ID {
+		t.Errorf("received ID = %q, want the acked %q", received.ID, ack.ID)
+	}
+	if received.SenderId != "alice" || received.Nickname != "alice" {
+		t.Errorf("received from %q (%q), want alice", received.SenderId, received.Nickname)
+	}
+	if _, ok := received.Metadata[senderConnectionKey]; ok {
+		t.Error("the sender connection leaked to the other clients")
+	}
+
+	// Neither a second copy for the other client nor an echo for the sender
+	bob.expectNone(300*time.Millisecond, withContent(TextMessage, "hello"))
+	alice.expectNone(0, withContent(TextMessage, "hello"))
+
+	stored := ts.store.roomMessages("lobby", TextMessage)
+	if len(stored) != 1 {
+		t.Fatalf("stored %d messages, want 1", len(stored))
+	}
+	if stored[0].ID.Hex() != ack.ID || stored[0].Message != "hello" || stored[0].FromUserID != "alice" {
+		t.Errorf("stored %+v, want alice's hello with ID %s", stored[0], ack.ID)
+	}
+}
+
+func TestWebSocketResendIsNotStoredTwice(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice")
+	ts.addUser("alice", middleware.UserClaims{})
+
+	alice := ts.mustDial("alice", "lobby")
+
+	alice.sendText("hello", "msg-1")
+	first := alice.receive(ofType(AckMessage))
+
+	// A resend is acked with the stored message, the rate limit doesn't apply to it
+	alice.sendText("hello", "msg-1")
+	second := alice.receive(ofType(AckMessage))
+
+	if second.ID != first.ID {
+		t.Errorf("resend acked %q, want the first message %q", second.ID, first.ID)
+	}
+	if stored := ts.store.roomMessages("lobby", TextMessage); len(stored) != 1 {
+		t.Errorf("stored %d messages, want 1", len(stored))
+	}
+}
+
+func TestWebSocketRateLimit(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice", "bob")
+	ts.addUser("alice", middleware.UserClaims{})
+	ts.addUser("bob", middleware.UserClaims{})
+
+	alice := ts.mustDial("alice", "lobby")
+	bob := ts.mustDial("bob", "lobby")
+
+	alice.sendText("first", "")
+	alice.receive(ofType(AckMessage))
+
+	alice.sendText("second", "")
+	alice.receive(func(msg ChatMessage) bool {
+		return msg.Type == SystemMessage && strings.HasPrefix(msg.Content, "Please wait")
+	})
+
+	bob.receive(withContent(TextMessage, "first"))
+	bob.expectNone(300*time.Millisecond, withContent(TextMessage, "second"))
+
+	if stored := ts.store.roomMessages("lobby", TextMessage); len(stored) != 1 {
+		t.Fatalf("stored %d messages, want 1", len(stored))
+	}
+
+	// The limit is per user, the other members can still send
+	bob.sendText("hi", "")
+	bob.receive(ofType(AckMessage))
+	alice.receive(withContent(TextMessage, "hi"))
+}
+
+func TestWebSocketRoomLock(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice", "bob")
+	ts.addUser("alice", middleware.UserClaims{})
+	ts.addUser("bob", middleware.UserClaims{})
+
+	alice := ts.mustDial("alice", "lobby")
+	bob := ts.mustDial("bob", "lobby")
+
+	if status, _ := ts.post("alice", "/rooms/lobby/lock", LockRoomBody{UserID: "alice"}); status != http.StatusOK {
+		t.Fatalf("lock status = %d, want 200", status)
+	}
+	bob.receive(withContent(SystemMessage, "Room has been locked by alice"))
+
+	// Only the lock holder can lock it again
+	if status, _ := ts.post("bob", "/rooms/lobby/lock", LockRoomBody{UserID: "bob"}); status != http.StatusConflict {
+		t.Errorf("lock by another member status = %d, want 409", status)
+	}
+
+	bob.sendText("let me talk", "")
+	bob.receive(withContent(SystemMessage, constants.ErrorMessages[constants.RoomLocked].Message))
+	if stored := ts.store.roomMessages("lobby", TextMessage); len(stored) != 0 {
+		t.Fatalf("stored %d messages in the locked room, want 0", len(stored))
+	}
+
+	// The holder sending a message releases the lock
+	alice.sendText("done", "")
+	alice.receive(ofType(AckMessage))
+	bob.receive(withContent(TextMessage, "done"))
+
+	room, err := ts.store.GetRoom(t.Context(), "lobby")
+	if err != nil {
+		t.Fatalf("get room: %v", err)
+	}
+	if room.LockedBy != "" {
+		t.Errorf("room still locked by %q", room.LockedBy)
+	}
+}
+
+func TestWebSocketRejectsUnauthorized(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice")
+	ts.store.addRoom("other", "alice")
+	ts.addUser("alice", middleware.UserClaims{})
+	ts.addUser("mallory", middleware.UserClaims{})
+	ts.addUser("scoped", middleware.UserClaims{UserID: "alice", Rooms: []string{"other"}})
+
+	tests := []struct {
+		name       string
+		token      string
+		roomID     string
+		wantStatus int
+		wantError  string
+	}{
+		{"unknown token", "forged", "lobby", http.StatusUnauthorized, constants.InvalidToken},
+		{"not a member", "mallory", "lobby", http.StatusForbidden, constants.UserNotRoomMember},
+		{"token scoped to another room", "scoped", "lobby", http.StatusForbidden, constants.RoomNotInToken},
+		{"unknown room", "alice", "missing", http.StatusNotFound, constants.RoomNotFound},
+		{"invalid room ID", "alice", "no%20spaces", http.StatusBadRequest, constants.InvalidRoomID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, resp := ts.dial(tt.token, tt.roomID)
+			if client != nil {
+				t.Fatal("connection upgraded, want it rejected")
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+
+			var body ErrorResponse
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("decode error body: %v", err)
+			}
+			if want := constants.ErrorMessages[tt.wantError].ID; body.ErrorID != want {
+				t.Errorf("error_id = %q, want %q", body.ErrorID, want)
+			}
+		})
+	}
+
+	// The REST send checks the membership too
+	if status, _ := ts.post("mallory", "/rooms/lobby/messages", SendMessageBody{Content: "hi"}); status != http.StatusForbidden {
+		t.Errorf("send by a non-member status = %d, want 403", status)
+	}
+	if stored := ts.store.roomMessages("lobby", TextMessage); len(stored) != 0 {
+		t.Errorf("stored %d messages, want 0", len(stored))
+	}
+}
+
+func TestWebSocketShutdown(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice", "bob")
+	ts.addUser("alice", middleware.UserClaims{})
+	ts.addUser("bob", middleware.UserClaims{})
+
+	alice := ts.mustDial("alice", "lobby")
+
+	ts.service.Shutdown(t.Context())
+
+	alice.receive(withContent(SystemMessage, "Server is restarting, please reconnect"))
+	// Then the connection is closed
+	alice.expectNone(5*time.Second, func(ChatMessage) bool { return true })
+	if _, ok := <-alice.messages; ok {
+		t.Fatal("connection still open after the shutdown")
+	}
+
+	// The clients reconnect to another instance meanwhile
+	client, resp := ts.dial("bob", "lobby")
+	if client != nil {
+		t.Fatal("connection upgraded during the shutdown, want it rejected")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", resp.StatusCode)
+	}
+}
+
+func TestRemovedMemberIsToldBeforeTheConnectionCloses(t *testing.T) {
+	ts := newTestServer(t, func(cfg *config.Config) {
+		cfg.Chat.MembershipCheckInterval = 1
+	})
+	ts.store.addRoom("lobby", "alice")
+	ts.addUser("alice", middleware.UserClaims{})
+
+	alice := ts.mustDial("alice", "lobby")
+	ts.store.removeMember("lobby", "alice")
+
+	errorID := constants.ErrorMessages[constants.UserNotRoomMember].ID
+	alice.receive(func(msg ChatMessage) bool {
+		return msg.Type == SystemMessage && msg.Metadata["error_id"] == errorID
+	})
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-alice.messages:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("connection still open after the removal")
+		}
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	withOrigins := func(cfg *config.Config) {
+		cfg.CORS.AllowedOrigins = []string{"https://app.example.com", "https://*.example.org"}
+	}
+
+	tests := []struct {
+		name         string
+		insecure     bool
+		origin       string
+		wantUpgraded bool
+	}{
+		{"allowed origin", false, "https://app.example.com", true},
+		{"allowed subdomain", false, "https://chat.example.org", true},
+		{"disallowed origin", false, "https://evil.example.com", false},
+		{"lookalike of an allowed origin", false, "https://app.example.com.evil.net", false},
+		{"missing origin", false, "", true},
+		{"any origin when insecure", true, "https://evil.example.com", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, withOrigins, func(cfg *config.Config) {
+				cfg.CORS.InsecureWebSocketOrigins = tt.insecure
+			})
+			ts.store.addRoom("lobby", "alice")
+			ts.addUser("alice", middleware.UserClaims{})
+
+			header := http.Header{}
+			if tt.origin != "" {
+				header.Set("Origin", tt.origin)
+			}
+
+			url := "ws" + strings.TrimPrefix(ts.server.URL, "http") + "/ws?token=alice&room_id=lobby"
+			conn, resp, err := websocket.Dial(t.Context(), url, &websocket.DialOptions{HTTPHeader: header})
+			if conn != nil {
+				defer conn.Close(websocket.StatusNormalClosure, "")
+			}
+
+			if upgraded := err == nil; upgraded != tt.wantUpgraded {
+				t.Fatalf("upgraded = %v (%v), want %v", upgraded, err, tt.wantUpgraded)
+			}
+			if !tt.wantUpgraded && resp.StatusCode != http.StatusForbidden {
+				t.Errorf("status = %d, want 403", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestWebSocketUserComesFromTheToken(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice", "bob")
+	ts.addUser("alice-session", middleware.UserClaims{UserID: "alice", Nickname: "Alice from the token"})
+	ts.addUser("bob", middleware.UserClaims{})
+	bob := ts.mustDial("bob", "lobby")
+
+	// The user_id query param must match the token, it can't pick another user
+	client, resp := ts.dialQuery("token=alice-session&room_id=lobby&user_id=bob")
+	if client != nil {
+		t.Fatal("connection upgraded with another user's ID, want it rejected")
+	}
+	defer resp.Body.Close()
+
+	var body ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode error body: %v", err)
+	}
+	if want := constants.ErrorMessages[constants.UserIDMismatch].ID; resp.StatusCode != http.StatusForbidden || body.ErrorID != want {
+		t.Fatalf("mismatched user_id status = %d %q, want 403 %s", resp.StatusCode, body.ErrorID, want)
+	}
+
+	// The nickname query param is ignored too, messages go out under the member nickname
+	alice, resp := ts.dialQuery("token=alice-session&room_id=lobby&user_id=alice&nickname=bob")
+	if alice == nil {
+		t.Fatalf("dial: status %d", resp.StatusCode)
+	}
+	alice.ready()
+
+	alice.sendText("hello", "")
+	alice.receive(ofType(AckMessage))
+	received := bob.receive(withContent(TextMessage, "hello"))
+	if received.SenderId != "alice" || received.Nickname != "alice" {
+		t.Errorf("received from %q as %q, want alice as the member nickname alice", received.SenderId, received.Nickname)
+	}
+
+	stored := ts.store.roomMessages("lobby", TextMessage)
+	if len(stored) != 1 || stored[0].FromUserID != "alice" || stored[0].Nickname != "alice" {
+		t.Errorf("stored %+v, want alice's message under the member nickname", stored)
+	}
+}
+
+func TestHistoryCount(t *testing.T) {
+	ts := newTestServer(t, func(cfg *config.Config) {
+		cfg.Chat.HistoryReplay = 5
+		cfg.Chat.MaxHistoryReplay = 20
+	})
+
+	tests := []struct {
+		name      string
+		query     string
+		wantCount int64
+		wantOK    bool
+	}{
+		{"default", "", 5, true},
+		{"requested", "history=10", 10, true},
+		{"none", "history=0", 0, true},
+		{"clamped to the max", "history=100", 20, true},
+		{"skipped", "skip_history=true", 0, true},
+		{"skipped whatever the history", "skip_history=true&history=10", 0, true},
+		{"not skipped", "skip_history=false", 5, true},
+		{"negative", "history=-1", 0, false},
+		{"not a number", "history=all", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatalf("parse query: %v", err)
+			}
+
+			count, ok := ts.service.historyCount(query)
+			if count != tt.wantCount || ok != tt.wantOK {
+				t.Errorf("historyCount(%q) = %d, %v, want %d, %v", tt.query, count, ok, tt.wantCount, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestWebSocketSkipHistory(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice")
+	ts.addUser("alice", middleware.UserClaims{})
+	ts.broadcastText("lobby", "alice", "first", time.Now().Add(-time.Minute))
+	ts.broadcastText("lobby", "alice", "second", time.Now())
+
+	replayed, resp := ts.dialQuery("history_batch=true&token=alice&room_id=lobby")
+	if replayed == nil {
+		t.Fatalf("dial: status %d", resp.StatusCode)
+	}
+	if history := replayed.receive(ofType(HistoryMessage)); len(history.Messages) != 2 {
+		t.Errorf("replayed %d messages, want 2", len(history.Messages))
+	}
+
+	skipped, resp := ts.dialQuery("history_batch=true&skip_history=true&token=alice&room_id=lobby")
+	if skipped == nil {
+		t.Fatalf("dial: status %d", resp.StatusCode)
+	}
+	skipped.ready()
+	skipped.expectNone(200*time.Millisecond, ofType(HistoryMessage))
+}
+
+func TestWebSocketRejectsInvalidRoomIDs(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser("alice", middleware.UserClaims{})
+
+	for _, roomID := range []string{"", "dot.room", "room%20id", "room%2F..", strings.Repeat("a", MaxRoomIDLen+1)} {
+		t.Run(roomID, func(t *testing.T) {
+			client, resp := ts.dialQuery("token=alice&room_id=" + roomID)
+			if client != nil {
+				t.Fatal("connection upgraded, want it rejected")
+			}
+			defer resp.Body.Close()
+
+			var body ErrorResponse
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("decode error body: %v", err)
+			}
+			if want := constants.ErrorMessages[constants.InvalidRoomID].ID; resp.StatusCode != http.StatusBadRequest || body.ErrorID != want {
+				t.Errorf("status = %d %q, want 400 %s", resp.StatusCode, body.ErrorID, want)
+			}
+		})
+	}
+}
+
+func TestWebSocketOversizedFrame(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addRoom("lobby", "alice")
+	ts.addUser("alice", middleware.UserClaims{})
+
+	alice := ts.mustDial("alice", "lobby")
+
+	// Content just over the limit fits in a frame, it's answered with an error
+	alice.sendText(strings.Repeat("a", MaxMessageLen+1), "")
+	alice.receive(withContent(SystemMessage, fmt.Sprintf("Message exceeds maximum length of %d characters", MaxMessageLen)))
+
+	// A frame over the read limit closes the connection unread
+	if err := alice.conn.Write(t.Context(), websocket.MessageText, make([]byte, MaxFrameSize+1)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-alice.messages:
+			if ok {
+				continue
+			}
+			if status := websocket.CloseStatus(alice.readErr); status != websocket.StatusMessageTooBig {
+				t.Errorf("close status = %d (%v), want %d", status, alice.readErr, websocket.StatusMessageTooBig)
+			}
+			if stored := ts.store.roomMessages("lobby", TextMessage); len(stored) != 0 {
+				t.Errorf("stored %d messages, want none", len(stored))
+			}
+			return
+		case <-timeout:
+			t.Fatal("connection still open after the oversized frame")
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package clientservice
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/vit0rr/chat/pkg/deps"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type ErrorResponse struct {
+	Error   string `json:"error"`
+	Code    int    `json:"code"`
+	ErrorID string `json:"error_id"`
+}
+
+// StatusCode is the status the response is answered with
+func (e ErrorResponse) StatusCode() int {
+	return e.Code
+}
+
+type HTTP struct {
+	service *Service
+}
+
+func NewHTTP(deps *deps.Deps, db *mongo.Database) *HTTP {
+	return &HTTP{
+		service: NewService(deps, db),
+	}
+}
+
+func (h *HTTP) CreateClient(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	result, svcErr := h.service.CreateClient(r.Context(), r.Body)
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) GetClients(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	result, svcErr := h.service.GetClients(r.Context())
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) GetClient(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	clientID := chi.URLParam(r, "clientId")
+
+	result, svcErr := h.service.GetClient(r.Context(), clientID)
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) UpdateClient(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	clientID := chi.URLParam(r, "clientId")
+
+	result, svcErr := h.service.UpdateClient(r.Context(), clientID, r.Body)
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) DeleteClient(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	clientID := chi.URLParam(r, "clientId")
+
+	result, svcErr := h.service.DeleteClient(r.Context(), clientID)
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) SetScopes(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	clientID := chi.URLParam(r, "clientId")
+
+	result, svcErr := h.service.SetScopes(r.Context(), clientID, r.Body)
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) RotateAPIKey(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	clientID := chi.URLParam(r, "clientId")
+
+	result, svcErr := h.service.RotateAPIKey(r.Context(), clientID)
+	return respond(w, result, svcErr)
+}
+
+func respond(w http.ResponseWriter, result interface{}, svcErr Error) (interface{}, error) {
+	if svcErr.ErrorMessage != nil {
+		code := http.StatusInternalServerError
+		if svcErr.ErrorCode != nil {
+			code = *svcErr.ErrorCode
+		}
+		return ErrorResponse{
+			Error:   *svcErr.ErrorMessage,
+			Code:    code,
+			ErrorID: *svcErr.ErrorID,
+		}, nil
+	}
+
+	return result, nil
+}
@@ -0,0 +1,326 @@
+package clientservice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/pkg/database/repositories"
+	"github.com/vit0rr/chat/pkg/deps"
+	"github.com/vit0rr/chat/pkg/log"
+	"github.com/vit0rr/chat/pkg/middleware"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// apiKeyPrefix makes the client API keys recognizable
+const apiKeyPrefix = "ck_"
+
+type Service struct {
+	deps  *deps.Deps
+	Mongo *mongo.Database
+}
+
+// CreateClientBody is the body of the create client
+type CreateClientBody struct {
+	Name     string   `json:"name"`
+	ReadOnly bool     `json:"read_only"`
+	Scopes   []string `json:"scopes"`
+	Tier     string   `json:"tier"` // Picks the room_creation limit, the default limit applies when empty or unknown
+}
+
+// UpdateClientBody is the body of the update client, only the set fields are updated
+type UpdateClientBody struct {
+	Name     *string `json:"name"`
+	ReadOnly *bool   `json:"read_only"`
+	Tier     *string `json:"tier"`
+}
+
+type ClientsList struct {
+	Clients []repositories.Client `json:"clients"`
+}
+
+// SetScopesBody is the body of the set client scopes
+type SetScopesBody struct {
+	Scopes []string `json:"scopes"`
+}
+
+// ClientWithAPIKey is returned when an API key is generated. The API key
+// is never stored, so it can't be retrieved again.
+type ClientWithAPIKey struct {
+	*repositories.Client
+	APIKey string `json:"api_key"`
+}
+
+type Error struct {
+	ErrorMessage *string `json:"error_message"`
+	ErrorID      *string `json:"error_id"`
+	ErrorCode    *int    `json:"error_code"`
+}
+
+func NewService(deps *deps.Deps, db *mongo.Database) *Service {
+	return &Service{
+		deps:  deps,
+		Mongo: db,
+	}
+}
+
+// @summary Create Client
+// @description Creates an integration client with a generated API key. The API key is only returned in this response.
+// @tags clients
+// @router /api/v1/clients [post]
+// @param X-Admin-Key header string true "Admin key"
+// @param body body CreateClientBody true "Client name, read-only flag and scopes"
+// @produce application/json
+// @success 200 {object} ClientWithAPIKey "Client created"
+// @failure 400 {object} Error "Missing name or unknown scopes"
+// @failure 403 {object} Error "Invalid admin key"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) CreateClient(ctx context.Context, b io.ReadCloser) (interface{}, Error) {
+	defer b.Close()
+
+	var body CreateClientBody
+	if err := json.NewDecoder(b).Decode(&body); err != nil {
+		log.Error(ctx, "Failed to decode CreateClientBody", log.ErrAttr(err))
+		return nil, newError(constants.FailedToDecodeBody)
+	}
+
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" || !validScopes(body.Scopes) {
+		return nil, newError(constants.InvalidClient)
+	}
+
+	apiKey, err := generateAPIKey()
+	if err != nil {
+		log.Error(ctx, "Failed to generate API key", log.ErrAttr(err))
+		return nil, newError(constants.FailedToCreateClient)
+	}
+
+	client, err := repositories.CreateClient(ctx, s.Mongo, repositories.CreateClientData{
+		Name:     body.Name,
+		APIKey:   apiKey,
+		ReadOnly: body.ReadOnly,
+		Scopes:   body.Scopes,
+		Tier:     strings.TrimSpace(body.Tier),
+	})
+	if err != nil {
+		return nil, newError(constants.FailedToCreateClient)
+	}
+
+	return ClientWithAPIKey{Client: client, APIKey: apiKey}, Error{}
+}
+
+// @summary List Clients
+// @description Lists the integration clients. API keys are never returned.
+// @tags clients
+// @router /api/v1/clients [get]
+// @param X-Admin-Key header string true "Admin key"
+// @produce application/json
+// @success 200 {object} ClientsList "Clients"
+// @failure 403 {object} Error "Invalid admin key"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) GetClients(ctx context.Context) (interface{}, Error) {
+	clients, err := repositories.GetClients(ctx, s.Mongo)
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	return ClientsList{Clients: clients}, Error{}
+}
+
+// @summary Get Client
+// @description Returns an integration client
+// @tags clients
+// @router /api/v1/clients/{clientId} [get]
+// @param X-Admin-Key header string true "Admin key"
+// @param clientId path string true "Client ID"
+// @produce application/json
+// @success 200 {object} repositories.Client "Client"
+// @failure 403 {object} Error "Invalid admin key"
+// @failure 404 {object} Error "Client not found"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) GetClient(ctx context.Context, clientID string) (interface{}, Error) {
+	client, err := repositories.GetClient(ctx, s.Mongo, repositories.GetClientData{ClientID: clientID})
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	return client, Error{}
+}
+
+// @summary Update Client
+// @description Updates the name, read-only flag or tier of an integration client
+// @tags clients
+// @router /api/v1/clients/{clientId} [patch]
+// @param X-Admin-Key header string true "Admin key"
+// @param clientId path string true "Client ID"
+// @param body body UpdateClientBody true "Fields to update"
+// @produce application/json
+// @success 200 {object} repositories.Client "Client updated"
+// @failure 400 {object} Error "Empty name"
+// @failure 403 {object} Error "Invalid admin key"
+// @failure 404 {object} Error "Client not found"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) UpdateClient(ctx context.Context, clientID string, b io.ReadCloser) (interface{}, Error) {
+	defer b.Close()
+
+	var body UpdateClientBody
+	if err := json.NewDecoder(b).Decode(&body); err != nil {
+		log.Error(ctx, "Failed to decode UpdateClientBody", log.ErrAttr(err))
+		return nil, newError(constants.FailedToDecodeBody)
+	}
+
+	if body.Name != nil {
+		name := strings.TrimSpace(*body.Name)
+		if name == "" {
+			return nil, newError(constants.InvalidClient)
+		}
+		body.Name = &name
+	}
+
+	if body.Tier != nil {
+		tier := strings.TrimSpace(*body.Tier)
+		body.Tier = &tier
+	}
+
+	if _, err := repositories.UpdateClient(ctx, s.Mongo, repositories.UpdateClientData{
+		ClientID: clientID,
+		Name:     body.Name,
+		ReadOnly: body.ReadOnly,
+		Tier:     body.Tier,
+	}); err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	return s.GetClient(ctx, clientID)
+}
+
+// @summary Delete Client
+// @description Deletes an integration client, its API key stops working immediately
+// @tags clients
+// @router /api/v1/clients/{clientId} [delete]
+// @param X-Admin-Key header string true "Admin key"
+// @param clientId path string true "Client ID"
+// @produce application/json
+// @success 200 {object} map[string]string "Client deleted"
+// @failure 403 {object} Error "Invalid admin key"
+// @failure 404 {object} Error "Client not found"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) DeleteClient(ctx context.Context, clientID string) (interface{}, Error) {
+	if err := repositories.DeleteClient(ctx, s.Mongo, clientID); err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	log.Warn(ctx, "Client deleted", log.AnyAttr("client_id", clientID))
+
+	return map[string]string{"message": "Client deleted successfully"}, Error{}
+}
+
+// @summary Set Client Scopes
+// @description Replaces the scopes granted to the client
+// @tags clients
+// @router /api/v1/clients/{clientId}/scopes [put]
+// @param X-Admin-Key header string true "Admin key"
+// @param clientId path string true "Client ID"
+// @param body body SetScopesBody true "Scopes granted to the client"
+// @produce application/json
+// @success 200 {object} repositories.Client "Client updated"
+// @failure 400 {object} Error "Unknown scopes"
+// @failure 403 {object} Error "Invalid admin key"
+// @failure 404 {object} Error "Client not found"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) SetScopes(ctx context.Context, clientID string, b io.ReadCloser) (interface{}, Error) {
+	defer b.Close()
+
+	var body SetScopesBody
+	if err := json.NewDecoder(b).Decode(&body); err != nil {
+		log.Error(ctx, "Failed to decode SetScopesBody", log.ErrAttr(err))
+		return nil, newError(constants.FailedToDecodeBody)
+	}
+
+	if !validScopes(body.Scopes) {
+		return nil, newError(constants.InvalidClient)
+	}
+
+	if _, err := repositories.UpdateClient(ctx, s.Mongo, repositories.UpdateClientData{
+		ClientID: clientID,
+		Scopes:   &body.Scopes,
+	}); err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	client, err := repositories.GetClient(ctx, s.Mongo, repositories.GetClientData{ClientID: clientID})
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	return client, Error{}
+}
+
+// @summary Rotate Client API Key
+// @description Replaces the client's API key with a generated one. The previous key keeps working for the configured grace period, and the new one is only returned in this response.
+// @tags clients
+// @router /api/v1/clients/{clientId}/rotate-key [post]
+// @param X-Admin-Key header string true "Admin key"
+// @param clientId path string true "Client ID"
+// @produce application/json
+// @success 200 {object} ClientWithAPIKey "API key rotated"
+// @failure 403 {object} Error "Invalid admin key"
+// @failure 404 {object} Error "Client not found"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) RotateAPIKey(ctx context.Context, clientID string) (interface{}, Error) {
+	apiKey, err := generateAPIKey()
+	if err != nil {
+		log.Error(ctx, "Failed to generate API key", log.ErrAttr(err))
+		return nil, newError(constants.FailedToUpdateClient)
+	}
+
+	client, err := repositories.RotateAPIKey(ctx, s.Mongo, repositories.RotateAPIKeyData{
+		ClientID:    clientID,
+		APIKey:      apiKey,
+		GracePeriod: time.Duration(s.deps.Config.APIKeyGracePeriod) * time.Second,
+	})
+	if err != nil {
+		return nil, newError(repositories.ErrorKey(err))
+	}
+
+	log.Warn(ctx, "Client API key rotated",
+		log.AnyAttr("client_id", clientID),
+		log.AnyAttr("previous_api_key_expires_at", client.PreviousAPIKeyExpiresAt))
+
+	return ClientWithAPIKey{Client: client, APIKey: apiKey}, Error{}
+}
+
+// generateAPIKey returns a random API key with 256 bits of entropy
+func generateAPIKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	return apiKeyPrefix + hex.EncodeToString(key), nil
+}
+
+func validScopes(scopes []string) bool {
+	for _, scope := range scopes {
+		if !slices.Contains(middleware.Scopes, scope) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newError(errKey string) Error {
+	errMsg := constants.ErrorMessages[errKey]
+	return Error{
+		ErrorMessage: &errMsg.Message,
+		ErrorID:      &errMsg.ID,
+		ErrorCode:    &errMsg.Code,
+	}
+}
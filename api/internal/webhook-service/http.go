@@ -0,0 +1,71 @@
+package webhookservice
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/vit0rr/chat/pkg/database/repositories"
+	"github.com/vit0rr/chat/pkg/deps"
+	"github.com/vit0rr/chat/pkg/middleware"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type ErrorResponse struct {
+	Error   string `json:"error"`
+	Code    int    `json:"code"`
+	ErrorID string `json:"error_id"`
+}
+
+// StatusCode is the status the response is answered with
+func (e ErrorResponse) StatusCode() int {
+	return e.Code
+}
+
+type HTTP struct {
+	service *Service
+}
+
+func NewHTTP(deps *deps.Deps, db *mongo.Database) *HTTP {
+	return &HTTP{
+		service: NewService(deps, db),
+	}
+}
+
+func (h *HTTP) CreateWebhook(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	result, svcErr := h.service.CreateWebhook(r.Context(), requestClient(r), r.Body)
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) GetWebhooks(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	result, svcErr := h.service.GetWebhooks(r.Context(), requestClient(r))
+	return respond(w, result, svcErr)
+}
+
+func (h *HTTP) DeleteWebhook(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	webhookID := chi.URLParam(r, "webhookId")
+
+	result, svcErr := h.service.DeleteWebhook(r.Context(), requestClient(r), webhookID)
+	return respond(w, result, svcErr)
+}
+
+// requestClient returns the client authenticated by its API key, if any
+func requestClient(r *http.Request) *repositories.Client {
+	client, _ := r.Context().Value(middleware.ClientContextKey).(*repositories.Client)
+	return client
+}
+
+func respond(w http.ResponseWriter, result interface{}, svcErr Error) (interface{}, error) {
+	if svcErr.ErrorMessage != nil {
+		code := http.StatusInternalServerError
+		if svcErr.ErrorCode != nil {
+			code = *svcErr.ErrorCode
+		}
+		return ErrorResponse{
+			Error:   *svcErr.ErrorMessage,
+			Code:    code,
+			ErrorID: *svcErr.ErrorID,
+		}, nil
+	}
+
+	return result, nil
+}
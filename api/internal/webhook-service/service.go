@@ -0,0 +1,173 @@
+package webhookservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/pkg/database/repositories"
+	"github.com/vit0rr/chat/pkg/deps"
+	"github.com/vit0rr/chat/pkg/log"
+	"github.com/vit0rr/chat/pkg/webhooks"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type Service struct {
+	deps  *deps.Deps
+	Mongo *mongo.Database
+}
+
+// CreateWebhookBody is the body of the create webhook
+type CreateWebhookBody struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Rooms  []string `json:"rooms,omitempty"` // Rooms of the client to get the events of, every one when empty
+}
+
+type WebhooksList struct {
+	Webhooks []repositories.Webhook `json:"webhooks"`
+}
+
+type Error struct {
+	ErrorMessage *string `json:"error_message"`
+	ErrorID      *string `json:"error_id"`
+	ErrorCode    *int    `json:"error_code"`
+}
+
+func NewService(deps *deps.Deps, db *mongo.Database) *Service {
+	return &Service{
+		deps:  deps,
+		Mongo: db,
+	}
+}
+
+// @summary Register Webhook
+// @description Registers an URL that receives the subscribed events of the rooms created with the client's API key, as signed JSON POSTs. The X-Chat-Signature header holds the hex HMAC-SHA256 of the body, keyed with the hex SHA-256 of the client's API key. The URL must resolve to public addresses.
+// @tags webhooks
+// @router /api/v1/webhooks [post]
+// @param X-API-Key header string true "Client API key"
+// @param body body CreateWebhookBody true "Webhook URL, events (message.created, member.joined, member.left, room.locked, room.unlocked) and optionally the rooms of the client"
+// @produce application/json
+// @success 200 {object} repositories.Webhook "Webhook registered"
+// @failure 400 {object} Error "Invalid URL, events or rooms"
+// @failure 403 {object} Error "A client API key is required"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) CreateWebhook(ctx context.Context, client *repositories.Client, b io.ReadCloser) (interface{}, Error) {
+	defer b.Close()
+
+	if client == nil {
+		return nil, newError(constants.ClientKeyRequired)
+	}
+
+	var body CreateWebhookBody
+	if err := json.NewDecoder(b).Decode(&body); err != nil {
+		log.Error(ctx, "Failed to decode CreateWebhookBody", log.ErrAttr(err))
+		return nil, newError(constants.FailedToDecodeBody)
+	}
+
+	if !isValidWebhookURL(ctx, body.URL) || len(body.Events) == 0 {
+		return nil, newError(constants.InvalidWebhook)
+	}
+
+	for _, event := range body.Events {
+		if !slices.Contains(webhooks.Events, event) {
+			return nil, newError(constants.InvalidWebhook)
+		}
+	}
+
+	rooms := slices.Compact(slices.Sorted(slices.Values(body.Rooms)))
+	if len(rooms) > 0 {
+		owned, err := repositories.CountClientRooms(ctx, s.Mongo, client.ID, rooms)
+		if err != nil {
+			return nil, newError(constants.FailedToCreateWebhook)
+		}
+
+		// Clients only get the events of their own rooms
+		if owned != int64(len(rooms)) {
+			log.Warn(ctx, "Rejected webhook for rooms of another client", log.AnyAttr("client_id", client.ID))
+			return nil, newError(constants.InvalidWebhook)
+		}
+	}
+
+	webhook, err := repositories.CreateWebhook(ctx, s.Mongo, repositories.CreateWebhookData{
+		ClientID: client.ID,
+		URL:      body.URL,
+		Events:   body.Events,
+		Rooms:    rooms,
+	})
+	if err != nil {
+		return nil, newError(constants.FailedToCreateWebhook)
+	}
+
+	return webhook, Error{}
+}
+
+// @summary List Webhooks
+// @description Lists the webhooks registered by the client
+// @tags webhooks
+// @router /api/v1/webhooks [get]
+// @param X-API-Key header string true "Client API key"
+// @produce application/json
+// @success 200 {object} WebhooksList "Webhooks of the client"
+// @failure 403 {object} Error "A client API key is required"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) GetWebhooks(ctx context.Context, client *repositories.Client) (interface{}, Error) {
+	if client == nil {
+		return nil, newError(constants.ClientKeyRequired)
+	}
+
+	clientWebhooks, err := repositories.GetClientWebhooks(ctx, s.Mongo, client.ID)
+	if err != nil {
+		return nil, newError(constants.FailedToGetWebhooks)
+	}
+
+	return WebhooksList{Webhooks: clientWebhooks}, Error{}
+}
+
+// @summary Delete Webhook
+// @description Deletes one of the client's webhooks
+// @tags webhooks
+// @router /api/v1/webhooks/{webhookId} [delete]
+// @param X-API-Key header string true "Client API key"
+// @param webhookId path string true "Webhook ID"
+// @produce application/json
+// @success 200 {object} map[string]string "Webhook deleted"
+// @failure 403 {object} Error "A client API key is required"
+// @failure 404 {object} Error "Webhook not found"
+// @failure 500 {object} Error "Internal server error"
+func (s *Service) DeleteWebhook(ctx context.Context, client *repositories.Client, webhookID string) (interface{}, Error) {
+	if client == nil {
+		return nil, newError(constants.ClientKeyRequired)
+	}
+
+	if err := repositories.DeleteWebhook(ctx, s.Mongo, client.ID, webhookID); err != nil {
+		if errors.Is(err, repositories.ErrWebhookNotFound) {
+			return nil, newError(constants.WebhookNotFound)
+		}
+		return nil, newError(constants.FailedToGetWebhooks)
+	}
+
+	return map[string]string{"message": "Webhook deleted successfully"}, Error{}
+}
+
+// isValidWebhookURL tells whether the URL is an HTTP(S) URL of a public host
+func isValidWebhookURL(ctx context.Context, rawURL string) bool {
+	if err := webhooks.ValidateURL(ctx, rawURL); err != nil {
+		log.Warn(ctx, "Rejected webhook URL", log.AnyAttr("url", rawURL), log.ErrAttr(err))
+		return false
+	}
+
+	return true
+}
+
+func newError(errKey string) Error {
+	errMsg := constants.ErrorMessages[errKey]
+	return Error{
+		ErrorMessage: &errMsg.Message,
+		ErrorID:      &errMsg.ID,
+		ErrorCode:    &errMsg.Code,
+	}
+}
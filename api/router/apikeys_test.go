@@ -0,0 +1,46 @@
+package router
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/vit0rr/chat/pkg/database/repositories"
+	"github.com/vit0rr/chat/pkg/middleware"
+)
+
+func TestClientKeysNeedTheRouteScope(t *testing.T) {
+	tr := newTestRouter(t)
+	tr.accounts.addClient("rooms-reader-key", repositories.Client{
+		ID:     "rooms-reader",
+		Scopes: []string{middleware.ScopeRoomsRead},
+	})
+	tr.accounts.addClient("every-scope-key", repositories.Client{
+		ID:     "every-scope",
+		Scopes: middleware.Scopes,
+	})
+	alice := token(t, testJWTSecret, "alice", nil)
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		apiKey      string
+		wantStatus  int
+		wantErrorID string
+	}{
+		{"write with a read scope", http.MethodPost, "/api/v1/rooms", "rooms-reader-key", http.StatusForbidden, "missing_scope"},
+		{"messages with a rooms scope", http.MethodGet, "/api/v1/rooms/lobby/messages", "rooms-reader-key", http.StatusForbidden, "missing_scope"},
+		{"webhooks without their scope", http.MethodGet, "/api/v1/webhooks", "rooms-reader-key", http.StatusForbidden, "missing_scope"},
+		{"clients without the admin key", http.MethodGet, "/api/v1/clients", "every-scope-key", http.StatusForbidden, "invalid_admin_key"},
+		{"unknown key", http.MethodGet, "/api/v1/rooms/lobby/members", "unknown-key", http.StatusUnauthorized, "invalid_api_key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, errResp := tr.do(tt.method, tt.path, alice, map[string]string{"X-API-Key": tt.apiKey}, nil)
+			if status != tt.wantStatus || errResp.ErrorID != tt.wantErrorID {
+				t.Fatalf("got %d %q, want %d %q", status, errResp.ErrorID, tt.wantStatus, tt.wantErrorID)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package router
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestUsersCannotActOnOtherUsers(t *testing.T) {
+	tr := newTestRouter(t)
+	alice := token(t, testJWTSecret, "alice", nil)
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		body        interface{}
+		wantErrorID string
+	}{
+		{
+			name:        "update another user",
+			method:      http.MethodPatch,
+			path:        "/api/v1/users/bob",
+			body:        map[string]string{"nickname": "Mallory"},
+			wantErrorID: "cannot_access_other_user",
+		},
+		{
+			name:        "another user's contacts",
+			method:      http.MethodGet,
+			path:        "/api/v1/users/bob/contacts",
+			wantErrorID: "cannot_access_other_user",
+		},
+		{
+			name:        "another user's unread rooms",
+			method:      http.MethodGet,
+			path:        "/api/v1/users/bob/rooms/unread",
+			wantErrorID: "cannot_access_other_user",
+		},
+		{
+			name:        "delete another user",
+			method:      http.MethodDelete,
+			path:        "/api/v1/auth/user",
+			body:        map[string]string{"user_id": "bob"},
+			wantErrorID: "cannot_delete_other_user",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, errResp := tr.do(tt.method, tt.path, alice, withAPIKey, tt.body)
+			if status != http.StatusForbidden || errResp.ErrorID != tt.wantErrorID {
+				t.Fatalf("got %d %q, want 403 %q", status, errResp.ErrorID, tt.wantErrorID)
+			}
+		})
+	}
+}
+
+func TestDisabledAccountIsRejected(t *testing.T) {
+	tr := newTestRouter(t)
+	tr.accounts.addSession("alice-session", "alice")
+	tr.accounts.setDisabled("alice", true)
+
+	withSession := token(t, testJWTSecret, "alice", func(c jwt.MapClaims) { c["sid"] = "alice-session" })
+	withoutSession := token(t, testJWTSecret, "alice", nil)
+
+	tests := []struct {
+		name  string
+		token string
+		path  string
+	}{
+		{"session token", withSession, "/api/v1/users/alice/contacts"},
+		{"token without session", withoutSession, "/api/v1/users/alice/contacts"},
+		{"WebSocket connect", "", "/api/v1/ws?room_id=lobby&token=" + withSession},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, errResp := tr.do(http.MethodGet, tt.path, tt.token, withAPIKey, nil)
+			if status != http.StatusForbidden || errResp.ErrorID != "account_disabled" {
+				t.Fatalf("got %d %q, want 403 account_disabled", status, errResp.ErrorID)
+			}
+		})
+	}
+}
+
+func TestInvalidRoomIDsAreRejected(t *testing.T) {
+	tr := newTestRouter(t)
+	alice := token(t, testJWTSecret, "alice", nil)
+	tooLong := strings.Repeat("a", 65)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+	}{
+		{"room", http.MethodGet, "/api/v1/rooms/dot.room"},
+		{"messages", http.MethodGet, "/api/v1/rooms/room%20id/messages"},
+		{"message", http.MethodDelete, "/api/v1/rooms/" + tooLong + "/messages/1"},
+		{"lock", http.MethodPost, "/api/v1/rooms/room%2F../lock"},
+		{"admin route", http.MethodPost, "/api/v1/rooms/dot.room/mute"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, errResp := tr.do(tt.method, tt.path, alice, withAPIKey, nil)
+			if status != http.StatusBadRequest || errResp.ErrorID != "invalid_room_id" {
+				t.Fatalf("got %d %q, want 400 invalid_room_id", status, errResp.ErrorID)
+			}
+		})
+	}
+}
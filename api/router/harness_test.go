@@ -0,0 +1,218 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/vit0rr/chat/api/handler"
+	"github.com/vit0rr/chat/config"
+	"github.com/vit0rr/chat/pkg/broker"
+	"github.com/vit0rr/chat/pkg/database/repositories"
+	"github.com/vit0rr/chat/pkg/deps"
+)
+
+const (
+	testJWTSecret = "router-test-jwt-secret"
+	testAPIKey    = "router-test-api-key"
+	testAdminKey  = "router-test-admin-key"
+)
+
+// memoryAccounts is an in-memory deps.Accounts
+type memoryAccounts struct {
+	mu       sync.Mutex
+	sessions map[string]repositories.Session
+	disabled map[string]bool
+	clients  map[string]repositories.Client
+}
+
+func newMemoryAccounts() *memoryAccounts {
+	return &memoryAccounts{
+		sessions: make(map[string]repositories.Session),
+		disabled: make(map[string]bool),
+		clients:  make(map[string]repositories.Client),
+	}
+}
+
+// addSession starts a session of the user, expiring in an hour
+func (m *memoryAccounts) addSession(sessionID string, userID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[sessionID] = repositories.Session{
+		ID:         sessionID,
+		UserID:     userID,
+		CreatedAt:  time.Now(),
+		LastUsedAt: time.Now(),
+		ExpiresAt:  time.Now().Add(time.Hour),
+	}
+}
+
+func (m *memoryAccounts) setDisabled(userID string, disabled bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.disabled[userID] = disabled
+}
+
+// addClient lets the API key authenticate the client
+func (m *memoryAccounts) addClient(apiKey string, client repositories.Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.clients[apiKey] = client
+}
+
+func (m *memoryAccounts) GetSession(ctx context.Context, sessionID string) (*repositories.Session, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok || !session.ExpiresAt.After(time.Now()) {
+		return nil, false, repositories.ErrSessionNotFound
+	}
+
+	return &session, m.disabled[session.UserID], nil
+}
+
+func (m *memoryAccounts) TouchSession(ctx context.Context, sessionID string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if session, ok := m.sessions[sessionID]; ok && at.After(session.LastUsedAt) {
+		session.LastUsedAt = at
+		m.sessions[sessionID] = session
+	}
+
+	return nil
+}
+
+func (m *memoryAccounts) IsUserDisabled(ctx context.Context, userID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.disabled[userID], nil
+}
+
+func (m *memoryAccounts) GetClientByAPIKey(ctx context.Context, apiKey string) (*repositories.Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	client, ok := m.clients[apiKey]
+	if !ok {
+		return nil, nil
+	}
+
+	return &client, nil
+}
+
+// testRouter serves the routes without MongoDB, authenticating against a memoryAccounts.
+// Only the requests rejected before reaching the database can be tested on it.
+type testRouter struct {
+	t        *testing.T
+	deps     *deps.Deps
+	accounts *memoryAccounts
+	server   *httptest.Server
+}
+
+// newTestRouter starts a testRouter, the config is the default one changed by configure
+func newTestRouter(t *testing.T, configure ...func(*config.Config)) *testRouter {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cfg := config.DefaultConfig(config.Config{})
+	cfg.JWT.Secret = testJWTSecret
+	cfg.APIKey = testAPIKey
+	cfg.AdminKey = testAdminKey
+	cfg.Attachments.Dir = t.TempDir()
+	for _, apply := range configure {
+		apply(&cfg)
+	}
+
+	messageBroker := broker.NewMemory()
+	dependencies := deps.New(cfg, nil, messageBroker)
+	accounts := newMemoryAccounts()
+	dependencies.Accounts = accounts
+
+	router := New(ctx, dependencies, nil, messageBroker)
+
+	tr := &testRouter{
+		t:        t,
+		deps:     dependencies,
+		accounts: accounts,
+		server:   httptest.NewServer(router.BuildRoutes(dependencies)),
+	}
+	t.Cleanup(func() {
+		tr.server.Close()
+		cancel()
+	})
+
+	return tr
+}
+
+// token signs a user token with the secret, expiring in an hour, its claims changed by the edit
+func token(t *testing.T, secret string, userID string, edit func(jwt.MapClaims)) string {
+	t.Helper()
+
+	claims := jwt.MapClaims{
+		"sub":      userID,
+		"email":    userID + "@example.com",
+		"nickname": userID,
+		"iat":      time.Now().Unix(),
+		"exp":      time.Now().Add(time.Hour).Unix(),
+	}
+	if edit != nil {
+		edit(claims)
+	}
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+
+	return signed
+}
+
+// do sends the request with the bearer token and headers, answering its status and error
+func (tr *testRouter) do(method string, path string, bearer string, headers map[string]string, body interface{}) (int, handler.ErrorResponse) {
+	tr.t.Helper()
+
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			tr.t.Fatalf("failed to encode body: %v", err)
+		}
+	}
+
+	req, err := http.NewRequest(method, tr.server.URL+path, &payload)
+	if err != nil {
+		tr.t.Fatalf("failed to create request: %v", err)
+	}
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		tr.t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	var errResp handler.ErrorResponse
+	_ = json.NewDecoder(resp.Body).Decode(&errResp)
+
+	return resp.StatusCode, errResp
+}
+
+// withAPIKey are the headers of a request made with the configured API key
+var withAPIKey = map[string]string{"X-API-Key": testAPIKey}
@@ -0,0 +1,29 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/api/handler"
+	"github.com/vit0rr/chat/pkg/deps"
+)
+
+// Liveness answers as long as the process serves requests, including while it shuts down,
+// so the orchestrator doesn't kill it before the connections drain
+func Liveness(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// Readiness fails with a 503 as soon as the shutdown starts, so load balancers stop
+// routing new requests to the instance
+func Readiness(dependencies *deps.Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if dependencies.ShuttingDown.Load() {
+			handler.WriteError(w, constants.ShuttingDown, nil)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"status": "ready"})
+	}
+}
@@ -1,43 +1,41 @@
 package router
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/go-chi/cors"
-	"github.com/redis/go-redis/v9"
 	httpSwagger "github.com/swaggo/http-swagger" // http-swagger middleware
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/api/handler"
 	authService "github.com/vit0rr/chat/api/internal/auth-service"
 	chatService "github.com/vit0rr/chat/api/internal/chat-service"
+	clientService "github.com/vit0rr/chat/api/internal/client-service"
+	webhookService "github.com/vit0rr/chat/api/internal/webhook-service"
 	_ "github.com/vit0rr/chat/docs"
+	"github.com/vit0rr/chat/pkg/broker"
 	"github.com/vit0rr/chat/pkg/deps"
 	pkgMiddlware "github.com/vit0rr/chat/pkg/middleware"
+	"github.com/vit0rr/chat/pkg/storage"
 	"github.com/vit0rr/chat/pkg/telemetry"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type Router struct {
-	Deps        *deps.Deps
-	chatService *chatService.HTTP
-	authService *authService.HTTP
+	Deps           *deps.Deps
+	chatService    *chatService.HTTP
+	authService    *authService.HTTP
+	webhookService *webhookService.HTTP
+	clientService  *clientService.HTTP
 }
 
 func (router *Router) BuildRoutes(deps *deps.Deps) *chi.Mux {
 	r := chi.NewRouter()
 
-	allowedOrigins := strings.Split(deps.Config.Env.AllowedOrigins, ",")
-
-	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins: allowedOrigins,
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
-		AllowCredentials: true,
-		MaxAge:           300,
-	}))
+	r.Use(pkgMiddlware.CORS(deps.Config.CORS))
 
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.RealIP)
@@ -46,6 +44,13 @@ func (router *Router) BuildRoutes(deps *deps.Deps) *chi.Mux {
 	r.Use(telemetry.TelemetryMiddleware)
 	r.Use(chatService.JSONResponseMiddleware)
 
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		handler.WriteError(w, constants.RouteNotFound, nil)
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		handler.WriteError(w, constants.MethodNotAllowed, nil)
+	})
+
 	swgUrl := func() string {
 		if deps.Config.Env.Env == "production" || deps.Config.Env.Env == "homologation" {
 			return fmt.Sprintf("https://%s/swagger/doc.json", deps.Config.Env.Host)
@@ -55,10 +60,39 @@ func (router *Router) BuildRoutes(deps *deps.Deps) *chi.Mux {
 	}
 
 	r.Route("/api/v1", func(r chi.Router) {
+		r.Use(pkgMiddlware.RejectWritesInMaintenance(deps))
+
+		r.Get("/time", telemetry.HandleFuncLogger(router.chatService.ServerTime))
+
 		r.Route("/auth", func(r chi.Router) {
 			r.Post("/register", telemetry.HandleFuncLogger(router.authService.Register))
 			r.Post("/login", telemetry.HandleFuncLogger(router.authService.Login))
-			r.With(pkgMiddlware.JWTAuth(deps)).Delete("/user", telemetry.HandleFuncLogger(router.authService.DeleteUser))
+			r.Post("/reactivate", telemetry.HandleFuncLogger(router.authService.ReactivateSelf))
+			r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeRoomsWrite)).Post("/guest", telemetry.HandleFuncLogger(router.authService.CreateGuest))
+			r.With(pkgMiddlware.JWTAuth(deps), pkgMiddlware.RejectGuests).Delete("/user", telemetry.HandleFuncLogger(router.authService.DeleteUser))
+			r.With(pkgMiddlware.JWTAuth(deps), pkgMiddlware.RejectGuests).Post("/user/deactivate", telemetry.HandleFuncLogger(router.authService.DeactivateSelf))
+			r.With(pkgMiddlware.JWTAuth(deps), pkgMiddlware.RejectGuests).Post("/logout", telemetry.HandleFuncLogger(router.authService.Logout))
+			r.With(pkgMiddlware.JWTAuth(deps), pkgMiddlware.RejectGuests).Get("/sessions", telemetry.HandleFuncLogger(router.authService.GetSessions))
+			r.With(pkgMiddlware.JWTAuth(deps), pkgMiddlware.RejectGuests).Delete("/sessions", telemetry.HandleFuncLogger(router.authService.RevokeOtherSessions))
+			r.With(pkgMiddlware.JWTAuth(deps), pkgMiddlware.RejectGuests).Delete("/sessions/{sessionId}", telemetry.HandleFuncLogger(router.authService.RevokeSession))
+		})
+
+		r.Route("/webhooks", func(r chi.Router) {
+			r.Use(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeWebhooks))
+			r.Post("/", telemetry.HandleFuncLogger(router.webhookService.CreateWebhook))
+			r.Get("/", telemetry.HandleFuncLogger(router.webhookService.GetWebhooks))
+			r.Delete("/{webhookId}", telemetry.HandleFuncLogger(router.webhookService.DeleteWebhook))
+		})
+
+		r.Route("/clients", func(r chi.Router) {
+			r.Use(pkgMiddlware.VerifyAdminKey(deps))
+			r.Post("/", telemetry.HandleFuncLogger(router.clientService.CreateClient))
+			r.Get("/", telemetry.HandleFuncLogger(router.clientService.GetClients))
+			r.Get("/{clientId}", telemetry.HandleFuncLogger(router.clientService.GetClient))
+			r.Patch("/{clientId}", telemetry.HandleFuncLogger(router.clientService.UpdateClient))
+			r.Delete("/{clientId}", telemetry.HandleFuncLogger(router.clientService.DeleteClient))
+			r.Put("/{clientId}/scopes", telemetry.HandleFuncLogger(router.clientService.SetScopes))
+			r.Post("/{clientId}/rotate-key", telemetry.HandleFuncLogger(router.clientService.RotateAPIKey))
 		})
 
 		r.Group(func(r chi.Router) {
@@ -67,16 +101,65 @@ func (router *Router) BuildRoutes(deps *deps.Deps) *chi.Mux {
 			r.Get("/ws", telemetry.HandleFuncLogger(router.chatService.WebSocket))
 
 			r.Route("/rooms", func(r chi.Router) {
-				r.Use(pkgMiddlware.VerifyApiKey(deps))
-				r.Get("/", telemetry.HandleFuncLogger(router.chatService.GetRooms))
-				r.Get("/{roomId}", telemetry.HandleFuncLogger(router.chatService.GetRoom))
-				r.Get("/{roomId}/messages", telemetry.HandleFuncLogger(router.chatService.GetMessages))
-				r.Post("/{roomId}/register-user", telemetry.HandleFuncLogger(router.chatService.RegisterUser))
-				r.Post("/{roomId}/lock", telemetry.HandleFuncLogger(router.chatService.LockRoom))
+				r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeRoomsRead)).Get("/", telemetry.HandleFuncLogger(router.chatService.GetRooms))
+				r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeRoomsWrite)).Post("/", telemetry.HandleFuncLogger(router.chatService.CreateRoom))
+				r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeRoomsWrite)).Post("/join", telemetry.HandleFuncLogger(router.chatService.JoinRoom))
+
+				// Every route of a room validates its ID first
+				r.Route("/{roomId}", func(r chi.Router) {
+					r.Use(chatService.ValidateRoomID)
+					r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeRoomsRead)).Get("/", telemetry.HandleFuncLogger(router.chatService.GetRoom))
+					r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeRoomsRead)).Get("/members", telemetry.HandleFuncLogger(router.chatService.GetRoomMembers))
+					r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeRoomsRead)).Get("/online", telemetry.HandleFuncLogger(router.chatService.GetOnlineRoomMembers))
+					r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeRoomsRead)).Get("/nickname-available", telemetry.HandleFuncLogger(router.chatService.NicknameAvailable))
+					r.With(pkgMiddlware.VerifyAdminKey(deps)).Delete("/members/{userId}", telemetry.HandleFuncLogger(router.chatService.RemoveRoomMember))
+					r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeMessagesRead)).Get("/messages", telemetry.HandleFuncLogger(router.chatService.GetMessages))
+					r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeMessagesWrite)).Post("/messages", telemetry.HandleFuncLogger(router.chatService.SendMessage))
+					r.With(pkgMiddlware.VerifyAdminKey(deps)).Post("/import", telemetry.HandleFuncLogger(router.chatService.ImportMessages))
+					r.With(pkgMiddlware.VerifyAdminKey(deps)).Post("/messages/purge", telemetry.HandleFuncLogger(router.chatService.PurgeMessages))
+					r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeMessagesRead)).Get("/messages/{messageId}", telemetry.HandleFuncLogger(router.chatService.GetMessage))
+					r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeMessagesWrite)).Patch("/messages/{messageId}", telemetry.HandleFuncLogger(router.chatService.EditMessage))
+					r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeMessagesWrite)).Delete("/messages/{messageId}", telemetry.HandleFuncLogger(router.chatService.DeleteMessage))
+					r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeMessagesWrite)).Post("/messages/{messageId}/report", telemetry.HandleFuncLogger(router.chatService.ReportMessage))
+					r.With(pkgMiddlware.VerifyAdminKey(deps)).Post("/mute", telemetry.HandleFuncLogger(router.chatService.MuteUser))
+					r.With(pkgMiddlware.VerifyAdminKey(deps)).Post("/unmute", telemetry.HandleFuncLogger(router.chatService.UnmuteUser))
+					r.With(pkgMiddlware.VerifyAdminKey(deps)).Post("/slow-mode", telemetry.HandleFuncLogger(router.chatService.SetSlowMode))
+					r.With(pkgMiddlware.VerifyAdminKey(deps)).Post("/invites", telemetry.HandleFuncLogger(router.chatService.CreateInvite))
+					r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeMessagesRead)).Post("/read", telemetry.HandleFuncLogger(router.chatService.MarkRoomRead))
+					r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeRoomsWrite)).Post("/register-user", telemetry.HandleFuncLogger(router.chatService.RegisterUser))
+					r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeRoomsWrite)).Post("/lock", telemetry.HandleFuncLogger(router.chatService.LockRoom))
+					r.With(pkgMiddlware.VerifyAdminKey(deps)).Patch("/settings", telemetry.HandleFuncLogger(router.chatService.UpdateRoomSettings))
+					r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeMessagesWrite)).Post("/attachments", telemetry.HandleFuncLogger(router.chatService.UploadAttachment))
+					r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeMessagesRead)).Get("/pins", telemetry.HandleFuncLogger(router.chatService.GetPinnedMessages))
+					r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeMessagesWrite)).Post("/pins", telemetry.HandleFuncLogger(router.chatService.PinMessage))
+					r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeMessagesWrite)).Patch("/pins", telemetry.HandleFuncLogger(router.chatService.ReorderPins))
+					r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeMessagesWrite)).Delete("/pins/{messageId}", telemetry.HandleFuncLogger(router.chatService.UnpinMessage))
+				})
+			})
+			r.Route("/admin", func(r chi.Router) {
+				r.Use(pkgMiddlware.VerifyAdminKey(deps))
+				r.Post("/users/{userId}/token", telemetry.HandleFuncLogger(router.authService.ImpersonateUser))
+				r.Post("/users/{userId}/deactivate", telemetry.HandleFuncLogger(router.authService.DeactivateUser))
+				r.Post("/users/{userId}/reactivate", telemetry.HandleFuncLogger(router.authService.ReactivateUser))
+				r.Get("/users/{userId}/audit", telemetry.HandleFuncLogger(router.authService.GetAuditLog))
+				r.Post("/maintenance", telemetry.HandleFuncLogger(router.chatService.SetMaintenanceMode))
+				r.Post("/announce", telemetry.HandleFuncLogger(router.chatService.Announce))
+			})
+			r.Route("/reports", func(r chi.Router) {
+				r.Use(pkgMiddlware.VerifyAdminKey(deps))
+				r.Get("/", telemetry.HandleFuncLogger(router.chatService.GetReports))
+				r.Post("/{reportId}/resolve", telemetry.HandleFuncLogger(router.chatService.ResolveReport))
+			})
+			r.Route("/me", func(r chi.Router) {
+				r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeRoomsRead)).Get("/rooms", telemetry.HandleFuncLogger(router.chatService.GetMyRooms))
+				r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeMessagesRead), pkgMiddlware.RejectGuests).Get("/export", telemetry.HandleFuncLogger(router.chatService.ExportMyData))
 			})
 			r.Route("/users", func(r chi.Router) {
-				r.Use(pkgMiddlware.VerifyApiKey(deps))
-				r.Patch("/{userId}", telemetry.HandleFuncLogger(router.chatService.UpdateUser))
+				r.Use(pkgMiddlware.RejectGuests)
+				r.Use(pkgMiddlware.RequireSelfOrAdmin(deps))
+				r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeUsersWrite)).Patch("/{userId}", telemetry.HandleFuncLogger(router.chatService.UpdateUser))
+				r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeRoomsRead)).Get("/{userId}/rooms/unread", telemetry.HandleFuncLogger(router.chatService.GetUnreadRooms))
+				r.With(pkgMiddlware.VerifyApiKey(deps, pkgMiddlware.ScopeRoomsRead)).Get("/{userId}/contacts", telemetry.HandleFuncLogger(router.chatService.GetUserContacts))
 			})
 		})
 	})
@@ -88,6 +171,19 @@ func (router *Router) BuildRoutes(deps *deps.Deps) *chi.Mux {
 			httpSwagger.URL(swgUrl()),
 		))
 
+		// Attachments stored on disk are served by the API itself
+		if strings.HasPrefix(deps.Config.Attachments.BaseURL, "/") {
+			attachments := storage.NewLocal(deps.Config.Attachments.Dir, deps.Config.Attachments.BaseURL)
+			r.Handle(deps.Config.Attachments.BaseURL+"/*", attachments.Handler())
+		}
+
+		r.Get("/healthz", Liveness)
+		r.Get("/readyz", Readiness(deps))
+
+		if deps.Config.Server.MetricsEnabled {
+			r.Handle("/metrics", telemetry.MetricsHandler())
+		}
+
 		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "text/html")
 			http.ServeFile(w, r, "./api/router/index.html")
@@ -97,17 +193,31 @@ func (router *Router) BuildRoutes(deps *deps.Deps) *chi.Mux {
 	return r
 }
 
-func New(deps *deps.Deps, db *mongo.Database, redisClient *redis.Client) *Router {
+// Shutdown drains the long-lived connections that http.Server.Shutdown doesn't track
+func (router *Router) Shutdown(ctx context.Context) {
+	router.chatService.Shutdown(ctx)
+}
+
+func New(ctx context.Context, deps *deps.Deps, db *mongo.Database, messageBroker broker.Broker) *Router {
 	return &Router{
 		Deps: deps,
 		chatService: chatService.NewHTTP(
+			ctx,
 			deps,
 			db,
-			redisClient,
+			messageBroker,
 		),
 		authService: authService.NewHTTP(
 			deps,
 			db,
 		),
+		webhookService: webhookService.NewHTTP(
+			deps,
+			db,
+		),
+		clientService: clientService.NewHTTP(
+			deps,
+			db,
+		),
 	}
 }
@@ -5,18 +5,36 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/redis/go-redis/v9"
 	"github.com/vit0rr/chat/api/router"
+	"github.com/vit0rr/chat/pkg/broker"
 	"github.com/vit0rr/chat/pkg/deps"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func New(ctx context.Context, deps *deps.Deps, db *mongo.Database, redisClient *redis.Client) *http.Server {
-	router := router.New(deps, db, redisClient)
+// Server wraps http.Server to also drain WebSocket connections on shutdown
+type Server struct {
+	*http.Server
+	router *router.Router
+}
+
+func New(ctx context.Context, deps *deps.Deps, db *mongo.Database, messageBroker broker.Broker) *Server {
+	router := router.New(ctx, deps, db, messageBroker)
 
-	return &http.Server{
-		Addr:              deps.Config.Server.BindAddr,
-		Handler:           router.BuildRoutes(deps),
-		ReadHeaderTimeout: 10 * time.Second,
+	return &Server{
+		Server: &http.Server{
+			Addr:              deps.Config.Server.BindAddr,
+			Handler:           router.BuildRoutes(deps),
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+		router: router,
 	}
 }
+
+// Shutdown first notifies and closes the WebSocket connections, refusing the new ones, as
+// http.Server.Shutdown doesn't track them since they are hijacked. Then it stops accepting
+// new connections and waits for the requests in flight.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.router.Shutdown(ctx)
+
+	return s.Server.Shutdown(ctx)
+}
@@ -7,11 +7,14 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/vit0rr/chat/api/server"
 	"github.com/vit0rr/chat/config"
+	"github.com/vit0rr/chat/pkg/broker"
+	"github.com/vit0rr/chat/pkg/database/repositories"
 	"github.com/vit0rr/chat/pkg/deps"
 	"github.com/vit0rr/chat/pkg/log"
 	"github.com/vit0rr/chat/shared"
@@ -58,10 +61,34 @@ func main() {
 	}
 	log.New(ctx, logLevel)
 
+	log.Info(ctx, "⚙️ Loaded configuration", log.AnyAttr("config", cfg.Sanitized()))
+
+	// Fail before connecting to anything, listing every problem at once
+	if err := cfg.Validate(); err != nil {
+		log.Error(ctx, "❌ Invalid configuration", log.ErrAttr(err))
+		os.Exit(1)
+	}
+	if cfg.JWT.Insecure() {
+		log.Warn(ctx, "⚠️ The JWT secret is a well-known placeholder, anyone can sign tokens. Only acceptable in development")
+	}
+
+	log.Info(ctx, "🌐 CORS policy",
+		log.AnyAttr("allowed_origins", cfg.CORS.AllowedOrigins),
+		log.AnyAttr("allowed_methods", cfg.CORS.AllowedMethods),
+		log.AnyAttr("allowed_headers", cfg.CORS.AllowedHeaders),
+		log.AnyAttr("allow_credentials", cfg.CORS.Credentials()),
+		log.AnyAttr("max_age", cfg.CORS.MaxAge))
+	if cfg.CORS.InsecureWebSocketOrigins {
+		log.Warn(ctx, "⚠️ WebSocket origin checks are disabled, any site can open a socket on behalf of the users")
+	}
+	if len(cfg.CORS.AllowedOrigins) == 0 {
+		log.Warn(ctx, "No CORS origins allowed, browsers can't call the API from other origins")
+	}
+
 	// create mongo client
 	mongoClient, err := deps.NewMongoClient(ctx, cfg)
 	if err != nil {
-		log.Error(ctx, "❌ Unable to parse database connection", log.ErrAttr(err))
+		log.Error(ctx, "❌ Unable to connect to MongoDB", log.ErrAttr(err))
 		os.Exit(1)
 	}
 
@@ -70,7 +97,11 @@ func main() {
 	log.Info(ctx, "✅ Connected to MongoDB")
 
 	defer func() {
-		if err := mongoClient.Disconnect(ctx); err != nil {
+		// ctx is already canceled at this point, since shutting down cancels it
+		disconnectCtx, cancelDisconnect := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelDisconnect()
+
+		if err := mongoClient.Disconnect(disconnectCtx); err != nil {
 			log.Error(ctx, "❌ Failed to disconnect from MongoDB", log.ErrAttr(err))
 			os.Exit(1)
 		}
@@ -86,26 +117,58 @@ func main() {
 		os.Exit(1)
 	}
 
-	redisClient, err := deps.NewRedisClient(ctx, cfg)
-	if err != nil {
-		log.Error(ctx, "❌ Failed to create redis client", log.ErrAttr(err))
+	if err := deps.CreateMessagesQueryIndexes(ctx, db); err != nil {
+		log.Error(ctx, "❌ Failed to create messages query indexes", log.ErrAttr(err))
+		os.Exit(1)
+	}
+
+	if err := deps.CreateMessagesImportIndex(ctx, db); err != nil {
+		log.Error(ctx, "❌ Failed to create messages import index", log.ErrAttr(err))
+		os.Exit(1)
+	}
+
+	if err := deps.CreateReportsIndex(ctx, db); err != nil {
+		log.Error(ctx, "❌ Failed to create reports index", log.ErrAttr(err))
 		os.Exit(1)
 	}
 
-	log.Info(ctx, "✅ Connected to Redis")
+	if err := deps.CreateAuditLogIndex(ctx, db); err != nil {
+		log.Error(ctx, "❌ Failed to create audit log index", log.ErrAttr(err))
+		os.Exit(1)
+	}
+
+	if err := deps.CreateSessionsIndexes(ctx, db); err != nil {
+		log.Error(ctx, "❌ Failed to create sessions indexes", log.ErrAttr(err))
+		os.Exit(1)
+	}
+
+	var messageBroker broker.Broker
+	if cfg.API.Broker == config.BrokerMemory {
+		messageBroker = broker.NewMemory()
+		log.Warn(ctx, "⚠️ Using the in-memory broker, messages and presence aren't shared with other instances")
+	} else {
+		redisClient, err := deps.NewRedisClient(ctx, cfg)
+		if err != nil {
+			log.Error(ctx, "❌ Unable to connect to Redis", log.ErrAttr(err))
+			os.Exit(1)
+		}
+
+		log.Info(ctx, "✅ Connected to Redis")
+		messageBroker = broker.NewRedis(redisClient)
+	}
 
-	dependencies := deps.New(cfg, db)
+	dependencies := deps.New(cfg, db, messageBroker)
 
-	if err := deps.RecoverUserStatuses(ctx, db, redisClient); err != nil {
+	if err := deps.RecoverUserStatuses(ctx, db, messageBroker); err != nil {
 		log.Error(ctx, "❌ Failed to recover user statuses", log.ErrAttr(err))
 		os.Exit(1)
 	}
 
-	httpServer := server.New(ctx, dependencies, db, redisClient)
+	httpServer := server.New(ctx, dependencies, db, messageBroker)
 
 	// Start cleanup routine
 	go func() {
-		ticker := time.NewTicker(10 * time.Minute) // 10m, we can increase/decrease it later
+		ticker := time.NewTicker(time.Duration(cfg.Chat.CleanupInterval) * time.Second)
 		defer ticker.Stop()
 
 		for {
@@ -113,7 +176,25 @@ func main() {
 			case <-ctx.Done():
 				return
 			case <-ticker.C:
-				deps.CleanupStaleRooms(ctx, redisClient)
+				deps.CleanupStaleRooms(ctx, messageBroker)
+
+				inactivity := time.Duration(cfg.Chat.InactivityTimeout) * time.Minute
+				count, err := deps.MarkInactiveUsersOffline(ctx, db, messageBroker, inactivity)
+				if err != nil {
+					log.Error(ctx, "❌ Failed to mark inactive users offline", log.ErrAttr(err))
+				} else if count > 0 {
+					log.Info(ctx, "Marked inactive users offline", log.AnyAttr("count", count))
+				}
+
+				if _, err := repositories.ClearExpiredAPIKeys(ctx, db); err != nil {
+					log.Error(ctx, "❌ Failed to clear expired API keys", log.ErrAttr(err))
+				}
+
+				if count, err := repositories.DeleteExpiredGuests(ctx, db); err != nil {
+					log.Error(ctx, "❌ Failed to delete expired guests", log.ErrAttr(err))
+				} else if count > 0 {
+					log.Info(ctx, "Deleted expired guests", log.AnyAttr("count", count))
+				}
 			}
 		}
 	}()
@@ -121,17 +202,33 @@ func main() {
 	idleConnsClosed := make(chan struct{})
 	go func() {
 		sigint := make(chan os.Signal, 1)
-		signal.Notify(sigint, os.Interrupt)
+		signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
 		<-sigint
 
+		// Load balancers stop routing new requests while the open ones finish
+		dependencies.ShuttingDown.Store(true)
+
+		// They only notice on their next readiness probe
+		if delay := time.Duration(cfg.Server.ShutdownDelay) * time.Second; delay > 0 {
+			log.Info(ctx, "Waiting for the load balancers before shutting down", log.AnyAttr("delay", delay.String()))
+			time.Sleep(delay)
+		}
+
 		if err := deps.UpdateAllOnlineUsersToOffline(ctx, db); err != nil {
 			log.Error(ctx, "❌ Failed to update all online users to offline", log.ErrAttr(err))
 		}
 
 		// We received an interrupt signal, shut down.
-		if err := httpServer.Shutdown(ctx); err != nil {
+		// The timeout keeps a slow WebSocket drain from hanging the shutdown
+		shutdownCtx, cancelShutdown := context.WithTimeout(ctx, 15*time.Second)
+		defer cancelShutdown()
+
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
 			log.Error(ctx, "unexpected error during server shutdown", log.ErrAttr(err))
 		}
+
+		// Stop the background routines: the cleanup ticker and the connection monitor
+		cancel()
 		close(idleConnsClosed)
 	}()
 
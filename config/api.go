@@ -1,21 +1,50 @@
 package config
 
 import (
+	"fmt"
 	"os"
 )
 
+const (
+	// DefaultMongoConnectTimeout is how many seconds connecting and the startup ping can take
+	DefaultMongoConnectTimeout = 10
+	// DefaultMongoServerSelectionTimeout is how many seconds an operation waits for a server to be available
+	DefaultMongoServerSelectionTimeout = 10
+	DefaultMongoMaxPoolSize            = 100
+	// DefaultRedisConnectAttempts is how many times the startup ping is tried while Redis starts
+	DefaultRedisConnectAttempts = 5
+
+	// BrokerRedis shares the messages and presence between the instances through Redis
+	BrokerRedis = "redis"
+	// BrokerMemory keeps them in the process, for a single instance running without Redis
+	BrokerMemory = "memory"
+)
+
 type API struct {
-	Mongo Mongo `hcl:"mongo,block"`
-	Redis Redis `hcl:"redis,block"`
+	Broker  string  `hcl:"broker,optional"` // redis or memory, redis when unset
+	Mongo   Mongo   `hcl:"mongo,block"`
+	Redis   Redis   `hcl:"redis,block"`
 	BaseURL BaseURL `hcl:"base_url,block"`
 }
 
 type Mongo struct {
-	Dsn string `hcl:"dsn,attr"`
+	Dsn                    string `hcl:"dsn,attr"`
+	ConnectTimeout         int    `hcl:"connect_timeout,optional"`          // In seconds
+	ServerSelectionTimeout int    `hcl:"server_selection_timeout,optional"` // In seconds
+	MaxPoolSize            int    `hcl:"max_pool_size,optional"`
+	MinPoolSize            int    `hcl:"min_pool_size,optional"`
 }
 
+// Redis configures the client, the unset values keep the go-redis defaults
 type Redis struct {
-	Dsn string `hcl:"dsn,attr"`
+	Dsn          string `hcl:"dsn,attr"`
+	PoolSize     int    `hcl:"pool_size,optional"`
+	DialTimeout  int    `hcl:"dial_timeout,optional"`  // In seconds
+	ReadTimeout  int    `hcl:"read_timeout,optional"`  // In seconds
+	WriteTimeout int    `hcl:"write_timeout,optional"` // In seconds
+	MaxRetries   int    `hcl:"max_retries,optional"`   // Retries of a failed command, -1 disables them
+	// ConnectAttempts is how many times the startup ping is tried, backing off between the attempts
+	ConnectAttempts int `hcl:"connect_attempts,optional"`
 }
 
 type BaseURL struct {
@@ -27,15 +56,82 @@ type BackendURL struct {
 }
 
 func GetDefaltAPIConfig(cfg Config) API {
-	return API{
+	api := API{
+		Broker: os.Getenv("BROKER"),
 		Mongo: Mongo{
-			Dsn: os.Getenv("DATABASE_URL"),
+			Dsn:                    os.Getenv("DATABASE_URL"),
+			ConnectTimeout:         int(getEnvInt64("MONGO_CONNECT_TIMEOUT", 0)),
+			ServerSelectionTimeout: int(getEnvInt64("MONGO_SERVER_SELECTION_TIMEOUT", 0)),
+			MaxPoolSize:            int(getEnvInt64("MONGO_MAX_POOL_SIZE", 0)),
+			MinPoolSize:            int(getEnvInt64("MONGO_MIN_POOL_SIZE", 0)),
 		},
 		Redis: Redis{
-			Dsn: os.Getenv("REDIS_URL"),
+			Dsn:             os.Getenv("REDIS_URL"),
+			PoolSize:        int(getEnvInt64("REDIS_POOL_SIZE", 0)),
+			DialTimeout:     int(getEnvInt64("REDIS_DIAL_TIMEOUT", 0)),
+			ReadTimeout:     int(getEnvInt64("REDIS_READ_TIMEOUT", 0)),
+			WriteTimeout:    int(getEnvInt64("REDIS_WRITE_TIMEOUT", 0)),
+			MaxRetries:      int(getEnvInt64("REDIS_MAX_RETRIES", 0)),
+			ConnectAttempts: int(getEnvInt64("REDIS_CONNECT_ATTEMPTS", 0)),
 		},
 		BaseURL: BaseURL{
 			Url: os.Getenv("BASE_URL"),
 		},
 	}
+	api.setDefaults()
+
+	return api
+}
+
+// setDefaults defaults to the Redis broker and fills the Mongo and Redis connection options
+func (a *API) setDefaults() {
+	if a.Broker == "" {
+		a.Broker = BrokerRedis
+	}
+
+	a.Mongo.setDefaults()
+	a.Redis.setDefaults()
+}
+
+// setDefaults fills the unset timeouts and pool size
+func (m *Mongo) setDefaults() {
+	if m.ConnectTimeout <= 0 {
+		m.ConnectTimeout = DefaultMongoConnectTimeout
+	}
+
+	if m.ServerSelectionTimeout <= 0 {
+		m.ServerSelectionTimeout = DefaultMongoServerSelectionTimeout
+	}
+
+	if m.MaxPoolSize <= 0 {
+		m.MaxPoolSize = DefaultMongoMaxPoolSize
+	}
+}
+
+func (r *Redis) setDefaults() {
+	if r.ConnectAttempts <= 0 {
+		r.ConnectAttempts = DefaultRedisConnectAttempts
+	}
+}
+
+// Validate rejects negative sizes and timeouts
+func (r Redis) Validate() error {
+	if r.PoolSize < 0 || r.DialTimeout < 0 || r.ReadTimeout < 0 || r.WriteTimeout < 0 {
+		return fmt.Errorf("api: the redis pool_size and timeouts can't be negative, use 0 for the defaults")
+	}
+
+	if r.MaxRetries < -1 {
+		return fmt.Errorf("api: the redis max_retries must be -1 to disable them, 0 for the default, or a positive number")
+	}
+
+	return nil
+}
+
+// Validate rejects a pool that can't hold its minimum size
+func (m Mongo) Validate() error {
+	if m.MinPoolSize < 0 || m.MinPoolSize > m.MaxPoolSize {
+		return fmt.Errorf("api: the mongo min_pool_size must be between 0 and max_pool_size (%d)", m.MaxPoolSize)
+	}
+
+	return nil
 }
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"os"
+	"strings"
+)
+
+const (
+	// DefaultAttachmentsDir is where the uploaded attachments are stored
+	DefaultAttachmentsDir = "./uploads"
+	// DefaultAttachmentsBaseURL is the URL prefix of the stored attachments, served by the API itself
+	DefaultAttachmentsBaseURL = "/attachments"
+	// DefaultAttachmentsMaxSize is 10MB
+	DefaultAttachmentsMaxSize = 10 << 20
+)
+
+// DefaultAttachmentsMimeTypes are the file types that can be uploaded
+var DefaultAttachmentsMimeTypes = []string{
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"image/webp",
+	"application/pdf",
+	"text/plain",
+}
+
+// Attachments related config
+type Attachments struct {
+	Dir              string   `hcl:"dir,optional"`
+	BaseURL          string   `hcl:"base_url,optional"`
+	MaxSize          int64    `hcl:"max_size,optional"` // In bytes
+	AllowedMimeTypes []string `hcl:"allowed_mime_types,optional"`
+}
+
+func GetDefaultAttachmentsConfig() Attachments {
+	attachments := Attachments{
+		Dir:     os.Getenv("ATTACHMENTS_DIR"),
+		BaseURL: os.Getenv("ATTACHMENTS_BASE_URL"),
+		MaxSize: getEnvInt64("ATTACHMENTS_MAX_SIZE", 0),
+	}
+
+	if mimeTypes := os.Getenv("ATTACHMENTS_ALLOWED_MIME_TYPES"); mimeTypes != "" {
+		attachments.AllowedMimeTypes = strings.Split(mimeTypes, ",")
+	}
+	attachments.setDefaults()
+
+	return attachments
+}
+
+// setDefaults also trims the trailing slash of the base URL
+func (a *Attachments) setDefaults() {
+	if a.Dir == "" {
+		a.Dir = DefaultAttachmentsDir
+	}
+
+	if a.BaseURL == "" {
+		a.BaseURL = DefaultAttachmentsBaseURL
+	}
+	a.BaseURL = strings.TrimSuffix(a.BaseURL, "/")
+
+	if a.MaxSize <= 0 {
+		a.MaxSize = DefaultAttachmentsMaxSize
+	}
+
+	if len(a.AllowedMimeTypes) == 0 {
+		a.AllowedMimeTypes = DefaultAttachmentsMimeTypes
+	}
+}
@@ -0,0 +1,243 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultHistorySize is how many messages are kept per room for live replay
+	DefaultHistorySize = 200
+	// DefaultHistoryReplay is how many messages are replayed on connect, unless the client asks otherwise
+	DefaultHistoryReplay = 50
+	// DefaultMaxHistoryReplay is how many messages a client can ask to be replayed on connect
+	DefaultMaxHistoryReplay = 500
+	// DefaultInactivityTimeout is how many minutes a user without a live connection stays online
+	DefaultInactivityTimeout = 30
+	// DefaultCleanupInterval is how many seconds between stale rooms and inactive users cleanups
+	DefaultCleanupInterval = 600
+	// DefaultMonitorInterval is how many seconds between stale connections checks
+	DefaultMonitorInterval = 60
+	// DefaultStaleClientTimeout is how many seconds without a heartbeat before a connection is considered stale
+	DefaultStaleClientTimeout = 120
+	// DefaultMaxPinsPerRoom is how many messages can be pinned in a room
+	DefaultMaxPinsPerRoom = 50
+	// DefaultMembershipCheckInterval is how many seconds between membership checks of idle connections
+	DefaultMembershipCheckInterval = 30
+	// DefaultPresenceTTL is how many seconds the presence keys of a connection live without a heartbeat
+	DefaultPresenceTTL = 24 * 60 * 60
+	// DefaultRateLimitTTL is how many seconds the last message time of a user is kept for rate limiting
+	DefaultRateLimitTTL = 3
+
+	// DefaultIdleTimeout is how many seconds a connection can go without any message or pong
+	DefaultIdleTimeout = 90
+	// DefaultPingInterval is how many seconds between the pings sent to each connection
+	DefaultPingInterval = 30
+
+	// DefaultEditWindow is how many seconds after sending a message its sender can edit it
+	DefaultEditWindow = 15 * 60
+
+	// DefaultLockTTL is how many seconds a room stays locked unless its holder unlocks it sooner
+	DefaultLockTTL = 30 * 60
+
+	// HeartbeatInterval is how many seconds between the heartbeats of a connection, which refresh its presence
+	HeartbeatInterval = 30
+
+	// MessageDelay is how long a user waits between two messages
+	MessageDelay = 1500 * time.Millisecond
+)
+
+// Chat related config
+type Chat struct {
+	HistorySize        int64 `hcl:"history_size,optional"`
+	HistoryReplay      int64 `hcl:"history_replay,optional"`       // Messages replayed on connect, unless the client asks otherwise
+	MaxHistoryReplay   int64 `hcl:"max_history_replay,optional"`   // Those past history_size are read from MongoDB
+	InactivityTimeout  int   `hcl:"inactivity_timeout,optional"`   // In minutes
+	CleanupInterval    int   `hcl:"cleanup_interval,optional"`     // In seconds
+	MonitorInterval    int   `hcl:"monitor_interval,optional"`     // In seconds
+	StaleClientTimeout int   `hcl:"stale_client_timeout,optional"` // In seconds
+	MaxPinsPerRoom     int   `hcl:"max_pins_per_room,optional"`
+	// Sent messages always re-check the membership, this is for connections that only listen
+	MembershipCheckInterval int `hcl:"membership_check_interval,optional"` // In seconds
+	// Shorter TTLs free the memory of crashed instances' connections sooner
+	PresenceTTL int `hcl:"presence_ttl,optional"` // In seconds
+	// Must outlast the delay between messages, or the rate limit stops applying
+	RateLimitTTL int `hcl:"rate_limit_ttl,optional"` // In seconds
+	// Quiet connections are kept alive by answering the pings, the others are closed once idle
+	IdleTimeout  int `hcl:"idle_timeout,optional"`  // In seconds
+	PingInterval int `hcl:"ping_interval,optional"` // In seconds
+	// Connection limits, unlimited when 0
+	MaxConnectionsPerUser int `hcl:"max_connections_per_user,optional"` // Across every instance
+	MaxConnections        int `hcl:"max_connections,optional"`          // Per instance
+	// How long senders can change their messages, rooms can override them. Admins can always delete.
+	EditWindow   *int `hcl:"edit_window,optional"`   // In seconds, unlimited when 0, DefaultEditWindow when unset
+	DeleteWindow int  `hcl:"delete_window,optional"` // In seconds, unlimited when 0
+	// Locks are also released once their holder's last connection to the room closes
+	LockTTL int `hcl:"lock_ttl,optional"` // In seconds
+	// Rooms are only created by POST /rooms with generated IDs, registering to an unknown room ID fails
+	ServerRoomIDs bool `hcl:"server_room_ids,optional"`
+	// Negotiates permessage-deflate with the clients supporting it, without context takeover so
+	// each connection only holds its compressor while writing
+	Compression bool `hcl:"compression,optional"`
+}
+
+func GetDefaultChatConfig() Chat {
+	chat := Chat{
+		HistorySize:             getEnvInt64("CHAT_HISTORY_SIZE", 0),
+		HistoryReplay:           getEnvInt64("CHAT_HISTORY_REPLAY", 0),
+		MaxHistoryReplay:        getEnvInt64("CHAT_MAX_HISTORY_REPLAY", 0),
+		InactivityTimeout:       int(getEnvInt64("CHAT_INACTIVITY_TIMEOUT", 0)),
+		CleanupInterval:         int(getEnvInt64("CHAT_CLEANUP_INTERVAL", 0)),
+		MonitorInterval:         int(getEnvInt64("CHAT_MONITOR_INTERVAL", 0)),
+		StaleClientTimeout:      int(getEnvInt64("CHAT_STALE_CLIENT_TIMEOUT", 0)),
+		MaxPinsPerRoom:          int(getEnvInt64("CHAT_MAX_PINS_PER_ROOM", 0)),
+		MembershipCheckInterval: int(getEnvInt64("CHAT_MEMBERSHIP_CHECK_INTERVAL", 0)),
+		PresenceTTL:             int(getEnvInt64("CHAT_PRESENCE_TTL", 0)),
+		RateLimitTTL:            int(getEnvInt64("CHAT_RATE_LIMIT_TTL", 0)),
+		IdleTimeout:             int(getEnvInt64("CHAT_IDLE_TIMEOUT", 0)),
+		PingInterval:            int(getEnvInt64("CHAT_PING_INTERVAL", 0)),
+		MaxConnectionsPerUser:   int(getEnvInt64("CHAT_MAX_CONNECTIONS_PER_USER", 0)),
+		MaxConnections:          int(getEnvInt64("CHAT_MAX_CONNECTIONS", 0)),
+		DeleteWindow:            int(getEnvInt64("CHAT_DELETE_WINDOW", 0)),
+		LockTTL:                 int(getEnvInt64("CHAT_LOCK_TTL", 0)),
+		ServerRoomIDs:           os.Getenv("CHAT_SERVER_ROOM_IDS") == "true",
+		Compression:             os.Getenv("CHAT_COMPRESSION") == "true",
+	}
+
+	if value := os.Getenv("CHAT_EDIT_WINDOW"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil {
+			chat.EditWindow = &seconds
+		}
+	}
+	chat.setDefaults()
+
+	return chat
+}
+
+// setDefaults fills the unset values, so both env and hcl configs share the same defaults
+func (c *Chat) setDefaults() {
+	if c.HistorySize <= 0 {
+		c.HistorySize = DefaultHistorySize
+	}
+
+	if c.HistoryReplay <= 0 {
+		c.HistoryReplay = DefaultHistoryReplay
+	}
+
+	if c.MaxHistoryReplay <= 0 {
+		c.MaxHistoryReplay = DefaultMaxHistoryReplay
+	}
+
+	if c.InactivityTimeout <= 0 {
+		c.InactivityTimeout = DefaultInactivityTimeout
+	}
+
+	if c.CleanupInterval <= 0 {
+		c.CleanupInterval = DefaultCleanupInterval
+	}
+
+	if c.MonitorInterval <= 0 {
+		c.MonitorInterval = DefaultMonitorInterval
+	}
+
+	if c.StaleClientTimeout <= 0 {
+		c.StaleClientTimeout = DefaultStaleClientTimeout
+	}
+
+	if c.MaxPinsPerRoom <= 0 {
+		c.MaxPinsPerRoom = DefaultMaxPinsPerRoom
+	}
+
+	if c.MembershipCheckInterval <= 0 {
+		c.MembershipCheckInterval = DefaultMembershipCheckInterval
+	}
+
+	if c.PresenceTTL <= 0 {
+		c.PresenceTTL = DefaultPresenceTTL
+	}
+
+	if c.RateLimitTTL <= 0 {
+		c.RateLimitTTL = DefaultRateLimitTTL
+	}
+
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = DefaultIdleTimeout
+	}
+
+	if c.PingInterval <= 0 {
+		c.PingInterval = DefaultPingInterval
+	}
+
+	// 0 is unlimited, like the delete window
+	if c.EditWindow == nil || *c.EditWindow < 0 {
+		editWindow := DefaultEditWindow
+		c.EditWindow = &editWindow
+	}
+
+	if c.LockTTL <= 0 {
+		c.LockTTL = DefaultLockTTL
+	}
+}
+
+// EditWindowSeconds returns how many seconds senders can edit their messages, 0 when unlimited
+func (c Chat) EditWindowSeconds() int {
+	if c.EditWindow == nil || *c.EditWindow < 0 {
+		return DefaultEditWindow
+	}
+
+	return *c.EditWindow
+}
+
+// Validate rejects the TTLs too short for the intervals they depend on
+func (c Chat) Validate() error {
+	// A live connection must be flagged stale by the monitor before its presence expires,
+	// and several heartbeats must be able to refresh it in between
+	if c.PresenceTTL <= c.StaleClientTimeout {
+		return fmt.Errorf("chat: presence_ttl (%ds) must be longer than stale_client_timeout (%ds)", c.PresenceTTL, c.StaleClientTimeout)
+	}
+
+	if c.PresenceTTL < 2*HeartbeatInterval {
+		return fmt.Errorf("chat: presence_ttl (%ds) must be at least twice the heartbeat interval (%ds)", c.PresenceTTL, HeartbeatInterval)
+	}
+
+	if c.PresenceTTL <= c.MonitorInterval {
+		return fmt.Errorf("chat: presence_ttl (%ds) must be longer than monitor_interval (%ds)", c.PresenceTTL, c.MonitorInterval)
+	}
+
+	// The last message time must outlive the delay, or a user sending right after it expires
+	// wouldn't be limited
+	if time.Duration(c.RateLimitTTL)*time.Second < 2*MessageDelay {
+		return fmt.Errorf("chat: rate_limit_ttl (%ds) must be at least twice the message delay (%s)", c.RateLimitTTL, MessageDelay)
+	}
+
+	// A connection answering the pings must never be seen as idle
+	if c.PingInterval >= c.IdleTimeout {
+		return fmt.Errorf("chat: ping_interval (%ds) must be shorter than idle_timeout (%ds)", c.PingInterval, c.IdleTimeout)
+	}
+
+	if c.HistoryReplay > c.MaxHistoryReplay {
+		return fmt.Errorf("chat: history_replay (%d) can't exceed max_history_replay (%d)", c.HistoryReplay, c.MaxHistoryReplay)
+	}
+
+	if c.MaxConnectionsPerUser < 0 || c.MaxConnections < 0 {
+		return fmt.Errorf("chat: connection limits can't be negative, use 0 for unlimited")
+	}
+
+	if c.DeleteWindow < 0 {
+		return fmt.Errorf("chat: delete_window can't be negative, use 0 for unlimited")
+	}
+
+	return nil
+}
+
+// getEnvInt64 returns the env var parsed as an int64, or the fallback when it's unset or invalid
+func getEnvInt64(key string, fallback int64) int64 {
+	value, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+	if err != nil {
+		return fallback
+	}
+
+	return value
+}
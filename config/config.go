@@ -2,27 +2,42 @@ package config
 
 import (
 	"fmt"
+	"net/url"
 	"os"
+	"strconv"
 
 	"github.com/hashicorp/hcl/v2/hclsimple"
 )
 
 // Config is the top-level config
 type Config struct {
-	Server Server `hcl:"server,block"`
-	API    API    `hcl:"api,block"`
-	Env    Env    `hcl:"env,block"`
-	JWT    JWT    `hcl:"jwt,block"`
-	APIKey string `hcl:"api_key,attr"`
+	Server   Server `hcl:"server,block"`
+	API      API    `hcl:"api,block"`
+	Env      Env    `hcl:"env,block"`
+	JWT      JWT    `hcl:"jwt,block"`
+	Chat     Chat   `hcl:"chat,block"`
+	// Attachments configures where the uploaded files are stored
+	Attachments Attachments `hcl:"attachments,block"`
+	// Moderation configures the banned words filter
+	Moderation Moderation `hcl:"moderation,block"`
+	// CORS configures the cross-origin requests policy
+	CORS CORS `hcl:"cors,block"`
+	// RoomCreation limits how many rooms each API client can create
+	RoomCreation RoomCreation `hcl:"room_creation,block"`
+	APIKey   string `hcl:"api_key,attr"`
+	AdminKey string `hcl:"admin_key,optional"` // Guards the admin endpoints, which are disabled when it's empty
+	// APIKeyGracePeriod is how many seconds a client's previous API key keeps working after a rotation
+	APIKeyGracePeriod int `hcl:"api_key_grace_period,optional"`
+	// BcryptCost is the cost of the password hashes. After raising it, the passwords hashed with a
+	// lower cost are hashed again when their users log in.
+	BcryptCost int `hcl:"bcrypt_cost,optional"`
 }
 
-type JWT struct {
-	Secret string `hcl:"secret,attr"`
-}
+// DefaultAPIKeyGracePeriod is one day, in seconds
+const DefaultAPIKeyGracePeriod = 24 * 60 * 60
 
-type OldJWT struct {
-	Secret string `hcl:"secret,attr"`
-}
+// DefaultBcryptCost is bcrypt.DefaultCost
+const DefaultBcryptCost = 10
 
 type Env struct {
 	Port string `hcl:"port,attr"`
@@ -33,15 +48,39 @@ type Env struct {
 
 // Server related config
 type Server struct {
-	BindAddr   string `hcl:"bind_addr,attr"`
-	LogLevel   string `hcl:"log_level,attr"`
-	CtxTimeout int    `hcl:"ctx_timeout,attr"`
+	BindAddr       string `hcl:"bind_addr,attr"`
+	LogLevel       string `hcl:"log_level,attr"`
+	CtxTimeout     int    `hcl:"ctx_timeout,attr"`
+	MetricsEnabled bool   `hcl:"metrics_enabled,optional"` // Exposes Prometheus metrics at /metrics
+	// ShutdownDelay is how long, in seconds, readiness fails before the shutdown starts, so load
+	// balancers stop routing to the instance first. 0 skips it.
+	ShutdownDelay int `hcl:"shutdown_delay,optional"`
 }
 
+// DefaultShutdownDelay covers a few readiness probes of the load balancers, in seconds
+const DefaultShutdownDelay = 5
+
 // GetConfig returns a config from an hcl file
 func GetConfig(path string) (Config, error) {
 	config := Config{}
 	err := hclsimple.DecodeFile(path, nil, &config)
+	config.API.setDefaults()
+	config.Chat.setDefaults()
+	config.Attachments.setDefaults()
+	config.Moderation.setDefaults()
+	if len(config.CORS.AllowedOrigins) == 0 {
+		config.CORS.AllowedOrigins = splitList(config.Env.AllowedOrigins)
+	}
+	config.CORS.setDefaults()
+	config.RoomCreation.setDefaults()
+	config.JWT.setDefaults()
+	if config.APIKeyGracePeriod <= 0 {
+		config.APIKeyGracePeriod = DefaultAPIKeyGracePeriod
+	}
+	// Other invalid costs are reported by Validate
+	if config.BcryptCost == 0 {
+		config.BcryptCost = DefaultBcryptCost
+	}
 
 	return config, err
 }
@@ -51,20 +90,81 @@ func DefaultConfig(cfg Config) Config {
 
 	return Config{
 		Server: Server{
-			BindAddr:   fmt.Sprintf(":%s", os.Getenv("PORT")),
-			LogLevel:   "INFO",
-			CtxTimeout: 5,
+			BindAddr:       fmt.Sprintf(":%s", os.Getenv("PORT")),
+			LogLevel:       "INFO",
+			CtxTimeout:     5,
+			MetricsEnabled: os.Getenv("METRICS_ENABLED") == "true",
+			ShutdownDelay:  int(getEnvInt64("SHUTDOWN_DELAY", DefaultShutdownDelay)),
 		},
 		API: GetDefaltAPIConfig(cfg),
-		JWT: JWT{
-			Secret: os.Getenv("JWT_SECRET"),
-		},
+		JWT: GetDefaultJWTConfig(),
 		Env: Env{
 			Port: os.Getenv("PORT"),
 			Host: os.Getenv("HOST"),
 			Env:  os.Getenv("ENV"),
 			AllowedOrigins: os.Getenv("ALLOWED_ORIGINS"),
 		},
-		APIKey: os.Getenv("API_KEY"),
+		Chat:              GetDefaultChatConfig(),
+		Attachments:       GetDefaultAttachmentsConfig(),
+		Moderation:        GetDefaultModerationConfig(),
+		CORS:              GetDefaultCORSConfig(),
+		RoomCreation:      GetDefaultRoomCreationConfig(),
+		APIKey:            os.Getenv("API_KEY"),
+		AdminKey:          os.Getenv("ADMIN_KEY"),
+		APIKeyGracePeriod: getAPIKeyGracePeriod(),
+		BcryptCost:        int(getEnvInt64("BCRYPT_COST", DefaultBcryptCost)),
 	}
 }
+
+func getAPIKeyGracePeriod() int {
+	gracePeriod, err := strconv.Atoi(os.Getenv("API_KEY_GRACE_PERIOD"))
+	if err != nil || gracePeriod <= 0 {
+		return DefaultAPIKeyGracePeriod
+	}
+
+	return gracePeriod
+}
+
+// redacted is the placeholder used in place of secret values when logging
+const redacted = "[REDACTED]"
+
+// Sanitized returns a copy of the config with secrets masked so it can be
+// safely logged
+func (c Config) Sanitized() Config {
+	sanitized := c
+
+	sanitized.JWT.Secret = redactSecret(c.JWT.Secret)
+	sanitized.JWT.PreviousSecrets = nil
+	for _, secret := range c.JWT.PreviousSecrets {
+		sanitized.JWT.PreviousSecrets = append(sanitized.JWT.PreviousSecrets, redactSecret(secret))
+	}
+	sanitized.APIKey = redactSecret(c.APIKey)
+	sanitized.AdminKey = redactSecret(c.AdminKey)
+	sanitized.API.Mongo.Dsn = redactDSN(c.API.Mongo.Dsn)
+	sanitized.API.Redis.Dsn = redactDSN(c.API.Redis.Dsn)
+
+	return sanitized
+}
+
+func redactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+
+	return redacted
+}
+
+// redactDSN masks the password of a connection string, keeping the rest of it
+// readable. If the DSN can't be parsed, it is masked entirely.
+func redactDSN(dsn string) string {
+	if dsn == "" {
+		return ""
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return redacted
+	}
+
+	return u.Redacted()
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+// DefaultCORSMaxAge is how many seconds the browsers cache a preflight response
+const DefaultCORSMaxAge = 300
+
+var (
+	DefaultCORSAllowedMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"}
+	DefaultCORSAllowedHeaders = []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"}
+)
+
+// CORS related config
+type CORS struct {
+	// AllowedOrigins are full origins ("https://app.example.com"), subdomain wildcards
+	// ("*.example.com" or "https://*.example.com") or "*" for any origin.
+	// When unset, the comma separated env.allowed_origins is used.
+	AllowedOrigins []string `hcl:"allowed_origins,optional"`
+	AllowedMethods []string `hcl:"allowed_methods,optional"`
+	AllowedHeaders []string `hcl:"allowed_headers,optional"`
+	// AllowCredentials lets the browsers send cookies and auth headers, it defaults to true
+	AllowCredentials *bool `hcl:"allow_credentials,optional"`
+	MaxAge           int   `hcl:"max_age,optional"` // In seconds
+	// InsecureWebSocketOrigins lets any origin open a WebSocket, only meant for local development
+	InsecureWebSocketOrigins bool `hcl:"insecure_websocket_origins,optional"`
+}
+
+func GetDefaultCORSConfig() CORS {
+	cors := CORS{
+		AllowedOrigins: splitList(os.Getenv("ALLOWED_ORIGINS")),
+		AllowedMethods: splitList(os.Getenv("CORS_ALLOWED_METHODS")),
+		AllowedHeaders: splitList(os.Getenv("CORS_ALLOWED_HEADERS")),
+		MaxAge:         int(getEnvInt64("CORS_MAX_AGE", 0)),
+
+		InsecureWebSocketOrigins: os.Getenv("CORS_INSECURE_WEBSOCKET_ORIGINS") == "true",
+	}
+
+	if credentials := os.Getenv("CORS_ALLOW_CREDENTIALS"); credentials != "" {
+		allow := credentials == "true"
+		cors.AllowCredentials = &allow
+	}
+	cors.setDefaults()
+
+	return cors
+}
+
+// setDefaults allows credentials unless they were explicitly turned off
+func (c *CORS) setDefaults() {
+	if len(c.AllowedMethods) == 0 {
+		c.AllowedMethods = DefaultCORSAllowedMethods
+	}
+
+	if len(c.AllowedHeaders) == 0 {
+		c.AllowedHeaders = DefaultCORSAllowedHeaders
+	}
+
+	if c.AllowCredentials == nil {
+		allow := true
+		c.AllowCredentials = &allow
+	}
+
+	if c.MaxAge <= 0 {
+		c.MaxAge = DefaultCORSMaxAge
+	}
+}
+
+// Credentials tells whether the credentials are allowed
+func (c CORS) Credentials() bool {
+	return c.AllowCredentials != nil && *c.AllowCredentials
+}
+
+// Validate rejects the policies the browsers refuse or that are unsafe
+func (c CORS) Validate() error {
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" && c.Credentials() {
+			return errors.New("cors: the \"*\" origin can't be allowed with credentials, list the origins or disable allow_credentials")
+		}
+
+		if origin != "*" && strings.Contains(origin, "*") && !validWildcardOrigin(origin) {
+			return errors.New("cors: invalid origin " + origin + ", wildcards are only supported as the leading subdomain (\"*.example.com\")")
+		}
+	}
+
+	return nil
+}
+
+// WebSocketOriginPatterns returns the allowed origins as the host patterns the WebSocket
+// handshake matches the Origin header against. Same-host requests are always allowed.
+func (c CORS) WebSocketOriginPatterns() []string {
+	patterns := make([]string, 0, len(c.AllowedOrigins))
+	for _, origin := range c.AllowedOrigins {
+		if _, host, found := strings.Cut(origin, "://"); found {
+			origin = host
+		}
+		patterns = append(patterns, origin)
+	}
+
+	return patterns
+}
+
+// validWildcardOrigin tells whether the only wildcard of the origin is its leading subdomain
+func validWildcardOrigin(origin string) bool {
+	if _, host, found := strings.Cut(origin, "://"); found {
+		origin = host
+	}
+
+	return strings.HasPrefix(origin, "*.") && strings.Count(origin, "*") == 1 && len(origin) > 2
+}
+
+// splitList splits a comma separated list, dropping the blank entries
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	return items
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"slices"
+)
+
+// DefaultGuestTTL is how many seconds the guest tokens are valid, one hour
+const DefaultGuestTTL = 60 * 60
+
+// insecureJWTSecrets are the well-known placeholder secrets, anyone can sign tokens with them
+var insecureJWTSecrets = []string{"secret", "secret-key", "your-secret-key", "changeme"}
+
+// JWT configures how the tokens are signed and verified
+type JWT struct {
+	// Secret signs the new tokens and verifies the outstanding ones
+	Secret string `hcl:"secret,attr"`
+	// PreviousSecrets keep verifying the tokens signed before a rotation, until they expire
+	PreviousSecrets []string `hcl:"previous_secrets,optional"`
+	// GuestTTL is how many seconds the guest tokens are valid, their guests are removed after
+	GuestTTL int `hcl:"guest_ttl,optional"`
+}
+
+func GetDefaultJWTConfig() JWT {
+	return JWT{
+		Secret:          os.Getenv("JWT_SECRET"),
+		PreviousSecrets: splitList(os.Getenv("JWT_PREVIOUS_SECRETS")),
+		GuestTTL:        int(getEnvInt64("JWT_GUEST_TTL", 0)),
+	}
+}
+
+func (j *JWT) setDefaults() {
+	if j.GuestTTL <= 0 {
+		j.GuestTTL = DefaultGuestTTL
+	}
+}
+
+// VerificationSecrets returns the secrets the tokens may be signed with, the current one first
+func (j JWT) VerificationSecrets() []string {
+	secrets := []string{j.Secret}
+	for _, secret := range j.PreviousSecrets {
+		if secret != "" && !slices.Contains(secrets, secret) {
+			secrets = append(secrets, secret)
+		}
+	}
+
+	return secrets
+}
+
+// Insecure tells whether the secret is one of the well-known placeholders
+func (j JWT) Insecure() bool {
+	return slices.Contains(insecureJWTSecrets, j.Secret)
+}
+
+// Validate requires a secret, which can't be a placeholder outside development
+func (j JWT) Validate(env string) error {
+	if j.Secret == "" {
+		return errors.New("jwt: the secret is required, set JWT_SECRET")
+	}
+
+	if j.Insecure() && env != "development" {
+		return errors.New("jwt: the secret is a well-known placeholder, set a random JWT_SECRET")
+	}
+
+	return nil
+}
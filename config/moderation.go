@@ -0,0 +1,44 @@
+package config
+
+import (
+	"os"
+	"strings"
+)
+
+// DefaultModerationMode masks the banned words
+const DefaultModerationMode = "mask"
+
+// Moderation configures the banned words filter applied to the messages
+type Moderation struct {
+	// Enabled applies the filter to every room, unless the room turns it off in its settings
+	Enabled        bool     `hcl:"enabled,optional"`
+	Mode           string   `hcl:"mode,optional"` // "mask" or "reject"
+	BannedWords    []string `hcl:"banned_words,optional"`
+	BannedPatterns []string `hcl:"banned_patterns,optional"` // Regular expressions matching whole words
+	Leetspeak      bool     `hcl:"leetspeak,optional"`       // Also catches variants like "h3ll0"
+}
+
+func GetDefaultModerationConfig() Moderation {
+	moderation := Moderation{
+		Enabled:   os.Getenv("MODERATION_ENABLED") == "true",
+		Mode:      os.Getenv("MODERATION_MODE"),
+		Leetspeak: os.Getenv("MODERATION_LEETSPEAK") == "true",
+	}
+
+	if words := os.Getenv("MODERATION_BANNED_WORDS"); words != "" {
+		moderation.BannedWords = strings.Split(words, ",")
+	}
+
+	if patterns := os.Getenv("MODERATION_BANNED_PATTERNS"); patterns != "" {
+		moderation.BannedPatterns = strings.Split(patterns, ",")
+	}
+	moderation.setDefaults()
+
+	return moderation
+}
+
+func (m *Moderation) setDefaults() {
+	if m.Mode == "" {
+		m.Mode = DefaultModerationMode
+	}
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultRoomCreationWindow is how many seconds the room creation limit is counted over
+const DefaultRoomCreationWindow = 60 * 60
+
+// RoomCreation limits how many rooms each API client can create over a sliding window
+type RoomCreation struct {
+	Window int `hcl:"window,optional"` // In seconds
+	// Rooms per window for the clients without a tier, and the configured API key. Unlimited when 0
+	Limit int `hcl:"limit,optional"`
+	// Rooms per window by client tier, overriding the limit. Unlimited when 0
+	Tiers map[string]int `hcl:"tiers,optional"`
+}
+
+func GetDefaultRoomCreationConfig() RoomCreation {
+	roomCreation := RoomCreation{
+		Window: int(getEnvInt64("ROOM_CREATION_WINDOW", 0)),
+		Limit:  int(getEnvInt64("ROOM_CREATION_LIMIT", 0)),
+		Tiers:  parseTierLimits(os.Getenv("ROOM_CREATION_TIERS")),
+	}
+	roomCreation.setDefaults()
+
+	return roomCreation
+}
+
+func (r *RoomCreation) setDefaults() {
+	if r.Window <= 0 {
+		r.Window = DefaultRoomCreationWindow
+	}
+}
+
+// Validate rejects negative limits
+func (r RoomCreation) Validate() error {
+	if r.Limit < 0 {
+		return fmt.Errorf("room_creation: limit can't be negative, use 0 for unlimited")
+	}
+
+	for tier, limit := range r.Tiers {
+		if limit < 0 {
+			return fmt.Errorf("room_creation: limit of tier %q can't be negative, use 0 for unlimited", tier)
+		}
+	}
+
+	return nil
+}
+
+// LimitFor returns how many rooms a client of the tier can create per window, 0 when unlimited
+func (r RoomCreation) LimitFor(tier string) int {
+	if limit, ok := r.Tiers[tier]; ok && tier != "" {
+		return limit
+	}
+
+	return r.Limit
+}
+
+// parseTierLimits parses a "tier=limit,tier=limit" list, skipping the invalid entries
+func parseTierLimits(value string) map[string]int {
+	tiers := map[string]int{}
+	for _, entry := range splitList(value) {
+		tier, limit, ok := strings.Cut(entry, "=")
+		if !ok {
+			continue
+		}
+
+		n, err := strconv.Atoi(strings.TrimSpace(limit))
+		if err != nil || n < 0 {
+			continue
+		}
+		tiers[strings.TrimSpace(tier)] = n
+	}
+
+	return tiers
+}
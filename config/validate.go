@@ -0,0 +1,96 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Validate checks the config before anything connects, returning every missing or invalid
+// field at once instead of failing on the first one
+func (c Config) Validate() error {
+	var errs []error
+
+	if c.API.Mongo.Dsn == "" {
+		errs = append(errs, errors.New("api: the mongo dsn is required, set DATABASE_URL"))
+	} else if !hasScheme(c.API.Mongo.Dsn, "mongodb", "mongodb+srv") {
+		errs = append(errs, errors.New("api: the mongo dsn must be a mongodb:// or mongodb+srv:// URL"))
+	}
+
+	switch c.API.Broker {
+	case BrokerRedis:
+		if c.API.Redis.Dsn == "" {
+			errs = append(errs, errors.New("api: the redis dsn is required, set REDIS_URL"))
+		} else if !hasScheme(c.API.Redis.Dsn, "redis", "rediss") {
+			errs = append(errs, errors.New("api: the redis dsn must be a redis:// or rediss:// URL"))
+		}
+	case BrokerMemory:
+	default:
+		errs = append(errs, fmt.Errorf("api: broker %q is not one of %s or %s", c.API.Broker, BrokerRedis, BrokerMemory))
+	}
+
+	if err := validateBindAddr(c.Server.BindAddr); err != nil {
+		errs = append(errs, err)
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Server.LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("server: log_level %q is not one of DEBUG, INFO, WARN or ERROR", c.Server.LogLevel))
+	}
+
+	if c.Server.ShutdownDelay < 0 {
+		errs = append(errs, fmt.Errorf("server: shutdown_delay %d must not be negative, set SHUTDOWN_DELAY", c.Server.ShutdownDelay))
+	}
+
+	if c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost {
+		errs = append(errs, fmt.Errorf("bcrypt_cost %d must be between %d and %d, set BCRYPT_COST", c.BcryptCost, bcrypt.MinCost, bcrypt.MaxCost))
+	}
+
+	if c.Env.Env == "production" && len(c.CORS.AllowedOrigins) == 0 {
+		errs = append(errs, errors.New("cors: allowed_origins are required in production, set ALLOWED_ORIGINS"))
+	}
+
+	for _, err := range []error{
+		c.API.Mongo.Validate(),
+		c.API.Redis.Validate(),
+		c.JWT.Validate(c.Env.Env),
+		c.Chat.Validate(),
+		c.CORS.Validate(),
+		c.RoomCreation.Validate(),
+	} {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateBindAddr requires a port, the server would listen on a random one otherwise
+func validateBindAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("server: bind_addr %q must be host:port", addr)
+	}
+
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return fmt.Errorf("server: bind_addr %q has no valid port, set PORT", addr)
+	}
+
+	return nil
+}
+
+func hasScheme(dsn string, schemes ...string) bool {
+	for _, scheme := range schemes {
+		if strings.HasPrefix(dsn, scheme+"://") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -46,7 +46,7 @@ export async function POST(req: NextRequest) {
 
     return NextResponse.json({
         user_id: data.users[0].id,
-        room_id: data.id,
+        room_id: data.room_id,
         nickname: data.users[0].nickname,
     });
 } 
\ No newline at end of file
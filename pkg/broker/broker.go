@@ -0,0 +1,99 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned when getting a key that doesn't exist or expired
+var ErrNotFound = errors.New("broker: key not found")
+
+// Broker fans the room messages out to the connections of every instance, and keeps the
+// state they share: the room history, the presence of the connections, and the short-lived
+// keys behind the rate limits, mutes and maintenance flag.
+//
+// Redis is the default. Memory keeps everything in the process, for single instance
+// deployments and tests.
+type Broker interface {
+	// Publish sends the payload to the channel subscribers, returning how many received it
+	Publish(ctx context.Context, channel string, payload []byte) (int64, error)
+	// PublishWithHistory publishes the payload to the room channel and appends it to the
+	// room history, trimmed to the historySize most recent entries
+	PublishWithHistory(ctx context.Context, roomID string, timestamp time.Time, payload []byte, historySize int64) (int64, error)
+	// Subscribe receives the payloads published to the channel until it's closed
+	Subscribe(ctx context.Context, channel string) Subscription
+
+	// History returns up to limit of the most recent entries of the room history, oldest
+	// first. The whole history is returned when limit isn't positive.
+	History(ctx context.Context, roomID string, limit int64) ([][]byte, error)
+	// RemoveHistory removes the entries from the room history
+	RemoveHistory(ctx context.Context, roomID string, entries [][]byte) error
+	// ReplaceHistory swaps the entry of the room history for the replacement, keeping its
+	// place. It's a no-op when the entry isn't in the history.
+	ReplaceHistory(ctx context.Context, roomID string, entry []byte, replacement []byte) error
+
+	// RegisterConnection marks the connection alive, its user connected to the room and
+	// online, for ttl unless refreshed. It returns the user's open connections.
+	RegisterConnection(ctx context.Context, conn Connection, ttl time.Duration) (PresenceCounts, error)
+	// ReleaseConnection removes the connection, and its user from the room once their last
+	// connection to it is released. Releasing a connection twice is a no-op.
+	ReleaseConnection(ctx context.Context, userID string, connectionID string, roomID string) (PresenceCounts, error)
+	// RefreshConnection records the connection as alive and extends its presence for ttl
+	RefreshConnection(ctx context.Context, conn Connection, ttl time.Duration) error
+	// Connections returns the connections registered by every instance
+	Connections(ctx context.Context) ([]Connection, error)
+	// RoomMembers returns the IDs of the users connected to the room
+	RoomMembers(ctx context.Context, roomID string) ([]string, error)
+	// CountRoomMembers returns how many users are connected to each of the rooms
+	CountRoomMembers(ctx context.Context, roomIDs []string) ([]int64, error)
+	// ConnectedRooms returns the IDs of the rooms with connected users
+	ConnectedRooms(ctx context.Context) ([]string, error)
+	// CountUserConnections returns how many connections the user has open
+	CountUserConnections(ctx context.Context, userID string) (int64, error)
+	// OnlineUsers returns the IDs of the users with an open connection
+	OnlineUsers(ctx context.Context) ([]string, error)
+	// PrunePresence removes the users from the rooms, and from the online users, that were only
+	// left there by connections that expired without being released, such as the connections
+	// of a crashed instance. It returns how many users were removed from rooms.
+	PrunePresence(ctx context.Context) (int64, error)
+
+	// Get returns the value of the key, or ErrNotFound
+	Get(ctx context.Context, key string) (string, error)
+	// Set stores the value for ttl, or until deleted when ttl is 0
+	Set(ctx context.Context, key string, value string, ttl time.Duration) error
+	// SetNX stores the value only when the key doesn't exist, reporting whether it was stored
+	SetNX(ctx context.Context, key string, value string, ttl time.Duration) (bool, error)
+	// Replace changes the value of the key, keeping its expiration
+	Replace(ctx context.Context, key string, value string) error
+	// Delete removes the key, reporting whether it existed
+	Delete(ctx context.Context, key string) (bool, error)
+	// TTL returns how long until the key expires, zero when it doesn't exist or never expires
+	TTL(ctx context.Context, key string) (time.Duration, error)
+	// RecordInWindow records the member in the sliding window of the key when it holds fewer
+	// than limit members. Otherwise, it returns how long until the oldest one leaves the window.
+	RecordInWindow(ctx context.Context, key string, member string, limit int, window time.Duration) (time.Duration, error)
+}
+
+// Subscription delivers the payloads published to a channel
+type Subscription interface {
+	// Messages is closed once the subscription is
+	Messages() <-chan []byte
+	Close() error
+}
+
+// Connection is the presence of a WebSocket connection
+type Connection struct {
+	UserID       string
+	RoomID       string
+	Nickname     string
+	ConnectionID string
+	LastSeen     time.Time // Last heartbeat
+}
+
+// PresenceCounts are the user's open connections after one is registered or released
+type PresenceCounts struct {
+	InRoom   int64 // To the connection's room
+	Total    int64 // Across every room
+	Released bool  // The release call is the one that released the connection
+}
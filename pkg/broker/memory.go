@@ -0,0 +1,437 @@
+package broker
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MemorySubscriptionBuffer is how many payloads a subscription holds before the next
+// ones are dropped, like Redis does for the subscribers that can't keep up
+const MemorySubscriptionBuffer = 100
+
+// Memory keeps the messages and state in the process. The instances don't share them,
+// so it only fits single instance deployments and tests.
+type Memory struct {
+	mu            sync.Mutex
+	subscriptions map[string]map[*memorySubscription]struct{} // By channel
+	history       map[string][]timedEntry                     // By room ID, oldest first
+	connections   map[string]memoryConnection                 // By connection ID
+	keys          map[string]memoryKey
+	windows       map[string][]timedEntry // Sliding windows, oldest first
+}
+
+// timedEntry is a history entry, or a member of a sliding window
+type timedEntry struct {
+	at      time.Time
+	payload []byte
+}
+
+type memoryConnection struct {
+	Connection
+	expiresAt time.Time
+}
+
+type memoryKey struct {
+	value     string
+	expiresAt time.Time // Zero when it never expires
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		subscriptions: make(map[string]map[*memorySubscription]struct{}),
+		history:       make(map[string][]timedEntry),
+		connections:   make(map[string]memoryConnection),
+		keys:          make(map[string]memoryKey),
+		windows:       make(map[string][]timedEntry),
+	}
+}
+
+func (m *Memory) Publish(ctx context.Context, channel string, payload []byte) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.publish(channel, payload), nil
+}
+
+// publish delivers the payload to the channel subscriptions, the caller holds the lock
+func (m *Memory) publish(channel string, payload []byte) int64 {
+	var receivers int64
+	for sub := range m.subscriptions[channel] {
+		select {
+		case sub.messages <- slices.Clone(payload):
+			receivers++
+		default:
+		}
+	}
+
+	return receivers
+}
+
+func (m *Memory) PublishWithHistory(ctx context.Context, roomID string, timestamp time.Time, payload []byte, historySize int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	receivers := m.publish(roomID, payload)
+
+	// Kept sorted by timestamp, like the Redis sorted set
+	history := m.history[roomID]
+	i, _ := slices.BinarySearchFunc(history, timestamp, func(entry timedEntry, t time.Time) int {
+		if entry.at.After(t) {
+			return 1
+		}
+		return -1
+	})
+	history = slices.Insert(history, i, timedEntry{at: timestamp, payload: slices.Clone(payload)})
+	if int64(len(history)) > historySize {
+		history = slices.Clone(history[int64(len(history))-historySize:])
+	}
+	m.history[roomID] = history
+
+	return receivers, nil
+}
+
+func (m *Memory) Subscribe(ctx context.Context, channel string) Subscription {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sub := &memorySubscription{
+		broker:   m,
+		channel:  channel,
+		messages: make(chan []byte, MemorySubscriptionBuffer),
+	}
+
+	if m.subscriptions[channel] == nil {
+		m.subscriptions[channel] = make(map[*memorySubscription]struct{})
+	}
+	m.subscriptions[channel][sub] = struct{}{}
+
+	return sub
+}
+
+type memorySubscription struct {
+	broker   *Memory
+	channel  string
+	messages chan []byte
+}
+
+func (s *memorySubscription) Messages() <-chan []byte {
+	return s.messages
+}
+
+func (s *memorySubscription) Close() error {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+
+	subs := s.broker.subscriptions[s.channel]
+	if _, ok := subs[s]; !ok {
+		return nil
+	}
+
+	delete(subs, s)
+	if len(subs) == 0 {
+		delete(s.broker.subscriptions, s.channel)
+	}
+	close(s.messages)
+
+	return nil
+}
+
+func (m *Memory) History(ctx context.Context, roomID string, limit int64) ([][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	history := m.history[roomID]
+	if limit > 0 && int64(len(history)) > limit {
+		history = history[int64(len(history))-limit:]
+	}
+
+	entries := make([][]byte, len(history))
+	for i, entry := range history {
+		entries[i] = slices.Clone(entry.payload)
+	}
+
+	return entries, nil
+}
+
+func (m *Memory) RemoveHistory(ctx context.Context, roomID string, entries [][]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.history[roomID] = slices.DeleteFunc(m.history[roomID], func(entry timedEntry) bool {
+		return slices.ContainsFunc(entries, func(removed []byte) bool { return string(removed) == string(entry.payload) })
+	})
+	if len(m.history[roomID]) == 0 {
+		delete(m.history, roomID)
+	}
+
+	return nil
+}
+
+func (m *Memory) ReplaceHistory(ctx context.Context, roomID string, entry []byte, replacement []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, stored := range m.history[roomID] {
+		if string(stored.payload) == string(entry) {
+			m.history[roomID][i].payload = slices.Clone(replacement)
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (m *Memory) RegisterConnection(ctx context.Context, conn Connection, ttl time.Duration) (PresenceCounts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.connections[conn.ConnectionID] = memoryConnection{Connection: conn, expiresAt: time.Now().Add(ttl)}
+
+	return m.presenceCounts(conn.UserID, conn.RoomID), nil
+}
+
+func (m *Memory) ReleaseConnection(ctx context.Context, userID string, connectionID string, roomID string) (PresenceCounts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conn, released := m.liveConnections()[connectionID]
+	released = released && conn.UserID == userID
+	if released {
+		delete(m.connections, connectionID)
+	}
+
+	counts := m.presenceCounts(userID, roomID)
+	counts.Released = released
+
+	return counts, nil
+}
+
+func (m *Memory) RefreshConnection(ctx context.Context, conn Connection, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	live, ok := m.liveConnections()[conn.ConnectionID]
+	if !ok {
+		return nil
+	}
+
+	live.LastSeen = conn.LastSeen
+	live.expiresAt = time.Now().Add(ttl)
+	m.connections[conn.ConnectionID] = live
+
+	return nil
+}
+
+func (m *Memory) Connections(ctx context.Context) ([]Connection, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	connections := []Connection{}
+	for _, conn := range m.liveConnections() {
+		connections = append(connections, conn.Connection)
+	}
+
+	return connections, nil
+}
+
+func (m *Memory) RoomMembers(ctx context.Context, roomID string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.users(func(conn Connection) bool { return conn.RoomID == roomID }), nil
+}
+
+func (m *Memory) CountRoomMembers(ctx context.Context, roomIDs []string) ([]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := make([]int64, len(roomIDs))
+	for i, roomID := range roomIDs {
+		counts[i] = int64(len(m.users(func(conn Connection) bool { return conn.RoomID == roomID })))
+	}
+
+	return counts, nil
+}
+
+func (m *Memory) ConnectedRooms(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	roomIDs := []string{}
+	for _, conn := range m.liveConnections() {
+		if !slices.Contains(roomIDs, conn.RoomID) {
+			roomIDs = append(roomIDs, conn.RoomID)
+		}
+	}
+
+	return roomIDs, nil
+}
+
+func (m *Memory) CountUserConnections(ctx context.Context, userID string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.presenceCounts(userID, "").Total, nil
+}
+
+func (m *Memory) OnlineUsers(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.users(func(Connection) bool { return true }), nil
+}
+
+// PrunePresence has nothing to remove, the presence is always counted from the live connections
+func (m *Memory) PrunePresence(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+
+// liveConnections drops the connections that weren't refreshed within their TTL, like
+// their Redis keys expire, and returns the others. The caller holds the lock.
+func (m *Memory) liveConnections() map[string]memoryConnection {
+	now := time.Now()
+	for connectionID, conn := range m.connections {
+		if !now.Before(conn.expiresAt) {
+			delete(m.connections, connectionID)
+		}
+	}
+
+	return m.connections
+}
+
+// users returns the IDs of the users with a live connection matching the filter, the
+// caller holds the lock
+func (m *Memory) users(filter func(Connection) bool) []string {
+	userIDs := []string{}
+	for _, conn := range m.liveConnections() {
+		if filter(conn.Connection) && !slices.Contains(userIDs, conn.UserID) {
+			userIDs = append(userIDs, conn.UserID)
+		}
+	}
+
+	return userIDs
+}
+
+// presenceCounts counts the user's live connections, the caller holds the lock
+func (m *Memory) presenceCounts(userID string, roomID string) PresenceCounts {
+	counts := PresenceCounts{}
+	for _, conn := range m.liveConnections() {
+		if conn.UserID != userID {
+			continue
+		}
+
+		counts.Total++
+		if conn.RoomID == roomID {
+			counts.InRoom++
+		}
+	}
+
+	return counts
+}
+
+// key returns the key unless it expired, the caller holds the lock
+func (m *Memory) key(key string) (memoryKey, bool) {
+	entry, ok := m.keys[key]
+	if ok && !entry.expiresAt.IsZero() && !time.Now().Before(entry.expiresAt) {
+		delete(m.keys, key)
+		return memoryKey{}, false
+	}
+
+	return entry, ok
+}
+
+func (m *Memory) Get(ctx context.Context, key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.key(key)
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	return entry.value, nil
+}
+
+func (m *Memory) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.set(key, value, ttl)
+
+	return nil
+}
+
+// set stores the key, the caller holds the lock
+func (m *Memory) set(key string, value string, ttl time.Duration) {
+	entry := memoryKey{value: value}
+	if ttl > 0 {
+		entry.expiresAt = time.Now().Add(ttl)
+	}
+	m.keys[key] = entry
+}
+
+func (m *Memory) SetNX(ctx context.Context, key string, value string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.key(key); ok {
+		return false, nil
+	}
+	m.set(key, value, ttl)
+
+	return true, nil
+}
+
+func (m *Memory) Replace(ctx context.Context, key string, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, _ := m.key(key)
+	entry.value = value
+	m.keys[key] = entry
+
+	return nil
+}
+
+func (m *Memory) Delete(ctx context.Context, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.key(key)
+	delete(m.keys, key)
+
+	return ok, nil
+}
+
+func (m *Memory) TTL(ctx context.Context, key string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.key(key)
+	if !ok || entry.expiresAt.IsZero() {
+		return 0, nil
+	}
+
+	return time.Until(entry.expiresAt), nil
+}
+
+func (m *Memory) RecordInWindow(ctx context.Context, key string, member string, limit int, window time.Duration) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	entries := slices.DeleteFunc(m.windows[key], func(entry timedEntry) bool {
+		return !entry.at.After(now.Add(-window))
+	})
+
+	if len(entries) >= limit {
+		m.windows[key] = entries
+		return max(entries[0].at.Add(window).Sub(now), time.Millisecond), nil
+	}
+
+	m.windows[key] = append(entries, timedEntry{at: now, payload: []byte(member)})
+
+	return 0, nil
+}
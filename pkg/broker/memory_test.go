@@ -0,0 +1,70 @@
+package broker
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMemoryPresenceOfUncleanDisconnect(t *testing.T) {
+	ctx := t.Context()
+	m := NewMemory()
+
+	register := func(userID string, connectionID string, ttl time.Duration) {
+		t.Helper()
+
+		_, err := m.RegisterConnection(ctx, Connection{
+			UserID:       userID,
+			RoomID:       "lobby",
+			Nickname:     userID,
+			ConnectionID: connectionID,
+			LastSeen:     time.Now(),
+		}, ttl)
+		if err != nil {
+			t.Fatalf("register %s: %v", connectionID, err)
+		}
+	}
+
+	register("alice", "alice-1", time.Minute)
+	// Bob's instance crashes, his connection is neither released nor refreshed
+	register("bob", "bob-1", 50*time.Millisecond)
+
+	members, _ := m.RoomMembers(ctx, "lobby")
+	slices.Sort(members)
+	if want := []string{"alice", "bob"}; !slices.Equal(members, want) {
+		t.Fatalf("room members = %v, want %v", members, want)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := m.PrunePresence(ctx); err != nil {
+		t.Fatalf("prune presence: %v", err)
+	}
+
+	if members, _ := m.RoomMembers(ctx, "lobby"); !slices.Equal(members, []string{"alice"}) {
+		t.Errorf("room members = %v, want [alice]", members)
+	}
+	if online, _ := m.OnlineUsers(ctx); !slices.Equal(online, []string{"alice"}) {
+		t.Errorf("online users = %v, want [alice]", online)
+	}
+	if count, _ := m.CountUserConnections(ctx, "bob"); count != 0 {
+		t.Errorf("bob has %d connections, want 0", count)
+	}
+
+	// Releasing the expired connection late changes nothing
+	counts, err := m.ReleaseConnection(ctx, "bob", "bob-1", "lobby")
+	if err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if counts.Released {
+		t.Error("the expired connection was released again")
+	}
+
+	// Alice leaving the room empties it
+	if _, err := m.ReleaseConnection(ctx, "alice", "alice-1", "lobby"); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if rooms, _ := m.ConnectedRooms(ctx); len(rooms) != 0 {
+		t.Errorf("connected rooms = %v, want none", rooms)
+	}
+}
@@ -0,0 +1,576 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis shares the messages and state between every instance connected to the same Redis
+type Redis struct {
+	client *redis.Client
+}
+
+func NewRedis(client *redis.Client) *Redis {
+	return &Redis{client: client}
+}
+
+// registerConnectionScript marks the connection alive, the user connected to the room and
+// online in a single step. Every connection has its own hash, and the user's connections
+// are tracked in a set, so the user stays online as long as any of them is open.
+//
+// KEYS: connection hash, user connections set, room members set, room connections hash, online users set
+// ARGV: user ID, room ID, nickname, connection ID, last seen, TTL in seconds
+// Returns the user's open connections to the room and in total.
+var registerConnectionScript = redis.NewScript(`
+redis.call('HSET', KEYS[1], 'userID', ARGV[1], 'roomID', ARGV[2], 'nickname', ARGV[3], 'connectionID', ARGV[4], 'lastSeen', ARGV[5])
+redis.call('EXPIRE', KEYS[1], ARGV[6])
+
+redis.call('SADD', KEYS[2], ARGV[4])
+redis.call('EXPIRE', KEYS[2], ARGV[6])
+
+redis.call('HINCRBY', KEYS[4], ARGV[1], 1)
+redis.call('EXPIRE', KEYS[4], ARGV[6])
+redis.call('SADD', KEYS[3], ARGV[1])
+redis.call('EXPIRE', KEYS[3], ARGV[6])
+
+redis.call('SADD', KEYS[5], ARGV[1])
+
+return {redis.call('HGET', KEYS[4], ARGV[1]) + 0, redis.call('SCARD', KEYS[2])}
+`)
+
+// releaseConnectionScript releases a connection, removing the user from the room once their
+// last connection to it is closed, and marking them offline once they have none left.
+// Releasing a connection twice, when it's closed after being dropped as stale, is a no-op.
+//
+// KEYS: connection hash, user connections set, room members set, room connections hash, online users set
+// ARGV: user ID, connection ID
+// Returns the user's remaining connections to the room and in total, and 1 when this call
+// released the connection or 0 when it was already released.
+var releaseConnectionScript = redis.NewScript(`
+redis.call('DEL', KEYS[1])
+
+if redis.call('SREM', KEYS[2], ARGV[2]) == 0 then
+	return {tonumber(redis.call('HGET', KEYS[4], ARGV[1]) or 0), redis.call('SCARD', KEYS[2]), 0}
+end
+
+local inRoom = redis.call('HINCRBY', KEYS[4], ARGV[1], -1)
+if inRoom <= 0 then
+	inRoom = 0
+	redis.call('HDEL', KEYS[4], ARGV[1])
+	redis.call('SREM', KEYS[3], ARGV[1])
+end
+
+local total = redis.call('SCARD', KEYS[2])
+if total == 0 then
+	redis.call('SREM', KEYS[5], ARGV[1])
+end
+
+return {inRoom, total, 1}
+`)
+
+// prunePresenceScript recounts the user's connections from the connection hashes that are
+// still alive, forgetting the ones that expired without being released, such as those of a
+// crashed instance. The user is removed from the room when none of them is to it, and from
+// the online users when none is left. The connection hashes are named after the IDs in the
+// user connections set, which are read beforehand so every key the script touches is
+// declared. When a connection was opened since, the script changes nothing and asks to be
+// run again with it.
+//
+// KEYS: user connections set, room members set, room connections hash, online users set,
+// then the hash of each connection in ARGV
+// ARGV: user ID, room ID or empty to only check the online users, then the connection IDs
+// Returns the user's live connections to the room and in total, or -1 for both when the
+// connections changed.
+var prunePresenceScript = redis.NewScript(`
+local listed = {}
+for i = 3, #ARGV do
+	listed[ARGV[i]] = true
+end
+for _, connectionID in ipairs(redis.call('SMEMBERS', KEYS[1])) do
+	if not listed[connectionID] then
+		return {-1, -1}
+	end
+end
+
+local inRoom = 0
+local total = 0
+for i = 3, #ARGV do
+	local roomID = redis.call('HGET', KEYS[i + 2], 'roomID')
+	if roomID then
+		total = total + 1
+		if roomID == ARGV[2] then
+			inRoom = inRoom + 1
+		end
+	else
+		redis.call('SREM', KEYS[1], ARGV[i])
+	end
+end
+
+if ARGV[2] ~= '' then
+	if inRoom == 0 then
+		redis.call('SREM', KEYS[2], ARGV[1])
+		redis.call('HDEL', KEYS[3], ARGV[1])
+	else
+		redis.call('HSET', KEYS[3], ARGV[1], inRoom)
+	end
+end
+
+if total == 0 then
+	redis.call('SREM', KEYS[4], ARGV[1])
+end
+
+return {inRoom, total}
+`)
+
+// replaceHistoryScript swaps a history entry for its replacement under the same score, so
+// it keeps its place in the history
+//
+// KEYS: room history sorted set
+// ARGV: entry, replacement
+// Returns 1 when the entry was replaced, 0 when it's not in the history.
+var replaceHistoryScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not score then
+	return 0
+end
+
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('ZADD', KEYS[1], score, ARGV[2])
+
+return 1
+`)
+
+// windowScript counts the members recorded over the sliding window, recording the new one
+// when the count is under the limit. It returns 0 when the member was recorded, or else how
+// many milliseconds until the oldest member leaves the window.
+//
+// KEYS: window sorted set, scored by record time
+// ARGV: now in ms, window in ms, limit, member
+var windowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[3]) then
+	local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+	return math.max(tonumber(oldest[2]) + window - now, 1)
+end
+
+redis.call('ZADD', KEYS[1], now, ARGV[4])
+redis.call('PEXPIRE', KEYS[1], window)
+return 0
+`)
+
+// presenceKeys are the keys of the presence scripts
+func presenceKeys(userID string, connectionID string, roomID string) []string {
+	return []string{
+		connectionKey(userID, connectionID),
+		userConnectionsKey(userID),
+		roomMembersKey(roomID),
+		roomConnectionsKey(roomID),
+		onlineUsersKey,
+	}
+}
+
+// onlineUsersKey is the set of the users with an open connection
+const onlineUsersKey = "users:online"
+
+// connectionKey is the presence hash of a single connection
+func connectionKey(userID string, connectionID string) string {
+	return fmt.Sprintf("client:%s:%s", userID, connectionID)
+}
+
+// userConnectionsKey is the set of the user's open connection IDs, across every instance
+func userConnectionsKey(userID string) string {
+	return fmt.Sprintf("user:%s:connections", userID)
+}
+
+// roomMembersKey is the set of the users connected to the room
+func roomMembersKey(roomID string) string {
+	return fmt.Sprintf("room:%s:members", roomID)
+}
+
+// roomConnectionsKey is the hash of how many connections each user has open to the room
+func roomConnectionsKey(roomID string) string {
+	return fmt.Sprintf("room:%s:connections", roomID)
+}
+
+func historyKey(roomID string) string {
+	return fmt.Sprintf("room:%s:history", roomID)
+}
+
+func (r *Redis) Publish(ctx context.Context, channel string, payload []byte) (int64, error) {
+	return r.client.Publish(ctx, channel, payload).Result()
+}
+
+// PublishWithHistory runs everything in a single MULTI/EXEC so the history never grows
+// past the limit
+func (r *Redis) PublishWithHistory(ctx context.Context, roomID string, timestamp time.Time, payload []byte, historySize int64) (int64, error) {
+	key := historyKey(roomID)
+
+	var publish *redis.IntCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		publish = pipe.Publish(ctx, roomID, payload)
+		pipe.ZAdd(ctx, key, redis.Z{
+			Score:  float64(timestamp.UnixMilli()),
+			Member: payload,
+		})
+		pipe.ZRemRangeByRank(ctx, key, 0, -historySize-1)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return publish.Val(), nil
+}
+
+func (r *Redis) Subscribe(ctx context.Context, channel string) Subscription {
+	pubsub := r.client.Subscribe(ctx, channel)
+
+	sub := &redisSubscription{
+		pubsub:   pubsub,
+		messages: make(chan []byte),
+		closed:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(sub.messages)
+		for msg := range pubsub.Channel() {
+			select {
+			case sub.messages <- []byte(msg.Payload):
+			case <-sub.closed:
+				return
+			}
+		}
+	}()
+
+	return sub
+}
+
+type redisSubscription struct {
+	pubsub    *redis.PubSub
+	messages  chan []byte
+	closed    chan struct{} // Stops the delivery when the receiver is gone
+	closeOnce sync.Once
+}
+
+func (s *redisSubscription) Messages() <-chan []byte {
+	return s.messages
+}
+
+func (s *redisSubscription) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return s.pubsub.Close()
+}
+
+func (r *Redis) History(ctx context.Context, roomID string, limit int64) ([][]byte, error) {
+	var entries []string
+	var err error
+	if limit > 0 {
+		entries, err = r.client.ZRevRangeByScore(ctx, historyKey(roomID), &redis.ZRangeBy{
+			Min:   "-inf",
+			Max:   "+inf",
+			Count: limit,
+		}).Result()
+	} else {
+		entries, err = r.client.ZRevRange(ctx, historyKey(roomID), 0, -1).Result()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([][]byte, len(entries))
+	for i, entry := range entries {
+		history[len(entries)-1-i] = []byte(entry)
+	}
+
+	return history, nil
+}
+
+func (r *Redis) RemoveHistory(ctx context.Context, roomID string, entries [][]byte) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	members := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		members[i] = string(entry)
+	}
+
+	return r.client.ZRem(ctx, historyKey(roomID), members...).Err()
+}
+
+func (r *Redis) ReplaceHistory(ctx context.Context, roomID string, entry []byte, replacement []byte) error {
+	return replaceHistoryScript.Run(ctx, r.client, []string{historyKey(roomID)}, string(entry), string(replacement)).Err()
+}
+
+func (r *Redis) RegisterConnection(ctx context.Context, conn Connection, ttl time.Duration) (PresenceCounts, error) {
+	counts, err := registerConnectionScript.Run(ctx, r.client, presenceKeys(conn.UserID, conn.ConnectionID, conn.RoomID),
+		conn.UserID,
+		conn.RoomID,
+		conn.Nickname,
+		conn.ConnectionID,
+		conn.LastSeen.Unix(),
+		int64(ttl.Seconds()),
+	).Int64Slice()
+	if err != nil {
+		return PresenceCounts{}, err
+	}
+
+	return PresenceCounts{InRoom: counts[0], Total: counts[1]}, nil
+}
+
+func (r *Redis) ReleaseConnection(ctx context.Context, userID string, connectionID string, roomID string) (PresenceCounts, error) {
+	counts, err := releaseConnectionScript.Run(ctx, r.client, presenceKeys(userID, connectionID, roomID), userID, connectionID).Int64Slice()
+	if err != nil {
+		return PresenceCounts{}, err
+	}
+
+	return PresenceCounts{InRoom: counts[0], Total: counts[1], Released: counts[2] == 1}, nil
+}
+
+func (r *Redis) RefreshConnection(ctx context.Context, conn Connection, ttl time.Duration) error {
+	keys := presenceKeys(conn.UserID, conn.ConnectionID, conn.RoomID)
+
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, keys[0], "lastSeen", conn.LastSeen.Unix())
+		for _, key := range keys[:4] {
+			pipe.Expire(ctx, key, ttl)
+		}
+		return nil
+	})
+	return err
+}
+
+// Connections also deletes the hashes left by the single hash per user presence, which
+// counted the connections instead
+func (r *Redis) Connections(ctx context.Context) ([]Connection, error) {
+	connections := []Connection{}
+
+	iter := r.client.Scan(ctx, 0, "client:*", 1000).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		data, err := r.client.HGetAll(ctx, key).Result()
+		if err != nil || len(data) == 0 {
+			continue
+		}
+
+		if data["userID"] == "" {
+			r.client.Del(ctx, key)
+			continue
+		}
+
+		lastSeen, _ := strconv.ParseInt(data["lastSeen"], 10, 64)
+		connections = append(connections, Connection{
+			UserID:       data["userID"],
+			RoomID:       data["roomID"],
+			Nickname:     data["nickname"],
+			ConnectionID: data["connectionID"],
+			LastSeen:     time.Unix(lastSeen, 0),
+		})
+	}
+
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	return connections, nil
+}
+
+func (r *Redis) RoomMembers(ctx context.Context, roomID string) ([]string, error) {
+	return r.client.SMembers(ctx, roomMembersKey(roomID)).Result()
+}
+
+func (r *Redis) CountRoomMembers(ctx context.Context, roomIDs []string) ([]int64, error) {
+	cmds := make([]*redis.IntCmd, len(roomIDs))
+	if _, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, roomID := range roomIDs {
+			cmds[i] = pipe.SCard(ctx, roomMembersKey(roomID))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	counts := make([]int64, len(cmds))
+	for i, cmd := range cmds {
+		counts[i] = cmd.Val()
+	}
+
+	return counts, nil
+}
+
+func (r *Redis) ConnectedRooms(ctx context.Context) ([]string, error) {
+	roomIDs := []string{}
+
+	iter := r.client.Scan(ctx, 0, roomMembersKey("*"), 1000).Iterator()
+	for iter.Next(ctx) {
+		roomIDs = append(roomIDs, strings.TrimSuffix(strings.TrimPrefix(iter.Val(), "room:"), ":members"))
+	}
+
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	return roomIDs, nil
+}
+
+func (r *Redis) CountUserConnections(ctx context.Context, userID string) (int64, error) {
+	return r.client.SCard(ctx, userConnectionsKey(userID)).Result()
+}
+
+func (r *Redis) OnlineUsers(ctx context.Context) ([]string, error) {
+	return r.client.SMembers(ctx, onlineUsersKey).Result()
+}
+
+func (r *Redis) PrunePresence(ctx context.Context) (int64, error) {
+	var pruned int64
+
+	roomIDs, err := r.ConnectedRooms(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, roomID := range roomIDs {
+		members, err := r.RoomMembers(ctx, roomID)
+		if err != nil {
+			return pruned, err
+		}
+
+		for _, userID := range members {
+			counts, err := r.prunePresence(ctx, userID, roomID)
+			if errors.Is(err, errPresenceChanged) {
+				// The user is connecting, so they aren't stale
+				continue
+			}
+			if err != nil {
+				return pruned, err
+			}
+			if counts[0] == 0 {
+				pruned++
+			}
+		}
+	}
+
+	// Users can be left online without being left in any room
+	onlineUsers, err := r.OnlineUsers(ctx)
+	if err != nil {
+		return pruned, err
+	}
+
+	for _, userID := range onlineUsers {
+		if _, err := r.prunePresence(ctx, userID, ""); err != nil && !errors.Is(err, errPresenceChanged) {
+			return pruned, err
+		}
+	}
+
+	return pruned, nil
+}
+
+// prunePresenceAttempts is how many times the user's connections are read again when they
+// keep changing while pruned
+const prunePresenceAttempts = 3
+
+// errPresenceChanged is returned when the user's connections kept changing while pruned
+var errPresenceChanged = errors.New("connections changed while pruning presence")
+
+// prunePresence runs prunePresenceScript for the user, in the room unless roomID is empty
+func (r *Redis) prunePresence(ctx context.Context, userID string, roomID string) ([]int64, error) {
+	for range prunePresenceAttempts {
+		connectionIDs, err := r.client.SMembers(ctx, userConnectionsKey(userID)).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		keys, args := prunePresenceArgs(userID, roomID, connectionIDs)
+		counts, err := prunePresenceScript.Run(ctx, r.client, keys, args...).Int64Slice()
+		if err != nil {
+			return nil, err
+		}
+
+		if counts[0] >= 0 {
+			return counts, nil
+		}
+	}
+
+	return nil, errPresenceChanged
+}
+
+// prunePresenceArgs are the KEYS and ARGV of prunePresenceScript for the user's connections
+func prunePresenceArgs(userID string, roomID string, connectionIDs []string) ([]string, []interface{}) {
+	keys := []string{userConnectionsKey(userID), roomMembersKey(roomID), roomConnectionsKey(roomID), onlineUsersKey}
+	args := []interface{}{userID, roomID}
+
+	for _, connectionID := range connectionIDs {
+		keys = append(keys, connectionKey(userID, connectionID))
+		args = append(args, connectionID)
+	}
+
+	return keys, args
+}
+
+func (r *Redis) Get(ctx context.Context, key string) (string, error) {
+	value, err := r.client.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrNotFound
+	}
+
+	return value, err
+}
+
+func (r *Redis) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	return r.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (r *Redis) SetNX(ctx context.Context, key string, value string, ttl time.Duration) (bool, error) {
+	return r.client.SetNX(ctx, key, value, ttl).Result()
+}
+
+func (r *Redis) Replace(ctx context.Context, key string, value string) error {
+	return r.client.SetArgs(ctx, key, value, redis.SetArgs{KeepTTL: true}).Err()
+}
+
+func (r *Redis) Delete(ctx context.Context, key string) (bool, error) {
+	deleted, err := r.client.Del(ctx, key).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return deleted > 0, nil
+}
+
+func (r *Redis) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ttl, err := r.client.TTL(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	// Missing keys and keys without expiration have a negative TTL
+	if ttl < 0 {
+		return 0, nil
+	}
+
+	return ttl, nil
+}
+
+func (r *Redis) RecordInWindow(ctx context.Context, key string, member string, limit int, window time.Duration) (time.Duration, error) {
+	retryAfter, err := windowScript.Run(ctx, r.client, []string{key},
+		time.Now().UnixMilli(),
+		window.Milliseconds(),
+		limit,
+		member,
+	).Int64()
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(retryAfter) * time.Millisecond, nil
+}
@@ -0,0 +1,42 @@
+package broker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPrunePresenceArgs(t *testing.T) {
+	keys, args := prunePresenceArgs("alice", "lobby", []string{"conn-1", "conn-2"})
+
+	wantKeys := []string{
+		"user:alice:connections",
+		"room:lobby:members",
+		"room:lobby:connections",
+		"users:online",
+		"client:alice:conn-1",
+		"client:alice:conn-2",
+	}
+	if !reflect.DeepEqual(keys, wantKeys) {
+		t.Errorf("keys = %v, want %v", keys, wantKeys)
+	}
+
+	wantArgs := []interface{}{"alice", "lobby", "conn-1", "conn-2"}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("args = %v, want %v", args, wantArgs)
+	}
+
+	// The script reads the hash of ARGV[i] from KEYS[i + 2], both 1-based
+	for i := 3; i <= len(args); i++ {
+		if want := connectionKey("alice", args[i-1].(string)); keys[i+1] != want {
+			t.Errorf("KEYS[%d] = %q, want %q", i+2, keys[i+1], want)
+		}
+	}
+}
+
+func TestPrunePresenceArgsWithoutConnections(t *testing.T) {
+	keys, args := prunePresenceArgs("alice", "", nil)
+
+	if len(keys) != 4 || len(args) != 2 {
+		t.Errorf("got %d keys and %d args, want 4 and 2", len(keys), len(args))
+	}
+}
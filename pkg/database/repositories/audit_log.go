@@ -0,0 +1,101 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/pkg/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Account events recorded in the audit log
+const (
+	AuditEventRegister    = "register"
+	AuditEventLogin       = "login"
+	AuditEventLoginFailed = "login_failed" // Wrong password for an existing account
+	AuditEventLogout      = "logout"
+	AuditEventRevoked     = "session_revoked" // By the user, from another session
+	AuditEventDeleted     = "account_deleted"
+	AuditEventDeactivated = "account_deactivated"
+	AuditEventReactivated = "account_reactivated"
+	AuditEventTokenIssued = "token_issued" // Minted by an admin, see ActorID
+)
+
+// AuditEntry is an account event. Entries are only ever appended.
+type AuditEntry struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID    string             `json:"user_id" bson:"userId"`
+	Event     string             `json:"event" bson:"event"`
+	ActorID   string             `json:"actor_id,omitempty" bson:"actorId,omitempty"` // Admin who acted on the user, empty when it was the user
+	IP        string             `json:"ip" bson:"ip"`
+	UserAgent string             `json:"user_agent" bson:"userAgent"`
+	CreatedAt time.Time          `json:"created_at" bson:"createdAt"`
+}
+
+type GetAuditEntriesData struct {
+	UserID string
+	From   *time.Time // Inclusive
+	To     *time.Time // Exclusive
+	Limit  int64
+	Skip   int64
+}
+
+func CreateAuditEntry(ctx context.Context, db *mongo.Database, entry AuditEntry) error {
+	collection := db.Collection(constants.AuditLogCollection)
+
+	entry.CreatedAt = time.Now()
+	if _, err := collection.InsertOne(ctx, entry); err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToCreateAuditEntry].Message, log.ErrAttr(err))
+		return errors.New(constants.ErrorMessages[constants.FailedToCreateAuditEntry].Message)
+	}
+
+	return nil
+}
+
+// GetAuditEntries returns a page of the user's audit trail within the dates, newest first,
+// along with its total
+func GetAuditEntries(ctx context.Context, db *mongo.Database, data GetAuditEntriesData) ([]AuditEntry, int64, error) {
+	collection := db.Collection(constants.AuditLogCollection)
+
+	filter := bson.M{"userId": data.UserID}
+	createdAt := bson.M{}
+	if data.From != nil {
+		createdAt["$gte"] = *data.From
+	}
+	if data.To != nil {
+		createdAt["$lt"] = *data.To
+	}
+	if len(createdAt) > 0 {
+		filter["createdAt"] = createdAt
+	}
+
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetAuditLog].Message, log.ErrAttr(err))
+		return nil, 0, errors.New(constants.ErrorMessages[constants.FailedToGetAuditLog].Message)
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdAt", Value: -1}}).
+		SetSkip(data.Skip).
+		SetLimit(data.Limit)
+
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetAuditLog].Message, log.ErrAttr(err))
+		return nil, 0, errors.New(constants.ErrorMessages[constants.FailedToGetAuditLog].Message)
+	}
+
+	entries := []AuditEntry{}
+	if err := cursor.All(ctx, &entries); err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetAuditLog].Message, log.ErrAttr(err))
+		return nil, 0, errors.New(constants.ErrorMessages[constants.FailedToGetAuditLog].Message)
+	}
+
+	return entries, total, nil
+}
@@ -0,0 +1,258 @@
+package repositories
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/pkg/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Client is an integration allowed to call the API with its own API key.
+// Only the hash of the API key is stored.
+type Client struct {
+	ID         string    `json:"id" bson:"_id"`
+	Name       string    `json:"name" bson:"name"`
+	APIKeyHash string    `json:"-" bson:"apiKeyHash"`
+	ReadOnly   bool      `json:"read_only" bson:"readOnly"`
+	Scopes     []string  `json:"scopes" bson:"scopes"`
+	Tier       string    `json:"tier,omitempty" bson:"tier,omitempty"` // Picks the client's room_creation limit
+	CreatedAt  time.Time `json:"created_at" bson:"createdAt"`
+	UpdatedAt  time.Time `json:"updated_at" bson:"updatedAt"`
+
+	// The API key replaced by the last rotation keeps working until it expires
+	PreviousAPIKeyHash      string     `json:"-" bson:"previousApiKeyHash,omitempty"`
+	PreviousAPIKeyExpiresAt *time.Time `json:"previous_api_key_expires_at,omitempty" bson:"previousApiKeyExpiresAt,omitempty"`
+}
+
+type CreateClientData struct {
+	Name     string
+	APIKey   string
+	ReadOnly bool
+	Scopes   []string
+	Tier     string
+}
+
+type GetClientData struct {
+	ClientID string
+}
+
+type UpdateClientData struct {
+	ClientID string
+	Name     *string
+	ReadOnly *bool
+	Scopes   *[]string
+	Tier     *string
+}
+
+type RotateAPIKeyData struct {
+	ClientID    string
+	APIKey      string
+	GracePeriod time.Duration // How long the replaced API key keeps working
+}
+
+// HasScope reports whether the client was granted the scope.
+// Read-only clients are limited to read scopes, whatever their scope list says.
+func (c *Client) HasScope(scope string) bool {
+	if c.ReadOnly && !strings.HasSuffix(scope, ":read") {
+		return false
+	}
+
+	return slices.Contains(c.Scopes, scope)
+}
+
+// HashAPIKey returns the hash stored in place of the API key
+func HashAPIKey(apiKey string) string {
+	hash := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(hash[:])
+}
+
+func CreateClient(ctx context.Context, db *mongo.Database, data CreateClientData) (*Client, error) {
+	now := time.Now()
+
+	client := Client{
+		ID:         primitive.NewObjectID().Hex(),
+		Name:       data.Name,
+		APIKeyHash: HashAPIKey(data.APIKey),
+		ReadOnly:   data.ReadOnly,
+		Scopes:     data.Scopes,
+		Tier:       data.Tier,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+
+	collection := db.Collection(constants.ClientsCollection)
+	_, err := collection.InsertOne(ctx, client)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToCreateClient].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToCreateClient].Message)
+	}
+
+	return &client, nil
+}
+
+func GetClient(ctx context.Context, db *mongo.Database, data GetClientData) (*Client, error) {
+	collection := db.Collection(constants.ClientsCollection)
+
+	var client Client
+	err := collection.FindOne(ctx, bson.M{"_id": data.ClientID}).Decode(&client)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrClientNotFound
+		}
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetClients].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetClients].Message)
+	}
+
+	return &client, nil
+}
+
+// GetClients returns every client, newest first
+func GetClients(ctx context.Context, db *mongo.Database) ([]Client, error) {
+	collection := db.Collection(constants.ClientsCollection)
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	cursor, err := collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetClients].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetClients].Message)
+	}
+
+	clients := []Client{}
+	if err := cursor.All(ctx, &clients); err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetClients].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetClients].Message)
+	}
+
+	return clients, nil
+}
+
+// GetClientByAPIKey returns the client owning the API key, or nil if there is none.
+// A client's previous API key is accepted until it expires.
+func GetClientByAPIKey(ctx context.Context, db *mongo.Database, apiKey string) (*Client, error) {
+	collection := db.Collection(constants.ClientsCollection)
+
+	var client Client
+	err := collection.FindOne(ctx, clientWithAPIKey(apiKey, time.Now())).Decode(&client)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetClients].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetClients].Message)
+	}
+
+	return &client, nil
+}
+
+// clientWithAPIKey matches the client whose API key, or previous one until it expires, is apiKey
+func clientWithAPIKey(apiKey string, now time.Time) bson.M {
+	hash := HashAPIKey(apiKey)
+	return bson.M{"$or": bson.A{
+		bson.M{"apiKeyHash": hash},
+		bson.M{"previousApiKeyHash": hash, "previousApiKeyExpiresAt": bson.M{"$gt": now}},
+	}}
+}
+
+func UpdateClient(ctx context.Context, db *mongo.Database, data UpdateClientData) (*mongo.UpdateResult, error) {
+	collection := db.Collection(constants.ClientsCollection)
+
+	update := bson.M{"$set": bson.M{"updatedAt": time.Now()}}
+	if data.Name != nil {
+		update["$set"].(bson.M)["name"] = *data.Name
+	}
+
+	if data.ReadOnly != nil {
+		update["$set"].(bson.M)["readOnly"] = *data.ReadOnly
+	}
+
+	if data.Scopes != nil {
+		update["$set"].(bson.M)["scopes"] = *data.Scopes
+	}
+
+	if data.Tier != nil {
+		update["$set"].(bson.M)["tier"] = *data.Tier
+	}
+
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": data.ClientID}, update)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToUpdateClient].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToUpdateClient].Message)
+	}
+
+	if result.MatchedCount == 0 {
+		return nil, ErrClientNotFound
+	}
+
+	return result, nil
+}
+
+// RotateAPIKey replaces the client's API key, keeping the current one valid for the grace period
+func RotateAPIKey(ctx context.Context, db *mongo.Database, data RotateAPIKeyData) (*Client, error) {
+	collection := db.Collection(constants.ClientsCollection)
+
+	now := time.Now()
+	// A pipeline update, so the current hash can be copied to the previous one
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"previousApiKeyHash":      "$apiKeyHash",
+			"previousApiKeyExpiresAt": now.Add(data.GracePeriod),
+			"apiKeyHash":              HashAPIKey(data.APIKey),
+			"updatedAt":               now,
+		}}},
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var client Client
+	err := collection.FindOneAndUpdate(ctx, bson.M{"_id": data.ClientID}, update, opts).Decode(&client)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrClientNotFound
+		}
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToUpdateClient].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToUpdateClient].Message)
+	}
+
+	return &client, nil
+}
+
+// ClearExpiredAPIKeys removes the previous API keys whose grace period is over
+func ClearExpiredAPIKeys(ctx context.Context, db *mongo.Database) (int64, error) {
+	collection := db.Collection(constants.ClientsCollection)
+
+	result, err := collection.UpdateMany(ctx,
+		bson.M{"previousApiKeyExpiresAt": bson.M{"$lte": time.Now()}},
+		bson.M{"$unset": bson.M{"previousApiKeyHash": "", "previousApiKeyExpiresAt": ""}})
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToUpdateClient].Message, log.ErrAttr(err))
+		return 0, errors.New(constants.ErrorMessages[constants.FailedToUpdateClient].Message)
+	}
+
+	return result.ModifiedCount, nil
+}
+
+func DeleteClient(ctx context.Context, db *mongo.Database, clientID string) error {
+	collection := db.Collection(constants.ClientsCollection)
+
+	result, err := collection.DeleteOne(ctx, bson.M{"_id": clientID})
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToDeleteClient].Message, log.ErrAttr(err))
+		return errors.New(constants.ErrorMessages[constants.FailedToDeleteClient].Message)
+	}
+
+	if result.DeletedCount == 0 {
+		return ErrClientNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package repositories
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestClientWithAPIKey(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	rotated := bson.M{
+		"apiKeyHash":         HashAPIKey("new-key"),
+		"previousApiKeyHash": HashAPIKey("old-key"),
+	}
+	withExpiry := func(expiresAt time.Time) bson.M {
+		client := bson.M{"previousApiKeyExpiresAt": expiresAt}
+		for key, value := range rotated {
+			client[key] = value
+		}
+		return client
+	}
+
+	tests := []struct {
+		name   string
+		client bson.M
+		apiKey string
+		want   bool
+	}{
+		{"current key", bson.M{"apiKeyHash": HashAPIKey("new-key")}, "new-key", true},
+		{"unknown key", bson.M{"apiKeyHash": HashAPIKey("new-key")}, "other-key", false},
+		{"new key after a rotation", withExpiry(now.Add(time.Minute)), "new-key", true},
+		{"previous key within the grace period", withExpiry(now.Add(time.Minute)), "old-key", true},
+		{"previous key once the grace period is over", withExpiry(now.Add(-time.Minute)), "old-key", false},
+		{"previous key as it expires", withExpiry(now), "old-key", false},
+		{"previous key cleared", bson.M{"apiKeyHash": HashAPIKey("new-key")}, "old-key", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matches(t, clientWithAPIKey(tt.apiKey, now), tt.client); got != tt.want {
+				t.Errorf("clientWithAPIKey(%q) matches %v = %v, want %v", tt.apiKey, tt.client, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package repositories
+
+import (
+	"errors"
+
+	"github.com/vit0rr/chat/api/constants"
+)
+
+// The errors callers tell apart with errors.Is. Like the other errors of the repositories,
+// their messages are keys of constants.ErrorMessages.
+var (
+	ErrRoomNotFound         = errors.New(constants.RoomNotFound)
+	ErrUserNotFound         = errors.New(constants.UserNotFound)
+	ErrUserNotRoomMember    = errors.New(constants.UserNotRoomMember)
+	ErrMessageNotFound      = errors.New(constants.MessageNotFound)
+	ErrMessageAlreadyPinned = errors.New(constants.MessageAlreadyPinned)
+	ErrPinNotFound          = errors.New(constants.PinNotFound)
+	ErrPinLimitReached      = errors.New(constants.PinLimitReached)
+	ErrReportNotFound       = errors.New(constants.ReportNotFound)
+	ErrReportAlreadyExists  = errors.New(constants.ReportAlreadyExists)
+	ErrClientNotFound       = errors.New(constants.ClientNotFound)
+	ErrWebhookNotFound      = errors.New(constants.WebhookNotFound)
+	ErrInviteNotFound       = errors.New(constants.InviteNotFound)
+	ErrInviteExpired        = errors.New(constants.InviteExpired)
+	ErrInviteExhausted      = errors.New(constants.InviteExhausted)
+	ErrSessionNotFound      = errors.New(constants.SessionNotFound)
+)
+
+// sentinelErrors maps the sentinel errors to their key in constants.ErrorMessages
+var sentinelErrors = map[error]string{
+	ErrRoomNotFound:         constants.RoomNotFound,
+	ErrUserNotFound:         constants.UserNotFound,
+	ErrUserNotRoomMember:    constants.UserNotRoomMember,
+	ErrMessageNotFound:      constants.MessageNotFound,
+	ErrMessageAlreadyPinned: constants.MessageAlreadyPinned,
+	ErrPinNotFound:          constants.PinNotFound,
+	ErrPinLimitReached:      constants.PinLimitReached,
+	ErrReportNotFound:       constants.ReportNotFound,
+	ErrReportAlreadyExists:  constants.ReportAlreadyExists,
+	ErrClientNotFound:       constants.ClientNotFound,
+	ErrWebhookNotFound:      constants.WebhookNotFound,
+	ErrInviteNotFound:       constants.InviteNotFound,
+	ErrInviteExpired:        constants.InviteExpired,
+	ErrInviteExhausted:      constants.InviteExhausted,
+	ErrSessionNotFound:      constants.SessionNotFound,
+}
+
+// ErrorKey returns the key in constants.ErrorMessages of the error answered for err, so it's
+// answered with its own status: the sentinel errors even when wrapped, then the errors keyed
+// by their message. Any other error, such as a raw driver error, is an internal error.
+func ErrorKey(err error) string {
+	for sentinel, errKey := range sentinelErrors {
+		if errors.Is(err, sentinel) {
+			return errKey
+		}
+	}
+
+	if _, ok := constants.ErrorMessages[err.Error()]; ok {
+		return err.Error()
+	}
+
+	return constants.InternalError
+}
@@ -0,0 +1,161 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/pkg/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Invite is a code that lets users join a room without an admin registering them
+type Invite struct {
+	Code      string     `json:"code" bson:"_id"`
+	RoomID    string     `json:"room_id" bson:"roomId"`
+	MaxUses   int        `json:"max_uses" bson:"maxUses"` // Unlimited when 0
+	Uses      int        `json:"uses" bson:"uses"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty" bson:"expiresAt,omitempty"` // Never expires when unset
+	CreatedAt time.Time  `json:"created_at" bson:"createdAt"`
+}
+
+// RemainingUses returns how many more times the invite can be used, -1 when unlimited
+func (i Invite) RemainingUses() int {
+	if i.MaxUses == 0 {
+		return -1
+	}
+
+	return max(i.MaxUses-i.Uses, 0)
+}
+
+// usable returns why the invite can't be used at the time, nil when it can
+func (i Invite) usable(now time.Time) error {
+	if i.ExpiresAt != nil && !now.Before(*i.ExpiresAt) {
+		return ErrInviteExpired
+	}
+
+	if i.RemainingUses() == 0 {
+		return ErrInviteExhausted
+	}
+
+	return nil
+}
+
+type CreateInviteData struct {
+	Code      string
+	RoomID    string
+	MaxUses   int
+	ExpiresAt *time.Time
+}
+
+func CreateInvite(ctx context.Context, db *mongo.Database, data CreateInviteData) (*Invite, error) {
+	collection := db.Collection(constants.InvitesCollection)
+
+	invite := Invite{
+		Code:      data.Code,
+		RoomID:    data.RoomID,
+		MaxUses:   data.MaxUses,
+		ExpiresAt: data.ExpiresAt,
+		CreatedAt: time.Now(),
+	}
+
+	if _, err := collection.InsertOne(ctx, invite); err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToCreateInvite].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToCreateInvite].Message)
+	}
+
+	return &invite, nil
+}
+
+func GetInvite(ctx context.Context, db *mongo.Database, code string) (*Invite, error) {
+	collection := db.Collection(constants.InvitesCollection)
+
+	var invite Invite
+	err := collection.FindOne(ctx, bson.M{"_id": code}).Decode(&invite)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrInviteNotFound
+		}
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetInvite].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetInvite].Message)
+	}
+
+	return &invite, nil
+}
+
+// CheckInvite returns the invite when it can be used now, without using it
+func CheckInvite(ctx context.Context, db *mongo.Database, code string) (*Invite, error) {
+	invite, err := GetInvite(ctx, db, code)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := invite.usable(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return invite, nil
+}
+
+// UseInvite uses the invite once when it hasn't expired nor run out of uses, in a single update
+// so concurrent joins can't use it more than its maximum. It returns the updated invite.
+func UseInvite(ctx context.Context, db *mongo.Database, code string) (*Invite, error) {
+	collection := db.Collection(constants.InvitesCollection)
+
+	now := time.Now()
+	filter := bson.M{
+		"_id": code,
+		"$and": bson.A{
+			bson.M{"$or": bson.A{
+				bson.M{"expiresAt": bson.M{"$exists": false}},
+				bson.M{"expiresAt": bson.M{"$gt": now}},
+			}},
+			bson.M{"$or": bson.A{
+				bson.M{"maxUses": 0},
+				bson.M{"$expr": bson.M{"$lt": bson.A{"$uses", "$maxUses"}}},
+			}},
+		},
+	}
+
+	var invite Invite
+	err := collection.FindOneAndUpdate(ctx, filter,
+		bson.M{"$inc": bson.M{"uses": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&invite)
+	if err == nil {
+		return &invite, nil
+	}
+
+	if err != mongo.ErrNoDocuments {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToUpdateInvite].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToUpdateInvite].Message)
+	}
+
+	// Tell why it can't be used
+	current, err := GetInvite(ctx, db, code)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := current.usable(now); err != nil {
+		return nil, err
+	}
+
+	// Another join used it meanwhile
+	return nil, ErrInviteExhausted
+}
+
+// ReleaseInvite gives back a use of the invite, when the join it was used for failed
+func ReleaseInvite(ctx context.Context, db *mongo.Database, code string) error {
+	collection := db.Collection(constants.InvitesCollection)
+
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": code, "uses": bson.M{"$gt": 0}}, bson.M{"$inc": bson.M{"uses": -1}})
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToUpdateInvite].Message, log.ErrAttr(err))
+		return errors.New(constants.ErrorMessages[constants.FailedToUpdateInvite].Message)
+	}
+
+	return nil
+}
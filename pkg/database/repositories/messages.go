@@ -2,37 +2,80 @@ package repositories
 
 import (
 	"context"
+	"errors"
+	"regexp"
 	"time"
 
 	"github.com/vit0rr/chat/api/constants"
 	"github.com/vit0rr/chat/pkg/log"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type Message struct {
-	RoomID     string    `bson:"roomId"`
-	Message    string    `bson:"message"`
-	FromUserID string    `bson:"fromUserId"`
-	Nickname   string    `bson:"nickname"`
-	CreatedAt  time.Time `bson:"createdAt"`
-	UpdatedAt  time.Time `bson:"updatedAt"`
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	RoomID     string             `bson:"roomId"`
+	Message    string             `bson:"message"`
+	FromUserID string             `bson:"fromUserId"`
+	Nickname   string             `bson:"nickname"`
+	Verified   bool               `bson:"verified,omitempty"` // The sender was a registered user, not a guest
+	Type       string             `bson:"type,omitempty"`
+	Attachment *Attachment        `bson:"attachment,omitempty"`
+	ImportID   string             `bson:"importId,omitempty"` // Set on imported messages, unique per room
+	CreatedAt  time.Time          `bson:"createdAt"`
+	UpdatedAt  time.Time          `bson:"updatedAt"`
+	DeletedAt  *time.Time         `bson:"deletedAt,omitempty"` // Set on soft-deleted messages, which are no longer returned
+	EditedAt   *time.Time         `bson:"editedAt,omitempty"`  // Set once the sender edits the message
+}
+
+// Attachment is a file shared in a message
+type Attachment struct {
+	URL      string `json:"url" bson:"url"`
+	MimeType string `json:"mime_type" bson:"mimeType"`
+	Size     int64  `json:"size" bson:"size"`
+	Filename string `json:"filename" bson:"filename"`
+	// ThumbnailURL is set once the thumbnail of an image is generated
+	ThumbnailURL string `json:"thumbnail_url,omitempty" bson:"thumbnailUrl,omitempty"`
+	Width        int    `json:"width,omitempty" bson:"width,omitempty"`   // Images only
+	Height       int    `json:"height,omitempty" bson:"height,omitempty"` // Images only
 }
 
 type CreateMessageData struct {
-	RoomID     string `json:"roomId"`
-	Message    string `json:"message"`
-	FromUserID string `json:"fromUserId"`
-	Nickname   string `json:"nickname"`
+	RoomID     string      `json:"roomId"`
+	Message    string      `json:"message"`
+	FromUserID string      `json:"fromUserId"`
+	Nickname   string      `json:"nickname"`
+	Verified   bool        `json:"verified"`
+	Type       string      `json:"type"`
+	Attachment *Attachment `json:"attachment"`
+	CreatedAt  time.Time   `json:"createdAt"` // Defaults to now
 }
 
 type GetMessagesData struct {
 	RoomID string
 	Limit  int64
 	Skip   int64
+	Before *time.Time // Only messages created before this time, used by cursor pagination
+	// Along with Before, also the messages created at that time with a lower ID, so the
+	// messages sharing the time of the last one of a page aren't skipped
+	BeforeID primitive.ObjectID
 }
 
+// PurgeMessagesData selects the messages of the room to purge, every set criteria must match
+type PurgeMessagesData struct {
+	RoomID string
+	UserID string
+	From   *time.Time
+	To     *time.Time
+	Text   string // Case-insensitive substring of the message
+	Limit  int64
+}
+
+// notDeleted filters out the soft-deleted messages
+var notDeleted = bson.M{"$exists": false}
+
 type GetTotalMessagesSentInARoomData struct {
 	RoomID string
 }
@@ -45,6 +88,10 @@ type UsersWhoSentMessagesInTheLastDaysData struct {
 
 func CreateMessage(ctx context.Context, db *mongo.Database, data CreateMessageData) (*mongo.InsertOneResult, error) {
 	now := time.Now()
+	createdAt := data.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = now
+	}
 
 	collection := db.Collection(constants.MessagesCollection)
 
@@ -53,7 +100,10 @@ func CreateMessage(ctx context.Context, db *mongo.Database, data CreateMessageDa
 		Message:    data.Message,
 		FromUserID: data.FromUserID,
 		Nickname:   data.Nickname,
-		CreatedAt:  now,
+		Verified:   data.Verified,
+		Type:       data.Type,
+		Attachment: data.Attachment,
+		CreatedAt:  createdAt,
 		UpdatedAt:  now,
 	})
 
@@ -65,21 +115,322 @@ func CreateMessage(ctx context.Context, db *mongo.Database, data CreateMessageDa
 	return messages, nil
 }
 
+// ImportMessages inserts messages keeping their timestamps. Messages whose import ID
+// was already imported to the room are skipped. It returns how many were inserted.
+func ImportMessages(ctx context.Context, db *mongo.Database, messages []Message) (int, error) {
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	collection := db.Collection(constants.MessagesCollection)
+
+	documents := make([]interface{}, len(messages))
+	for i, message := range messages {
+		documents[i] = message
+	}
+
+	_, err := collection.InsertMany(ctx, documents, options.InsertMany().SetOrdered(false))
+	if err == nil {
+		return len(messages), nil
+	}
+
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToImportMessages].Message, log.ErrAttr(err))
+		return 0, errors.New(constants.ErrorMessages[constants.FailedToImportMessages].Message)
+	}
+
+	for _, writeErr := range bulkErr.WriteErrors {
+		if !mongo.IsDuplicateKeyError(writeErr) {
+			log.Error(ctx, constants.ErrorMessages[constants.FailedToImportMessages].Message, log.ErrAttr(err))
+			return 0, errors.New(constants.ErrorMessages[constants.FailedToImportMessages].Message)
+		}
+	}
+
+	return len(messages) - len(bulkErr.WriteErrors), nil
+}
+
 func GetMessages(ctx context.Context, db *mongo.Database, data GetMessagesData) (*mongo.Cursor, error) {
 	collection := db.Collection(constants.MessagesCollection)
 
+	filter, options := GetMessagesQuery(data)
+	cursor, err := collection.Find(ctx, filter, options)
+	if err != nil {
+		log.Error(ctx, "Failed to get messages", log.ErrAttr(err))
+		return nil, err
+	}
+
+	return cursor, nil
+}
+
+// GetMessagesQuery returns the filter and the options GetMessages finds the page with, so
+// the indexes can be checked against the query
+func GetMessagesQuery(data GetMessagesData) (bson.M, *options.FindOptions) {
 	options := options.Find()
-	options.SetSort(bson.D{{Key: "createdAt", Value: -1}}) // Sort by newest first
+	// Sort by newest first, the ID orders the messages sent at the same time
+	options.SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}})
 	options.SetLimit(data.Limit)
 	options.SetSkip(data.Skip)
 
-	filter := bson.M{"roomId": data.RoomID}
+	filter := bson.M{"roomId": data.RoomID, "deletedAt": notDeleted}
+	if data.Before != nil {
+		filter["$or"] = messagesBefore(*data.Before, data.BeforeID)
+	}
 
-	cursor, err := collection.Find(ctx, filter, options)
+	return filter, options
+}
+
+// messagesBefore matches the messages sorted after the one created at the time with the ID, in
+// the newest first order. Without an ID, the messages created before the time.
+func messagesBefore(createdAt time.Time, id primitive.ObjectID) bson.A {
+	before := bson.A{bson.M{"createdAt": bson.M{"$lt": createdAt}}}
+	if !id.IsZero() {
+		before = append(before, bson.M{"createdAt": createdAt, "_id": bson.M{"$lt": id}})
+	}
+
+	return before
+}
+
+// CountRoomMessages returns how many messages of the room aren't deleted, the total of the
+// GetMessages pages
+func CountRoomMessages(ctx context.Context, db *mongo.Database, data GetTotalMessagesSentInARoomData) (int64, error) {
+	collection := db.Collection(constants.MessagesCollection)
+
+	total, err := collection.CountDocuments(ctx, bson.M{"roomId": data.RoomID, "deletedAt": notDeleted})
+	if err != nil {
+		log.Error(ctx, "Failed to count messages", log.ErrAttr(err))
+		return 0, errors.New(constants.ErrorMessages[constants.FailedToGetMessages].Message)
+	}
+
+	return total, nil
+}
+
+// SetAttachmentThumbnail sets the thumbnail of the room messages sharing the attachment
+func SetAttachmentThumbnail(ctx context.Context, db *mongo.Database, roomID string, attachmentURL string, thumbnailURL string) error {
+	collection := db.Collection(constants.MessagesCollection)
+
+	_, err := collection.UpdateMany(ctx,
+		bson.M{"roomId": roomID, "attachment.url": attachmentURL},
+		bson.M{"$set": bson.M{"attachment.thumbnailUrl": thumbnailURL, "updatedAt": time.Now()}})
+	if err != nil {
+		log.Error(ctx, "Failed to set attachment thumbnail", log.ErrAttr(err))
+		return err
+	}
+
+	return nil
+}
+
+// GetMessagesByIDs returns the messages of the room with the given IDs. Unknown IDs are ignored.
+func GetMessagesByIDs(ctx context.Context, db *mongo.Database, roomID string, messageIDs []string) ([]Message, error) {
+	collection := db.Collection(constants.MessagesCollection)
+
+	objectIDs := make([]primitive.ObjectID, 0, len(messageIDs))
+	for _, messageID := range messageIDs {
+		objectID, err := primitive.ObjectIDFromHex(messageID)
+		if err != nil {
+			continue
+		}
+		objectIDs = append(objectIDs, objectID)
+	}
+
+	cursor, err := collection.Find(ctx, bson.M{"roomId": roomID, "_id": bson.M{"$in": objectIDs}, "deletedAt": notDeleted})
 	if err != nil {
 		log.Error(ctx, "Failed to get messages", log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetMessages].Message)
+	}
+
+	messages := []Message{}
+	if err := cursor.All(ctx, &messages); err != nil {
+		log.Error(ctx, "Failed to decode messages", log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetMessages].Message)
+	}
+
+	return messages, nil
+}
+
+// DeletedMessageError is returned when the requested message was soft-deleted
+type DeletedMessageError struct {
+	DeletedAt time.Time
+}
+
+func (e DeletedMessageError) Error() string {
+	return constants.ErrorMessages[constants.MessageDeleted].Message
+}
+
+// GetMessage returns a message of the room by its ID. A soft-deleted message returns
+// a DeletedMessageError.
+func GetMessage(ctx context.Context, db *mongo.Database, roomID string, messageID string) (*Message, error) {
+	collection := db.Collection(constants.MessagesCollection)
+
+	objectID, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return nil, ErrMessageNotFound
+	}
+
+	var message Message
+	if err := collection.FindOne(ctx, bson.M{"_id": objectID, "roomId": roomID}).Decode(&message); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrMessageNotFound
+		}
+		log.Error(ctx, "Failed to get message", log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetMessages].Message)
+	}
+
+	if message.DeletedAt != nil {
+		return nil, DeletedMessageError{DeletedAt: *message.DeletedAt}
+	}
+
+	return &message, nil
+}
+
+// GetUserMessages returns a cursor over every message sent by the user, oldest first.
+// Soft-deleted messages are included, they are still stored.
+func GetUserMessages(ctx context.Context, db *mongo.Database, userID string) (*mongo.Cursor, error) {
+	collection := db.Collection(constants.MessagesCollection)
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}})
+
+	cursor, err := collection.Find(ctx, bson.M{"fromUserId": userID}, opts)
+	if err != nil {
+		log.Error(ctx, "Failed to get user messages", log.ErrAttr(err))
 		return nil, err
 	}
 
 	return cursor, nil
 }
+
+// EditMessage replaces the content of a message of the room
+func EditMessage(ctx context.Context, db *mongo.Database, roomID string, messageID string, content string) (*Message, error) {
+	collection := db.Collection(constants.MessagesCollection)
+
+	objectID, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return nil, ErrMessageNotFound
+	}
+
+	now := time.Now()
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var message Message
+	err = collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": objectID, "roomId": roomID, "deletedAt": notDeleted},
+		bson.M{"$set": bson.M{"message": content, "editedAt": now, "updatedAt": now}},
+		opts).Decode(&message)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrMessageNotFound
+		}
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToUpdateMessage].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToUpdateMessage].Message)
+	}
+
+	return &message, nil
+}
+
+// DeleteMessage soft-deletes a message of the room
+func DeleteMessage(ctx context.Context, db *mongo.Database, roomID string, messageID string) error {
+	collection := db.Collection(constants.MessagesCollection)
+
+	objectID, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return ErrMessageNotFound
+	}
+
+	now := time.Now()
+	result, err := collection.UpdateOne(ctx,
+		bson.M{"_id": objectID, "roomId": roomID, "deletedAt": notDeleted},
+		bson.M{"$set": bson.M{"deletedAt": now, "updatedAt": now}})
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToPurgeMessages].Message, log.ErrAttr(err))
+		return errors.New(constants.ErrorMessages[constants.FailedToPurgeMessages].Message)
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrMessageNotFound
+	}
+
+	return nil
+}
+
+func purgeFilter(data PurgeMessagesData) bson.M {
+	filter := bson.M{"roomId": data.RoomID, "deletedAt": notDeleted}
+
+	if data.UserID != "" {
+		filter["fromUserId"] = data.UserID
+	}
+
+	createdAt := bson.M{}
+	if data.From != nil {
+		createdAt["$gte"] = *data.From
+	}
+	if data.To != nil {
+		createdAt["$lte"] = *data.To
+	}
+	if len(createdAt) > 0 {
+		filter["createdAt"] = createdAt
+	}
+
+	if data.Text != "" {
+		filter["message"] = bson.M{"$regex": regexp.QuoteMeta(data.Text), "$options": "i"}
+	}
+
+	return filter
+}
+
+// CountPurgeableMessages returns how many messages a purge would delete
+func CountPurgeableMessages(ctx context.Context, db *mongo.Database, data PurgeMessagesData) (int64, error) {
+	collection := db.Collection(constants.MessagesCollection)
+
+	count, err := collection.CountDocuments(ctx, purgeFilter(data))
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetMessages].Message, log.ErrAttr(err))
+		return 0, errors.New(constants.ErrorMessages[constants.FailedToGetMessages].Message)
+	}
+
+	return count, nil
+}
+
+// PurgeMessages soft-deletes up to data.Limit of the selected messages, oldest first,
+// and returns their IDs
+func PurgeMessages(ctx context.Context, db *mongo.Database, data PurgeMessagesData) ([]string, error) {
+	collection := db.Collection(constants.MessagesCollection)
+
+	opts := options.Find().
+		SetProjection(bson.M{"_id": 1}).
+		SetSort(bson.D{{Key: "createdAt", Value: 1}}).
+		SetLimit(data.Limit)
+
+	cursor, err := collection.Find(ctx, purgeFilter(data), opts)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToPurgeMessages].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToPurgeMessages].Message)
+	}
+
+	var messages []Message
+	if err := cursor.All(ctx, &messages); err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToPurgeMessages].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToPurgeMessages].Message)
+	}
+
+	if len(messages) == 0 {
+		return []string{}, nil
+	}
+
+	objectIDs := make([]primitive.ObjectID, len(messages))
+	messageIDs := make([]string, len(messages))
+	for i, message := range messages {
+		objectIDs[i] = message.ID
+		messageIDs[i] = message.ID.Hex()
+	}
+
+	now := time.Now()
+	_, err = collection.UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$in": objectIDs}},
+		bson.M{"$set": bson.M{"deletedAt": now, "updatedAt": now}})
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToPurgeMessages].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToPurgeMessages].Message)
+	}
+
+	return messageIDs, nil
+}
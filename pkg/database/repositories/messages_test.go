@@ -0,0 +1,44 @@
+package repositories
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMessagesBefore(t *testing.T) {
+	createdAt := time.Date(2025, 3, 1, 12, 30, 0, 0, time.UTC)
+	id := primitive.NewObjectID()
+
+	tests := []struct {
+		name string
+		id   primitive.ObjectID
+		want bson.A
+	}{
+		{
+			name: "ties broken by ID",
+			id:   id,
+			want: bson.A{
+				bson.M{"createdAt": bson.M{"$lt": createdAt}},
+				bson.M{"createdAt": createdAt, "_id": bson.M{"$lt": id}},
+			},
+		},
+		{
+			name: "cursor without ID",
+			want: bson.A{
+				bson.M{"createdAt": bson.M{"$lt": createdAt}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := messagesBefore(createdAt, tt.id); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("messagesBefore() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
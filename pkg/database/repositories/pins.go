@@ -0,0 +1,258 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/pkg/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Pin orders
+const (
+	PinOrderPosition = "position"  // Manual order, set when reordering
+	PinOrderPinnedAt = "pinned_at" // Oldest pin first
+)
+
+// Pin is a message pinned in a room. Its ID is derived from the room and message,
+// so a message can only be pinned once per room.
+type Pin struct {
+	ID        string    `json:"-" bson:"_id"`
+	RoomID    string    `json:"room_id" bson:"roomId"`
+	MessageID string    `json:"message_id" bson:"messageId"`
+	PinnedBy  string    `json:"pinned_by" bson:"pinnedBy"`
+	Position  int       `json:"position" bson:"position"`
+	PinnedAt  time.Time `json:"pinned_at" bson:"pinnedAt"`
+}
+
+type CreatePinData struct {
+	RoomID    string
+	MessageID string
+	PinnedBy  string
+	Limit     int // Most pins the room can have
+}
+
+type GetPinsData struct {
+	RoomID string
+	Order  string
+}
+
+func pinID(roomID string, messageID string) string {
+	return fmt.Sprintf("%s:%s", roomID, messageID)
+}
+
+// The room document counts its pins and hands out their positions. Positions only grow, the
+// reorders set positions below every position handed out, so no two pins share one.
+const (
+	pinCountField   = "pinCount"
+	nextPinPosField = "nextPinPosition"
+)
+
+// CreatePin pins the message after the room's last pin, unless the room already has Limit pins.
+// The pin is counted and given its position by a single conditional update of the room, so
+// concurrent pins can neither go past the limit nor share a position.
+func CreatePin(ctx context.Context, db *mongo.Database, data CreatePinData) (*Pin, error) {
+	collection := db.Collection(constants.PinsCollection)
+
+	position, err := reservePin(ctx, db, data.RoomID, data.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	pin := Pin{
+		ID:        pinID(data.RoomID, data.MessageID),
+		RoomID:    data.RoomID,
+		MessageID: data.MessageID,
+		PinnedBy:  data.PinnedBy,
+		Position:  position,
+		PinnedAt:  time.Now(),
+	}
+
+	_, err = collection.InsertOne(ctx, pin)
+	if err != nil {
+		// The position is lost, the pin count is given back
+		releasePin(ctx, db, data.RoomID)
+
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrMessageAlreadyPinned
+		}
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToUpdatePins].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToUpdatePins].Message)
+	}
+
+	return &pin, nil
+}
+
+// pinSlotAvailable matches the room when it has fewer than limit pins
+func pinSlotAvailable(roomID string, limit int) bson.M {
+	return bson.M{"_id": roomID, pinCountField: bson.M{"$lt": limit}}
+}
+
+// reservePin counts a pin in the room when it has fewer than limit pins, returning its position
+func reservePin(ctx context.Context, db *mongo.Database, roomID string, limit int) (int, error) {
+	rooms := db.Collection(constants.RoomsCollection)
+
+	opts := options.FindOneAndUpdate().
+		SetProjection(bson.M{nextPinPosField: 1}).
+		SetReturnDocument(options.Before)
+	update := bson.M{"$inc": bson.M{pinCountField: 1, nextPinPosField: 1}}
+
+	// The rooms pinned in before the count was kept are counted on their first pin since
+	for attempt := 0; attempt < 2; attempt++ {
+		var room struct {
+			NextPosition int `bson:"nextPinPosition"`
+		}
+		err := rooms.FindOneAndUpdate(ctx, pinSlotAvailable(roomID, limit), update, opts).Decode(&room)
+		if err == nil {
+			return room.NextPosition, nil
+		}
+
+		if err != mongo.ErrNoDocuments {
+			log.Error(ctx, constants.ErrorMessages[constants.FailedToUpdatePins].Message, log.ErrAttr(err))
+			return 0, errors.New(constants.ErrorMessages[constants.FailedToUpdatePins].Message)
+		}
+
+		counted, err := countRoomPins(ctx, db, roomID)
+		if err != nil {
+			return 0, err
+		}
+
+		if counted {
+			return 0, ErrPinLimitReached
+		}
+	}
+
+	return 0, ErrPinLimitReached
+}
+
+// countRoomPins starts the pin count of the room from its pins when it doesn't have one yet.
+// It reports whether the room already had a count, and fails for the missing rooms.
+func countRoomPins(ctx context.Context, db *mongo.Database, roomID string) (bool, error) {
+	rooms := db.Collection(constants.RoomsCollection)
+
+	var room bson.M
+	opts := options.FindOne().SetProjection(bson.M{pinCountField: 1})
+	if err := rooms.FindOne(ctx, bson.M{"_id": roomID}, opts).Decode(&room); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return false, ErrRoomNotFound
+		}
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetRooms].Message, log.ErrAttr(err))
+		return false, errors.New(constants.ErrorMessages[constants.FailedToGetRooms].Message)
+	}
+
+	if _, ok := room[pinCountField]; ok {
+		return true, nil
+	}
+
+	pins := db.Collection(constants.PinsCollection)
+
+	count, err := pins.CountDocuments(ctx, bson.M{"roomId": roomID})
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetPins].Message, log.ErrAttr(err))
+		return false, errors.New(constants.ErrorMessages[constants.FailedToGetPins].Message)
+	}
+
+	nextPosition := 0
+	var last Pin
+	lastOpts := options.FindOne().SetSort(bson.D{{Key: "position", Value: -1}})
+	err = pins.FindOne(ctx, bson.M{"roomId": roomID}, lastOpts).Decode(&last)
+	if err == nil {
+		nextPosition = last.Position + 1
+	} else if err != mongo.ErrNoDocuments {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetPins].Message, log.ErrAttr(err))
+		return false, errors.New(constants.ErrorMessages[constants.FailedToGetPins].Message)
+	}
+
+	// Concurrent first pins all count, only one sets the count
+	_, err = rooms.UpdateOne(ctx,
+		bson.M{"_id": roomID, pinCountField: bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{pinCountField: count, nextPinPosField: nextPosition}})
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToUpdatePins].Message, log.ErrAttr(err))
+		return false, errors.New(constants.ErrorMessages[constants.FailedToUpdatePins].Message)
+	}
+
+	return false, nil
+}
+
+// releasePin uncounts a pin of the room
+func releasePin(ctx context.Context, db *mongo.Database, roomID string) {
+	rooms := db.Collection(constants.RoomsCollection)
+
+	_, err := rooms.UpdateOne(ctx,
+		bson.M{"_id": roomID, pinCountField: bson.M{"$gt": 0}},
+		bson.M{"$inc": bson.M{pinCountField: -1}})
+	if err != nil {
+		log.Error(ctx, "Failed to release pin", log.AnyAttr("room_id", roomID), log.ErrAttr(err))
+	}
+}
+
+// GetPins returns the pins of the room, in manual order unless ordered by pin time
+func GetPins(ctx context.Context, db *mongo.Database, data GetPinsData) ([]Pin, error) {
+	collection := db.Collection(constants.PinsCollection)
+
+	sort := bson.D{{Key: "position", Value: 1}, {Key: "pinnedAt", Value: 1}}
+	if data.Order == PinOrderPinnedAt {
+		sort = bson.D{{Key: "pinnedAt", Value: 1}}
+	}
+
+	cursor, err := collection.Find(ctx, bson.M{"roomId": data.RoomID}, options.Find().SetSort(sort))
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetPins].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetPins].Message)
+	}
+
+	pins := []Pin{}
+	if err := cursor.All(ctx, &pins); err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetPins].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetPins].Message)
+	}
+
+	return pins, nil
+}
+
+func DeletePin(ctx context.Context, db *mongo.Database, roomID string, messageID string) error {
+	collection := db.Collection(constants.PinsCollection)
+
+	result, err := collection.DeleteOne(ctx, bson.M{"_id": pinID(roomID, messageID)})
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToUpdatePins].Message, log.ErrAttr(err))
+		return errors.New(constants.ErrorMessages[constants.FailedToUpdatePins].Message)
+	}
+
+	if result.DeletedCount == 0 {
+		return ErrPinNotFound
+	}
+	releasePin(ctx, db, roomID)
+
+	return nil
+}
+
+// ReorderPins sets the position of every pin to its index in messageIDs
+func ReorderPins(ctx context.Context, db *mongo.Database, roomID string, messageIDs []string) error {
+	collection := db.Collection(constants.PinsCollection)
+
+	models := make([]mongo.WriteModel, 0, len(messageIDs))
+	for position, messageID := range messageIDs {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": pinID(roomID, messageID)}).
+			SetUpdate(bson.M{"$set": bson.M{"position": position}}))
+	}
+
+	if len(models) == 0 {
+		return nil
+	}
+
+	_, err := collection.BulkWrite(ctx, models)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToUpdatePins].Message, log.ErrAttr(err))
+		return errors.New(constants.ErrorMessages[constants.FailedToUpdatePins].Message)
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/pkg/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MaxUnreadCount caps how many unread messages are counted per room
+const MaxUnreadCount = 1000
+
+// ReadMarker is when a user last read a room. Its ID is derived from the room and
+// user, so there's a single marker per user and room.
+type ReadMarker struct {
+	ID         string    `json:"-" bson:"_id"`
+	RoomID     string    `json:"room_id" bson:"roomId"`
+	UserID     string    `json:"user_id" bson:"userId"`
+	LastReadAt time.Time `json:"last_read_at" bson:"lastReadAt"`
+}
+
+// UnreadRoom is a room with messages the user hasn't read yet
+type UnreadRoom struct {
+	RoomID       string    `json:"room_id" bson:"roomId"`
+	UnreadCount  int64     `json:"unread_count" bson:"unreadCount"` // Capped at MaxUnreadCount
+	LastUnreadAt time.Time `json:"last_unread_at" bson:"lastUnreadAt"`
+}
+
+type GetUnreadRoomsData struct {
+	UserID string
+	Limit  int64
+	Skip   int64
+}
+
+func readMarkerID(roomID string, userID string) string {
+	return fmt.Sprintf("%s:%s", roomID, userID)
+}
+
+// SetReadMarker marks the room as read up to readAt. The marker never moves back.
+func SetReadMarker(ctx context.Context, db *mongo.Database, roomID string, userID string, readAt time.Time) error {
+	collection := db.Collection(constants.ReadMarkersCollection)
+
+	_, err := collection.UpdateOne(ctx,
+		bson.M{"_id": readMarkerID(roomID, userID)},
+		bson.M{
+			"$setOnInsert": bson.M{"roomId": roomID, "userId": userID},
+			"$max":         bson.M{"lastReadAt": readAt},
+		},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToUpdateReadMarker].Message, log.ErrAttr(err))
+		return errors.New(constants.ErrorMessages[constants.FailedToUpdateReadMarker].Message)
+	}
+
+	return nil
+}
+
+// GetUnreadRooms returns a page of the user's rooms with messages from others newer than
+// their read marker, most recent unread message first, along with the total of such rooms
+func GetUnreadRooms(ctx context.Context, db *mongo.Database, data GetUnreadRoomsData) ([]UnreadRoom, int64, error) {
+	collection := db.Collection(constants.RoomsCollection)
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"users.id": data.UserID}}},
+		{{Key: "$project", Value: bson.M{"_id": 1}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from": constants.ReadMarkersCollection,
+			"let":  bson.M{"roomId": "$_id"},
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{"$expr": bson.M{"$eq": bson.A{"$_id", bson.M{"$concat": bson.A{"$$roomId", ":", data.UserID}}}}}},
+			},
+			"as": "marker",
+		}}},
+		// Rooms never read count every message as unread
+		{{Key: "$addFields", Value: bson.M{
+			"lastReadAt": bson.M{"$ifNull": bson.A{bson.M{"$arrayElemAt": bson.A{"$marker.lastReadAt", 0}}, time.Time{}}},
+		}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from": constants.MessagesCollection,
+			"let":  bson.M{"roomId": "$_id", "lastReadAt": "$lastReadAt"},
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{"$expr": bson.M{"$and": bson.A{
+					bson.M{"$eq": bson.A{"$roomId", "$$roomId"}},
+					bson.M{"$gt": bson.A{"$createdAt", "$$lastReadAt"}},
+					bson.M{"$ne": bson.A{"$fromUserId", data.UserID}},
+					bson.M{"$ne": bson.A{"$type", "system"}},
+					bson.M{"$not": bson.A{"$deletedAt"}},
+				}}}},
+				bson.M{"$sort": bson.M{"createdAt": -1}},
+				bson.M{"$limit": MaxUnreadCount},
+				bson.M{"$group": bson.M{
+					"_id":   nil,
+					"count": bson.M{"$sum": 1},
+					"last":  bson.M{"$max": "$createdAt"},
+				}},
+			},
+			"as": "unread",
+		}}},
+		// Drops the rooms without unread messages
+		{{Key: "$unwind", Value: "$unread"}},
+		{{Key: "$facet", Value: bson.M{
+			"total": bson.A{bson.M{"$count": "count"}},
+			"rooms": bson.A{
+				bson.M{"$sort": bson.D{{Key: "unread.last", Value: -1}, {Key: "_id", Value: 1}}},
+				bson.M{"$skip": data.Skip},
+				bson.M{"$limit": data.Limit},
+				bson.M{"$project": bson.M{
+					"_id":          0,
+					"roomId":       "$_id",
+					"unreadCount":  "$unread.count",
+					"lastUnreadAt": "$unread.last",
+				}},
+			},
+		}}},
+	}
+
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetUnreadRooms].Message, log.ErrAttr(err))
+		return nil, 0, errors.New(constants.ErrorMessages[constants.FailedToGetUnreadRooms].Message)
+	}
+	defer cursor.Close(ctx)
+
+	var results []struct {
+		Total []struct {
+			Count int64 `bson:"count"`
+		} `bson:"total"`
+		Rooms []UnreadRoom `bson:"rooms"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetUnreadRooms].Message, log.ErrAttr(err))
+		return nil, 0, errors.New(constants.ErrorMessages[constants.FailedToGetUnreadRooms].Message)
+	}
+
+	rooms := []UnreadRoom{}
+	var total int64
+	if len(results) > 0 {
+		if results[0].Rooms != nil {
+			rooms = results[0].Rooms
+		}
+		if len(results[0].Total) > 0 {
+			total = results[0].Total[0].Count
+		}
+	}
+
+	return rooms, total, nil
+}
@@ -0,0 +1,140 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/pkg/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Report statuses
+const (
+	ReportStatusOpen      = "open"
+	ReportStatusDismissed = "dismissed" // Reviewed, the message was kept
+	ReportStatusDeleted   = "deleted"   // Reviewed, the message was deleted
+)
+
+// Report is a message flagged by a user for moderation. A user can report a message once.
+type Report struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	RoomID     string             `json:"room_id" bson:"roomId"`
+	MessageID  string             `json:"message_id" bson:"messageId"`
+	ReporterID string             `json:"reporter_id" bson:"reporterId"`
+	Reason     string             `json:"reason" bson:"reason"`
+	Status     string             `json:"status" bson:"status"`
+	CreatedAt  time.Time          `json:"created_at" bson:"createdAt"`
+	ResolvedAt *time.Time         `json:"resolved_at,omitempty" bson:"resolvedAt,omitempty"`
+}
+
+type CreateReportData struct {
+	RoomID     string
+	MessageID  string
+	ReporterID string
+	Reason     string
+}
+
+type GetReportsData struct {
+	Status string
+	Limit  int64
+	Skip   int64
+}
+
+func CreateReport(ctx context.Context, db *mongo.Database, data CreateReportData) (*Report, error) {
+	collection := db.Collection(constants.ReportsCollection)
+
+	report := Report{
+		RoomID:     data.RoomID,
+		MessageID:  data.MessageID,
+		ReporterID: data.ReporterID,
+		Reason:     data.Reason,
+		Status:     ReportStatusOpen,
+		CreatedAt:  time.Now(),
+	}
+
+	result, err := collection.InsertOne(ctx, report)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrReportAlreadyExists
+		}
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToUpdateReports].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToUpdateReports].Message)
+	}
+
+	report.ID = result.InsertedID.(primitive.ObjectID)
+
+	return &report, nil
+}
+
+// GetReports returns a page of the reports with the status, oldest first, along with their total
+func GetReports(ctx context.Context, db *mongo.Database, data GetReportsData) ([]Report, int64, error) {
+	collection := db.Collection(constants.ReportsCollection)
+
+	filter := bson.M{"status": data.Status}
+
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetReports].Message, log.ErrAttr(err))
+		return nil, 0, errors.New(constants.ErrorMessages[constants.FailedToGetReports].Message)
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdAt", Value: 1}}).
+		SetSkip(data.Skip).
+		SetLimit(data.Limit)
+
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetReports].Message, log.ErrAttr(err))
+		return nil, 0, errors.New(constants.ErrorMessages[constants.FailedToGetReports].Message)
+	}
+
+	reports := []Report{}
+	if err := cursor.All(ctx, &reports); err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetReports].Message, log.ErrAttr(err))
+		return nil, 0, errors.New(constants.ErrorMessages[constants.FailedToGetReports].Message)
+	}
+
+	return reports, total, nil
+}
+
+func GetReport(ctx context.Context, db *mongo.Database, reportID string) (*Report, error) {
+	collection := db.Collection(constants.ReportsCollection)
+
+	objectID, err := primitive.ObjectIDFromHex(reportID)
+	if err != nil {
+		return nil, ErrReportNotFound
+	}
+
+	var report Report
+	err = collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&report)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrReportNotFound
+		}
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetReports].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetReports].Message)
+	}
+
+	return &report, nil
+}
+
+// ResolveReports closes every open report of the message with the status
+func ResolveReports(ctx context.Context, db *mongo.Database, roomID string, messageID string, status string) error {
+	collection := db.Collection(constants.ReportsCollection)
+
+	_, err := collection.UpdateMany(ctx,
+		bson.M{"roomId": roomID, "messageId": messageID, "status": ReportStatusOpen},
+		bson.M{"$set": bson.M{"status": status, "resolvedAt": time.Now()}})
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToUpdateReports].Message, log.ErrAttr(err))
+		return errors.New(constants.ErrorMessages[constants.FailedToUpdateReports].Message)
+	}
+
+	return nil
+}
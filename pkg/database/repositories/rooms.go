@@ -13,23 +13,67 @@ import (
 )
 
 type Room struct {
-	ID        string    `bson:"_id" json:"id"`
-	Users     []UserRef `bson:"users" json:"users"`
-	LockedBy  string    `bson:"lockedBy,omitempty" json:"lockedBy,omitempty"`
-	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
-	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+	ID              string       `bson:"_id" json:"id"`
+	Users           []UserRef    `bson:"users" json:"users"`
+	LockedBy        string       `bson:"lockedBy,omitempty" json:"lockedBy,omitempty"`
+	LockedAt        *time.Time   `bson:"lockedAt,omitempty" json:"lockedAt,omitempty"`               // Unset on the locks taken before it was tracked
+	Mode            string       `bson:"mode,omitempty" json:"mode,omitempty"`                       // RoomModeOpen when unset
+	SlowModeSeconds int          `bson:"slowModeSeconds,omitempty" json:"slowModeSeconds,omitempty"` // Members wait between their messages, off when 0
+	Settings        RoomSettings `bson:"settings,omitempty" json:"settings"`
+	CreatedBy       string       `bson:"createdBy,omitempty" json:"createdBy,omitempty"` // Empty for the rooms created before it was tracked
+	CreatedAt       time.Time    `bson:"createdAt" json:"createdAt"`
+	UpdatedAt       time.Time    `bson:"updatedAt" json:"updatedAt"`
+	// ClientID is the API client the room was created with, whose webhooks get its events. Empty
+	// for the rooms created with the configured API key or before it was tracked.
+	ClientID string `bson:"clientId,omitempty" json:"-"`
+}
+
+// The room modes. Only admins can send messages to announcement rooms, the other members
+// only read them.
+const (
+	RoomModeOpen         = "open"
+	RoomModeAnnouncement = "announcement"
+)
+
+// RoomSettings are the per-room overrides of the chat config, unset settings use the config
+type RoomSettings struct {
+	ProfanityFilter *bool    `bson:"profanityFilter,omitempty" json:"profanity_filter,omitempty"`
+	Tags            []string `bson:"tags,omitempty" json:"tags,omitempty"` // Used to target announcements
+	// Override the chat edit and delete windows, in seconds. Unlimited when 0.
+	EditWindow   *int `bson:"editWindow,omitempty" json:"edit_window,omitempty"`
+	DeleteWindow *int `bson:"deleteWindow,omitempty" json:"delete_window,omitempty"`
+	// Broadcast the join and leave system messages, on when unset
+	PresenceMessages *bool `bson:"presenceMessages,omitempty" json:"presence_messages,omitempty"`
+}
+
+type UpdateRoomSettingsData struct {
+	RoomID           string
+	ProfanityFilter  *bool
+	Tags             *[]string
+	EditWindow       *int
+	DeleteWindow     *int
+	PresenceMessages *bool
+	Mode             *string
 }
 
 type CreateRoomData struct {
 	UserID   string `json:"userId"`
 	RoomID   string `json:"roomId"`
 	Nickname string `json:"nickname"`
+	Guest    bool   `json:"guest"`
+	ClientID string `json:"-"` // Only recorded when the room is created
 }
 
 type GetRoomData struct {
 	RoomID string `json:"roomId"`
 }
 
+type GetRoomMembersData struct {
+	RoomID string
+	Limit  int64
+	Skip   int64
+}
+
 type GetRoomsCursorData struct {
 	Limit int64
 	Skip  int64
@@ -39,11 +83,18 @@ func CreateRoom(ctx context.Context, db *mongo.Database, data CreateRoomData) (*
 	now := time.Now()
 	collection := db.Collection(constants.RoomsCollection)
 
+	// Only the user and client creating the room, the later joins don't overwrite them
+	onInsert := bson.M{
+		"createdAt": now,
+		"createdBy": data.UserID,
+	}
+	if data.ClientID != "" {
+		onInsert["clientId"] = data.ClientID
+	}
+
 	filter := bson.M{"_id": data.RoomID}
 	update := bson.M{
-		"$setOnInsert": bson.M{
-			"createdAt": now,
-		},
+		"$setOnInsert": onInsert,
 		"$set": bson.M{
 			"updatedAt": now,
 		},
@@ -51,6 +102,7 @@ func CreateRoom(ctx context.Context, db *mongo.Database, data CreateRoomData) (*
 			"users": UserRef{
 				ID:       data.UserID,
 				Nickname: data.Nickname,
+				Guest:    data.Guest,
 			},
 		},
 	}
@@ -72,7 +124,6 @@ func GetRooms(ctx context.Context, db *mongo.Database, data GetRoomData) (*Room,
 	filter := bson.M{"_id": data.RoomID}
 
 	err := collection.FindOne(ctx, filter).Decode(&room)
-	// fmt.Println("eraaaar", err)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return nil, nil
@@ -84,6 +135,255 @@ func GetRooms(ctx context.Context, db *mongo.Database, data GetRoomData) (*Room,
 	return &room, nil
 }
 
+// UpdateRoomSettings updates the set settings of the room
+func UpdateRoomSettings(ctx context.Context, db *mongo.Database, data UpdateRoomSettingsData) error {
+	collection := db.Collection(constants.RoomsCollection)
+
+	set := bson.M{"updatedAt": time.Now()}
+	if data.ProfanityFilter != nil {
+		set["settings.profanityFilter"] = *data.ProfanityFilter
+	}
+
+	if data.Tags != nil {
+		set["settings.tags"] = *data.Tags
+	}
+
+	if data.EditWindow != nil {
+		set["settings.editWindow"] = *data.EditWindow
+	}
+
+	if data.DeleteWindow != nil {
+		set["settings.deleteWindow"] = *data.DeleteWindow
+	}
+
+	if data.PresenceMessages != nil {
+		set["settings.presenceMessages"] = *data.PresenceMessages
+	}
+
+	if data.Mode != nil {
+		set["mode"] = *data.Mode
+	}
+
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": data.RoomID}, bson.M{"$set": set})
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToCreateOrUpdateRoom].Message, log.ErrAttr(err))
+		return errors.New(constants.ErrorMessages[constants.FailedToCreateOrUpdateRoom].Message)
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrRoomNotFound
+	}
+
+	return nil
+}
+
+// GetRoomIDsByTags returns the IDs of the rooms with any of the tags
+func GetRoomIDsByTags(ctx context.Context, db *mongo.Database, tags []string) ([]string, error) {
+	collection := db.Collection(constants.RoomsCollection)
+
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+
+	cursor, err := collection.Find(ctx, bson.M{"settings.tags": bson.M{"$in": tags}}, opts)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetRooms].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetRooms].Message)
+	}
+
+	var rooms []Room
+	if err := cursor.All(ctx, &rooms); err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetRooms].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetRooms].Message)
+	}
+
+	roomIDs := make([]string, len(rooms))
+	for i, room := range rooms {
+		roomIDs[i] = room.ID
+	}
+
+	return roomIDs, nil
+}
+
+// GetRoomClientID returns the API client the room was created with, empty when there's none
+func GetRoomClientID(ctx context.Context, db *mongo.Database, roomID string) (string, error) {
+	collection := db.Collection(constants.RoomsCollection)
+
+	var room Room
+	opts := options.FindOne().SetProjection(bson.M{"clientId": 1})
+	if err := collection.FindOne(ctx, bson.M{"_id": roomID}, opts).Decode(&room); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return "", ErrRoomNotFound
+		}
+		log.Error(ctx, "Failed to get room", log.ErrAttr(err))
+		return "", errors.New(constants.ErrorMessages[constants.FailedToGetRooms].Message)
+	}
+
+	return room.ClientID, nil
+}
+
+// CountClientRooms returns how many of the rooms were created with the API client
+func CountClientRooms(ctx context.Context, db *mongo.Database, clientID string, roomIDs []string) (int64, error) {
+	collection := db.Collection(constants.RoomsCollection)
+
+	count, err := collection.CountDocuments(ctx, bson.M{"_id": bson.M{"$in": roomIDs}, "clientId": clientID})
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetRooms].Message, log.ErrAttr(err))
+		return 0, errors.New(constants.ErrorMessages[constants.FailedToGetRooms].Message)
+	}
+
+	return count, nil
+}
+
+// LockRoom locks the room for the user unless it's already locked, in a single update so only
+// one of concurrent lock requests wins. It reports whether the user got the lock.
+func LockRoom(ctx context.Context, db *mongo.Database, roomID string, userID string) (bool, error) {
+	collection := db.Collection(constants.RoomsCollection)
+
+	result, err := collection.UpdateOne(ctx,
+		bson.M{"_id": roomID, "lockedBy": bson.M{"$in": bson.A{"", nil}}},
+		bson.M{"$set": bson.M{"lockedBy": userID, "lockedAt": time.Now()}})
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToCreateOrUpdateRoom].Message, log.ErrAttr(err))
+		return false, errors.New(constants.ErrorMessages[constants.FailedToCreateOrUpdateRoom].Message)
+	}
+
+	return result.ModifiedCount == 1, nil
+}
+
+// UnlockRoom releases the room lock when the user holds it. It reports whether this call
+// released it, so a lock released twice concurrently is only announced once.
+func UnlockRoom(ctx context.Context, db *mongo.Database, roomID string, userID string) (bool, error) {
+	collection := db.Collection(constants.RoomsCollection)
+
+	result, err := collection.UpdateOne(ctx,
+		bson.M{"_id": roomID, "lockedBy": userID},
+		unlockRoom)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToCreateOrUpdateRoom].Message, log.ErrAttr(err))
+		return false, errors.New(constants.ErrorMessages[constants.FailedToCreateOrUpdateRoom].Message)
+	}
+
+	return result.ModifiedCount == 1, nil
+}
+
+// SetRoomSlowMode sets the seconds members wait between their messages to the room, turning
+// slow mode off when 0. It reports whether the slow mode changed.
+func SetRoomSlowMode(ctx context.Context, db *mongo.Database, roomID string, seconds int) (bool, error) {
+	collection := db.Collection(constants.RoomsCollection)
+
+	update := bson.M{"$set": bson.M{"slowModeSeconds": seconds, "updatedAt": time.Now()}}
+	filter := bson.M{"_id": roomID, "slowModeSeconds": bson.M{"$ne": seconds}}
+	if seconds == 0 {
+		update = bson.M{"$set": bson.M{"updatedAt": time.Now()}, "$unset": bson.M{"slowModeSeconds": ""}}
+		filter = bson.M{"_id": roomID, "slowModeSeconds": bson.M{"$exists": true}}
+	}
+
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToCreateOrUpdateRoom].Message, log.ErrAttr(err))
+		return false, errors.New(constants.ErrorMessages[constants.FailedToCreateOrUpdateRoom].Message)
+	}
+
+	if result.MatchedCount == 1 {
+		return true, nil
+	}
+
+	// Unchanged, unless the room doesn't exist
+	count, err := collection.CountDocuments(ctx, bson.M{"_id": roomID})
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetRooms].Message, log.ErrAttr(err))
+		return false, errors.New(constants.ErrorMessages[constants.FailedToGetRooms].Message)
+	}
+
+	if count == 0 {
+		return false, ErrRoomNotFound
+	}
+
+	return false, nil
+}
+
+var unlockRoom = bson.M{"$set": bson.M{"lockedBy": ""}, "$unset": bson.M{"lockedAt": ""}}
+
+// expiredLock matches the rooms locked before the cutoff, or locked before the lock time was tracked
+func expiredLock(cutoff time.Time) bson.M {
+	return bson.M{
+		"lockedBy": bson.M{"$nin": bson.A{"", nil}},
+		"$or": bson.A{
+			bson.M{"lockedAt": bson.M{"$lt": cutoff}},
+			bson.M{"lockedAt": bson.M{"$exists": false}},
+		},
+	}
+}
+
+// expiredLockOf matches the room when the user's lock on it is expired
+func expiredLockOf(roomID string, userID string, cutoff time.Time) bson.M {
+	filter := expiredLock(cutoff)
+	filter["_id"] = roomID
+	filter["lockedBy"] = userID
+	return filter
+}
+
+// GetRoomsWithExpiredLocks returns the rooms locked before the cutoff
+func GetRoomsWithExpiredLocks(ctx context.Context, db *mongo.Database, cutoff time.Time) ([]Room, error) {
+	collection := db.Collection(constants.RoomsCollection)
+
+	cursor, err := collection.Find(ctx, expiredLock(cutoff))
+	if err != nil {
+		log.Error(ctx, "Failed to get rooms with expired locks", log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetRooms].Message)
+	}
+
+	rooms := []Room{}
+	if err := cursor.All(ctx, &rooms); err != nil {
+		log.Error(ctx, "Failed to decode rooms with expired locks", log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetRooms].Message)
+	}
+
+	return rooms, nil
+}
+
+// ExpireRoomLock releases the user's lock on the room when it was taken before the cutoff.
+// It reports whether this call released it, so concurrent expiries announce it only once.
+func ExpireRoomLock(ctx context.Context, db *mongo.Database, roomID string, userID string, cutoff time.Time) (bool, error) {
+	collection := db.Collection(constants.RoomsCollection)
+
+	result, err := collection.UpdateOne(ctx, expiredLockOf(roomID, userID, cutoff), unlockRoom)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToCreateOrUpdateRoom].Message, log.ErrAttr(err))
+		return false, errors.New(constants.ErrorMessages[constants.FailedToCreateOrUpdateRoom].Message)
+	}
+
+	return result.ModifiedCount == 1, nil
+}
+
+// RemoveRoomMember removes the user from the room, releasing the room lock if they held it
+func RemoveRoomMember(ctx context.Context, db *mongo.Database, roomID string, userID string) error {
+	collection := db.Collection(constants.RoomsCollection)
+
+	result, err := collection.UpdateOne(ctx,
+		bson.M{"_id": roomID, "users.id": userID},
+		bson.M{
+			"$pull": bson.M{"users": bson.M{"id": userID}},
+			"$set":  bson.M{"updatedAt": time.Now()},
+		})
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToCreateOrUpdateRoom].Message, log.ErrAttr(err))
+		return errors.New(constants.ErrorMessages[constants.FailedToCreateOrUpdateRoom].Message)
+	}
+
+	if result.MatchedCount == 0 {
+		if _, err := GetRoom(ctx, db, GetRoomData{RoomID: roomID}); err != nil {
+			return err
+		}
+		return ErrUserNotRoomMember
+	}
+
+	if _, err := UnlockRoom(ctx, db, roomID, userID); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func GetRoom(ctx context.Context, db *mongo.Database, data GetRoomData) (*Room, error) {
 	collection := db.Collection(constants.RoomsCollection)
 
@@ -93,7 +393,7 @@ func GetRoom(ctx context.Context, db *mongo.Database, data GetRoomData) (*Room,
 	err := collection.FindOne(ctx, filter).Decode(&room)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return nil, errors.New(constants.ErrorMessages[constants.RoomNotFound].Message)
+			return nil, ErrRoomNotFound
 		}
 		log.Error(ctx, "Failed to get room", log.ErrAttr(err))
 		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetRooms].Message)
@@ -102,6 +402,42 @@ func GetRoom(ctx context.Context, db *mongo.Database, data GetRoomData) (*Room,
 	return &room, nil
 }
 
+// GetRoomMembers returns a page of the room members, in join order, along with the total number of members
+func GetRoomMembers(ctx context.Context, db *mongo.Database, data GetRoomMembersData) ([]UserRef, int64, error) {
+	collection := db.Collection(constants.RoomsCollection)
+
+	users := bson.M{"$ifNull": bson.A{"$users", bson.A{}}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"_id": data.RoomID}}},
+		{{Key: "$project", Value: bson.M{
+			"users": bson.M{"$slice": bson.A{users, data.Skip, data.Limit}},
+			"total": bson.M{"$size": users},
+		}}},
+	}
+
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		log.Error(ctx, "Failed to get room members", log.ErrAttr(err))
+		return nil, 0, errors.New(constants.ErrorMessages[constants.FailedToGetRooms].Message)
+	}
+	defer cursor.Close(ctx)
+
+	if !cursor.Next(ctx) {
+		return nil, 0, ErrRoomNotFound
+	}
+
+	var result struct {
+		Users []UserRef `bson:"users"`
+		Total int64     `bson:"total"`
+	}
+	if err := cursor.Decode(&result); err != nil {
+		log.Error(ctx, "Failed to decode room members", log.ErrAttr(err))
+		return nil, 0, errors.New(constants.ErrorMessages[constants.FailedToGetRooms].Message)
+	}
+
+	return result.Users, result.Total, nil
+}
+
 func GetRoomsCursor(ctx context.Context, db *mongo.Database, data GetRoomsCursorData) (*mongo.Cursor, error) {
 	collection := db.Collection(constants.RoomsCollection)
 
@@ -113,7 +449,7 @@ func GetRoomsCursor(ctx context.Context, db *mongo.Database, data GetRoomsCursor
 	cursor, err := collection.Find(ctx, bson.M{}, options)
 	if err == mongo.ErrNoDocuments {
 		log.Error(ctx, "Room not found", log.ErrAttr(err))
-		return nil, errors.New(constants.ErrorMessages[constants.RoomNotFound].Message)
+		return nil, ErrRoomNotFound
 	}
 
 	if err != nil {
@@ -124,6 +460,43 @@ func GetRoomsCursor(ctx context.Context, db *mongo.Database, data GetRoomsCursor
 	return cursor, nil
 }
 
+// CountRooms returns how many rooms there are, the total of the GetRoomsCursor pages
+func CountRooms(ctx context.Context, db *mongo.Database) (int64, error) {
+	collection := db.Collection(constants.RoomsCollection)
+
+	total, err := collection.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		log.Error(ctx, "Failed to count rooms", log.ErrAttr(err))
+		return 0, errors.New(constants.ErrorMessages[constants.FailedToGetRooms].Message)
+	}
+
+	return total, nil
+}
+
+// GetUserMemberships returns the rooms where the user is registered, with only the
+// user in their members
+func GetUserMemberships(ctx context.Context, db *mongo.Database, userID string) ([]Room, error) {
+	collection := db.Collection(constants.RoomsCollection)
+
+	opts := options.Find().
+		SetProjection(bson.M{"users": bson.M{"$elemMatch": bson.M{"id": userID}}, "createdAt": 1}).
+		SetSort(bson.D{{Key: "createdAt", Value: 1}})
+
+	cursor, err := collection.Find(ctx, bson.M{"users.id": userID}, opts)
+	if err != nil {
+		log.Error(ctx, "Failed to get user memberships", log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetRooms].Message)
+	}
+
+	rooms := []Room{}
+	if err := cursor.All(ctx, &rooms); err != nil {
+		log.Error(ctx, "Failed to decode user memberships", log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetRooms].Message)
+	}
+
+	return rooms, nil
+}
+
 func GetAllRoomsWhereUserIsRegistered(ctx context.Context, db *mongo.Database, data GetUserData) ([]Room, error) {
 	collection := db.Collection(constants.RoomsCollection)
 
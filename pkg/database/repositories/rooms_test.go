@@ -0,0 +1,115 @@
+package repositories
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// matches evaluates the filter against the document for the operators the filters use
+func matches(t *testing.T, filter bson.M, doc bson.M) bool {
+	t.Helper()
+
+	for key, cond := range filter {
+		if key == "$or" {
+			matched := false
+			for _, clause := range cond.(bson.A) {
+				matched = matched || matches(t, clause.(bson.M), doc)
+			}
+			if !matched {
+				return false
+			}
+			continue
+		}
+
+		value, present := doc[key]
+
+		ops, ok := cond.(bson.M)
+		if !ok {
+			if !present || value != cond {
+				return false
+			}
+			continue
+		}
+
+		for op, operand := range ops {
+			switch op {
+			case "$lt":
+				at, ok := value.(time.Time)
+				if !present || !ok || !at.Before(operand.(time.Time)) {
+					return false
+				}
+			case "$gt":
+				at, ok := value.(time.Time)
+				if !present || !ok || !at.After(operand.(time.Time)) {
+					return false
+				}
+			case "$exists":
+				if present != operand.(bool) {
+					return false
+				}
+			case "$nin":
+				// A missing field is null to MongoDB
+				if slices.Contains(operand.(bson.A), value) {
+					return false
+				}
+			default:
+				t.Fatalf("operator %s isn't supported", op)
+			}
+		}
+	}
+
+	return true
+}
+
+func TestExpiredLock(t *testing.T) {
+	cutoff := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		room bson.M
+		want bool
+	}{
+		{"locked before the cutoff", bson.M{"lockedBy": "alice", "lockedAt": cutoff.Add(-time.Minute)}, true},
+		{"locked after the cutoff", bson.M{"lockedBy": "alice", "lockedAt": cutoff.Add(time.Minute)}, false},
+		{"locked at the cutoff", bson.M{"lockedBy": "alice", "lockedAt": cutoff}, false},
+		{"lock time not tracked", bson.M{"lockedBy": "alice"}, true},
+		{"unlocked", bson.M{"lockedBy": ""}, false},
+		{"never locked", bson.M{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matches(t, expiredLock(cutoff), tt.room); got != tt.want {
+				t.Errorf("expiredLock() matches %v = %v, want %v", tt.room, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpiredLockOf(t *testing.T) {
+	cutoff := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	expired := cutoff.Add(-time.Minute)
+
+	tests := []struct {
+		name string
+		room bson.M
+		want bool
+	}{
+		{"user's expired lock", bson.M{"_id": "lobby", "lockedBy": "alice", "lockedAt": expired}, true},
+		{"user's untracked lock", bson.M{"_id": "lobby", "lockedBy": "alice"}, true},
+		{"user's current lock", bson.M{"_id": "lobby", "lockedBy": "alice", "lockedAt": cutoff.Add(time.Minute)}, false},
+		{"relocked by another user", bson.M{"_id": "lobby", "lockedBy": "bob", "lockedAt": expired}, false},
+		{"another room", bson.M{"_id": "other", "lockedBy": "alice", "lockedAt": expired}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matches(t, expiredLockOf("lobby", "alice", cutoff), tt.room); got != tt.want {
+				t.Errorf("expiredLockOf() matches %v = %v, want %v", tt.room, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/pkg/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Session is a login of the user, referenced by the "sid" claim of the tokens issued for it.
+// Revoking it, by deleting it, stops its tokens from working.
+type Session struct {
+	ID         string    `json:"id" bson:"_id"`
+	UserID     string    `json:"-" bson:"userId"`
+	IP         string    `json:"ip" bson:"ip"`
+	UserAgent  string    `json:"user_agent" bson:"userAgent"`
+	CreatedAt  time.Time `json:"created_at" bson:"createdAt"`
+	LastUsedAt time.Time `json:"last_used_at" bson:"lastUsedAt"`
+	ExpiresAt  time.Time `json:"expires_at" bson:"expiresAt"` // Along with its tokens
+}
+
+type CreateSessionData struct {
+	ID        string
+	UserID    string
+	IP        string
+	UserAgent string
+	ExpiresAt time.Time
+}
+
+func CreateSession(ctx context.Context, db *mongo.Database, data CreateSessionData) (*Session, error) {
+	collection := db.Collection(constants.SessionsCollection)
+
+	now := time.Now()
+	session := Session{
+		ID:         data.ID,
+		UserID:     data.UserID,
+		IP:         data.IP,
+		UserAgent:  data.UserAgent,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  data.ExpiresAt,
+	}
+
+	if _, err := collection.InsertOne(ctx, session); err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToCreateSession].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToCreateSession].Message)
+	}
+
+	return &session, nil
+}
+
+// GetSession returns the session unless it was revoked or expired, and whether the account
+// of its user is disabled. Both are read in a single query, as every authenticated request
+// checks them. MongoDB only removes the expired sessions about every minute, so the
+// expiration is checked here too.
+func GetSession(ctx context.Context, db *mongo.Database, sessionID string) (*Session, bool, error) {
+	collection := db.Collection(constants.SessionsCollection)
+
+	cursor, err := collection.Aggregate(ctx, sessionWithAccount(sessionID, time.Now()))
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetSessions].Message, log.ErrAttr(err))
+		return nil, false, errors.New(constants.ErrorMessages[constants.FailedToGetSessions].Message)
+	}
+
+	var sessions []struct {
+		Session      `bson:",inline"`
+		UserDisabled bool `bson:"userDisabled"`
+	}
+	if err := cursor.All(ctx, &sessions); err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetSessions].Message, log.ErrAttr(err))
+		return nil, false, errors.New(constants.ErrorMessages[constants.FailedToGetSessions].Message)
+	}
+
+	if len(sessions) == 0 {
+		return nil, false, ErrSessionNotFound
+	}
+
+	return &sessions[0].Session, sessions[0].UserDisabled, nil
+}
+
+// sessionWithAccount matches the session when it didn't expire by now, adding whether the
+// account of its user is disabled. Unknown users aren't disabled.
+func sessionWithAccount(sessionID string, now time.Time) mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"_id": sessionID, "expiresAt": bson.M{"$gt": now}}}},
+		{{Key: "$limit", Value: 1}},
+		{{Key: "$lookup", Value: bson.M{
+			"from":         constants.UsersCollection,
+			"localField":   "userId",
+			"foreignField": "_id",
+			"as":           "user",
+		}}},
+		{{Key: "$addFields", Value: bson.M{
+			"userDisabled": bson.M{"$ifNull": bson.A{bson.M{"$arrayElemAt": bson.A{"$user.disabled", 0}}, false}},
+		}}},
+		{{Key: "$project", Value: bson.M{"user": 0}}},
+	}
+}
+
+// TouchSession records that the session was used at the time
+func TouchSession(ctx context.Context, db *mongo.Database, sessionID string, at time.Time) error {
+	collection := db.Collection(constants.SessionsCollection)
+
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": sessionID}, bson.M{"$max": bson.M{"lastUsedAt": at}})
+	if err != nil {
+		log.Error(ctx, "Failed to update session", log.ErrAttr(err))
+		return err
+	}
+
+	return nil
+}
+
+// GetUserSessions returns the sessions of the user that didn't expire, most recently used first
+func GetUserSessions(ctx context.Context, db *mongo.Database, userID string) ([]Session, error) {
+	collection := db.Collection(constants.SessionsCollection)
+
+	opts := options.Find().SetSort(bson.D{{Key: "lastUsedAt", Value: -1}})
+
+	cursor, err := collection.Find(ctx, bson.M{
+		"userId":    userID,
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}, opts)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetSessions].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetSessions].Message)
+	}
+
+	sessions := []Session{}
+	if err := cursor.All(ctx, &sessions); err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetSessions].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetSessions].Message)
+	}
+
+	return sessions, nil
+}
+
+// DeleteSession revokes one of the user's sessions
+func DeleteSession(ctx context.Context, db *mongo.Database, userID string, sessionID string) error {
+	collection := db.Collection(constants.SessionsCollection)
+
+	result, err := collection.DeleteOne(ctx, bson.M{"_id": sessionID, "userId": userID})
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToDeleteSession].Message, log.ErrAttr(err))
+		return errors.New(constants.ErrorMessages[constants.FailedToDeleteSession].Message)
+	}
+
+	if result.DeletedCount == 0 {
+		return ErrSessionNotFound
+	}
+
+	return nil
+}
+
+// DeleteUserSessions revokes every session of the user but exceptID, when set. It returns
+// how many were revoked.
+func DeleteUserSessions(ctx context.Context, db *mongo.Database, userID string, exceptID string) (int64, error) {
+	collection := db.Collection(constants.SessionsCollection)
+
+	filter := bson.M{"userId": userID}
+	if exceptID != "" {
+		filter["_id"] = bson.M{"$ne": exceptID}
+	}
+
+	result, err := collection.DeleteMany(ctx, filter)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToDeleteSession].Message, log.ErrAttr(err))
+		return 0, errors.New(constants.ErrorMessages[constants.FailedToDeleteSession].Message)
+	}
+
+	return result.DeletedCount, nil
+}
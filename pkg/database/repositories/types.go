@@ -3,4 +3,5 @@ package repositories
 type UserRef struct {
 	ID       string `json:"id" bson:"id"`
 	Nickname string `json:"nickname" bson:"nickname"`
+	Guest    bool   `json:"guest,omitempty" bson:"guest,omitempty"` // Joined with a guest token, see User.IsGuest
 }
@@ -14,13 +14,23 @@ import (
 )
 
 type User struct {
-	Id        string    `json:"id" bson:"_id"`
-	Email     string    `json:"email" bson:"email"`
-	Password  string    `json:"password" bson:"password"`
-	Nickname  string    `json:"nickname" bson:"nickname"`
-	Activity  string    `json:"activity" bson:"activity"`
-	CreatedAt time.Time `json:"created_at" bson:"created_at"`
-	UpdatedAt time.Time `json:"updated_at" bson:"updated_at"`
+	Id         string     `json:"id" bson:"_id"`
+	Email      string     `json:"email" bson:"email"`
+	Password   string     `json:"password" bson:"password"`
+	Nickname   string     `json:"nickname" bson:"nickname"`
+	Activity   string     `json:"activity" bson:"activity"`
+	Disabled   bool       `json:"disabled" bson:"disabled,omitempty"`              // Disabled accounts can't log in or connect, but keep their data
+	DisabledBy string     `json:"-" bson:"disabledBy,omitempty"`                   // The admin who disabled the account, only an admin can reactivate it then
+	IsGuest    bool       `json:"is_guest" bson:"isGuest,omitempty"`               // Created with a guest token, removed once it expires
+	ExpiresAt  *time.Time `json:"expires_at,omitempty" bson:"expiresAt,omitempty"` // When the guest is removed
+	CreatedAt  time.Time  `json:"created_at" bson:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at" bson:"updated_at"`
+}
+
+// Verified tells whether the user registered with an email and password, unlike the
+// guests created with only a nickname
+func (u User) Verified() bool {
+	return u.Email != "" && u.Password != ""
 }
 
 type CreateUserData struct {
@@ -29,6 +39,9 @@ type CreateUserData struct {
 	Activity string `json:"activity"`
 	Password string `json:"password"`
 	Email    string `json:"email"`
+	// Guests are removed at ExpiresAt
+	IsGuest   bool       `json:"isGuest"`
+	ExpiresAt *time.Time `json:"expiresAt"`
 }
 
 type GetUserData struct {
@@ -56,6 +69,13 @@ type GetUserContactsData struct {
 	Skip   int64
 }
 
+// Contact is a user sharing at least one room with another user
+type Contact struct {
+	UserID      string `json:"user_id" bson:"_id"`
+	Nickname    string `json:"nickname" bson:"nickname"`
+	SharedRooms int64  `json:"shared_rooms" bson:"sharedRooms"`
+}
+
 func CreateUser(ctx context.Context, db *mongo.Database, data CreateUserData) (*mongo.InsertOneResult, error) {
 	now := time.Now()
 
@@ -69,6 +89,8 @@ func CreateUser(ctx context.Context, db *mongo.Database, data CreateUserData) (*
 		Activity:  data.Activity,
 		Password:  data.Password,
 		Email:     data.Email,
+		IsGuest:   data.IsGuest,
+		ExpiresAt: data.ExpiresAt,
 		CreatedAt: now,
 		UpdatedAt: now,
 	})
@@ -107,7 +129,7 @@ func UpdateUser(ctx context.Context, db *mongo.Database, data UpdateUserData) (*
 		return nil, err
 	}
 	if user == nil {
-		return nil, errors.New(constants.ErrorMessages[constants.UserNotFound].Message)
+		return nil, ErrUserNotFound
 	}
 
 	collection := db.Collection(constants.UsersCollection)
@@ -131,6 +153,255 @@ func UpdateUser(ctx context.Context, db *mongo.Database, data UpdateUserData) (*
 	return result, nil
 }
 
+// UpdateUserPassword replaces the user's password hash
+func UpdateUserPassword(ctx context.Context, db *mongo.Database, userID string, passwordHash string) error {
+	collection := db.Collection(constants.UsersCollection)
+
+	result, err := collection.UpdateOne(ctx,
+		bson.M{"_id": userID},
+		bson.M{"$set": bson.M{"password": passwordHash, "updated_at": time.Now()}})
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToUpdateUser].Message, log.ErrAttr(err))
+		return errors.New(constants.ErrorMessages[constants.FailedToUpdateUser].Message)
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+// SetUserDisabled disables the account, on behalf of the admin when adminID is set, or
+// reactivates it
+func SetUserDisabled(ctx context.Context, db *mongo.Database, userID string, disabled bool, adminID string) error {
+	collection := db.Collection(constants.UsersCollection)
+
+	update := bson.M{"$set": bson.M{"disabled": disabled, "disabledBy": adminID, "updatedAt": time.Now()}}
+	if !disabled || adminID == "" {
+		update = bson.M{
+			"$set":   bson.M{"disabled": disabled, "updatedAt": time.Now()},
+			"$unset": bson.M{"disabledBy": ""},
+		}
+	}
+
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": userID}, update)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToUpdateUser].Message, log.ErrAttr(err))
+		return errors.New(constants.ErrorMessages[constants.FailedToUpdateUser].Message)
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+// MarkInactiveUsersOffline sets the users online without a live connection offline when their
+// activity didn't change since the cutoff. It returns how many users it set offline.
+func MarkInactiveUsersOffline(ctx context.Context, db *mongo.Database, connectedUserIDs []string, cutoff time.Time) (int64, error) {
+	collection := db.Collection(constants.UsersCollection)
+
+	result, err := collection.UpdateMany(ctx, inactiveUsers(connectedUserIDs, cutoff), bson.M{"$set": bson.M{
+		"activity":  "offline",
+		"updatedAt": time.Now(),
+	}})
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToUpdateUser].Message, log.ErrAttr(err))
+		return 0, errors.New(constants.ErrorMessages[constants.FailedToUpdateUser].Message)
+	}
+
+	return result.ModifiedCount, nil
+}
+
+// inactiveUsers matches the online users without a live connection whose activity didn't change
+// since the cutoff. The users created before updatedAt was tracked have updated_at instead.
+func inactiveUsers(connectedUserIDs []string, cutoff time.Time) bson.M {
+	connected := make(bson.A, len(connectedUserIDs))
+	for i, userID := range connectedUserIDs {
+		connected[i] = userID
+	}
+
+	return bson.M{
+		"activity": "online",
+		"_id":      bson.M{"$nin": connected},
+		"$or": bson.A{
+			bson.M{"updatedAt": bson.M{"$lt": cutoff}},
+			bson.M{"updatedAt": bson.M{"$exists": false}, "updated_at": bson.M{"$lt": cutoff}},
+		},
+	}
+}
+
+// DeleteExpiredGuests removes the guests whose token expired, along with their room memberships.
+// It returns how many guests were removed.
+func DeleteExpiredGuests(ctx context.Context, db *mongo.Database) (int64, error) {
+	collection := db.Collection(constants.UsersCollection)
+
+	filter := bson.M{"isGuest": true, "expiresAt": bson.M{"$lte": time.Now()}}
+	cursor, err := collection.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetUsers].Message, log.ErrAttr(err))
+		return 0, errors.New(constants.ErrorMessages[constants.FailedToGetUsers].Message)
+	}
+
+	guests := []User{}
+	if err := cursor.All(ctx, &guests); err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetUsers].Message, log.ErrAttr(err))
+		return 0, errors.New(constants.ErrorMessages[constants.FailedToGetUsers].Message)
+	}
+
+	if len(guests) == 0 {
+		return 0, nil
+	}
+
+	guestIDs := make([]string, len(guests))
+	for i, guest := range guests {
+		guestIDs[i] = guest.Id
+	}
+
+	// The memberships go first, so a failure leaves the guests to be removed on the next run
+	_, err = db.Collection(constants.RoomsCollection).UpdateMany(ctx,
+		bson.M{"users.id": bson.M{"$in": guestIDs}},
+		bson.M{"$pull": bson.M{"users": bson.M{"id": bson.M{"$in": guestIDs}}}})
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToCreateOrUpdateRoom].Message, log.ErrAttr(err))
+		return 0, errors.New(constants.ErrorMessages[constants.FailedToCreateOrUpdateRoom].Message)
+	}
+
+	result, err := collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": guestIDs}})
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToUpdateUser].Message, log.ErrAttr(err))
+		return 0, errors.New(constants.ErrorMessages[constants.FailedToUpdateUser].Message)
+	}
+
+	return result.DeletedCount, nil
+}
+
+// IsUserDisabled reports whether the account is disabled. Unknown users aren't disabled.
+func IsUserDisabled(ctx context.Context, db *mongo.Database, userID string) (bool, error) {
+	collection := db.Collection(constants.UsersCollection)
+
+	opts := options.FindOne().SetProjection(bson.M{"disabled": 1})
+
+	var user User
+	err := collection.FindOne(ctx, bson.M{"_id": userID}, opts).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return false, nil
+		}
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetUsers].Message, log.ErrAttr(err))
+		return false, errors.New(constants.ErrorMessages[constants.FailedToGetUsers].Message)
+	}
+
+	return user.Disabled, nil
+}
+
+// GetVerifiedUsers returns which of the users registered with an email and password
+func GetVerifiedUsers(ctx context.Context, db *mongo.Database, userIDs []string) (map[string]bool, error) {
+	verified := make(map[string]bool, len(userIDs))
+	if len(userIDs) == 0 {
+		return verified, nil
+	}
+
+	collection := db.Collection(constants.UsersCollection)
+
+	filter := bson.M{
+		"_id":      bson.M{"$in": userIDs},
+		"email":    bson.M{"$nin": bson.A{"", nil}},
+		"password": bson.M{"$nin": bson.A{"", nil}},
+	}
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetUsers].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetUsers].Message)
+	}
+
+	var users []User
+	if err := cursor.All(ctx, &users); err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetUsers].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetUsers].Message)
+	}
+
+	for _, user := range users {
+		verified[user.Id] = true
+	}
+
+	return verified, nil
+}
+
+// GetUserContacts returns a page of the users sharing a room with the user, each counted
+// once however many rooms they share, and the total number of contacts. The deleted
+// users are left out.
+func GetUserContacts(ctx context.Context, db *mongo.Database, data GetUserContactsData) ([]Contact, int64, error) {
+	collection := db.Collection(constants.RoomsCollection)
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"users.id": data.UserID}}},
+		{{Key: "$project", Value: bson.M{"users.id": 1}}},
+		{{Key: "$unwind", Value: "$users"}},
+		{{Key: "$match", Value: bson.M{"users.id": bson.M{"$ne": data.UserID}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":         "$users.id",
+			"sharedRooms": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from":         constants.UsersCollection,
+			"localField":   "_id",
+			"foreignField": "_id",
+			"as":           "user",
+		}}},
+		// Drops the members whose account was deleted
+		{{Key: "$unwind", Value: "$user"}},
+		{{Key: "$facet", Value: bson.M{
+			"total": bson.A{bson.M{"$count": "count"}},
+			"contacts": bson.A{
+				bson.M{"$sort": bson.D{{Key: "user.nickname", Value: 1}, {Key: "_id", Value: 1}}},
+				bson.M{"$skip": data.Skip},
+				bson.M{"$limit": data.Limit},
+				bson.M{"$project": bson.M{
+					"_id":         1,
+					"nickname":    "$user.nickname",
+					"sharedRooms": 1,
+				}},
+			},
+		}}},
+	}
+
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetContacts].Message, log.ErrAttr(err))
+		return nil, 0, errors.New(constants.ErrorMessages[constants.FailedToGetContacts].Message)
+	}
+	defer cursor.Close(ctx)
+
+	var results []struct {
+		Total []struct {
+			Count int64 `bson:"count"`
+		} `bson:"total"`
+		Contacts []Contact `bson:"contacts"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetContacts].Message, log.ErrAttr(err))
+		return nil, 0, errors.New(constants.ErrorMessages[constants.FailedToGetContacts].Message)
+	}
+
+	contacts := []Contact{}
+	var total int64
+	if len(results) > 0 {
+		if results[0].Contacts != nil {
+			contacts = results[0].Contacts
+		}
+		if len(results[0].Total) > 0 {
+			total = results[0].Total[0].Count
+		}
+	}
+
+	return contacts, total, nil
+}
+
 func GetUserByEmail(ctx context.Context, db *mongo.Database, email string) (*User, error) {
 	collection := db.Collection(constants.UsersCollection)
 	filter := bson.M{"email": email}
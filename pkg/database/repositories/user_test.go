@@ -0,0 +1,36 @@
+package repositories
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestInactiveUsers(t *testing.T) {
+	cutoff := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	idle := cutoff.Add(-time.Minute)
+	active := cutoff.Add(time.Minute)
+
+	tests := []struct {
+		name string
+		user bson.M
+		want bool
+	}{
+		{"online and idle", bson.M{"_id": "alice", "activity": "online", "updatedAt": idle}, true},
+		{"online and active", bson.M{"_id": "alice", "activity": "online", "updatedAt": active}, false},
+		{"connected", bson.M{"_id": "bob", "activity": "online", "updatedAt": idle}, false},
+		{"offline", bson.M{"_id": "alice", "activity": "offline", "updatedAt": idle}, false},
+		{"idle before updatedAt was tracked", bson.M{"_id": "alice", "activity": "online", "updated_at": idle}, true},
+		{"active before updatedAt was tracked", bson.M{"_id": "alice", "activity": "online", "updated_at": active}, false},
+		{"never updated", bson.M{"_id": "alice", "activity": "online"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matches(t, inactiveUsers([]string{"bob"}, cutoff), tt.user); got != tt.want {
+				t.Errorf("inactiveUsers() matches %v = %v, want %v", tt.user, got, tt.want)
+			}
+		})
+	}
+}
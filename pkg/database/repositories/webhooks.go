@@ -0,0 +1,132 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/pkg/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Webhook is an URL registered by a client to receive events
+type Webhook struct {
+	ID        string    `json:"id" bson:"_id"`
+	ClientID  string    `json:"client_id" bson:"clientId"`
+	URL       string    `json:"url" bson:"url"`
+	Events    []string  `json:"events" bson:"events"`
+	Rooms     []string  `json:"rooms,omitempty" bson:"rooms,omitempty"` // Only these rooms of the client, every one when empty
+	CreatedAt time.Time `json:"created_at" bson:"createdAt"`
+}
+
+// WebhookDeadLetter is a delivery that failed permanently
+type WebhookDeadLetter struct {
+	WebhookID string    `bson:"webhookId"`
+	ClientID  string    `bson:"clientId"`
+	URL       string    `bson:"url"`
+	Event     string    `bson:"event"`
+	Payload   string    `bson:"payload"`
+	Attempts  int       `bson:"attempts"`
+	LastError string    `bson:"lastError"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+type CreateWebhookData struct {
+	ClientID string
+	URL      string
+	Events   []string
+	Rooms    []string
+}
+
+func CreateWebhook(ctx context.Context, db *mongo.Database, data CreateWebhookData) (*Webhook, error) {
+	webhook := Webhook{
+		ID:        primitive.NewObjectID().Hex(),
+		ClientID:  data.ClientID,
+		URL:       data.URL,
+		Events:    data.Events,
+		Rooms:     data.Rooms,
+		CreatedAt: time.Now(),
+	}
+
+	collection := db.Collection(constants.WebhooksCollection)
+	_, err := collection.InsertOne(ctx, webhook)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToCreateWebhook].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToCreateWebhook].Message)
+	}
+
+	return &webhook, nil
+}
+
+func GetClientWebhooks(ctx context.Context, db *mongo.Database, clientID string) ([]Webhook, error) {
+	return findWebhooks(ctx, db, bson.M{"clientId": clientID})
+}
+
+// GetWebhooksForEvent returns the client's webhooks subscribed to the event of the room
+func GetWebhooksForEvent(ctx context.Context, db *mongo.Database, event string, clientID string, roomID string) ([]Webhook, error) {
+	return findWebhooks(ctx, db, webhooksForEvent(event, clientID, roomID))
+}
+
+// webhooksForEvent matches the client's webhooks subscribed to the event, for every room
+// of the client or this one
+func webhooksForEvent(event string, clientID string, roomID string) bson.M {
+	return bson.M{
+		"events":   event,
+		"clientId": clientID,
+		"$or": bson.A{
+			bson.M{"rooms": bson.M{"$exists": false}},
+			bson.M{"rooms": roomID},
+		},
+	}
+}
+
+func findWebhooks(ctx context.Context, db *mongo.Database, filter bson.M) ([]Webhook, error) {
+	collection := db.Collection(constants.WebhooksCollection)
+
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetWebhooks].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetWebhooks].Message)
+	}
+
+	webhooks := []Webhook{}
+	if err := cursor.All(ctx, &webhooks); err != nil {
+		log.Error(ctx, constants.ErrorMessages[constants.FailedToGetWebhooks].Message, log.ErrAttr(err))
+		return nil, errors.New(constants.ErrorMessages[constants.FailedToGetWebhooks].Message)
+	}
+
+	return webhooks, nil
+}
+
+// DeleteWebhook deletes a webhook, as long as it belongs to the client
+func DeleteWebhook(ctx context.Context, db *mongo.Database, clientID string, webhookID string) error {
+	collection := db.Collection(constants.WebhooksCollection)
+
+	result, err := collection.DeleteOne(ctx, bson.M{"_id": webhookID, "clientId": clientID})
+	if err != nil {
+		log.Error(ctx, "Failed to delete webhook", log.ErrAttr(err))
+		return err
+	}
+
+	if result.DeletedCount == 0 {
+		return ErrWebhookNotFound
+	}
+
+	return nil
+}
+
+func CreateWebhookDeadLetter(ctx context.Context, db *mongo.Database, deadLetter WebhookDeadLetter) error {
+	deadLetter.CreatedAt = time.Now()
+
+	collection := db.Collection(constants.WebhookDeadLettersCollection)
+	_, err := collection.InsertOne(ctx, deadLetter)
+	if err != nil {
+		log.Error(ctx, "Failed to store webhook dead letter", log.ErrAttr(err))
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,24 @@
+package repositories
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestWebhooksForEventIsScopedToTheClient(t *testing.T) {
+	got := webhooksForEvent("message.created", "client-a", "lobby")
+
+	want := bson.M{
+		"events":   "message.created",
+		"clientId": "client-a",
+		"$or": bson.A{
+			bson.M{"rooms": bson.M{"$exists": false}},
+			bson.M{"rooms": "lobby"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("webhooksForEvent() = %v, want %v", got, want)
+	}
+}
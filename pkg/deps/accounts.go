@@ -0,0 +1,49 @@
+package deps
+
+import (
+	"context"
+	"time"
+
+	"github.com/vit0rr/chat/pkg/database/repositories"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Accounts is what the middlewares authenticate the requests against: the sessions of the
+// tokens, the disabled accounts and the API keys of the clients. MongoDB backs it, the tests
+// authenticate against an in-memory one.
+type Accounts interface {
+	// GetSession returns the session unless it was revoked or expired, or
+	// repositories.ErrSessionNotFound, and whether the account of its user is disabled
+	GetSession(ctx context.Context, sessionID string) (*repositories.Session, bool, error)
+	// TouchSession records that the session was used at the time
+	TouchSession(ctx context.Context, sessionID string, at time.Time) error
+	// IsUserDisabled reports whether the account is disabled. Unknown users aren't disabled.
+	IsUserDisabled(ctx context.Context, userID string) (bool, error)
+	// GetClientByAPIKey returns the client owning the API key, or nil if there is none
+	GetClientByAPIKey(ctx context.Context, apiKey string) (*repositories.Client, error)
+}
+
+// mongoAccounts is the Accounts of the repositories
+type mongoAccounts struct {
+	db *mongo.Database
+}
+
+func NewMongoAccounts(db *mongo.Database) Accounts {
+	return &mongoAccounts{db: db}
+}
+
+func (m *mongoAccounts) GetSession(ctx context.Context, sessionID string) (*repositories.Session, bool, error) {
+	return repositories.GetSession(ctx, m.db, sessionID)
+}
+
+func (m *mongoAccounts) TouchSession(ctx context.Context, sessionID string, at time.Time) error {
+	return repositories.TouchSession(ctx, m.db, sessionID, at)
+}
+
+func (m *mongoAccounts) IsUserDisabled(ctx context.Context, userID string) (bool, error) {
+	return repositories.IsUserDisabled(ctx, m.db, userID)
+}
+
+func (m *mongoAccounts) GetClientByAPIKey(ctx context.Context, apiKey string) (*repositories.Client, error) {
+	return repositories.GetClientByAPIKey(ctx, m.db, apiKey)
+}
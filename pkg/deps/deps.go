@@ -1,18 +1,29 @@
 package deps
 
 import (
+	"sync/atomic"
+
 	"github.com/vit0rr/chat/config"
+	"github.com/vit0rr/chat/pkg/broker"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type Deps struct {
 	Config config.Config
 	Mongo  *mongo.Database
+	Broker broker.Broker
+	// Accounts authenticates the requests, on MongoDB
+	Accounts Accounts
+
+	// ShuttingDown is set once the shutdown starts, so readiness fails while the connections drain
+	ShuttingDown atomic.Bool
 }
 
-func New(config config.Config, db *mongo.Database) *Deps {
+func New(config config.Config, db *mongo.Database, messageBroker broker.Broker) *Deps {
 	return &Deps{
-		Config: config,
-		Mongo:  db,
+		Config:   config,
+		Mongo:    db,
+		Broker:   messageBroker,
+		Accounts: NewMongoAccounts(db),
 	}
 }
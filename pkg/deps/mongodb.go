@@ -13,10 +13,28 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// NewMongoClient connects to MongoDB and pings it, so an unreachable database fails the
+// startup within the connect timeout instead of hanging
 func NewMongoClient(ctx context.Context, cfg config.Config) (*mongo.Client, error) {
-	mongoClient, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.API.Mongo.Dsn))
+	mongoCfg := cfg.API.Mongo
+	connectTimeout := time.Duration(mongoCfg.ConnectTimeout) * time.Second
+
+	mongoClient, err := mongo.Connect(ctx, options.Client().
+		ApplyURI(mongoCfg.Dsn).
+		SetConnectTimeout(connectTimeout).
+		SetServerSelectionTimeout(time.Duration(mongoCfg.ServerSelectionTimeout)*time.Second).
+		SetMaxPoolSize(uint64(mongoCfg.MaxPoolSize)).
+		SetMinPoolSize(uint64(mongoCfg.MinPoolSize)))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to create MongoDB client: %w", err)
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+
+	if err := mongoClient.Ping(pingCtx, nil); err != nil {
+		mongoClient.Disconnect(context.Background())
+		return nil, fmt.Errorf("failed to reach MongoDB within %s, check that it's running and the DSN is right: %w", connectTimeout, err)
 	}
 
 	return mongoClient, nil
@@ -44,12 +62,15 @@ func CreateKeyIndex(ctx context.Context, db *mongo.Database) error {
 	return nil
 }
 
+// MessagesTTL is how long messages are kept before MongoDB expires them
+const MessagesTTL = 90 * 24 * time.Hour
+
 func CreateMessagesTTLIndex(ctx context.Context, db *mongo.Database) error {
 	collection := db.Collection(constants.MessagesCollection)
 
 	messagesTTLIndex := mongo.IndexModel{
 		Keys:    bson.D{{Key: "createdAt", Value: 1}},
-		Options: options.Index().SetExpireAfterSeconds(90 * 24 * 60 * 60), // 90 days
+		Options: options.Index().SetExpireAfterSeconds(int32(MessagesTTL.Seconds())), // 90 days
 	}
 
 	_, err := collection.Indexes().CreateOne(ctx, messagesTTLIndex)
@@ -62,6 +83,132 @@ func CreateMessagesTTLIndex(ctx context.Context, db *mongo.Database) error {
 	return nil
 }
 
+// CreateMessagesQueryIndexes backs the room history pagination, which filters by room and
+// sorts by newest first then by ID, and the queries over a user's messages sorted by date. Without
+// them MongoDB sorts in memory, and aborts once the sort goes past 32MB.
+func CreateMessagesQueryIndexes(ctx context.Context, db *mongo.Database) error {
+	collection := db.Collection(constants.MessagesCollection)
+
+	queryIndexes := []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{Key: "roomId", Value: 1},
+				{Key: "createdAt", Value: -1},
+				{Key: "_id", Value: -1},
+			},
+		},
+		{
+			Keys: bson.D{
+				{Key: "fromUserId", Value: 1},
+				{Key: "createdAt", Value: 1},
+			},
+		},
+	}
+
+	_, err := collection.Indexes().CreateMany(ctx, queryIndexes)
+	if err != nil {
+		return fmt.Errorf("failed to create messages query indexes: %v", err)
+	}
+
+	log.Info(ctx, "✅ Created/Verified indexes for 'roomId, createdAt, _id' and 'fromUserId, createdAt' fields in 'messages' collection")
+
+	return nil
+}
+
+// CreateMessagesImportIndex makes the import ID unique per room, so importing the same
+// messages twice doesn't duplicate them
+func CreateMessagesImportIndex(ctx context.Context, db *mongo.Database) error {
+	collection := db.Collection(constants.MessagesCollection)
+
+	importIndex := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "roomId", Value: 1},
+			{Key: "importId", Value: 1},
+		},
+		Options: options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"importId": bson.M{"$exists": true}}),
+	}
+
+	_, err := collection.Indexes().CreateOne(ctx, importIndex)
+	if err != nil {
+		return fmt.Errorf("failed to create messages import index: %v", err)
+	}
+
+	log.Info(ctx, "✅ Created/Verified unique index for 'roomId' and 'importId' fields in 'messages' collection")
+
+	return nil
+}
+
+// CreateAuditLogIndex speeds up reading a user's audit trail, newest first
+func CreateAuditLogIndex(ctx context.Context, db *mongo.Database) error {
+	collection := db.Collection(constants.AuditLogCollection)
+
+	auditLogIndex := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "userId", Value: 1},
+			{Key: "createdAt", Value: -1},
+		},
+	}
+
+	_, err := collection.Indexes().CreateOne(ctx, auditLogIndex)
+	if err != nil {
+		return fmt.Errorf("failed to create audit log index: %v", err)
+	}
+
+	log.Info(ctx, "✅ Created/Verified index for 'userId' and 'createdAt' fields in 'audit_log' collection")
+
+	return nil
+}
+
+// CreateSessionsIndexes lets MongoDB remove the sessions once they expire, and speeds up
+// listing the sessions of a user
+func CreateSessionsIndexes(ctx context.Context, db *mongo.Database) error {
+	collection := db.Collection(constants.SessionsCollection)
+
+	sessionsIndexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+		{
+			Keys: bson.D{{Key: "userId", Value: 1}},
+		},
+	}
+
+	_, err := collection.Indexes().CreateMany(ctx, sessionsIndexes)
+	if err != nil {
+		return fmt.Errorf("failed to create sessions indexes: %v", err)
+	}
+
+	log.Info(ctx, "✅ Created/Verified TTL index for 'expiresAt' and index for 'userId' fields in 'sessions' collection")
+
+	return nil
+}
+
+// CreateReportsIndex lets a user report a message only once
+func CreateReportsIndex(ctx context.Context, db *mongo.Database) error {
+	collection := db.Collection(constants.ReportsCollection)
+
+	reportsIndex := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "roomId", Value: 1},
+			{Key: "messageId", Value: 1},
+			{Key: "reporterId", Value: 1},
+		},
+		Options: options.Index().SetUnique(true),
+	}
+
+	_, err := collection.Indexes().CreateOne(ctx, reportsIndex)
+	if err != nil {
+		return fmt.Errorf("failed to create reports index: %v", err)
+	}
+
+	log.Info(ctx, "✅ Created/Verified unique index for 'roomId', 'messageId' and 'reporterId' fields in 'reports' collection")
+
+	return nil
+}
+
 func UpdateAllOnlineUsersToOffline(ctx context.Context, db *mongo.Database) error {
 	collection := db.Collection(constants.UsersCollection)
 	_, err := collection.UpdateMany(
@@ -0,0 +1,121 @@
+package deps
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/pkg/database/repositories"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testDatabase connects to the MongoDB of MONGO_TEST_DSN and returns a database dropped
+// after the test, skipping the test when the variable isn't set
+func testDatabase(t *testing.T) *mongo.Database {
+	t.Helper()
+
+	dsn := os.Getenv("MONGO_TEST_DSN")
+	if dsn == "" {
+		t.Skip("MONGO_TEST_DSN isn't set")
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(dsn))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+
+	db := client.Database(fmt.Sprintf("chat_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		db.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+
+	return db
+}
+
+// planStages returns the stages of the query plan, the nested input stages included
+func planStages(plan bson.M) []bson.M {
+	stages := []bson.M{plan}
+	if input, ok := plan["inputStage"].(bson.M); ok {
+		stages = append(stages, planStages(input)...)
+	}
+	if inputs, ok := plan["inputStages"].(bson.A); ok {
+		for _, input := range inputs {
+			if input, ok := input.(bson.M); ok {
+				stages = append(stages, planStages(input)...)
+			}
+		}
+	}
+
+	return stages
+}
+
+func TestGetMessagesUsesTheRoomIndex(t *testing.T) {
+	db := testDatabase(t)
+	if err := CreateMessagesQueryIndexes(t.Context(), db); err != nil {
+		t.Fatalf("create indexes: %v", err)
+	}
+
+	before := time.Now()
+	queries := map[string]repositories.GetMessagesData{
+		"first page": {RoomID: "lobby", Limit: 50},
+		"page":       {RoomID: "lobby", Limit: 50, Skip: 50},
+		"cursor":     {RoomID: "lobby", Limit: 50, Before: &before},
+	}
+
+	for name, data := range queries {
+		t.Run(name, func(t *testing.T) {
+			filter, opts := repositories.GetMessagesQuery(data)
+			find := bson.D{
+				{Key: "find", Value: constants.MessagesCollection},
+				{Key: "filter", Value: filter},
+				{Key: "sort", Value: opts.Sort},
+				{Key: "limit", Value: *opts.Limit},
+				{Key: "skip", Value: *opts.Skip},
+			}
+
+			var explain struct {
+				QueryPlanner struct {
+					WinningPlan bson.M `bson:"winningPlan"`
+				} `bson:"queryPlanner"`
+			}
+			err := db.RunCommand(t.Context(), bson.D{
+				{Key: "explain", Value: find},
+				{Key: "verbosity", Value: "queryPlanner"},
+			}).Decode(&explain)
+			if err != nil {
+				t.Fatalf("explain: %v", err)
+			}
+
+			// The slot based engine nests the classic plan under queryPlan
+			plan := explain.QueryPlanner.WinningPlan
+			if queryPlan, ok := plan["queryPlan"].(bson.M); ok {
+				plan = queryPlan
+			}
+
+			indexScan := false
+			for _, stage := range planStages(plan) {
+				switch stage["stage"] {
+				case "SORT":
+					t.Errorf("the plan sorts in memory: %v", plan)
+				case "IXSCAN":
+					indexScan = indexScan || stage["indexName"] == "roomId_1_createdAt_-1__id_-1"
+				}
+			}
+			if !indexScan {
+				t.Errorf("the plan doesn't scan the room index: %v", plan)
+			}
+		})
+	}
+}
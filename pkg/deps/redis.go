@@ -2,90 +2,311 @@ package deps
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 	"github.com/vit0rr/chat/api/constants"
 	"github.com/vit0rr/chat/config"
+	"github.com/vit0rr/chat/pkg/broker"
+	"github.com/vit0rr/chat/pkg/database/repositories"
 	"github.com/vit0rr/chat/pkg/log"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+// redisConnectBackoff is the wait before the second startup ping, doubled after each failed attempt
+const redisConnectBackoff = 500 * time.Millisecond
+
+// NewRedisClient connects to Redis, retrying the ping with a backoff so a Redis that's still
+// starting doesn't fail the startup
 func NewRedisClient(ctx context.Context, cfg config.Config) (*redis.Client, error) {
-	opt, _ := redis.ParseURL(cfg.API.Redis.Dsn)
+	redisCfg := cfg.API.Redis
+
+	opt, err := redis.ParseURL(redisCfg.Dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis DSN: %w", err)
+	}
+
+	if redisCfg.PoolSize > 0 {
+		opt.PoolSize = redisCfg.PoolSize
+	}
+	if redisCfg.DialTimeout > 0 {
+		opt.DialTimeout = time.Duration(redisCfg.DialTimeout) * time.Second
+	}
+	if redisCfg.ReadTimeout > 0 {
+		opt.ReadTimeout = time.Duration(redisCfg.ReadTimeout) * time.Second
+	}
+	if redisCfg.WriteTimeout > 0 {
+		opt.WriteTimeout = time.Duration(redisCfg.WriteTimeout) * time.Second
+	}
+	if redisCfg.MaxRetries != 0 {
+		opt.MaxRetries = redisCfg.MaxRetries
+	}
+
 	redisClient := redis.NewClient(opt)
 
-	if err := redisClient.Ping(ctx).Err(); err != nil {
-		return nil, err
+	attempts := max(redisCfg.ConnectAttempts, 1)
+	backoff := redisConnectBackoff
+	for attempt := 1; ; attempt++ {
+		err = redisClient.Ping(ctx).Err()
+		if err == nil {
+			return redisClient, nil
+		}
+
+		if attempt == attempts {
+			break
+		}
+
+		log.Warn(ctx, "Redis isn't reachable yet, retrying",
+			log.AnyAttr("attempt", attempt),
+			log.AnyAttr("retry_in", backoff.String()),
+			log.ErrAttr(err))
+
+		select {
+		case <-ctx.Done():
+			redisClient.Close()
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
 	}
 
-	return redisClient, nil
+	redisClient.Close()
+	return nil, fmt.Errorf("failed to reach Redis after %d attempts: %w", attempts, err)
 }
 
-func CleanupStaleRooms(ctx context.Context, redisClient *redis.Client) {
-	pattern := "room:*:clients"
-	iter := redisClient.Scan(ctx, 0, pattern, 0).Iterator()
-	for iter.Next(ctx) {
-		roomKey := iter.Val()
-		if members, _ := redisClient.SCard(ctx, roomKey).Result(); members == 0 {
-			if err := redisClient.Del(ctx, roomKey).Err(); err != nil {
-				log.Error(ctx, "Failed to delete empty room", log.ErrAttr(err))
-			}
-		}
+// CleanupStaleRooms removes the users left connected to rooms, or online, by connections
+// that expired without being released, such as those of a crashed instance
+func CleanupStaleRooms(ctx context.Context, messageBroker broker.Broker) {
+	pruned, err := messageBroker.PrunePresence(ctx)
+	if err != nil {
+		log.Error(ctx, "Failed to prune stale presence", log.ErrAttr(err))
+		return
+	}
+
+	if pruned > 0 {
+		log.Info(ctx, "Removed stale room members", log.AnyAttr("count", pruned))
 	}
 }
 
-func RecoverUserStatuses(ctx context.Context, db *mongo.Database, redisClient *redis.Client) error {
+// RecoverUserStatuses sets the users' activity from the presence shared by the instances,
+// once the connections left by a crashed instance are pruned from it
+func RecoverUserStatuses(ctx context.Context, db *mongo.Database, messageBroker broker.Broker) error {
 	// First, set all users to offline
 	if err := UpdateAllOnlineUsersToOffline(ctx, db); err != nil {
 		return err
 	}
 
-	// Then check Redis for actually connected users and update them
-	pattern := "room:*:online"
-	iter := redisClient.Scan(ctx, 0, pattern, 0).Iterator()
+	if _, err := messageBroker.PrunePresence(ctx); err != nil {
+		return err
+	}
 
-	for iter.Next(ctx) {
-		roomKey := iter.Val()
-		members, err := redisClient.SMembers(ctx, roomKey).Result()
-		if err != nil {
-			continue
-		}
+	// Then set the users still connected to another instance back online
+	onlineUsers, err := messageBroker.OnlineUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(onlineUsers) == 0 {
+		return nil
+	}
+
+	collection := db.Collection(constants.UsersCollection)
+	_, err = collection.UpdateMany(
+		ctx,
+		bson.M{"_id": bson.M{"$in": onlineUsers}},
+		bson.M{"$set": bson.M{
+			"activity":  "online",
+			"updatedAt": time.Now(),
+		}},
+	)
+
+	return err
+}
+
+// MarkInactiveUsersOffline sets users to offline when they have no live connection
+// and their activity hasn't changed for longer than the inactivity window.
+// It catches users whose disconnect events were missed.
+func MarkInactiveUsersOffline(ctx context.Context, db *mongo.Database, messageBroker broker.Broker, inactivity time.Duration) (int64, error) {
+	connectedUsers, err := messageBroker.OnlineUsers(ctx)
+	if err != nil {
+		return 0, err
+	}
 
-		// Update these users to online since they have active Redis connections
-		if len(members) > 0 {
-			collection := db.Collection(constants.UsersCollection)
-			_, err = collection.UpdateMany(
-				ctx,
-				bson.M{"id": bson.M{"$in": members}},
-				bson.M{"$set": bson.M{
-					"activity":  "online",
-					"updatedAt": time.Now(),
-				}},
-			)
-			if err != nil {
-				log.Error(ctx, "Failed to update recovered users", log.ErrAttr(err))
+	return repositories.MarkInactiveUsersOffline(ctx, db, connectedUsers, time.Now().Add(-inactivity))
+}
+
+const maintenanceModeKey = "maintenance:enabled"
+
+// SetMaintenanceMode stores the maintenance flag in the broker, so every instance honors it
+func SetMaintenanceMode(ctx context.Context, messageBroker broker.Broker, enabled bool) error {
+	if !enabled {
+		_, err := messageBroker.Delete(ctx, maintenanceModeKey)
+		return err
+	}
+
+	return messageBroker.Set(ctx, maintenanceModeKey, "1", 0)
+}
+
+// IsMaintenanceMode reports whether writes are currently rejected
+func IsMaintenanceMode(ctx context.Context, messageBroker broker.Broker) (bool, error) {
+	_, err := messageBroker.Get(ctx, maintenanceModeKey)
+	if errors.Is(err, broker.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// sessionRevocationsChannel tells every instance about the revoked sessions, so they close the
+// WebSocket connections opened with their tokens. Room IDs can't have a colon, so it's never
+// a room's channel.
+const sessionRevocationsChannel = "sessions:revoked"
+
+// SessionRevocation is a revocation of the user's sessions: the session when SessionID is set,
+// every session but ExceptSessionID with AllSessions, or else every connection of the user, as
+// when the account is disabled or deleted
+type SessionRevocation struct {
+	UserID          string `json:"user_id"`
+	SessionID       string `json:"session_id,omitempty"`
+	AllSessions     bool   `json:"all_sessions,omitempty"`
+	ExceptSessionID string `json:"except_session_id,omitempty"`
+}
+
+// Revokes tells whether the revocation ends a connection of the user opened with a token of
+// the session, empty for the tokens without one
+func (r SessionRevocation) Revokes(userID string, sessionID string) bool {
+	switch {
+	case userID != r.UserID:
+		return false
+	case r.SessionID != "":
+		return sessionID == r.SessionID
+	case r.AllSessions:
+		return sessionID != "" && sessionID != r.ExceptSessionID
+	default:
+		return true
+	}
+}
+
+// PublishSessionRevocation tells every instance about the revocation
+func PublishSessionRevocation(ctx context.Context, messageBroker broker.Broker, revocation SessionRevocation) error {
+	payload, err := json.Marshal(revocation)
+	if err != nil {
+		return err
+	}
+
+	_, err = messageBroker.Publish(ctx, sessionRevocationsChannel, payload)
+	return err
+}
+
+// SubscribeSessionRevocations calls revoked with every revocation published until ctx is done
+func SubscribeSessionRevocations(ctx context.Context, messageBroker broker.Broker, revoked func(SessionRevocation)) {
+	subscription := messageBroker.Subscribe(ctx, sessionRevocationsChannel)
+	defer subscription.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case payload, ok := <-subscription.Messages():
+			if !ok {
+				return
+			}
+
+			var revocation SessionRevocation
+			if err := json.Unmarshal(payload, &revocation); err != nil {
+				log.Error(ctx, "Failed to decode session revocation", log.ErrAttr(err))
+				continue
 			}
+
+			revoked(revocation)
 		}
 	}
+}
+
+func muteKey(roomID string, userID string) string {
+	return fmt.Sprintf("room:%s:mute:%s", roomID, userID)
+}
+
+// MuteUser stops the user from sending messages to the room for the duration
+func MuteUser(ctx context.Context, messageBroker broker.Broker, roomID string, userID string, duration time.Duration) error {
+	return messageBroker.Set(ctx, muteKey(roomID, userID), "1", duration)
+}
+
+// UnmuteUser lifts the user's mute in the room, it reports whether they were muted
+func UnmuteUser(ctx context.Context, messageBroker broker.Broker, roomID string, userID string) (bool, error) {
+	return messageBroker.Delete(ctx, muteKey(roomID, userID))
+}
+
+// MuteRemaining returns how long the user stays muted in the room, zero when they aren't muted
+func MuteRemaining(ctx context.Context, messageBroker broker.Broker, roomID string, userID string) (time.Duration, error) {
+	return messageBroker.TTL(ctx, muteKey(roomID, userID))
+}
+
+func slowModeKey(roomID string, userID string) string {
+	return fmt.Sprintf("slowmode:%s:%s", roomID, userID)
+}
+
+// SlowModeRemaining returns how long until the user can send another message to the room under
+// its slow mode cooldown, zero when they can now. Messages are allowed when the broker fails.
+// It doesn't record anything, RecordSlowMode does once the message is sent.
+func SlowModeRemaining(ctx context.Context, messageBroker broker.Broker, roomID string, userID string) time.Duration {
+	remaining, err := messageBroker.TTL(ctx, slowModeKey(roomID, userID))
+	if err != nil {
+		log.Error(ctx, "Failed to check slow mode", log.ErrAttr(err))
+		return 0
+	}
+
+	return remaining
+}
 
-	return nil
+// RecordSlowMode starts the user's slow mode cooldown in the room, after a message was sent
+func RecordSlowMode(ctx context.Context, messageBroker broker.Broker, roomID string, userID string, cooldown time.Duration) {
+	if err := messageBroker.Set(ctx, slowModeKey(roomID, userID), "1", cooldown); err != nil {
+		log.Error(ctx, "Failed to record slow mode", log.ErrAttr(err))
+	}
+}
+
+// CheckAndRecordRoomCreation tells whether the client can create another room under its limit
+// over the sliding window, recording the creation when it can. Otherwise, it returns how long
+// until it can. Creations are allowed when the broker fails.
+func CheckAndRecordRoomCreation(ctx context.Context, messageBroker broker.Broker, clientID string, roomID string, limit int, window time.Duration) (bool, time.Duration) {
+	key := fmt.Sprintf("rate_limit:%s:rooms", clientID)
+
+	retryAfter, err := messageBroker.RecordInWindow(ctx, key, roomID, limit, window)
+	if err != nil {
+		log.Error(ctx, "Failed to check room creation limit", log.ErrAttr(err))
+		return true, 0
+	}
+
+	if retryAfter > 0 {
+		return false, retryAfter
+	}
+
+	return true, 0
 }
 
-func CheckAndUpdateMessageRateLimit(ctx context.Context, redisClient *redis.Client, userID string, delay time.Duration) (bool, float64) {
+// CheckAndUpdateMessageRateLimit tells whether the user can send a message, or how many seconds
+// they must wait. The last message time is kept for ttl, which is raised to the delay if shorter.
+func CheckAndUpdateMessageRateLimit(ctx context.Context, messageBroker broker.Broker, userID string, delay time.Duration, ttl time.Duration) (bool, float64) {
 	lastMsgKey := fmt.Sprintf("rate_limit:%s:last_msg", userID)
+	ttl = max(ttl, delay)
 	
-	lastMsgStr, err := redisClient.Get(ctx, lastMsgKey).Result()
-	if err != nil && err != redis.Nil {
+	lastMsgStr, err := messageBroker.Get(ctx, lastMsgKey)
+	if err != nil && err != broker.ErrNotFound {
 		log.Error(ctx, "Failed to check rate limit", log.ErrAttr(err))
 		return true, 0
 	}
 	
-	if err == redis.Nil {
+	if err == broker.ErrNotFound {
 		now := time.Now()
-		redisClient.Set(ctx, lastMsgKey, now.Format(time.RFC3339Nano), delay*2)
+		messageBroker.Set(ctx, lastMsgKey, now.Format(time.RFC3339Nano), ttl)
 		return true, 0
 	}
 	
@@ -103,6 +324,6 @@ func CheckAndUpdateMessageRateLimit(ctx context.Context, redisClient *redis.Clie
 	}
 	
 
-	redisClient.Set(ctx, lastMsgKey, now.Format(time.RFC3339Nano), delay*2)
+	messageBroker.Set(ctx, lastMsgKey, now.Format(time.RFC3339Nano), ttl)
 	return true, 0
 }
@@ -0,0 +1,56 @@
+package deps
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vit0rr/chat/config"
+)
+
+func TestSessionRevocationRevokes(t *testing.T) {
+	tests := []struct {
+		name       string
+		revocation SessionRevocation
+		userID     string
+		sessionID  string
+		want       bool
+	}{
+		{"the session", SessionRevocation{UserID: "alice", SessionID: "s1"}, "alice", "s1", true},
+		{"another session", SessionRevocation{UserID: "alice", SessionID: "s1"}, "alice", "s2", false},
+		{"token without session", SessionRevocation{UserID: "alice", SessionID: "s1"}, "alice", "", false},
+		{"another user's session", SessionRevocation{UserID: "alice", SessionID: "s1"}, "bob", "s1", false},
+		{"other sessions", SessionRevocation{UserID: "alice", AllSessions: true, ExceptSessionID: "s1"}, "alice", "s2", true},
+		{"kept session", SessionRevocation{UserID: "alice", AllSessions: true, ExceptSessionID: "s1"}, "alice", "s1", false},
+		{"every session", SessionRevocation{UserID: "alice", AllSessions: true}, "alice", "s1", true},
+		{"every session spares tokens without one", SessionRevocation{UserID: "alice", AllSessions: true}, "alice", "", false},
+		{"every connection", SessionRevocation{UserID: "alice"}, "alice", "", true},
+		{"every connection of another user", SessionRevocation{UserID: "alice"}, "bob", "s1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.revocation.Revokes(tt.userID, tt.sessionID); got != tt.want {
+				t.Errorf("Revokes(%q, %q) = %v, want %v", tt.userID, tt.sessionID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRedisClientRejectsMalformedDSNs(t *testing.T) {
+	for _, dsn := range []string{"", "localhost:6379", "http://localhost:6379", "redis://localhost:6379/db"} {
+		t.Run(dsn, func(t *testing.T) {
+			cfg := config.Config{}
+			cfg.API.Redis = config.Redis{Dsn: dsn, ConnectAttempts: 1}
+
+			// Failing the parse, not a ping to localhost
+			client, err := NewRedisClient(t.Context(), cfg)
+			if err == nil {
+				client.Close()
+				t.Fatal("NewRedisClient accepted the DSN")
+			}
+			if !strings.HasPrefix(err.Error(), "invalid Redis DSN") {
+				t.Errorf("error = %v, want the invalid DSN", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vit0rr/chat/config"
+	"github.com/vit0rr/chat/pkg/database/repositories"
+	"github.com/vit0rr/chat/pkg/deps"
+)
+
+// clientAccounts authenticates the API keys of its clients, without any session nor account
+type clientAccounts map[string]repositories.Client
+
+func (c clientAccounts) GetSession(ctx context.Context, sessionID string) (*repositories.Session, bool, error) {
+	return nil, false, repositories.ErrSessionNotFound
+}
+
+func (c clientAccounts) TouchSession(ctx context.Context, sessionID string, at time.Time) error {
+	return nil
+}
+
+func (c clientAccounts) IsUserDisabled(ctx context.Context, userID string) (bool, error) {
+	return false, nil
+}
+
+func (c clientAccounts) GetClientByAPIKey(ctx context.Context, apiKey string) (*repositories.Client, error) {
+	client, ok := c[apiKey]
+	if !ok {
+		return nil, nil
+	}
+
+	return &client, nil
+}
+
+func TestVerifyApiKeyReadOnlyClient(t *testing.T) {
+	dependencies := deps.New(config.Config{APIKey: "configured-key"}, nil, nil)
+	dependencies.Accounts = clientAccounts{
+		"read-only-key": {ID: "read-only", ReadOnly: true, Scopes: Scopes},
+	}
+
+	protected := VerifyApiKey(dependencies, ScopeMessagesWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	readProtected := VerifyApiKey(dependencies, ScopeMessagesRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		method     string
+		handler    http.Handler
+		wantStatus int
+	}{
+		{http.MethodPost, protected, http.StatusForbidden},
+		{http.MethodPatch, protected, http.StatusForbidden},
+		{http.MethodDelete, protected, http.StatusForbidden},
+		{http.MethodGet, readProtected, http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/v1/rooms/lobby/messages", nil)
+			req.Header.Set("X-API-Key", "read-only-key")
+			rec := httptest.NewRecorder()
+
+			tt.handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+		})
+	}
+}
+
+func TestVerifyApiKeyConfiguredKey(t *testing.T) {
+	dependencies := deps.New(config.Config{APIKey: "configured-key"}, nil, nil)
+	dependencies.Accounts = clientAccounts{}
+
+	handler := VerifyApiKey(dependencies, ScopeRoomsWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name       string
+		apiKey     string
+		wantStatus int
+	}{
+		{"configured key", "configured-key", http.StatusNoContent},
+		{"prefix of the configured key", "configured", http.StatusUnauthorized},
+		{"configured key with a suffix", "configured-key-2", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/rooms", nil)
+			req.Header.Set("X-API-Key", tt.apiKey)
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestVerifyApiKeyScopes(t *testing.T) {
+	dependencies := deps.New(config.Config{APIKey: "configured-key"}, nil, nil)
+	dependencies.Accounts = clientAccounts{
+		"rooms-key": {ID: "rooms", Scopes: []string{ScopeRoomsRead, ScopeRoomsWrite}},
+	}
+
+	tests := []struct {
+		name       string
+		scope      string
+		wantStatus int
+	}{
+		{"granted scope", ScopeRoomsWrite, http.StatusNoContent},
+		{"missing scope", ScopeMessagesWrite, http.StatusForbidden},
+		{"missing webhooks scope", ScopeWebhooks, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := VerifyApiKey(dependencies, tt.scope)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if RequestClientID(r.Context()) != "rooms" {
+					t.Errorf("client ID = %q, want %q", RequestClientID(r.Context()), "rooms")
+				}
+				w.WriteHeader(http.StatusNoContent)
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/rooms", nil)
+			req.Header.Set("X-API-Key", "rooms-key")
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/cors"
+	"github.com/vit0rr/chat/config"
+)
+
+// CORS applies the configured cross-origin policy. The config must have been validated.
+func CORS(cfg config.CORS) func(http.Handler) http.Handler {
+	return cors.Handler(cors.Options{
+		AllowOriginFunc: func(r *http.Request, origin string) bool {
+			return AllowedOrigin(cfg.AllowedOrigins, origin)
+		},
+		AllowedMethods:   cfg.AllowedMethods,
+		AllowedHeaders:   cfg.AllowedHeaders,
+		ExposedHeaders:   []string{"Link"},
+		AllowCredentials: cfg.Credentials(),
+		MaxAge:           cfg.MaxAge,
+	})
+}
+
+// AllowedOrigin tells whether the origin matches one of the allowed ones. An allowed
+// origin can be "*", a full origin, or a subdomain wildcard with or without the scheme,
+// "*.example.com" matching "https://app.example.com" but not "https://example.com".
+func AllowedOrigin(allowed []string, origin string) bool {
+	origin = strings.ToLower(origin)
+
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+
+		wildcard := strings.Index(pattern, "*.")
+		if wildcard == -1 {
+			continue
+		}
+
+		scheme, suffix := pattern[:wildcard], pattern[wildcard+1:]
+		host := origin
+		if scheme != "" {
+			if !strings.HasPrefix(origin, scheme) {
+				continue
+			}
+			host = strings.TrimPrefix(origin, scheme)
+		} else if _, h, found := strings.Cut(origin, "://"); found {
+			host = h
+		}
+
+		if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -2,11 +2,19 @@ package middleware
 
 import (
 	"context"
+	"crypto/subtle"
 	"errors"
+	"fmt"
 	"net/http"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/api/handler"
+	"github.com/vit0rr/chat/pkg/database/repositories"
 	"github.com/vit0rr/chat/pkg/deps"
 	"github.com/vit0rr/chat/pkg/log"
 )
@@ -15,10 +23,43 @@ type contextKey string
 
 const UserContextKey contextKey = "user"
 
+// ClientContextKey holds the *repositories.Client authenticated by its API key.
+// It's absent when the request used the configured API key.
+const ClientContextKey contextKey = "client"
+
 type UserClaims struct {
 	UserID   string
 	Email    string
 	Nickname string
+	// Rooms restricts the token to these room IDs, when the token has a "rooms" claim
+	Rooms []string
+	// Guest tokens are minted for a single room, without an account
+	Guest bool
+	// SessionID is the session the token was issued for, from the "sid" claim. Tokens
+	// without one (guests, impersonation, tokens issued before sessions) aren't revocable.
+	SessionID string
+}
+
+// SessionTouchInterval is how often the last use of a session is updated, rather than on
+// every request
+const SessionTouchInterval = time.Minute
+
+// CanAccessRoom tells whether the token is allowed to access the room. Tokens
+// without a "rooms" claim aren't restricted to any room.
+func (c UserClaims) CanAccessRoom(roomID string) bool {
+	return c.Rooms == nil || slices.Contains(c.Rooms, roomID)
+}
+
+// jwtParserOptions only accept the HMAC tokens we issue, which must expire and
+// can't be issued in the future
+var jwtParserOptions = []jwt.ParserOption{
+	jwt.WithValidMethods([]string{
+		jwt.SigningMethodHS256.Alg(),
+		jwt.SigningMethodHS384.Alg(),
+		jwt.SigningMethodHS512.Alg(),
+	}),
+	jwt.WithExpirationRequired(),
+	jwt.WithIssuedAt(),
 }
 
 func JWTAuth(deps *deps.Deps) func(http.Handler) http.Handler {
@@ -36,7 +77,7 @@ func JWTAuth(deps *deps.Deps) func(http.Handler) http.Handler {
 				tokenString := r.URL.Query().Get("token")
 				if tokenString == "" {
 					log.Error(r.Context(), "Authorization header required", log.ErrAttr(errors.New("authorization header required")))
-					http.Error(w, "Authorization header required", http.StatusUnauthorized)
+					handler.WriteError(w, constants.AuthorizationRequired, nil)
 					return
 				}
 
@@ -47,34 +88,58 @@ func JWTAuth(deps *deps.Deps) func(http.Handler) http.Handler {
 			tokenString := strings.Replace(authHeader, "Bearer ", "", 1)
 			if tokenString == "" {
 				log.Error(r.Context(), "Invalid token format", log.ErrAttr(errors.New("invalid token format")))
-				http.Error(w, "Invalid token format", http.StatusUnauthorized)
+				handler.WriteError(w, constants.InvalidToken, nil)
 				return
 			}
 
-			// Parse and validate the token with current secret
+			// Parse and validate the token with the current secret, or a previous one during a rotation
 			token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-				return []byte(deps.Config.JWT.Secret), nil
-			})
+				// Only HMAC tokens are issued, anything else ("none", RS256 signed with the secret as
+				// a public key...) is an algorithm confusion attempt
+				if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+					return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+				}
+				return verificationKeys(deps.Config.JWT.VerificationSecrets()), nil
+			}, jwtParserOptions...)
 
-			// If token is invalid with current secret, return unauthorized error
+			// If token is invalid with every secret, return unauthorized error
 			if err != nil || !token.Valid {
 				log.Error(r.Context(), "Invalid or expired token", log.ErrAttr(errors.New("invalid or expired token")))
-				http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+				handler.WriteError(w, constants.InvalidToken, nil)
 				return
 			}
 
 			// Extract claims
 			claims, ok := token.Claims.(jwt.MapClaims)
 			if !ok {
-				http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+				handler.WriteError(w, constants.InvalidTokenClaims, nil)
+				return
+			}
+
+			// The parser only checks iat when it's present
+			if issuedAt, err := claims.GetIssuedAt(); err != nil || issuedAt == nil {
+				handler.WriteError(w, constants.InvalidTokenClaims, nil)
 				return
 			}
 
 			// Create user context
-			userClaims := UserClaims{
-				UserID:   claims["sub"].(string),
-				Email:    claims["email"].(string),
-				Nickname: claims["nickname"].(string),
+			userClaims, err := extractUserClaims(claims)
+			if err != nil {
+				log.Error(r.Context(), "Invalid token claims", log.ErrAttr(err))
+				handler.WriteError(w, constants.InvalidTokenClaims, map[string]interface{}{"reason": err.Error()})
+				return
+			}
+
+			// Tokens of a revoked or expired session stop working, and so do the tokens issued
+			// before the account was disabled. The session lookup reads both at once.
+			verify := verifyAccount
+			if userClaims.SessionID != "" {
+				verify = verifySession
+			}
+
+			if errKey := verify(r.Context(), deps, userClaims); errKey != "" {
+				handler.WriteError(w, errKey, nil)
+				return
 			}
 
 			// Add user to context
@@ -84,12 +149,261 @@ func JWTAuth(deps *deps.Deps) func(http.Handler) http.Handler {
 	}
 }
 
-func VerifyApiKey(deps *deps.Deps) func(http.Handler) http.Handler {
+// verifyAccount checks that the account of a token without a session isn't disabled. It
+// returns the key in constants.ErrorMessages of the error to answer with, empty when valid.
+func verifyAccount(ctx context.Context, deps *deps.Deps, claims UserClaims) string {
+	disabled, err := deps.Accounts.IsUserDisabled(ctx, claims.UserID)
+	if err != nil {
+		return constants.FailedToVerifyAccount
+	}
+
+	if disabled {
+		return constants.AccountDisabled
+	}
+
+	return ""
+}
+
+// verifySession checks that the token's session is still active, and its account not
+// disabled, and records its use. It returns the key in constants.ErrorMessages of the error
+// to answer with, empty when valid.
+func verifySession(ctx context.Context, deps *deps.Deps, claims UserClaims) string {
+	session, disabled, err := deps.Accounts.GetSession(ctx, claims.SessionID)
+	if errors.Is(err, repositories.ErrSessionNotFound) || (err == nil && session.UserID != claims.UserID) {
+		log.Warn(ctx, "Rejected token of a revoked session",
+			log.AnyAttr("user_id", claims.UserID),
+			log.AnyAttr("session_id", claims.SessionID))
+		return constants.SessionRevoked
+	}
+
+	if err != nil {
+		return constants.FailedToVerifySession
+	}
+
+	if disabled {
+		return constants.AccountDisabled
+	}
+
+	// Failing to record the use doesn't invalidate the session
+	if now := time.Now(); now.Sub(session.LastUsedAt) >= SessionTouchInterval {
+		_ = deps.Accounts.TouchSession(ctx, session.ID, now)
+	}
+
+	return ""
+}
+
+// verificationKeys returns the secrets as a key set, the parser accepts a token signed with any of them
+func verificationKeys(secrets []string) jwt.VerificationKeySet {
+	keys := make([]jwt.VerificationKey, 0, len(secrets))
+	for _, secret := range secrets {
+		keys = append(keys, []byte(secret))
+	}
+
+	return jwt.VerificationKeySet{Keys: keys}
+}
+
+// extractUserClaims reads the user from the token claims, which must all be non-empty
+// strings. Hand-crafted tokens can omit them or use other types.
+func extractUserClaims(claims jwt.MapClaims) (UserClaims, error) {
+	userID, err := stringClaim(claims, "sub")
+	if err != nil {
+		return UserClaims{}, err
+	}
+
+	guest, err := boolClaim(claims, "guest")
+	if err != nil {
+		return UserClaims{}, err
+	}
+
+	// Guests have no email
+	var email string
+	if !guest {
+		email, err = stringClaim(claims, "email")
+		if err != nil {
+			return UserClaims{}, err
+		}
+	}
+
+	nickname, err := stringClaim(claims, "nickname")
+	if err != nil {
+		return UserClaims{}, err
+	}
+
+	rooms, err := roomsClaim(claims)
+	if err != nil {
+		return UserClaims{}, err
+	}
+
+	var sessionID string
+	if _, found := claims["sid"]; found {
+		sessionID, err = stringClaim(claims, "sid")
+		if err != nil {
+			return UserClaims{}, err
+		}
+	}
+
+	return UserClaims{
+		UserID:    userID,
+		Email:     email,
+		Nickname:  nickname,
+		Rooms:     rooms,
+		Guest:     guest,
+		SessionID: sessionID,
+	}, nil
+}
+
+// boolClaim reads an optional boolean claim, false without it
+func boolClaim(claims jwt.MapClaims, name string) (bool, error) {
+	value, found := claims[name]
+	if !found {
+		return false, nil
+	}
+
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s claim must be a boolean", name)
+	}
+
+	return b, nil
+}
+
+// roomsClaim reads the optional list of room IDs the token is scoped to. It returns
+// nil without the claim, and an empty list for a token scoped to no room.
+func roomsClaim(claims jwt.MapClaims) ([]string, error) {
+	value, found := claims["rooms"]
+	if !found {
+		return nil, nil
+	}
+
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, errors.New("rooms claim must be a list of room IDs")
+	}
+
+	rooms := make([]string, 0, len(list))
+	for _, item := range list {
+		roomID, ok := item.(string)
+		if !ok || roomID == "" {
+			return nil, errors.New("rooms claim must be a list of room IDs")
+		}
+		rooms = append(rooms, roomID)
+	}
+
+	return rooms, nil
+}
+
+func stringClaim(claims jwt.MapClaims, name string) (string, error) {
+	value, found := claims[name]
+	if !found {
+		return "", fmt.Errorf("missing %s claim", name)
+	}
+
+	str, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%s claim must be a string", name)
+	}
+
+	if strings.TrimSpace(str) == "" {
+		return "", fmt.Errorf("empty %s claim", name)
+	}
+
+	return str, nil
+}
+
+// API key scopes required by the routes
+const (
+	ScopeRoomsRead     = "rooms:read"
+	ScopeRoomsWrite    = "rooms:write"
+	ScopeMessagesRead  = "messages:read"
+	ScopeMessagesWrite = "messages:write"
+	ScopeUsersWrite    = "users:write"
+	ScopeWebhooks      = "webhooks:manage"
+)
+
+// Scopes lists every scope that can be granted to a client
+var Scopes = []string{
+	ScopeRoomsRead,
+	ScopeRoomsWrite,
+	ScopeMessagesRead,
+	ScopeMessagesWrite,
+	ScopeUsersWrite,
+	ScopeWebhooks,
+}
+
+// HasScope reports whether the request's API key was granted the scope.
+// Requests made with the configured API key have every scope.
+func HasScope(ctx context.Context, scope string) bool {
+	client, ok := ctx.Value(ClientContextKey).(*repositories.Client)
+	if !ok {
+		return true
+	}
+
+	return client.HasScope(scope)
+}
+
+// RequestClientID returns the ID of the client authenticated by its API key, empty for
+// the requests made with the configured API key
+func RequestClientID(ctx context.Context) string {
+	client, ok := ctx.Value(ClientContextKey).(*repositories.Client)
+	if !ok {
+		return ""
+	}
+
+	return client.ID
+}
+
+// VerifyApiKey checks the X-API-Key header. The configured API key has full access,
+// client API keys must have been granted the route's required scope.
+func VerifyApiKey(deps *deps.Deps, scope string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			apiKey := r.Header.Get("X-API-Key")
-			if apiKey != deps.Config.APIKey {
-				http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			if apiKey == "" {
+				handler.WriteError(w, constants.InvalidAPIKey, nil)
+				return
+			}
+
+			// The configured API key has full access
+			if deps.Config.APIKey != "" && subtle.ConstantTimeCompare([]byte(apiKey), []byte(deps.Config.APIKey)) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			client, err := deps.Accounts.GetClientByAPIKey(r.Context(), apiKey)
+			if err != nil {
+				handler.WriteError(w, constants.FailedToVerifyAPIKey, nil)
+				return
+			}
+
+			if client == nil {
+				handler.WriteError(w, constants.InvalidAPIKey, nil)
+				return
+			}
+
+			if client.ReadOnly && !isReadMethod(r.Method) {
+				handler.WriteError(w, constants.ReadOnlyAPIKey, nil)
+				return
+			}
+
+			if !client.HasScope(scope) {
+				handler.WriteError(w, constants.MissingScope, map[string]interface{}{"scope": scope})
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), ClientContextKey, client)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// VerifyAdminKey checks the X-Admin-Key header against the configured admin key.
+// Admin routes are disabled when no admin key is configured.
+func VerifyAdminKey(deps *deps.Deps) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !IsAdmin(deps, r) {
+				log.Warn(r.Context(), "Rejected admin request", log.AnyAttr("path", r.URL.Path))
+				handler.WriteError(w, constants.InvalidAdminKey, nil)
 				return
 			}
 
@@ -98,6 +412,54 @@ func VerifyApiKey(deps *deps.Deps) func(http.Handler) http.Handler {
 	}
 }
 
+// IsAdmin tells whether the request carries the configured admin key
+func IsAdmin(deps *deps.Deps, r *http.Request) bool {
+	adminKey := r.Header.Get("X-Admin-Key")
+	return deps.Config.AdminKey != "" && subtle.ConstantTimeCompare([]byte(adminKey), []byte(deps.Config.AdminKey)) == 1
+}
+
+// RequireSelfOrAdmin only lets the authenticated user reach the routes of their
+// own {userId}. Requests with the admin key may act on any user.
+func RequireSelfOrAdmin(deps *deps.Deps) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, _ := r.Context().Value(UserContextKey).(UserClaims)
+			userID := chi.URLParam(r, "userId")
+
+			if claims.UserID == "" || (userID != claims.UserID && !IsAdmin(deps, r)) {
+				log.Warn(r.Context(), "Rejected request for another user",
+					log.AnyAttr("path", r.URL.Path),
+					log.AnyAttr("user_id", claims.UserID),
+					log.AnyAttr("target_user_id", userID))
+				handler.WriteError(w, constants.CannotAccessOtherUser, nil)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RejectGuests keeps the guest tokens out of the account routes, guests only chat in their room
+func RejectGuests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := r.Context().Value(UserContextKey).(UserClaims)
+		if claims.Guest {
+			log.Warn(r.Context(), "Rejected guest request",
+				log.AnyAttr("path", r.URL.Path),
+				log.AnyAttr("user_id", claims.UserID))
+			handler.WriteError(w, constants.GuestNotAllowed, nil)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isReadMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
 func isPublicPath(path string) bool {
 	publicPaths := []string{
 		"/api/v1/auth/register",
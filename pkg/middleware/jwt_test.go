@@ -0,0 +1,220 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/api/handler"
+	"github.com/vit0rr/chat/config"
+	"github.com/vit0rr/chat/pkg/deps"
+)
+
+// userClaims are the claims of a user token, changed by the edit
+func userClaims(edit func(jwt.MapClaims)) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"sub":      "alice",
+		"email":    "alice@example.com",
+		"nickname": "Alice",
+	}
+	if edit != nil {
+		edit(claims)
+	}
+
+	return claims
+}
+
+func TestExtractUserClaims(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		want   UserClaims
+	}{
+		{
+			name:   "user",
+			claims: userClaims(nil),
+			want:   UserClaims{UserID: "alice", Email: "alice@example.com", Nickname: "Alice"},
+		},
+		{
+			name:   "session",
+			claims: userClaims(func(c jwt.MapClaims) { c["sid"] = "session-1" }),
+			want:   UserClaims{UserID: "alice", Email: "alice@example.com", Nickname: "Alice", SessionID: "session-1"},
+		},
+		{
+			name:   "rooms",
+			claims: userClaims(func(c jwt.MapClaims) { c["rooms"] = []interface{}{"lobby", "general"} }),
+			want:   UserClaims{UserID: "alice", Email: "alice@example.com", Nickname: "Alice", Rooms: []string{"lobby", "general"}},
+		},
+		{
+			name:   "scoped to no room",
+			claims: userClaims(func(c jwt.MapClaims) { c["rooms"] = []interface{}{} }),
+			want:   UserClaims{UserID: "alice", Email: "alice@example.com", Nickname: "Alice", Rooms: []string{}},
+		},
+		{
+			name: "guest without email",
+			claims: jwt.MapClaims{
+				"sub":      "guest-1",
+				"nickname": "Visitor",
+				"guest":    true,
+				"rooms":    []interface{}{"lobby"},
+			},
+			want: UserClaims{UserID: "guest-1", Nickname: "Visitor", Guest: true, Rooms: []string{"lobby"}},
+		},
+		{
+			name:   "guest email ignored",
+			claims: userClaims(func(c jwt.MapClaims) { c["guest"] = true; c["email"] = 42 }),
+			want:   UserClaims{UserID: "alice", Nickname: "Alice", Guest: true},
+		},
+		{
+			name:   "not a guest",
+			claims: userClaims(func(c jwt.MapClaims) { c["guest"] = false }),
+			want:   UserClaims{UserID: "alice", Email: "alice@example.com", Nickname: "Alice"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractUserClaims(tt.claims)
+			if err != nil {
+				t.Fatalf("extractUserClaims() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("extractUserClaims() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractUserClaimsRejectsInvalidClaims(t *testing.T) {
+	tests := []struct {
+		name    string
+		claims  jwt.MapClaims
+		wantErr string
+	}{
+		{"missing sub", userClaims(func(c jwt.MapClaims) { delete(c, "sub") }), "missing sub claim"},
+		{"numeric sub", userClaims(func(c jwt.MapClaims) { c["sub"] = 42.0 }), "sub claim must be a string"},
+		{"blank sub", userClaims(func(c jwt.MapClaims) { c["sub"] = "  " }), "empty sub claim"},
+		{"missing email", userClaims(func(c jwt.MapClaims) { delete(c, "email") }), "missing email claim"},
+		{"list email", userClaims(func(c jwt.MapClaims) { c["email"] = []interface{}{"alice@example.com"} }), "email claim must be a string"},
+		{"missing nickname", userClaims(func(c jwt.MapClaims) { delete(c, "nickname") }), "missing nickname claim"},
+		{"boolean nickname", userClaims(func(c jwt.MapClaims) { c["nickname"] = true }), "nickname claim must be a string"},
+		{"empty nickname", userClaims(func(c jwt.MapClaims) { c["nickname"] = "" }), "empty nickname claim"},
+		{"string rooms", userClaims(func(c jwt.MapClaims) { c["rooms"] = "lobby" }), "rooms claim must be a list of room IDs"},
+		{"numeric room", userClaims(func(c jwt.MapClaims) { c["rooms"] = []interface{}{"lobby", 1.0} }), "rooms claim must be a list of room IDs"},
+		{"empty room", userClaims(func(c jwt.MapClaims) { c["rooms"] = []interface{}{""} }), "rooms claim must be a list of room IDs"},
+		{"string guest", userClaims(func(c jwt.MapClaims) { c["guest"] = "true" }), "guest claim must be a boolean"},
+		{"numeric sid", userClaims(func(c jwt.MapClaims) { c["sid"] = 1.0 }), "sid claim must be a string"},
+		{"empty sid", userClaims(func(c jwt.MapClaims) { c["sid"] = "" }), "empty sid claim"},
+		{"guest without nickname", jwt.MapClaims{"sub": "guest-1", "guest": true}, "missing nickname claim"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := extractUserClaims(tt.claims)
+			if err == nil {
+				t.Fatal("extractUserClaims() error = nil, want an error")
+			}
+			if err.Error() != tt.wantErr {
+				t.Errorf("extractUserClaims() error = %q, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// signedToken signs the claims of a user token with the method and key, exp and iat
+// defaulting to an hour from now and now
+func signedToken(t *testing.T, method jwt.SigningMethod, key interface{}, edit func(jwt.MapClaims)) string {
+	t.Helper()
+
+	claims := userClaims(func(c jwt.MapClaims) {
+		c["exp"] = time.Now().Add(time.Hour).Unix()
+		c["iat"] = time.Now().Unix()
+		if edit != nil {
+			edit(c)
+		}
+	})
+
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+
+	return token
+}
+
+func TestJWTAuth(t *testing.T) {
+	dependencies := deps.New(config.Config{JWT: config.JWT{
+		Secret:          "current-secret",
+		PreviousSecrets: []string{"previous-secret"},
+	}}, nil, nil)
+	dependencies.Accounts = clientAccounts{}
+
+	authenticated := JWTAuth(dependencies)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if claims, ok := r.Context().Value(UserContextKey).(UserClaims); !ok || claims.UserID != "alice" {
+			t.Errorf("user claims = %+v, want alice's", claims)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate RSA key: %v", err)
+	}
+
+	current := []byte("current-secret")
+	tests := []struct {
+		name      string
+		token     string
+		wantError string // Empty when the token is accepted
+	}{
+		{"current secret", signedToken(t, jwt.SigningMethodHS256, current, nil), ""},
+		{"previous secret", signedToken(t, jwt.SigningMethodHS512, []byte("previous-secret"), nil), ""},
+		{"rotated out secret", signedToken(t, jwt.SigningMethodHS256, []byte("rotated-out-secret"), nil), constants.InvalidToken},
+		{"alg none", signedToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, nil), constants.InvalidToken},
+		{"RS256", signedToken(t, jwt.SigningMethodRS256, rsaKey, nil), constants.InvalidToken},
+		{"missing exp", signedToken(t, jwt.SigningMethodHS256, current, func(c jwt.MapClaims) { delete(c, "exp") }), constants.InvalidToken},
+		{"expired", signedToken(t, jwt.SigningMethodHS256, current, func(c jwt.MapClaims) {
+			c["iat"] = time.Now().Add(-2 * time.Hour).Unix()
+			c["exp"] = time.Now().Add(-time.Hour).Unix()
+		}), constants.InvalidToken},
+		{"issued in the future", signedToken(t, jwt.SigningMethodHS256, current, func(c jwt.MapClaims) {
+			c["iat"] = time.Now().Add(time.Hour).Unix()
+		}), constants.InvalidToken},
+		{"missing iat", signedToken(t, jwt.SigningMethodHS256, current, func(c jwt.MapClaims) { delete(c, "iat") }), constants.InvalidTokenClaims},
+		{"invalid claims", signedToken(t, jwt.SigningMethodHS256, current, func(c jwt.MapClaims) { delete(c, "sub") }), constants.InvalidTokenClaims},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/rooms", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rec := httptest.NewRecorder()
+
+			authenticated.ServeHTTP(rec, req)
+
+			if tt.wantError == "" {
+				if rec.Code != http.StatusNoContent {
+					t.Errorf("status = %d, want 204: %s", rec.Code, rec.Body)
+				}
+				return
+			}
+
+			var body handler.ErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatalf("decode error body: %v", err)
+			}
+
+			want := constants.ErrorMessages[tt.wantError]
+			if rec.Code != want.Code || body.ErrorID != want.ID {
+				t.Errorf("rejected with %d %q, want %d %q", rec.Code, body.ErrorID, want.Code, want.ID)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/vit0rr/chat/api/constants"
+	"github.com/vit0rr/chat/api/handler"
+	"github.com/vit0rr/chat/pkg/deps"
+	"github.com/vit0rr/chat/pkg/log"
+)
+
+// RejectWritesInMaintenance rejects every write request with a 503 while the
+// maintenance mode is enabled. Reads, logins and the admin and clients routes keep working.
+func RejectWritesInMaintenance(dependencies *deps.Deps) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isReadMethod(r.Method) || isMaintenanceExemptPath(r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			enabled, err := deps.IsMaintenanceMode(r.Context(), dependencies.Broker)
+			if err != nil {
+				// Don't take the API down because the flag can't be read
+				log.Error(r.Context(), "Failed to check maintenance mode", log.ErrAttr(err))
+			}
+
+			if !enabled {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			handler.WriteError(w, constants.MaintenanceMode, nil)
+		})
+	}
+}
+
+func isMaintenanceExemptPath(path string) bool {
+	return path == "/api/v1/auth/login" || strings.HasPrefix(path, "/api/v1/admin") || strings.HasPrefix(path, "/api/v1/clients")
+}
@@ -0,0 +1,181 @@
+package moderation
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Modes of the filter
+const (
+	ModeMask   = "mask"   // Banned words are replaced with asterisks
+	ModeReject = "reject" // Messages with banned words aren't sent
+)
+
+// leetspeak maps the characters commonly used in place of letters
+var leetspeak = map[rune]rune{
+	'0': 'o',
+	'1': 'i',
+	'3': 'e',
+	'4': 'a',
+	'5': 's',
+	'7': 't',
+	'8': 'b',
+	'@': 'a',
+	'$': 's',
+	'!': 'i',
+}
+
+// Filter finds banned words in messages. Messages are split in words of letters and
+// digits of any script, and each word is compared, case-insensitively, to the banned
+// words and patterns. Banned words never match inside a longer word.
+type Filter struct {
+	words     map[string]bool
+	patterns  []*regexp.Regexp
+	leetspeak bool
+}
+
+// New returns a filter for the banned words and regular expressions. Patterns must
+// match a whole word. With leetspeak, "h3ll0" is checked as "hello".
+func New(words []string, patterns []string, leetspeak bool) (*Filter, error) {
+	filter := &Filter{
+		words:     make(map[string]bool, len(words)),
+		leetspeak: leetspeak,
+	}
+
+	for _, word := range words {
+		word = strings.TrimSpace(word)
+		if word != "" {
+			filter.words[strings.ToLower(word)] = true
+		}
+	}
+
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+
+		re, err := regexp.Compile(`(?i)^(?:` + pattern + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("invalid banned pattern %q: %w", pattern, err)
+		}
+		filter.patterns = append(filter.patterns, re)
+	}
+
+	return filter, nil
+}
+
+// Empty reports whether the filter has nothing to ban
+func (f *Filter) Empty() bool {
+	return len(f.words) == 0 && len(f.patterns) == 0
+}
+
+// Contains reports whether the text has any banned word
+func (f *Filter) Contains(text string) bool {
+	found := false
+	f.scan(text, func(start int, end int) {
+		found = true
+	})
+
+	return found
+}
+
+// Mask returns the text with every rune of the banned words replaced with an asterisk
+func (f *Filter) Mask(text string) string {
+	var masked strings.Builder
+	last := 0
+	f.scan(text, func(start int, end int) {
+		masked.WriteString(text[last:start])
+		masked.WriteString(strings.Repeat("*", len([]rune(text[start:end]))))
+		last = end
+	})
+	masked.WriteString(text[last:])
+
+	return masked.String()
+}
+
+// scan calls banned with the byte offsets of each banned word of the text
+func (f *Filter) scan(text string, banned func(start int, end int)) {
+	start := -1
+	for i, r := range text {
+		if f.isWordRune(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+
+		if start >= 0 {
+			f.check(text, start, i, banned)
+			start = -1
+		}
+	}
+
+	if start >= 0 {
+		f.check(text, start, len(text), banned)
+	}
+}
+
+// check calls banned when the word is banned. With leetspeak, symbols around the word
+// can be punctuation too, so "darn!" is checked as "darn" when "darni" isn't banned.
+func (f *Filter) check(text string, start int, end int, banned func(start int, end int)) {
+	if f.isBanned(text[start:end]) {
+		banned(start, end)
+		return
+	}
+
+	if !f.leetspeak {
+		return
+	}
+
+	isSymbol := func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsNumber(r) }
+	word := strings.TrimRightFunc(strings.TrimLeftFunc(text[start:end], isSymbol), isSymbol)
+	if word == "" || len(word) == end-start {
+		return
+	}
+
+	trimmedStart := start + strings.Index(text[start:end], word)
+	if f.isBanned(word) {
+		banned(trimmedStart, trimmedStart+len(word))
+	}
+}
+
+func (f *Filter) isWordRune(r rune) bool {
+	if unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.Is(unicode.Mn, r) {
+		return true
+	}
+
+	_, ok := leetspeak[r]
+	return f.leetspeak && ok
+}
+
+func (f *Filter) isBanned(word string) bool {
+	candidates := []string{strings.ToLower(word)}
+	if f.leetspeak {
+		normalized := strings.Map(func(r rune) rune {
+			if letter, ok := leetspeak[r]; ok {
+				return letter
+			}
+			return unicode.ToLower(r)
+		}, word)
+		if normalized != candidates[0] {
+			candidates = append(candidates, normalized)
+		}
+	}
+
+	for _, candidate := range candidates {
+		if f.words[candidate] {
+			return true
+		}
+
+		for _, re := range f.patterns {
+			if re.MatchString(candidate) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
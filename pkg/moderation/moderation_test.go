@@ -0,0 +1,149 @@
+package moderation
+
+import "testing"
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		name      string
+		words     []string
+		patterns  []string
+		leetspeak bool
+		text      string
+		// wantContains is whether the reject mode drops the message, wantMasked what the
+		// mask mode sends instead
+		wantContains bool
+		wantMasked   string
+	}{
+		{
+			name:         "banned word",
+			words:        []string{"darn"},
+			text:         "Darn it",
+			wantContains: true,
+			wantMasked:   "**** it",
+		},
+		{
+			name:       "clean text",
+			words:      []string{"darn"},
+			text:       "all good",
+			wantMasked: "all good",
+		},
+		{
+			name:       "inside a longer word",
+			words:      []string{"darn", "hell"},
+			text:       "darning socks, hello",
+			wantMasked: "darning socks, hello",
+		},
+		{
+			name:         "every occurrence",
+			words:        []string{"darn"},
+			text:         "darn, darn and darn",
+			wantContains: true,
+			wantMasked:   "****, **** and ****",
+		},
+		{
+			name:         "pattern matches the whole word",
+			patterns:     []string{`spam+`},
+			text:         "spammm not spamming",
+			wantContains: true,
+			wantMasked:   "****** not spamming",
+		},
+		{
+			name:         "unicode word",
+			words:        []string{"ñandú", "привет"},
+			text:         "Ñandú и ПРИВЕТ",
+			wantContains: true,
+			wantMasked:   "***** и ******",
+		},
+		{
+			name:         "combining marks are part of the word",
+			words:        []string{"cafe\u0301"},
+			text:         "un cafe\u0301 noir",
+			wantContains: true,
+			wantMasked:   "un ***** noir",
+		},
+		{
+			name:       "combining mark makes another word",
+			words:      []string{"cafe"},
+			text:       "un cafe\u0301 noir",
+			wantMasked: "un cafe\u0301 noir",
+		},
+		{
+			name:       "leetspeak off",
+			words:      []string{"hello"},
+			text:       "h3ll0 there",
+			wantMasked: "h3ll0 there",
+		},
+		{
+			name:         "leetspeak on",
+			words:        []string{"hello"},
+			leetspeak:    true,
+			text:         "h3ll0 there",
+			wantContains: true,
+			wantMasked:   "***** there",
+		},
+		{
+			name:         "trailing exclamation mark",
+			words:        []string{"darn"},
+			text:         "darn!",
+			wantContains: true,
+			wantMasked:   "****!",
+		},
+		{
+			name:         "trailing exclamation mark with leetspeak",
+			words:        []string{"darn"},
+			leetspeak:    true,
+			text:         "darn!",
+			wantContains: true,
+			wantMasked:   "****!",
+		},
+		{
+			name:         "trailing dollar with leetspeak",
+			words:        []string{"darn"},
+			leetspeak:    true,
+			text:         "darn$ again",
+			wantContains: true,
+			wantMasked:   "****$ again",
+		},
+		{
+			name:         "symbols spelling a letter with leetspeak",
+			words:        []string{"darns"},
+			leetspeak:    true,
+			text:         "darn$",
+			wantContains: true,
+			wantMasked:   "*****",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := New(tt.words, tt.patterns, tt.leetspeak)
+			if err != nil {
+				t.Fatalf("new filter: %v", err)
+			}
+
+			if got := filter.Contains(tt.text); got != tt.wantContains {
+				t.Errorf("Contains(%q) = %v, want %v", tt.text, got, tt.wantContains)
+			}
+			if got := filter.Mask(tt.text); got != tt.wantMasked {
+				t.Errorf("Mask(%q) = %q, want %q", tt.text, got, tt.wantMasked)
+			}
+		})
+	}
+}
+
+func TestNewRejectsInvalidPatterns(t *testing.T) {
+	if _, err := New(nil, []string{"spam("}, false); err == nil {
+		t.Error("New accepted an invalid pattern")
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	filter, err := New([]string{" ", ""}, []string{""}, true)
+	if err != nil {
+		t.Fatalf("new filter: %v", err)
+	}
+
+	if !filter.Empty() {
+		t.Error("filter of blank words and patterns isn't empty")
+	}
+}
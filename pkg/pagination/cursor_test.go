@@ -0,0 +1,112 @@
+package pagination
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testKey = DeriveKey("test-secret")
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	cursor := Cursor{
+		Scope:     "lobby",
+		SortValue: time.Date(2025, 3, 1, 12, 30, 0, 123000000, time.UTC),
+		ID:        "65e1c0ffee0000000000abcd",
+		Direction: "desc",
+	}
+
+	token, err := Encode(cursor, testKey)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	decoded, err := Decode(token, testKey)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+
+	if decoded.Scope != cursor.Scope || decoded.ID != cursor.ID || decoded.Direction != cursor.Direction ||
+		!decoded.SortValue.Equal(cursor.SortValue) {
+		t.Errorf("Decode() = %+v, want %+v", decoded, cursor)
+	}
+}
+
+func TestDecodeRejectsTamperedTokens(t *testing.T) {
+	token, err := Encode(Cursor{Scope: "lobby", SortValue: time.Now(), ID: "65e1c0ffee0000000000abcd", Direction: "desc"}, testKey)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	payload, signature, _ := strings.Cut(token, ".")
+
+	// The same cursor pointed at another room, keeping the signature
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"s":"other","v":"2025-03-01T12:30:00Z","d":"desc"}`))
+
+	tests := []struct {
+		name  string
+		token string
+		keys  [][]byte
+	}{
+		{"other payload", forged + "." + signature, [][]byte{testKey}},
+		{"altered signature", payload + "." + strings.Repeat("A", len(signature)), [][]byte{testKey}},
+		{"missing signature", payload, [][]byte{testKey}},
+		{"not base64", "%%%." + signature, [][]byte{testKey}},
+		{"empty", "", [][]byte{testKey}},
+		{"other key", token, [][]byte{DeriveKey("other-secret")}},
+		{"raw secret", token, [][]byte{[]byte("test-secret")}},
+		{"no keys", token, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Decode(tt.token, tt.keys...); !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("Decode() error = %v, want ErrInvalidCursor", err)
+			}
+		})
+	}
+}
+
+func TestDecodeAcceptsPreviousKeys(t *testing.T) {
+	previous := DeriveKey("previous-secret")
+	token, err := Encode(Cursor{Scope: "lobby", SortValue: time.Now(), Direction: "desc"}, previous)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	if _, err := Decode(token, testKey, previous); err != nil {
+		t.Errorf("Decode() with the previous key error = %v, want nil", err)
+	}
+}
+
+func TestCursorsOfTiedItemsStayDistinct(t *testing.T) {
+	// Both messages were stored within the same millisecond, only their IDs order them
+	sentAt := time.Date(2025, 3, 1, 12, 30, 0, 0, time.UTC)
+	first := Cursor{Scope: "lobby", SortValue: sentAt, ID: "65e1c0ffee0000000000abcd", Direction: "desc"}
+	second := Cursor{Scope: "lobby", SortValue: sentAt, ID: "65e1c0ffee0000000000abce", Direction: "desc"}
+
+	firstToken, err := Encode(first, testKey)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	secondToken, err := Encode(second, testKey)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	if firstToken == secondToken {
+		t.Fatal("cursors of tied items encode to the same token")
+	}
+
+	for _, want := range []Cursor{first, second} {
+		token, _ := Encode(want, testKey)
+		got, err := Decode(token, testKey)
+		if err != nil {
+			t.Fatalf("Decode() error = %v", err)
+		}
+		if got.ID != want.ID || !got.SortValue.Equal(want.SortValue) {
+			t.Errorf("Decode() = (%s, %s), want (%s, %s)", got.SortValue, got.ID, want.SortValue, want.ID)
+		}
+	}
+}
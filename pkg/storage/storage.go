@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrInvalidKey is returned for keys that would be stored outside of the storage
+var ErrInvalidKey = errors.New("invalid storage key")
+
+// Storage stores the uploaded files
+type Storage interface {
+	// Save stores the content under the key and returns its public URL
+	Save(ctx context.Context, key string, content io.Reader) (string, error)
+}
+
+// Local stores the files on disk, served by Handler under baseURL
+type Local struct {
+	dir     string
+	baseURL string
+}
+
+func NewLocal(dir string, baseURL string) *Local {
+	return &Local{
+		dir:     dir,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+func (l *Local) Save(ctx context.Context, key string, content io.Reader) (string, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, content); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+
+	return l.baseURL + "/" + key, nil
+}
+
+// path returns where the key is stored, making sure it stays inside the storage dir
+func (l *Local) path(key string) (string, error) {
+	cleaned := filepath.Clean(filepath.FromSlash(key))
+	if cleaned == "." || filepath.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", ErrInvalidKey
+	}
+
+	return filepath.Join(l.dir, cleaned), nil
+}
+
+// Handler serves the stored files. It must be mounted under the base URL path.
+// Directory listings are disabled, so files can only be fetched by their URL.
+func (l *Local) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, err := l.path(strings.TrimPrefix(r.URL.Path, l.baseURL+"/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+
+		// Let ServeFile set the type from the file extension
+		w.Header().Del("Content-Type")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		http.ServeFile(w, r, path)
+	})
+}
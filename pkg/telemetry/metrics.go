@@ -0,0 +1,79 @@
+package telemetry
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "chat"
+
+var (
+	// ActiveConnections is the number of WebSocket connections currently open
+	ActiveConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_websocket_connections",
+		Help:      "Number of WebSocket connections currently open.",
+	})
+
+	// MessagesSent counts the messages broadcast, by message type. Rooms are created by the
+	// clients, so labeling by room would grow a series per room without bound.
+	MessagesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_sent_total",
+		Help:      "Number of messages broadcast, by message type.",
+	}, []string{"type"})
+
+	// BroadcastLatency measures how long it takes to persist and publish a message
+	BroadcastLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "message_broadcast_duration_seconds",
+		Help:      "Time spent persisting and publishing a message.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// RedisPublishErrors counts failed publishes to Redis
+	RedisPublishErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "redis_publish_errors_total",
+		Help:      "Number of messages that failed to be published to Redis.",
+	})
+
+	// RateLimitRejections counts messages rejected by the per-user rate limit
+	RateLimitRejections = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limit_rejections_total",
+		Help:      "Number of messages rejected by the rate limit.",
+	})
+
+	// DroppedMessages counts messages dropped because the client was too slow to receive them
+	DroppedMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dropped_messages_total",
+		Help:      "Number of messages dropped for slow WebSocket clients.",
+	})
+
+	// AuthAttempts counts authentication attempts, by action (register/login) and result (success/failure)
+	AuthAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_attempts_total",
+		Help:      "Number of authentication attempts, by action and result.",
+	}, []string{"action", "result"})
+)
+
+// MetricsHandler serves the registered metrics in the Prometheus exposition format
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// RecordAuthAttempt increments the auth attempts counter for the given action
+func RecordAuthAttempt(action string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	AuthAttempts.WithLabelValues(action, result).Inc()
+}
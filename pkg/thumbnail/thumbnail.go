@@ -0,0 +1,114 @@
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif" // Decodes the first frame of GIFs
+	"image/jpeg"
+	"image/png"
+)
+
+const (
+	// MaxSize is the maximum width and height of a thumbnail
+	MaxSize = 320
+	// MaxSourcePixels caps the decoded images, so a small file declaring huge
+	// dimensions can't exhaust the memory
+	MaxSourcePixels = 40_000_000
+)
+
+var (
+	ErrUnsupported = errors.New("unsupported image type")
+	ErrTooLarge    = errors.New("image dimensions are too large")
+)
+
+// Supported reports whether a thumbnail can be generated for the MIME type
+func Supported(mimeType string) bool {
+	return mimeType == "image/jpeg" || mimeType == "image/png" || mimeType == "image/gif"
+}
+
+// Generate returns a thumbnail of the image fitting in MaxSize x MaxSize, along with
+// its MIME type. JPEGs are thumbnailed as JPEG, PNGs and GIFs as PNG to keep transparency.
+func Generate(data []byte, mimeType string) ([]byte, string, error) {
+	if !Supported(mimeType) {
+		return nil, "", ErrUnsupported
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > MaxSourcePixels {
+		return nil, "", ErrTooLarge
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	thumb := resize(src, MaxSize)
+
+	var out bytes.Buffer
+	if mimeType == "image/jpeg" {
+		err = jpeg.Encode(&out, thumb, &jpeg.Options{Quality: 80})
+	} else {
+		mimeType = "image/png"
+		err = png.Encode(&out, thumb)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	return out.Bytes(), mimeType, nil
+}
+
+// resize scales the image down to fit in maxSize x maxSize, averaging the source
+// pixels covered by each thumbnail pixel. Smaller images are kept as they are.
+func resize(src image.Image, maxSize int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxSize && height <= maxSize {
+		return src
+	}
+
+	dstWidth, dstHeight := maxSize, height*maxSize/width
+	if height > width {
+		dstWidth, dstHeight = width*maxSize/height, maxSize
+	}
+	dstWidth, dstHeight = max(dstWidth, 1), max(dstHeight, 1)
+
+	dst := image.NewNRGBA64(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		y0 := bounds.Min.Y + y*height/dstHeight
+		y1 := max(bounds.Min.Y+(y+1)*height/dstHeight, y0+1)
+
+		for x := 0; x < dstWidth; x++ {
+			x0 := bounds.Min.X + x*width/dstWidth
+			x1 := max(bounds.Min.X+(x+1)*width/dstWidth, x0+1)
+
+			var r, g, b, a, count uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pixel := color.NRGBA64Model.Convert(src.At(sx, sy)).(color.NRGBA64)
+					r += uint64(pixel.R)
+					g += uint64(pixel.G)
+					b += uint64(pixel.B)
+					a += uint64(pixel.A)
+					count++
+				}
+			}
+
+			dst.SetNRGBA64(x, y, color.NRGBA64{
+				R: uint16(r / count),
+				G: uint16(g / count),
+				B: uint16(b / count),
+				A: uint16(a / count),
+			})
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,113 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// ErrForbiddenAddress is returned for the webhook URLs resolving to private or reserved addresses,
+// which would let clients reach the internal network through the server
+var ErrForbiddenAddress = errors.New("webhook address is not public")
+
+// reservedPrefixes are the ranges that aren't reachable on the internet, besides the loopback,
+// private, link-local and multicast ones netip already tells apart
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // This network
+	netip.MustParsePrefix("100.64.0.0/10"),   // Carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // Documentation
+	netip.MustParsePrefix("198.18.0.0/15"),   // Benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // Documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // Documentation
+	netip.MustParsePrefix("240.0.0.0/4"),     // Reserved, and the broadcast address
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64, maps to any IPv4 address
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // Local NAT64
+	netip.MustParsePrefix("100::/64"),        // Discard
+	netip.MustParsePrefix("2001::/23"),       // IETF protocol assignments
+	netip.MustParsePrefix("2001:db8::/32"),   // Documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4, maps to any IPv4 address
+}
+
+// publicAddr tells whether the address is reachable on the internet
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+
+	for _, prefix := range reservedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ValidateURL checks that the webhook URL is an HTTP(S) URL whose host only resolves to public
+// addresses. The addresses are checked again when delivering, as the DNS may change since.
+func ValidateURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return fmt.Errorf("webhook URL must be an http or https URL")
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		if !publicAddr(addr) {
+			return ErrForbiddenAddress
+		}
+	}
+
+	return nil
+}
+
+// dialControl rejects the connections to non-public addresses. It runs once the host is
+// resolved, so a DNS record changed after the registration can't point a webhook inward.
+func dialControl(network string, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+
+	if !publicAddr(addrPort.Addr()) {
+		return ErrForbiddenAddress
+	}
+
+	return nil
+}
+
+// newTransport dials the public addresses only, and never through a proxy, which would make
+// the connections on the server's behalf
+func newTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   requestTimeout,
+		KeepAlive: 30 * time.Second,
+		Control:   dialControl,
+	}
+
+	return &http.Transport{
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   requestTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+}
@@ -0,0 +1,95 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"198.18.0.1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"64:ff9b::a00:1", false},
+		{"2002:a00:1::", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := publicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("publicAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"https://93.184.216.34/events", false},
+		{"http://93.184.216.34:8080/events", false},
+		{"ftp://93.184.216.34/events", true},
+		{"https:///events", true},
+		{"not a url", true},
+		{"http://127.0.0.1/events", true},
+		{"http://[::1]:8080/events", true},
+		{"http://169.254.169.254/latest/meta-data", true},
+		{"http://10.0.0.1/events", true},
+		{"http://192.168.0.10/events", true},
+		{"http://localhost/events", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			err := ValidateURL(context.Background(), tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateURL(%q) = %v, want error %v", tt.url, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDeliveryRefusesPrivateAddresses(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newTransport()}
+	resp, err := client.Post(server.URL, "application/json", nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("POST to loopback = %v, want ErrForbiddenAddress", err)
+	}
+	if called {
+		t.Error("the loopback server received the delivery")
+	}
+}
@@ -0,0 +1,206 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/vit0rr/chat/pkg/database/repositories"
+	"github.com/vit0rr/chat/pkg/log"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Events clients can subscribe to
+const (
+	EventMessageCreated = "message.created"
+	EventMemberJoined   = "member.joined"
+	EventMemberLeft     = "member.left"
+	EventRoomLocked     = "room.locked"
+	EventRoomUnlocked   = "room.unlocked"
+)
+
+// Events lists every event clients can subscribe to
+var Events = []string{
+	EventMessageCreated,
+	EventMemberJoined,
+	EventMemberLeft,
+	EventRoomLocked,
+	EventRoomUnlocked,
+}
+
+const (
+	// SignatureHeader holds the hex HMAC-SHA256 of the request body
+	SignatureHeader = "X-Chat-Signature"
+	// EventHeader holds the event name
+	EventHeader = "X-Chat-Event"
+
+	queueSize      = 1000
+	workers        = 4
+	maxAttempts    = 5
+	initialBackoff = time.Second
+	requestTimeout = 10 * time.Second
+)
+
+// Event is the payload POSTed to the webhooks
+type Event struct {
+	Event     string      `json:"event"`
+	RoomID    string      `json:"room_id"`
+	Data      interface{} `json:"data"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+type delivery struct {
+	webhook    repositories.Webhook
+	event      string
+	payload    []byte
+	signingKey string
+}
+
+// Dispatcher delivers events to the webhooks in the background, so a slow
+// endpoint never blocks a broadcast
+type Dispatcher struct {
+	db     *mongo.Database
+	client *http.Client
+	queue  chan delivery
+}
+
+// NewDispatcher creates a dispatcher whose workers run until ctx is done
+func NewDispatcher(ctx context.Context, db *mongo.Database) *Dispatcher {
+	dispatcher := &Dispatcher{
+		db:     db,
+		client: &http.Client{Timeout: requestTimeout, Transport: newTransport()},
+		queue:  make(chan delivery, queueSize),
+	}
+
+	for range workers {
+		go dispatcher.work(ctx)
+	}
+
+	return dispatcher
+}
+
+// Emit queues the event for the webhooks subscribed to it by the client the room was created
+// with. Deliveries that don't fit in the queue go straight to the dead letters.
+func (d *Dispatcher) Emit(ctx context.Context, event Event) {
+	// The rooms created without a client don't belong to any client's webhooks
+	clientID, err := repositories.GetRoomClientID(ctx, d.db, event.RoomID)
+	if err != nil || clientID == "" {
+		return
+	}
+
+	webhooks, err := repositories.GetWebhooksForEvent(ctx, d.db, event.Event, clientID, event.RoomID)
+	if err != nil || len(webhooks) == 0 {
+		return
+	}
+
+	// Every webhook is the client's, signed with its key
+	client, err := repositories.GetClient(ctx, d.db, repositories.GetClientData{ClientID: clientID})
+	if err != nil {
+		return
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Error(ctx, "Failed to marshal webhook event", log.ErrAttr(err))
+		return
+	}
+
+	for _, webhook := range webhooks {
+		job := delivery{webhook: webhook, event: event.Event, payload: payload, signingKey: client.APIKeyHash}
+		select {
+		case d.queue <- job:
+		default:
+			d.deadLetter(ctx, job, 0, fmt.Errorf("delivery queue is full"))
+		}
+	}
+}
+
+func (d *Dispatcher) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-d.queue:
+			d.deliver(ctx, job)
+		}
+	}
+}
+
+// deliver POSTs the payload, retrying with exponential backoff
+func (d *Dispatcher) deliver(ctx context.Context, job delivery) {
+	backoff := initialBackoff
+
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err = d.post(ctx, job); err == nil {
+			return
+		}
+
+		if attempt == maxAttempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	d.deadLetter(ctx, job, maxAttempts, err)
+}
+
+func (d *Dispatcher) post(ctx context.Context, job delivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.webhook.URL, bytes.NewReader(job.payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, job.event)
+	req.Header.Set(SignatureHeader, Sign(job.payload, job.signingKey))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+func (d *Dispatcher) deadLetter(ctx context.Context, job delivery, attempts int, err error) {
+	log.Warn(ctx, "Webhook delivery failed permanently",
+		log.AnyAttr("webhook_id", job.webhook.ID),
+		log.AnyAttr("event", job.event),
+		log.ErrAttr(err))
+
+	repositories.CreateWebhookDeadLetter(context.WithoutCancel(ctx), d.db, repositories.WebhookDeadLetter{
+		WebhookID: job.webhook.ID,
+		ClientID:  job.webhook.ClientID,
+		URL:       job.webhook.URL,
+		Event:     job.event,
+		Payload:   string(job.payload),
+		Attempts:  attempts,
+		LastError: err.Error(),
+	})
+}
+
+// Sign returns the hex HMAC-SHA256 of the payload. Deliveries are signed with the
+// hex SHA-256 of the client's API key, so the server never needs the key itself.
+func Sign(payload []byte, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}